@@ -0,0 +1,150 @@
+// Package fraud evaluates configurable fraud and velocity rules over the payments which are created
+package fraud
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/getaceres/payment-demo/payment"
+	"github.com/getaceres/payment-demo/persistence"
+)
+
+// Types of the rules
+const (
+	// VelocityRuleType rules are triggered when too many payments with the same values in some fields are created within a window
+	VelocityRuleType = "velocity"
+	// AmountLimitRuleType rules are triggered by payments above the limit of their organisation in their currency
+	AmountLimitRuleType = "amount-limit"
+	// NewBeneficiaryRuleType rules are triggered by the first payment of an organisation to a beneficiary account above a threshold
+	NewBeneficiaryRuleType = "new-beneficiary"
+)
+
+// RuleConfig is the declaration of a rule in the configuration file. The fields used depend on its type.
+type RuleConfig struct {
+	// Name identifies the rule in the reasons of the risk of the payments
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Outcome is the outcome of the payments which trigger the rule, review or block
+	Outcome string `json:"outcome"`
+	// Fields contains the JSON paths of the fields whose values must be the same in the payments counted by velocity rules
+	Fields []string `json:"fields,omitempty"`
+	// Window is the time during which velocity rules count the payments, like 1h
+	Window string `json:"window,omitempty"`
+	// MaxPayments is the maximum number of payments with the same values created within the window of velocity rules
+	MaxPayments int `json:"max_payments,omitempty"`
+	// Limits contains the maximum amount by currency of the payments of every organisation for amount-limit rules
+	Limits map[string][]payment.PaymentAmountType `json:"limits,omitempty"`
+	// Thresholds contains the amount by currency above which the payments to new beneficiaries trigger new-beneficiary rules
+	Thresholds []payment.PaymentAmountType `json:"thresholds,omitempty"`
+}
+
+// Config is the content of the configuration file of the rules
+type Config struct {
+	Rules []RuleConfig `json:"rules"`
+}
+
+// Rule is a fraud rule which can be evaluated for a payment before it is saved
+type Rule interface {
+	// Evaluate returns a reason if the payment triggers the rule or an empty string if it doesn't.
+	// The repository contains the payments saved before.
+	Evaluate(ctx context.Context, repository persistence.PaymentRepository, pay payment.Payment, now time.Time) (string, error)
+}
+
+// ruleTypes contains the constructors of the rules by type
+var ruleTypes = map[string]func(config RuleConfig) (Rule, error){
+	VelocityRuleType:       newVelocityRule,
+	AmountLimitRuleType:    newAmountLimitRule,
+	NewBeneficiaryRuleType: newNewBeneficiaryRule,
+}
+
+// namedRule is a rule with the name and outcome of its declaration
+type namedRule struct {
+	Rule
+	name    string
+	outcome string
+}
+
+// Engine evaluates the fraud rules of a configuration
+type Engine struct {
+	rules []namedRule
+}
+
+// LoadEngine reads the rules from a JSON configuration file, so they can be changed without recompiling
+func LoadEngine(path string) (*Engine, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	engine, err := ParseEngine(file)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading fraud rules from %s: %s", path, err.Error())
+	}
+	return engine, nil
+}
+
+// ParseEngine reads the rules from a JSON configuration and returns an error if any of them is not valid
+func ParseEngine(reader io.Reader) (*Engine, error) {
+	var config Config
+	decoder := json.NewDecoder(reader)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, err
+	}
+	return NewEngine(config)
+}
+
+// NewEngine builds the rules of the configuration. Every rule must have a different name,
+// a known type and review or block as outcome.
+func NewEngine(config Config) (*Engine, error) {
+	engine := &Engine{}
+	names := make(map[string]bool)
+	for i, ruleConfig := range config.Rules {
+		if ruleConfig.Name == "" || names[ruleConfig.Name] {
+			return nil, fmt.Errorf("rule %d must have a unique name", i)
+		}
+		names[ruleConfig.Name] = true
+		if ruleConfig.Outcome != payment.ReviewOutcome && ruleConfig.Outcome != payment.BlockOutcome {
+			return nil, fmt.Errorf("the outcome of rule %s must be %s or %s", ruleConfig.Name, payment.ReviewOutcome, payment.BlockOutcome)
+		}
+		constructor, ok := ruleTypes[ruleConfig.Type]
+		if !ok {
+			return nil, fmt.Errorf("unknown type %q of rule %s", ruleConfig.Type, ruleConfig.Name)
+		}
+		rule, err := constructor(ruleConfig)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %s: %s", ruleConfig.Name, err.Error())
+		}
+		engine.rules = append(engine.rules, namedRule{rule, ruleConfig.Name, ruleConfig.Outcome})
+	}
+	return engine, nil
+}
+
+// Evaluate evaluates all the rules for the payment, which hasn't been saved yet, against the payments of the repository.
+// The outcome is the most severe one of the triggered rules, or allow if none is triggered, and the reasons contain
+// the triggered rules in the order of the configuration. If the context is cancelled or its deadline is exceeded,
+// its error is returned unchanged so it can be told apart from the errors of the rules.
+func (e *Engine) Evaluate(ctx context.Context, repository persistence.PaymentRepository, pay payment.Payment, now time.Time) (payment.PaymentRiskType, error) {
+	risk := payment.PaymentRiskType{Outcome: payment.AllowOutcome}
+	for _, rule := range e.rules {
+		reason, err := rule.Evaluate(ctx, repository, pay, now)
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return risk, ctxErr
+			}
+			return risk, fmt.Errorf("Error evaluating rule %s: %s", rule.name, err.Error())
+		}
+		if reason == "" {
+			continue
+		}
+		risk.Reasons = append(risk.Reasons, payment.RiskReason{Rule: rule.name, Outcome: rule.outcome, Reason: reason})
+		if payment.MoreSevere(rule.outcome, risk.Outcome) {
+			risk.Outcome = rule.outcome
+		}
+	}
+	return risk, nil
+}
@@ -0,0 +1,121 @@
+package fraud
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getaceres/payment-demo/payment"
+	"github.com/getaceres/payment-demo/persistence"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseEngine(t *testing.T) {
+	engine, err := LoadEngine("../test_resources/fraud_rules.json")
+	if err != nil {
+		t.Fatalf("Error loading fraud rules: %s", err.Error())
+	}
+	if len(engine.rules) != 3 {
+		t.Errorf("Expected 3 rules but got %d", len(engine.rules))
+	}
+
+	invalid := []string{
+		`{"rules": [{"name": "limit", "type": "unknown", "outcome": "review"}]}`,
+		`{"rules": [{"name": "limit", "type": "new-beneficiary", "outcome": "allow", "thresholds": [{"amount": "10", "currency": "GBP"}]}]}`,
+		`{"rules": [{"type": "new-beneficiary", "outcome": "review", "thresholds": [{"amount": "10", "currency": "GBP"}]}]}`,
+		`{"rules": [{"name": "new", "type": "new-beneficiary", "outcome": "review", "thresholds": [{"amount": "10", "currency": "GBP"}]},
+			{"name": "new", "type": "new-beneficiary", "outcome": "block", "thresholds": [{"amount": "20", "currency": "GBP"}]}]}`,
+		`{"rules": [{"name": "new", "type": "new-beneficiary", "outcome": "review", "thresholds": [{"amount": "-10", "currency": "GBP"}]}]}`,
+		`{"rules": [{"name": "new", "type": "new-beneficiary", "outcome": "review", "thresholds": [{"amount": "10", "currency": "XXY"}]}]}`,
+		`{"rules": [{"name": "new", "type": "new-beneficiary", "outcome": "review", "thresholds": [{"amount": "10", "currency": "GBP"}, {"amount": "20", "currency": "GBP"}]}]}`,
+		`{"rules": [{"name": "limit", "type": "amount-limit", "outcome": "block"}]}`,
+		`{"rules": [{"name": "velocity", "type": "velocity", "outcome": "review", "fields": ["attributes.unknown"], "window": "1h", "max_payments": 2}]}`,
+		`{"rules": [{"name": "velocity", "type": "velocity", "outcome": "review", "fields": ["attributes.charges_information.sender_charges.amount"], "window": "1h", "max_payments": 2}]}`,
+		`{"rules": [{"name": "velocity", "type": "velocity", "outcome": "review", "fields": ["organisation_id"], "window": "an hour", "max_payments": 2}]}`,
+		`{"rules": [{"name": "velocity", "type": "velocity", "outcome": "review", "fields": ["organisation_id"], "window": "1h"}]}`,
+		`{"rules": [{"name": "velocity", "type": "velocity", "outcome": "review", "field": "organisation_id", "window": "1h", "max_payments": 2}]}`,
+	}
+	for _, config := range invalid {
+		if _, err := ParseEngine(strings.NewReader(config)); err == nil {
+			t.Errorf("Expected error parsing fraud rules %s", config)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	ctx := context.Background()
+	engine, err := LoadEngine("../test_resources/fraud_rules.json")
+	if err != nil {
+		t.Fatalf("Error loading fraud rules: %s", err.Error())
+	}
+	pay, err := payment.GetDefaultTestPayment("../test_resources")
+	if err != nil {
+		t.Fatalf("Error reading test payment: %s", err.Error())
+	}
+	repository := persistence.NewMemoryPaymentRepository()
+
+	evaluate := func(pay payment.Payment, now time.Time, expected payment.PaymentRiskType) {
+		t.Helper()
+		risk, err := engine.Evaluate(ctx, repository, pay, now)
+		if err != nil {
+			t.Fatalf("Error evaluating fraud rules: %s", err.Error())
+		}
+		if diff := cmp.Diff(expected, risk); diff != "" {
+			t.Errorf("Unexpected risk for amount %s. Diff: %s", pay.Attributes.Amount, diff)
+		}
+	}
+
+	evaluate(pay, time.Now(), payment.PaymentRiskType{Outcome: payment.AllowOutcome})
+
+	large := pay
+	large.Attributes.Amount = "1500.00"
+	evaluate(large, time.Now(), payment.PaymentRiskType{
+		Outcome: payment.ReviewOutcome,
+		Reasons: []payment.RiskReason{
+			{Rule: "new-beneficiary", Outcome: payment.ReviewOutcome, Reason: "First payment to account 31926819 above 1000.00 GBP"},
+		},
+	})
+
+	for i := 0; i < 2; i++ {
+		pay.CreatedAt = time.Now().UTC().Format(payment.CreationTimestampLayout)
+		if _, err := repository.AddPayment(ctx, pay); err != nil {
+			t.Fatalf("Error adding payment: %s", err.Error())
+		}
+	}
+	velocity := payment.RiskReason{
+		Rule:    "beneficiary-velocity",
+		Outcome: payment.ReviewOutcome,
+		Reason:  "2 payments with attributes.beneficiary_party.account_number 31926819 have been created in the last 1h0m0s",
+	}
+	evaluate(large, time.Now(), payment.PaymentRiskType{Outcome: payment.ReviewOutcome, Reasons: []payment.RiskReason{velocity}})
+	evaluate(large, time.Now().Add(2*time.Hour), payment.PaymentRiskType{Outcome: payment.AllowOutcome})
+
+	other := pay
+	other.Attributes.BeneficiaryParty.AccountNumber = "12345678"
+	evaluate(other, time.Now(), payment.PaymentRiskType{Outcome: payment.AllowOutcome})
+
+	blocked := pay
+	blocked.Attributes.Amount = "10000.01"
+	evaluate(blocked, time.Now(), payment.PaymentRiskType{
+		Outcome: payment.BlockOutcome,
+		Reasons: []payment.RiskReason{
+			velocity,
+			{Rule: "organisation-limit", Outcome: payment.BlockOutcome, Reason: "The amount is above the limit of 10000.00 GBP of the organisation"},
+		},
+	})
+
+	blocked.OrganisationID = "ee2fb143-6dfe-4787-b183-ca8ddd4164d2"
+	evaluate(blocked, time.Now().Add(2*time.Hour), payment.PaymentRiskType{
+		Outcome: payment.ReviewOutcome,
+		Reasons: []payment.RiskReason{
+			{Rule: "new-beneficiary", Outcome: payment.ReviewOutcome, Reason: "First payment to account 31926819 above 1000.00 GBP"},
+		},
+	})
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := engine.Evaluate(cancelled, repository, large, time.Now()); err != context.Canceled {
+		t.Errorf("Expected %v evaluating fraud rules with a cancelled context but got %v", context.Canceled, err)
+	}
+}
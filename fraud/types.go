@@ -0,0 +1,182 @@
+package fraud
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/getaceres/payment-demo/payment"
+	"github.com/getaceres/payment-demo/persistence"
+)
+
+// velocityRule is triggered when the payment would make the number of payments created within the window
+// with the same values in all the fields exceed the maximum
+type velocityRule struct {
+	fields      []persistence.PaymentField
+	window      time.Duration
+	maxPayments int
+}
+
+func newVelocityRule(config RuleConfig) (Rule, error) {
+	if len(config.Fields) == 0 {
+		return nil, fmt.Errorf("velocity rules need at least one field")
+	}
+	rule := &velocityRule{maxPayments: config.MaxPayments}
+	for _, path := range config.Fields {
+		field, err := persistence.GetPaymentField(path)
+		if err != nil {
+			return nil, err
+		}
+		if field.Repeated {
+			return nil, fmt.Errorf("%s is inside a list", path)
+		}
+		rule.fields = append(rule.fields, field)
+	}
+	window, err := time.ParseDuration(config.Window)
+	if err != nil || window <= 0 {
+		return nil, fmt.Errorf("the window must be a positive duration, like 1h")
+	}
+	rule.window = window
+	if config.MaxPayments < 1 {
+		return nil, fmt.Errorf("the maximum number of payments must be at least 1")
+	}
+	return rule, nil
+}
+
+// Evaluate counts the payments with the same values whose creation time is within the window.
+// Payments without value in any of the fields don't trigger the rule.
+func (r *velocityRule) Evaluate(ctx context.Context, repository persistence.PaymentRepository, pay payment.Payment, now time.Time) (string, error) {
+	var conditions []persistence.FilterCondition
+	var values []string
+	for _, field := range r.fields {
+		fieldValues := field.Values(pay)
+		if len(fieldValues) == 0 || fieldValues[0] == "" {
+			return "", nil
+		}
+		conditions = append(conditions, persistence.FilterCondition{Field: field, Operator: persistence.EqualOperator, Value: fieldValues[0]})
+		values = append(values, field.Path+" "+fieldValues[0])
+	}
+
+	start := now.Add(-r.window).UTC().Format(payment.CreationTimestampLayout)
+	created, err := persistence.NewFilterCondition("created_at", persistence.GreaterOrEqualOperator, start)
+	if err != nil {
+		return "", err
+	}
+	id, err := persistence.GetSelectablePaymentField("id")
+	if err != nil {
+		return "", err
+	}
+	query := persistence.PaymentQuery{Filter: append(conditions, created), Fields: []persistence.PaymentField{id}}
+	payments, err := repository.FindPayments(ctx, query)
+	if err != nil {
+		return "", err
+	}
+	recent := len(payments)
+	if recent < r.maxPayments {
+		return "", nil
+	}
+	return fmt.Sprintf("%d payments with %s have been created in the last %s", recent, strings.Join(values, " and "), r.window), nil
+}
+
+// amountLimitRule is triggered by payments whose amount is above the limit of their organisation in their currency
+type amountLimitRule struct {
+	limits map[string]map[string]payment.Decimal
+}
+
+func newAmountLimitRule(config RuleConfig) (Rule, error) {
+	if len(config.Limits) == 0 {
+		return nil, fmt.Errorf("amount-limit rules need the limits of at least one organisation")
+	}
+	rule := &amountLimitRule{limits: make(map[string]map[string]payment.Decimal)}
+	for organisation, amounts := range config.Limits {
+		limits, err := parseAmounts(amounts)
+		if err != nil {
+			return nil, fmt.Errorf("limits of organisation %s: %s", organisation, err.Error())
+		}
+		rule.limits[organisation] = limits
+	}
+	return rule, nil
+}
+
+// Evaluate compares the amount of the payment with the limit of its organisation in its currency.
+// Payments of organisations or currencies without limit don't trigger the rule.
+func (r *amountLimitRule) Evaluate(ctx context.Context, repository persistence.PaymentRepository, pay payment.Payment, now time.Time) (string, error) {
+	limit, ok := r.limits[pay.OrganisationID][pay.Attributes.Currency]
+	if !ok || !above(pay, limit) {
+		return "", nil
+	}
+	return fmt.Sprintf("The amount is above the limit of %s %s of the organisation", limit, pay.Attributes.Currency), nil
+}
+
+// newBeneficiaryRule is triggered by payments above the threshold of their currency to beneficiary accounts
+// which the organisation has never paid before
+type newBeneficiaryRule struct {
+	thresholds map[string]payment.Decimal
+}
+
+func newNewBeneficiaryRule(config RuleConfig) (Rule, error) {
+	if len(config.Thresholds) == 0 {
+		return nil, fmt.Errorf("new-beneficiary rules need at least one threshold")
+	}
+	thresholds, err := parseAmounts(config.Thresholds)
+	if err != nil {
+		return nil, fmt.Errorf("thresholds: %s", err.Error())
+	}
+	return &newBeneficiaryRule{thresholds: thresholds}, nil
+}
+
+// Evaluate looks for payments of the organisation to the same beneficiary account when the amount is above the threshold
+func (r *newBeneficiaryRule) Evaluate(ctx context.Context, repository persistence.PaymentRepository, pay payment.Payment, now time.Time) (string, error) {
+	threshold, ok := r.thresholds[pay.Attributes.Currency]
+	account := pay.Attributes.BeneficiaryParty.AccountNumber
+	if !ok || account == "" || !above(pay, threshold) {
+		return "", nil
+	}
+
+	query, err := persistence.NewFilterQuery(map[string]string{
+		"organisation_id": pay.OrganisationID,
+		"attributes.beneficiary_party.account_number": account,
+	})
+	if err != nil {
+		return "", err
+	}
+	id, err := persistence.GetSelectablePaymentField("id")
+	if err != nil {
+		return "", err
+	}
+	query.Fields = []persistence.PaymentField{id}
+	previous, err := repository.FindPayments(ctx, query)
+	if err != nil || len(previous) > 0 {
+		return "", err
+	}
+	return fmt.Sprintf("First payment to account %s above %s %s", account, threshold, pay.Attributes.Currency), nil
+}
+
+// parseAmounts returns the amounts by currency. Every currency must have a single positive amount.
+func parseAmounts(amounts []payment.PaymentAmountType) (map[string]payment.Decimal, error) {
+	result := make(map[string]payment.Decimal)
+	for _, amount := range amounts {
+		if _, ok := payment.CurrencyMinorUnits(amount.Currency); !ok {
+			return nil, fmt.Errorf("%q is not a valid currency", amount.Currency)
+		}
+		if _, ok := result[amount.Currency]; ok {
+			return nil, fmt.Errorf("there's more than one amount in %s", amount.Currency)
+		}
+		value, err := payment.ParseDecimal(amount.Amount)
+		if err != nil {
+			return nil, err
+		}
+		if value.Sign() <= 0 {
+			return nil, fmt.Errorf("%s is not a positive amount", amount.Amount)
+		}
+		result[amount.Currency] = value
+	}
+	return result, nil
+}
+
+// above returns true if the amount of the payment is greater than the limit. Invalid amounts are never above it.
+func above(pay payment.Payment, limit payment.Decimal) bool {
+	amount, err := payment.ParseDecimal(pay.Attributes.Amount)
+	return err == nil && amount.Cmp(limit) > 0
+}
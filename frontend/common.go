@@ -1,11 +1,15 @@
 package frontend
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"strings"
 
+	"github.com/getaceres/payment-demo/payment"
 	"github.com/getaceres/payment-demo/persistence"
 )
 
@@ -36,17 +40,60 @@ func RespondWithJSON(w http.ResponseWriter, code int, payload interface{}) error
 	return nil
 }
 
+// Accepts returns true if the Accept header of the request lists the media type, regardless of its parameters.
+// Wildcards don't match, so clients which accept anything get the default JSON representation.
+func Accepts(r *http.Request, mediaType string) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		if parsed, _, err := mime.ParseMediaType(strings.TrimSpace(accepted)); err == nil && parsed == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
 func RespondWithError(w http.ResponseWriter, code int, err error) {
 	RespondWithText(w, code, err.Error())
 }
 
+// RespondWithValidationError sends the field errors of a payment.ValidationError as a ValidationErrorResponse
+// with a 422 status code and returns true, or returns false if the error is not a validation error
+func RespondWithValidationError(w http.ResponseWriter, err error) bool {
+	validationError, ok := err.(payment.ValidationError)
+	if !ok {
+		return false
+	}
+	RespondWithJSON(w, http.StatusUnprocessableEntity, ValidationErrorResponse{
+		Errors: validationError.Errors,
+	})
+	return true
+}
+
+const (
+	// StatusClientClosedRequest is the non standard status code used when the client closes the connection
+	// before the response is sent, so it only appears in logs and metrics
+	StatusClientClosedRequest = 499
+)
+
 func GetPersistenceErrorCode(err error) int {
+	switch err {
+	case context.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case context.Canceled:
+		return StatusClientClosedRequest
+	}
+
 	code := http.StatusInternalServerError
 	switch err.(type) {
 	case persistence.NotFoundError:
 		code = http.StatusNotFound
-	case persistence.AlreadyExistsError:
+	case persistence.GoneError:
+		code = http.StatusGone
+	case persistence.AlreadyExistsError, persistence.ConflictError, persistence.NotDeletedError:
 		code = http.StatusConflict
+	case persistence.InvalidFieldError, persistence.InvalidValueError, persistence.InvalidOperatorError, persistence.InvalidPageError:
+		code = http.StatusBadRequest
+	case persistence.IdempotencyKeyReusedError:
+		code = http.StatusUnprocessableEntity
 	}
 	return code
 }
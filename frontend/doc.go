@@ -2,6 +2,9 @@
 //
 // Manages payment information
 //
+// The X-User-ID header identifies the user who makes a request. It must be set by a gateway which authenticates
+// the users, and it is ignored unless the server is started with --trust-user-header since clients could send any user.
+//
 //   Version: 1.0
 //   BasePath: /v1
 // swagger:meta
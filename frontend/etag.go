@@ -0,0 +1,61 @@
+package frontend
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/getaceres/payment-demo/payment"
+)
+
+// PreconditionFailedError is returned when the entity tag of a resource doesn't satisfy the If-Match header of a request
+type PreconditionFailedError struct {
+	ETag string
+}
+
+func (e PreconditionFailedError) Error() string {
+	return fmt.Sprintf("The current entity tag %s doesn't match the If-Match header", e.ETag)
+}
+
+// PaymentETag returns the entity tag of a payment, which is derived from its version
+func PaymentETag(pay payment.Payment) string {
+	return fmt.Sprintf(`"%d"`, pay.Version)
+}
+
+// CheckIfMatch returns a PreconditionFailedError if the request has an If-Match header
+// which doesn't contain the entity tag of the payment
+func CheckIfMatch(r *http.Request, pay payment.Payment) error {
+	header := r.Header.Get("If-Match")
+	etag := PaymentETag(pay)
+	if header != "" && !matchesETag(header, etag, false) {
+		return PreconditionFailedError{ETag: etag}
+	}
+	return nil
+}
+
+// IsNotModified returns true if the request has an If-None-Match header which contains the entity tag of the payment
+func IsNotModified(r *http.Request, pay payment.Payment) bool {
+	header := r.Header.Get("If-None-Match")
+	return header != "" && matchesETag(header, PaymentETag(pay), true)
+}
+
+// matchesETag returns true if the list of entity tags of a conditional header contains the given one or is *.
+// Weak entity tags only match with weak comparison, as described in RFC 7232.
+func matchesETag(header, etag string, weak bool) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if strings.HasPrefix(candidate, "W/") {
+			if !weak {
+				continue
+			}
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -1,11 +1,20 @@
 package frontend
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/getaceres/payment-demo/fraud"
 	"github.com/getaceres/payment-demo/payment"
+	"github.com/getaceres/payment-demo/payment/iso20022"
+	"github.com/getaceres/payment-demo/payment/sanctions"
 	"github.com/getaceres/payment-demo/persistence"
 	"github.com/gorilla/mux"
 	"github.com/imdario/mergo"
@@ -13,19 +22,90 @@ import (
 
 const (
 	basePath = "/v1"
+	// ActorHeader is the request header which identifies the user who makes the request,
+	// who is recorded as the actor of the payment revisions created by it. It is only trusted if TrustActorHeader is set.
+	ActorHeader = "X-User-ID"
 )
 
+// actions contains the payment lifecycle actions, which are done with a POST request to the payment path followed by the action
+var actions = []string{
+	payment.RequestApprovalAction,
+	payment.ApproveAction,
+	payment.SubmitAction,
+	payment.SettleAction,
+	payment.RejectAction,
+	payment.ReturnAction,
+	payment.CancelAction,
+	payment.ClearHitAction,
+	payment.ConfirmHitAction,
+}
+
 type FrontendV1 struct {
 	Router            *mux.Router
 	PaymentRepository persistence.PaymentRepository
+	// RequestTimeout is the maximum time the persistence operations of a request can take. Zero means no limit.
+	RequestTimeout time.Duration
+	// IdempotencyKeyExpiry is the time the idempotency keys of payment creations are kept. Zero means DefaultIdempotencyKeyExpiry.
+	IdempotencyKeyExpiry time.Duration
+	// Validator checks the payments which are created or updated and the exchange information of the fx-check endpoint
+	Validator payment.Validator
+	// Screener checks the parties of the payments which are created or updated against the sanctions list.
+	// Payments which match it are held. They aren't screened if it is nil.
+	Screener *sanctions.Screener
+	// Rules are the fraud rules evaluated for the payments which are created. Payments which need review are held
+	// and the ones which must be blocked are blocked. The rules aren't evaluated if it is nil.
+	Rules *fraud.Engine
+	// TrustActorHeader makes the ActorHeader identify the actor of the requests. It must only be set when the server
+	// is behind a gateway which authenticates the users and sets the header, replacing the one sent by the clients.
+	// Otherwise the header is removed from the requests, which have no actor.
+	TrustActorHeader bool
 }
 
 func (a *FrontendV1) InitializeRoutes() {
+	a.Router.Use(a.requestTimeout, a.setActor)
 	a.Router.HandleFunc(basePath+"/payments", a.AddPayment).Methods("POST")
 	a.Router.HandleFunc(basePath+"/payments", a.GetPaymentList).Methods("GET")
 	a.Router.HandleFunc(basePath+"/payments/{paymentID}", a.UpdatePayment).Methods("PUT")
 	a.Router.HandleFunc(basePath+"/payments/{paymentID}", a.DeletePayment).Methods("DELETE")
 	a.Router.HandleFunc(basePath+"/payments/{paymentID}", a.GetPayment).Methods("GET")
+	a.Router.HandleFunc(basePath+"/payments/{paymentID}/restore", a.RestorePayment).Methods("POST")
+	a.Router.HandleFunc(basePath+"/payments/{paymentID}/{action:"+strings.Join(actions, "|")+"}", a.TransitionPayment).Methods("POST")
+	a.Router.HandleFunc(basePath+"/admin/payments/{paymentID}", a.PurgePayment).Methods("DELETE")
+	a.Router.HandleFunc(basePath+"/payments/{paymentID}/history", a.GetPaymentHistory).Methods("GET")
+	a.Router.HandleFunc(basePath+"/payments/{paymentID}/history/{revision}", a.GetPaymentRevision).Methods("GET")
+	a.Router.HandleFunc(basePath+"/payments/{paymentID}/fx-check", a.CheckPaymentFX).Methods("GET")
+	a.Router.HandleFunc(basePath+"/approvals", a.GetPendingApprovals).Methods("GET")
+	a.Router.HandleFunc(basePath+"/organisations/{organisationID}/approval-policy", a.SaveApprovalPolicy).Methods("PUT")
+	a.Router.HandleFunc(basePath+"/organisations/{organisationID}/approval-policy", a.GetApprovalPolicy).Methods("GET")
+	a.Router.HandleFunc(basePath+"/organisations/{organisationID}/approval-policy", a.DeleteApprovalPolicy).Methods("DELETE")
+	a.Router.HandleFunc(basePath+"/organisations/{organisationID}/duplicate-policy", a.SaveDuplicatePolicy).Methods("PUT")
+	a.Router.HandleFunc(basePath+"/organisations/{organisationID}/duplicate-policy", a.GetDuplicatePolicy).Methods("GET")
+	a.Router.HandleFunc(basePath+"/organisations/{organisationID}/duplicate-policy", a.DeleteDuplicatePolicy).Methods("DELETE")
+}
+
+// requestTimeout is a middleware which sets the request timeout as deadline of the request context
+func (a *FrontendV1) requestTimeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.RequestTimeout > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), a.RequestTimeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// setActor is a middleware which sets the user of the ActorHeader as the actor of the persistence operations of the request
+// if the header is trusted, or removes the header otherwise so the handlers can't read a user sent by the client
+func (a *FrontendV1) setActor(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.TrustActorHeader {
+			r.Header.Del(ActorHeader)
+		} else if actor := r.Header.Get(ActorHeader); actor != "" {
+			r = r.WithContext(persistence.WithActor(r.Context(), actor))
+		}
+		next.ServeHTTP(w, r)
+	})
 }
 
 func (a *FrontendV1) doPaymentOperation(w http.ResponseWriter, r *http.Request, function func(id string) (payment.Payment, error), verb string) {
@@ -35,14 +115,41 @@ func (a *FrontendV1) doPaymentOperation(w http.ResponseWriter, r *http.Request,
 		return
 	}
 
-	payment, err := function(paymentID)
+	pay, err := function(paymentID)
+	if RespondWithValidationError(w, err) {
+		return
+	}
 	if err != nil {
-		RespondWithError(w, GetPersistenceErrorCode(err), fmt.Errorf("Error %s payment %s: %s", verb, paymentID, err.Error()))
+		code := GetPersistenceErrorCode(err)
+		switch err.(type) {
+		case PreconditionFailedError:
+			code = http.StatusPreconditionFailed
+		case payment.InvalidTransitionError, payment.ApprovalRequiredError:
+			code = http.StatusConflict
+		case payment.FourEyesError:
+			code = http.StatusForbidden
+		}
+		RespondWithError(w, code, fmt.Errorf("Error %s payment %s: %s", verb, paymentID, err.Error()))
+		return
+	}
+
+	w.Header().Set("ETag", PaymentETag(pay))
+	if r.Method == http.MethodGet && IsNotModified(r, pay) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if r.Method == http.MethodGet && Accepts(r, iso20022.Pain001MediaType) {
+		var document bytes.Buffer
+		if err := iso20022.Write(&document, iso20022.MessageID(pay.ID), time.Now(), []payment.Payment{pay}); err != nil {
+			RespondWithError(w, http.StatusUnprocessableEntity, fmt.Errorf("Error exporting payment %s: %s", paymentID, err.Error()))
+			return
+		}
+		Respond(w, http.StatusOK, document.Bytes(), iso20022.Pain001MediaType)
 		return
 	}
 
 	RespondWithJSON(w, http.StatusOK, PaymentResponse{
-		Data: payment,
+		Data: pay,
 		Links: map[string]string{
 			"self": r.URL.String(),
 		},
@@ -59,6 +166,19 @@ func (a *FrontendV1) doPaymentOperation(w http.ResponseWriter, r *http.Request,
 // - application/json
 // - application/text
 // parameters:
+// - name: X-User-ID
+//   in: header
+//   description: The user who creates the payment, set by the authenticating gateway, recorded as its creator, who can't approve it, and as the actor of the payment revision
+//   required: false
+//   type: string
+// - name: Idempotency-Key
+//   in: header
+//   description: A unique key chosen by the client, like a UUID, which makes the request safe to retry.
+//     A request repeated with the same key and payment returns the response of the first one with an Idempotent-Replayed header
+//     instead of saving the payment again, until the key expires
+//   required: false
+//   type: string
+//   maxLength: 255
 // - name: payment
 //   in: body
 //   description: The payment to add
@@ -67,12 +187,35 @@ func (a *FrontendV1) doPaymentOperation(w http.ResponseWriter, r *http.Request,
 //     "$ref": "#/definitions/Payment"
 // responses:
 //   '201':
-//     description: The payment with an assigned identifier
+//     description: >
+//       The payment with an assigned identifier. Payments whose debtor or beneficiary match the sanctions list
+//       are held with the details of the matches in their sanctions hits. The outcome of the fraud rules is recorded
+//       in the risk of the payment, which is held if it needs review and blocked if the rules block it.
+//       Suspected duplicates of existing payments are flagged with the identifier of the original payment
+//       if the duplicate policy of their organisation flags them
 //     schema:
 //       "$ref": "#/definitions/PaymentResponse"
+//   400:
+//     description: The payment or the idempotency key are not valid
+//     type: string
+//   409:
+//     description: >
+//       The payment is a suspected duplicate of an existing payment and the duplicate policy of its organisation rejects duplicates.
+//       The original link of the response points to the existing payment
+//     schema:
+//       "$ref": "#/definitions/DuplicatePaymentResponse"
+//   422:
+//     description: >
+//       The payment is not valid, in which case the response contains the errors of its invalid fields.
+//       If the idempotency key has already been used for a different payment, the response is a text describing the error
+//     schema:
+//       "$ref": "#/definitions/ValidationErrorResponse"
 //   500:
 //     description: Unexpected error
 //     type: string
+//   504:
+//     description: The database operations didn't finish before the request timeout
+//     type: string
 func (a *FrontendV1) AddPayment(w http.ResponseWriter, r *http.Request) {
 	var pay payment.Payment
 	err := ReadBody(r.Body, &pay)
@@ -81,7 +224,94 @@ func (a *FrontendV1) AddPayment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	updated, err := a.PaymentRepository.AddPayment(pay)
+	// The status is managed by the payment actions, so new payments are always created
+	pay.Status = payment.CreatedStatus
+	pay.Transitions = nil
+	pay.SanctionsHits = nil
+	pay.Risk = nil
+	pay.SuspectedDuplicateOf = ""
+	pay.CreatedBy = persistence.ActorFromContext(r.Context())
+	pay.CreatedAt = ""
+	if err := a.Validator.Validate(pay); err != nil {
+		RespondWithValidationError(w, err)
+		return
+	}
+
+	expiry := a.IdempotencyKeyExpiry
+	if expiry == 0 {
+		expiry = DefaultIdempotencyKeyExpiry
+	}
+	key, idempotent, err := GetIdempotencyKey(r, pay, expiry)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	if idempotent {
+		// Retries are answered before screening the payment, so the checks don't count the payment saved by the first request
+		record, err := a.PaymentRepository.GetIdempotencyRecord(r.Context(), key.Key)
+		if _, ok := err.(persistence.NotFoundError); err != nil && !ok {
+			RespondWithError(w, GetPersistenceErrorCode(err), fmt.Errorf("Error getting idempotency key: %s", err.Error()))
+			return
+		}
+		if err == nil {
+			replayed, err := record.Replay(key)
+			if err != nil {
+				RespondWithError(w, GetPersistenceErrorCode(err), fmt.Errorf("Error saving payment: %s", err.Error()))
+				return
+			}
+			w.Header().Set(IdempotentReplayedHeader, "true")
+			RespondWithJSON(w, http.StatusCreated, PaymentResponse{
+				Data: replayed,
+				Links: map[string]string{
+					"self": fmt.Sprintf("%s/%s", r.URL.String(), replayed.ID),
+				},
+			})
+			return
+		}
+	}
+	// The creation time is set after fingerprinting the request so retries of the same request have the same fingerprint
+	pay.CreatedAt = time.Now().UTC().Format(payment.CreationTimestampLayout)
+	policy, err := a.PaymentRepository.GetDuplicatePolicy(r.Context(), pay.OrganisationID)
+	checkDuplicates := err == nil
+	if _, ok := err.(persistence.NotFoundError); err != nil && !ok {
+		RespondWithError(w, GetPersistenceErrorCode(err), fmt.Errorf("Error getting duplicate policy: %s", err.Error()))
+		return
+	}
+	if pay, err = a.screen(r, pay); err != nil {
+		RespondWithError(w, http.StatusInternalServerError, fmt.Errorf("Error screening payment: %s", err.Error()))
+		return
+	}
+	if pay, err = a.assess(r, pay); err != nil {
+		RespondWithError(w, GetPersistenceErrorCode(err), fmt.Errorf("Error evaluating fraud rules: %s", err.Error()))
+		return
+	}
+
+	var updated payment.Payment
+	var replayed bool
+	switch {
+	case checkDuplicates:
+		var idempotencyKey *persistence.IdempotencyKey
+		if idempotent {
+			idempotencyKey = &key
+		}
+		updated, replayed, err = a.PaymentRepository.AddPaymentUnlessDuplicate(r.Context(), pay, policy, idempotencyKey)
+	case idempotent:
+		updated, replayed, err = a.PaymentRepository.AddPaymentOnce(r.Context(), pay, key)
+	default:
+		updated, err = a.PaymentRepository.AddPayment(r.Context(), pay)
+	}
+	if replayed {
+		w.Header().Set(IdempotentReplayedHeader, "true")
+	}
+	if duplicate, ok := err.(payment.DuplicatePaymentError); ok {
+		RespondWithJSON(w, http.StatusConflict, DuplicatePaymentResponse{
+			Message: duplicate.Error(),
+			Links: map[string]string{
+				"original": fmt.Sprintf("%s/%s", r.URL.String(), duplicate.OriginalID),
+			},
+		})
+		return
+	}
 	if err != nil {
 		RespondWithError(w, GetPersistenceErrorCode(err), fmt.Errorf("Error saving payment: %s", err.Error()))
 		return
@@ -96,11 +326,16 @@ func (a *FrontendV1) AddPayment(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-// UpdatePayment updates the information of a payment by providing a partial document that will be merged with the original one
+// UpdatePayment updates the information of a payment by providing a partial document that will be merged with the original one.
+// If the document contains a version, the payment is only updated if it still has that version.
 // swagger:operation PUT /payments/{paymentID} updatePayment
 //
 // ---
-// description: Updates the information of a payment by providing a partial document that will be merged with the original one
+// description: >
+//   Updates the information of a payment by providing a partial document that will be merged with the original one.
+//   If the document contains a version, the payment is only updated if it still has that version.
+//   Every update increases the version of the payment by one.
+//   Created payments whose debtor or beneficiary change are screened again against the sanctions list and held if they match it.
 // produces:
 // - application/json
 // - application/text
@@ -110,6 +345,16 @@ func (a *FrontendV1) AddPayment(w http.ResponseWriter, r *http.Request) {
 //   description: The identifier of the payment to update
 //   required: true
 //   type: string
+// - name: If-Match
+//   in: header
+//   description: Entity tag of the payment returned in the ETag header. The payment is only updated if it hasn't changed since then
+//   required: false
+//   type: string
+// - name: X-User-ID
+//   in: header
+//   description: The user who makes the change, set by the authenticating gateway, recorded as the actor of the payment revision
+//   required: false
+//   type: string
 // - name: payment
 //   in: body
 //   description: A partial payment document with the fields to update
@@ -121,15 +366,39 @@ func (a *FrontendV1) AddPayment(w http.ResponseWriter, r *http.Request) {
 //     description: The updated payment
 //     schema:
 //       "$ref": "#/definitions/PaymentResponse"
+//     headers:
+//       ETag:
+//         type: string
+//         description: Entity tag of the payment, derived from its version
 //   500:
 //     description: Unexpected error
 //     type: string
+//   504:
+//     description: The database operations didn't finish before the request timeout
+//     type: string
 //   404:
 //     description: Payment not found
 //     type: string
+//   409:
+//     description: The payment has been modified and its version is not the expected one
+//     type: string
+//   410:
+//     description: The payment has been deleted
+//     type: string
+//   412:
+//     description: The payment has been modified and its entity tag doesn't match the If-Match header
+//     type: string
+//   422:
+//     description: The updated payment is not valid, changes its status, transitions, sanctions hits, risk, suspected duplicate, creator or creation time or changes the amount, currency, exchange information, charges or parties of a payment pending approval, approved, held or submitted
+//     schema:
+//       "$ref": "#/definitions/ValidationErrorResponse"
 func (a *FrontendV1) UpdatePayment(w http.ResponseWriter, r *http.Request) {
 	a.doPaymentOperation(w, r, func(id string) (payment.Payment, error) {
-		existing, err := a.PaymentRepository.GetPayment(id)
+		existing, err := a.PaymentRepository.GetPayment(r.Context(), id)
+		if err != nil {
+			return existing, err
+		}
+		err = CheckIfMatch(r, existing)
 		if err != nil {
 			return existing, err
 		}
@@ -146,15 +415,66 @@ func (a *FrontendV1) UpdatePayment(w http.ResponseWriter, r *http.Request) {
 		}
 
 		partial.ID = id
-		return a.PaymentRepository.UpdatePayment(partial)
+		if err := payment.CheckUpdate(existing, partial); err != nil {
+			return existing, err
+		}
+		if err := a.Validator.Validate(partial); err != nil {
+			return existing, err
+		}
+		// Held payments are locked and the rest of statuses can't be held, so only created payments are screened again
+		if partial.CurrentStatus() == payment.CreatedStatus && sanctions.Changed(existing, partial) {
+			if partial, err = a.screen(r, partial); err != nil {
+				return existing, err
+			}
+		}
+		updated, err := a.PaymentRepository.UpdatePayment(r.Context(), partial)
+		return updated, conditionalError(r, err)
 	}, "updating")
 }
 
-// DeletePayment deletes the information of a payment given its identifier
+// screen checks the parties of the payment against the sanctions list and returns it held with the hits if it matches,
+// or without hits otherwise. The payment is returned as it is if there's no screener.
+func (a *FrontendV1) screen(r *http.Request, pay payment.Payment) (payment.Payment, error) {
+	if a.Screener == nil {
+		return pay, nil
+	}
+	hits := a.Screener.Screen(pay)
+	if len(hits) == 0 {
+		pay.SanctionsHits = nil
+		return pay, nil
+	}
+	return pay.Hold(hits, persistence.ActorFromContext(r.Context()), time.Now())
+}
+
+// assess evaluates the fraud rules for the payment and returns it with their outcome, held if it needs review
+// or blocked if it must be blocked. The payment is returned as it is if there are no rules.
+func (a *FrontendV1) assess(r *http.Request, pay payment.Payment) (payment.Payment, error) {
+	if a.Rules == nil {
+		return pay, nil
+	}
+	risk, err := a.Rules.Evaluate(r.Context(), a.PaymentRepository, pay, time.Now())
+	if err != nil {
+		return pay, err
+	}
+	return pay.Assess(risk, persistence.ActorFromContext(r.Context()), time.Now())
+}
+
+// conditionalError converts a ConflictError into a PreconditionFailedError
+// if the operation was conditioned by the If-Match header of the request
+func conditionalError(r *http.Request, err error) error {
+	if conflict, ok := err.(persistence.ConflictError); ok && r.Header.Get("If-Match") != "" {
+		return PreconditionFailedError{ETag: PaymentETag(payment.Payment{Version: conflict.ActualVersion})}
+	}
+	return err
+}
+
+// DeletePayment marks a payment as deleted given its identifier. Deleted payments can be restored until they are purged.
 // swagger:operation DELETE /payments/{paymentID} deletePayment
 //
 // ---
-// description: Deletes the information of a payment given its identifier
+// description: >
+//   Marks a payment as deleted given its identifier. Deleted payments are not returned by the rest of operations
+//   but they can be restored with the restore operation until an administrator purges them.
 // produces:
 // - application/json
 // - application/text
@@ -164,28 +484,73 @@ func (a *FrontendV1) UpdatePayment(w http.ResponseWriter, r *http.Request) {
 //   description: The identifier of the payment to update
 //   required: true
 //   type: string
+// - name: If-Match
+//   in: header
+//   description: Entity tag of the payment returned in the ETag header. The payment is only deleted if it hasn't changed since then
+//   required: false
+//   type: string
+// - name: X-User-ID
+//   in: header
+//   description: The user who makes the change, set by the authenticating gateway, recorded as the actor of the payment revision
+//   required: false
+//   type: string
 // responses:
 //   '200':
 //     description: The deleted payment
 //     schema:
 //       "$ref": "#/definitions/PaymentResponse"
+//     headers:
+//       ETag:
+//         type: string
+//         description: Entity tag of the payment, derived from its version
 //   500:
 //     description: Unexpected error
 //     type: string
+//   504:
+//     description: The database operations didn't finish before the request timeout
+//     type: string
 //   404:
 //     description: Payment not found
 //     type: string
+//   410:
+//     description: The payment is already deleted
+//     type: string
+//   412:
+//     description: The payment has been modified and its entity tag doesn't match the If-Match header
+//     type: string
 func (a *FrontendV1) DeletePayment(w http.ResponseWriter, r *http.Request) {
-	a.doPaymentOperation(w, r, a.PaymentRepository.DeletePayment, "deleting")
+	a.doPaymentOperation(w, r, func(id string) (payment.Payment, error) {
+		version := persistence.AnyVersion
+		if r.Header.Get("If-Match") != "" {
+			existing, err := a.PaymentRepository.GetPayment(r.Context(), id)
+			if err != nil {
+				return existing, err
+			}
+			err = CheckIfMatch(r, existing)
+			if err != nil {
+				return existing, err
+			}
+			version = existing.Version
+		}
+
+		deleted, err := a.PaymentRepository.DeletePayment(r.Context(), id, version)
+		return deleted, conditionalError(r, err)
+	}, "deleting")
 }
 
-// GetPayment retrieves the information of a payment given its identifier
+// GetPayment retrieves the information of a payment given its identifier, as it is now or as it was at the time of the as_of parameter.
+// Clients which accept application/pain.001+xml get the payment as an ISO 20022 pain.001 credit transfer initiation.
 // swagger:operation GET /payments/{paymentID} getPayment
 //
 // ---
-// description: Retrieves the information of a payment given its identifier
+// description: >
+//   Retrieves the information of a payment given its identifier.
+//   If the as_of parameter is present, the payment is returned as it was at that time, even if it has been deleted since then.
+//   If the Accept header contains application/pain.001+xml, the payment is returned as an ISO 20022 pain.001.001.09
+//   customer credit transfer initiation document whose message identifier is the identifier of the payment without hyphens.
 // produces:
 // - application/json
+// - application/pain.001+xml
 // - application/text
 // parameters:
 // - name: paymentID
@@ -193,29 +558,241 @@ func (a *FrontendV1) DeletePayment(w http.ResponseWriter, r *http.Request) {
 //   description: The identifier of the requiered payment
 //   required: true
 //   type: string
+// - name: as_of
+//   in: query
+//   description: Time in RFC 3339 format, like 2019-01-31T23:59:59Z, at which the state of the payment is returned
+//   required: false
+//   type: string
+//   format: date-time
+// - name: If-None-Match
+//   in: header
+//   description: Entity tag of the payment returned in the ETag header. The payment is only returned if it has changed since then
+//   required: false
+//   type: string
 // responses:
 //   '200':
 //     description: The required payment
 //     schema:
 //       "$ref": "#/definitions/PaymentResponse"
+//     headers:
+//       ETag:
+//         type: string
+//         description: Entity tag of the payment, derived from its version
+//   304:
+//     description: The payment hasn't changed since the entity tag in the If-None-Match header was returned
+//   400:
+//     description: The as_of parameter is not a valid time
+//     type: string
+//   422:
+//     description: The payment can't be exported as a pain.001 document, because it has no valid amount, bearer code or accounts
+//     type: string
 //   500:
 //     description: Unexpected error
 //     type: string
+//   504:
+//     description: The database operations didn't finish before the request timeout
+//     type: string
 //   404:
-//     description: Payment not found
+//     description: Payment not found or it didn't exist at the as_of time
+//     type: string
+//   410:
+//     description: The payment has been deleted
 //     type: string
 func (a *FrontendV1) GetPayment(w http.ResponseWriter, r *http.Request) {
-	a.doPaymentOperation(w, r, a.PaymentRepository.GetPayment, "getting")
+	var asOf time.Time
+	if value := r.URL.Query().Get(asOfParameter); value != "" {
+		var err error
+		asOf, err = parseAsOfParameter(value)
+		if err != nil {
+			RespondWithError(w, http.StatusBadRequest, fmt.Errorf("Invalid %s parameter: %s", asOfParameter, err.Error()))
+			return
+		}
+	}
+
+	a.doPaymentOperation(w, r, func(id string) (payment.Payment, error) {
+		if !asOf.IsZero() {
+			return a.PaymentRepository.GetPaymentAsOf(r.Context(), id, asOf)
+		}
+		return a.PaymentRepository.GetPayment(r.Context(), id)
+	}, "getting")
 }
 
-// GetPaymentList retrieves a list with all the registered payments
+// RestorePayment undoes the deletion of a payment given its identifier
+// swagger:operation POST /payments/{paymentID}/restore restorePayment
+//
+// ---
+// description: >
+//   Undoes the deletion of a payment given its identifier. The version of the restored payment is increased by one.
+// produces:
+// - application/json
+// - application/text
+// parameters:
+// - name: paymentID
+//   in: path
+//   description: The identifier of the payment to restore
+//   required: true
+//   type: string
+// - name: If-Match
+//   in: header
+//   description: Entity tag of the payment returned in the ETag header. The payment is only restored if it hasn't changed since then
+//   required: false
+//   type: string
+// - name: X-User-ID
+//   in: header
+//   description: The user who makes the change, set by the authenticating gateway, recorded as the actor of the payment revision
+//   required: false
+//   type: string
+// responses:
+//   '200':
+//     description: The restored payment
+//     schema:
+//       "$ref": "#/definitions/PaymentResponse"
+//     headers:
+//       ETag:
+//         type: string
+//         description: Entity tag of the payment, derived from its version
+//   500:
+//     description: Unexpected error
+//     type: string
+//   504:
+//     description: The database operations didn't finish before the request timeout
+//     type: string
+//   404:
+//     description: Payment not found
+//     type: string
+//   409:
+//     description: The payment is not deleted
+//     type: string
+//   412:
+//     description: The payment has been modified and its entity tag doesn't match the If-Match header
+//     type: string
+func (a *FrontendV1) RestorePayment(w http.ResponseWriter, r *http.Request) {
+	a.doPaymentOperation(w, r, func(id string) (payment.Payment, error) {
+		version := persistence.AnyVersion
+		if r.Header.Get("If-Match") != "" {
+			// Deleted payments can't be read with GetPayment, so the version is taken from the last revision
+			revisions, err := a.PaymentRepository.GetPaymentRevisions(r.Context(), id)
+			if err != nil {
+				return payment.Payment{}, err
+			}
+			deleted := revisions[len(revisions)-1].Payment
+			err = CheckIfMatch(r, deleted)
+			if err != nil {
+				return deleted, err
+			}
+			version = deleted.Version
+		}
+
+		restored, err := a.PaymentRepository.RestorePayment(r.Context(), id, version)
+		return restored, conditionalError(r, err)
+	}, "restoring")
+}
+
+// PurgePayment permanently removes a deleted payment and its history given its identifier
+// swagger:operation DELETE /admin/payments/{paymentID} purgePayment
+//
+// ---
+// description: >
+//   Permanently removes a deleted payment and its history given its identifier, so it can't be restored anymore.
+//   This is an administrative operation, so access to it should be restricted.
+// produces:
+// - application/json
+// - application/text
+// parameters:
+// - name: paymentID
+//   in: path
+//   description: The identifier of the payment to purge
+//   required: true
+//   type: string
+// responses:
+//   '200':
+//     description: The purged payment
+//     schema:
+//       "$ref": "#/definitions/PaymentResponse"
+//   500:
+//     description: Unexpected error
+//     type: string
+//   504:
+//     description: The database operations didn't finish before the request timeout
+//     type: string
+//   404:
+//     description: Payment not found
+//     type: string
+//   409:
+//     description: The payment is not deleted
+//     type: string
+func (a *FrontendV1) PurgePayment(w http.ResponseWriter, r *http.Request) {
+	a.doPaymentOperation(w, r, func(id string) (payment.Payment, error) {
+		return a.PaymentRepository.PurgePayment(r.Context(), id)
+	}, "purging")
+}
+
+// GetPaymentList retrieves a page of the list of registered payments which match the query parameters
 // swagger:operation GET /payments getPaymentList
 //
 // ---
-// description: Retrieves a list with all the registered payments
+// description: >
+//   Retrieves a page of the list of registered payments which match the query parameters.
+//   The links of the response contain the first page of the list and the next and previous pages if they exist.
+//   If the as_of parameter is present, the list contains the payments as they were at that time, including the ones deleted since then.
 // produces:
 // - application/json
 // - application/text
+// parameters:
+// - name: filter[<field>]
+//   in: query
+//   description: >
+//     Returns only the payments whose field is equal to the value. Fields are JSON paths in the payment document
+//     like attributes.beneficiary_party.bank_id. Paths are also looked up inside the attributes so filter[currency]
+//     is equivalent to filter[attributes.currency]. Amounts are compared by their numeric value.
+//   required: false
+//   type: string
+// - name: filter[<field>][<operator>]
+//   in: query
+//   description: >
+//     Returns only the payments whose field satisfies the comparison with the value.
+//     Valid operators are eq, ne, lt, lte, gt and gte. For example filter[processing_date][gte]=2017-01-01
+//   required: false
+//   type: string
+// - name: sort
+//   in: query
+//   description: >
+//     Comma separated list of fields used to sort the payments. Fields prefixed with - are sorted in descending order.
+//     For example sort=-attributes.amount
+//   required: false
+//   type: string
+// - name: fields
+//   in: query
+//   description: >
+//     Comma separated list of fields returned for each payment. The identifier is always returned.
+//     For example fields=id,attributes.amount
+//   required: false
+//   type: string
+// - name: page[size]
+//   in: query
+//   description: Maximum number of payments returned. Defaults to 100 and can't be greater than 1000
+//   required: false
+//   type: integer
+// - name: page[after]
+//   in: query
+//   description: >
+//     Opaque cursor which makes the list start after the payment it points to.
+//     Cursors are returned in the next link of the previous page
+//   required: false
+//   type: string
+// - name: page[before]
+//   in: query
+//   description: >
+//     Opaque cursor which makes the list end before the payment it points to.
+//     Cursors are returned in the prev link of the following page
+//   required: false
+//   type: string
+// - name: as_of
+//   in: query
+//   description: Time in RFC 3339 format, like 2019-01-31T23:59:59Z, at which the state of the payments is returned
+//   required: false
+//   type: string
+//   format: date-time
 // responses:
 //   '200':
 //     description: The list of registered payments
@@ -223,20 +800,715 @@ func (a *FrontendV1) GetPayment(w http.ResponseWriter, r *http.Request) {
 //       type: array
 //       items:
 //         "$ref": "#/definitions/PaymentListResponse"
+//   400:
+//     description: Unknown or malformed query parameters
+//     schema:
+//       "$ref": "#/definitions/ParameterErrorResponse"
 //   500:
 //     description: Unexpected error
 //     type: string
+//   504:
+//     description: The database operations didn't finish before the request timeout
+//     type: string
 func (a *FrontendV1) GetPaymentList(w http.ResponseWriter, r *http.Request) {
-	payments, err := a.PaymentRepository.GetPayments(nil)
+	a.respondWithPaymentPage(w, r)
+}
+
+// respondWithPaymentPage sends the page of the payments which match the query parameters and the given conditions
+func (a *FrontendV1) respondWithPaymentPage(w http.ResponseWriter, r *http.Request, conditions ...persistence.FilterCondition) {
+	query, pageRequest, parameterErrors := ParsePaymentListParameters(r.URL.Query())
+	query.Filter = append(query.Filter, conditions...)
+	if len(parameterErrors) > 0 {
+		RespondWithJSON(w, http.StatusBadRequest, ParameterErrorResponse{
+			Errors: parameterErrors,
+		})
+		return
+	}
+
+	page, err := a.PaymentRepository.GetPaymentPage(r.Context(), query, pageRequest)
 	if err != nil {
 		RespondWithError(w, GetPersistenceErrorCode(err), fmt.Errorf("Error getting payment list: %s", err.Error()))
 		return
 	}
 
+	links := map[string]string{
+		"self":  r.URL.String(),
+		"first": pageLink(r.URL, "", ""),
+	}
+	if page.Next != "" {
+		links["next"] = pageLink(r.URL, pageAfterParameter, page.Next)
+	}
+	if page.Previous != "" {
+		links["prev"] = pageLink(r.URL, pageBeforeParameter, page.Previous)
+	}
+
 	RespondWithJSON(w, http.StatusOK, PaymentListResponse{
-		Data: payments,
+		Data:  page.Payments,
+		Links: links,
+	})
+}
+
+// pageLink returns the URL of the list request with the given cursor parameter instead of the original ones
+func pageLink(requestURL *url.URL, cursorParameter, cursor string) string {
+	parameters := requestURL.Query()
+	parameters.Del(pageAfterParameter)
+	parameters.Del(pageBeforeParameter)
+	if cursorParameter != "" {
+		parameters.Set(cursorParameter, cursor)
+	}
+	link := *requestURL
+	link.RawQuery = parameters.Encode()
+	return link.String()
+}
+
+// GetPaymentHistory retrieves all the revisions of a payment given its identifier
+// swagger:operation GET /payments/{paymentID}/history getPaymentHistory
+//
+// ---
+// description: >
+//   Retrieves all the revisions of a payment sorted by revision number. Every creation, update, deletion and restoration of a payment
+//   is recorded as a revision with its timestamp, the user of the X-User-ID header of the request and the whole payment document.
+//   Revisions are kept after the payment is deleted and removed when it is purged.
+// produces:
+// - application/json
+// - application/text
+// parameters:
+// - name: paymentID
+//   in: path
+//   description: The identifier of the payment
+//   required: true
+//   type: string
+// responses:
+//   '200':
+//     description: The revisions of the payment
+//     schema:
+//       "$ref": "#/definitions/PaymentRevisionListResponse"
+//   500:
+//     description: Unexpected error
+//     type: string
+//   504:
+//     description: The database operations didn't finish before the request timeout
+//     type: string
+//   404:
+//     description: Payment not found
+//     type: string
+func (a *FrontendV1) GetPaymentHistory(w http.ResponseWriter, r *http.Request) {
+	paymentID := mux.Vars(r)["paymentID"]
+	revisions, err := a.PaymentRepository.GetPaymentRevisions(r.Context(), paymentID)
+	if err != nil {
+		RespondWithError(w, GetPersistenceErrorCode(err), fmt.Errorf("Error getting history of payment %s: %s", paymentID, err.Error()))
+		return
+	}
+
+	RespondWithJSON(w, http.StatusOK, PaymentRevisionListResponse{
+		Data: revisions,
+		Links: map[string]string{
+			"self":    r.URL.String(),
+			"payment": fmt.Sprintf("%s/payments/%s", basePath, paymentID),
+		},
+	})
+}
+
+// GetPaymentRevision retrieves a revision of a payment given its identifier and the revision number
+// swagger:operation GET /payments/{paymentID}/history/{revision} getPaymentRevision
+//
+// ---
+// description: Retrieves a revision of a payment given its identifier and the revision number, which starts at 1
+// produces:
+// - application/json
+// - application/text
+// parameters:
+// - name: paymentID
+//   in: path
+//   description: The identifier of the payment
+//   required: true
+//   type: string
+// - name: revision
+//   in: path
+//   description: The number of the revision
+//   required: true
+//   type: integer
+// responses:
+//   '200':
+//     description: The required revision
+//     schema:
+//       "$ref": "#/definitions/PaymentRevisionResponse"
+//   400:
+//     description: The revision is not a number
+//     type: string
+//   500:
+//     description: Unexpected error
+//     type: string
+//   504:
+//     description: The database operations didn't finish before the request timeout
+//     type: string
+//   404:
+//     description: Payment revision not found
+//     type: string
+func (a *FrontendV1) GetPaymentRevision(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	paymentID := vars["paymentID"]
+	revision, err := strconv.Atoi(vars["revision"])
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, fmt.Errorf("Invalid revision %s of payment %s", vars["revision"], paymentID))
+		return
+	}
+
+	found, err := a.PaymentRepository.GetPaymentRevision(r.Context(), paymentID, revision)
+	if err != nil {
+		RespondWithError(w, GetPersistenceErrorCode(err), fmt.Errorf("Error getting revision %d of payment %s: %s", revision, paymentID, err.Error()))
+		return
+	}
+
+	RespondWithJSON(w, http.StatusOK, PaymentRevisionResponse{
+		Data: found,
+		Links: map[string]string{
+			"self":    r.URL.String(),
+			"history": fmt.Sprintf("%s/payments/%s/history", basePath, paymentID),
+			"payment": fmt.Sprintf("%s/payments/%s", basePath, paymentID),
+		},
+	})
+}
+
+// CheckPaymentFX checks whether the amount of a payment is consistent with its original amount and exchange rate
+// swagger:operation GET /payments/{paymentID}/fx-check checkPaymentFX
+//
+// ---
+// description: >
+//   Checks whether the amount of a payment is its original amount converted at its exchange rate,
+//   rounded to the minor unit of its currency with the configured rounding mode and within the configured tolerances.
+//   Payments without exchange information are returned as not checked.
+// produces:
+// - application/json
+// - application/text
+// parameters:
+// - name: paymentID
+//   in: path
+//   description: The identifier of the payment to check
+//   required: true
+//   type: string
+// responses:
+//   '200':
+//     description: The result of the check
+//     schema:
+//       "$ref": "#/definitions/FXCheckResponse"
+//   500:
+//     description: Unexpected error
+//     type: string
+//   504:
+//     description: The database operations didn't finish before the request timeout
+//     type: string
+//   404:
+//     description: Payment not found
+//     type: string
+//   410:
+//     description: The payment has been deleted
+//     type: string
+func (a *FrontendV1) CheckPaymentFX(w http.ResponseWriter, r *http.Request) {
+	paymentID := mux.Vars(r)["paymentID"]
+	found, err := a.PaymentRepository.GetPayment(r.Context(), paymentID)
+	if err != nil {
+		RespondWithError(w, GetPersistenceErrorCode(err), fmt.Errorf("Error getting payment %s: %s", paymentID, err.Error()))
+		return
+	}
+
+	RespondWithJSON(w, http.StatusOK, FXCheckResponse{
+		Data: a.Validator.FX.Check(found),
+		Links: map[string]string{
+			"self":    r.URL.String(),
+			"payment": fmt.Sprintf("%s/payments/%s", basePath, paymentID),
+		},
+	})
+}
+
+// TransitionPayment changes the status of a payment with one of the lifecycle actions
+// swagger:operation POST /payments/{paymentID}/{action} transitionPayment
+//
+// ---
+// description: >
+//   Changes the status of a payment with one of the lifecycle actions, recording the transition with its time, reason and actor.
+//   New payments are created. They can request approval, which makes them pending approval, or be submitted or cancelled.
+//   Payments pending approval can be approved, rejected or cancelled. Approved payments can be submitted, rejected or cancelled.
+//   Submitted payments can be settled or rejected and settled payments can be returned.
+//   Rejected, returned and cancelled payments can't change anymore.
+//   Pending approvals must be approved or rejected by a user identified by the X-User-ID header
+//   different from the one who requested the approval. Payments which need approval according to the approval policy
+//   of their organisation can't be submitted until they are approved.
+//   Payments held because their parties match the sanctions list can have the hit cleared, which makes them created again,
+//   or confirmed, which blocks them permanently.
+//   The version of the payment is increased by one.
+// produces:
+// - application/json
+// - application/text
+// parameters:
+// - name: paymentID
+//   in: path
+//   description: The identifier of the payment
+//   required: true
+//   type: string
+// - name: action
+//   in: path
+//   description: The lifecycle action
+//   required: true
+//   type: string
+//   enum:
+//   - request-approval
+//   - approve
+//   - submit
+//   - settle
+//   - reject
+//   - return
+//   - cancel
+//   - clear-hit
+//   - confirm-hit
+// - name: If-Match
+//   in: header
+//   description: Entity tag of the payment returned in the ETag header. The action is only done if the payment hasn't changed since then
+//   required: false
+//   type: string
+// - name: X-User-ID
+//   in: header
+//   description: >
+//     The user who does the action, set by the authenticating gateway, recorded as the actor of the transition and of the payment revision.
+//     It is required to request, approve or reject the approval of the payment
+//   required: false
+//   type: string
+// - name: transition
+//   in: body
+//   description: The reason of the action
+//   required: false
+//   schema:
+//     "$ref": "#/definitions/TransitionRequest"
+// responses:
+//   '200':
+//     description: The payment in its new status
+//     schema:
+//       "$ref": "#/definitions/PaymentResponse"
+//     headers:
+//       ETag:
+//         type: string
+//         description: Entity tag of the payment, derived from its version
+//   400:
+//     description: The body is not valid
+//     type: string
+//   500:
+//     description: Unexpected error
+//     type: string
+//   504:
+//     description: The database operations didn't finish before the request timeout
+//     type: string
+//   404:
+//     description: Payment not found
+//     type: string
+//   403:
+//     description: >
+//       The approval is requested anonymously or the pending approval is approved or rejected anonymously,
+//       by the user who created the payment or by the user who requested it
+//     type: string
+//   409:
+//     description: >
+//       The action can't be done in the status of the payment, the payment needs approval before being submitted
+//       or the payment has been modified concurrently
+//     type: string
+//   410:
+//     description: The payment has been deleted
+//     type: string
+//   412:
+//     description: The payment has been modified and its entity tag doesn't match the If-Match header
+//     type: string
+func (a *FrontendV1) TransitionPayment(w http.ResponseWriter, r *http.Request) {
+	action := mux.Vars(r)["action"]
+	var request TransitionRequest
+	if r.ContentLength != 0 {
+		if err := ReadBody(r.Body, &request); err != nil {
+			RespondWithError(w, http.StatusBadRequest, fmt.Errorf("Error reading transition body: %s", err.Error()))
+			return
+		}
+	}
+
+	a.doPaymentOperation(w, r, func(id string) (payment.Payment, error) {
+		existing, err := a.PaymentRepository.GetPayment(r.Context(), id)
+		if err != nil {
+			return existing, err
+		}
+		err = CheckIfMatch(r, existing)
+		if err != nil {
+			return existing, err
+		}
+
+		transitioned, err := existing.Transition(action, request.Reason, persistence.ActorFromContext(r.Context()), time.Now())
+		if err != nil {
+			return existing, err
+		}
+		if action == payment.SubmitAction {
+			if err := a.checkApprovalPolicy(r.Context(), existing); err != nil {
+				return existing, err
+			}
+		}
+		updated, err := a.PaymentRepository.UpdatePayment(r.Context(), transitioned)
+		return updated, conditionalError(r, err)
+	}, fmt.Sprintf("applying action %s to", action))
+}
+
+// checkApprovalPolicy returns an error if the payment can't be submitted according to the approval policy of its organisation.
+// Payments of organisations without approval policy don't need approval.
+func (a *FrontendV1) checkApprovalPolicy(ctx context.Context, pay payment.Payment) error {
+	policy, err := a.PaymentRepository.GetApprovalPolicy(ctx, pay.OrganisationID)
+	if err != nil {
+		if _, ok := err.(persistence.NotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+	return policy.CheckSubmission(pay)
+}
+
+// GetPendingApprovals retrieves a page of the list of payments pending approval which match the query parameters
+// swagger:operation GET /approvals getPendingApprovals
+//
+// ---
+// description: >
+//   Retrieves a page of the list of payments whose approval has been requested and hasn't been approved or rejected yet.
+//   It accepts the same parameters as the payment list, so for example filter[organisation_id] returns the pending approvals of an organisation.
+//   The links of the response contain the first page of the list and the next and previous pages if they exist.
+// produces:
+// - application/json
+// - application/text
+// parameters:
+// - name: filter[<field>]
+//   in: query
+//   description: Returns only the payments whose field is equal to the value, as in the payment list
+//   required: false
+//   type: string
+// - name: sort
+//   in: query
+//   description: Comma separated list of fields used to sort the payments, as in the payment list
+//   required: false
+//   type: string
+// - name: page[size]
+//   in: query
+//   description: Maximum number of payments returned. Defaults to 100 and can't be greater than 1000
+//   required: false
+//   type: integer
+// - name: page[after]
+//   in: query
+//   description: Opaque cursor which makes the list start after the payment it points to
+//   required: false
+//   type: string
+// - name: page[before]
+//   in: query
+//   description: Opaque cursor which makes the list end before the payment it points to
+//   required: false
+//   type: string
+// responses:
+//   '200':
+//     description: The list of payments pending approval
+//     schema:
+//       "$ref": "#/definitions/PaymentListResponse"
+//   400:
+//     description: Unknown or malformed query parameters
+//     schema:
+//       "$ref": "#/definitions/ParameterErrorResponse"
+//   500:
+//     description: Unexpected error
+//     type: string
+//   504:
+//     description: The database operations didn't finish before the request timeout
+//     type: string
+func (a *FrontendV1) GetPendingApprovals(w http.ResponseWriter, r *http.Request) {
+	pending, err := persistence.NewFilterCondition("status", persistence.EqualOperator, payment.PendingApprovalStatus)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, fmt.Errorf("Error getting pending approvals: %s", err.Error()))
+		return
+	}
+	a.respondWithPaymentPage(w, r, pending)
+}
+
+// SaveApprovalPolicy creates or replaces the approval policy of an organisation
+// swagger:operation PUT /organisations/{organisationID}/approval-policy saveApprovalPolicy
+//
+// ---
+// description: >
+//   Creates or replaces the approval policy of an organisation. Its payments whose amount is above the threshold of their currency,
+//   or in a currency without threshold, must be approved by a second user before they can be submitted.
+//   The organisation identifier of the path is used as organisation of the policy.
+// produces:
+// - application/json
+// - application/text
+// parameters:
+// - name: organisationID
+//   in: path
+//   description: The identifier of the organisation
+//   required: true
+//   type: string
+// - name: policy
+//   in: body
+//   description: The approval policy
+//   required: true
+//   schema:
+//     "$ref": "#/definitions/ApprovalPolicy"
+// responses:
+//   '200':
+//     description: The saved approval policy
+//     schema:
+//       "$ref": "#/definitions/ApprovalPolicyResponse"
+//   400:
+//     description: The body is not valid
+//     type: string
+//   422:
+//     description: The organisation identifier or the thresholds are not valid
+//     schema:
+//       "$ref": "#/definitions/ValidationErrorResponse"
+//   500:
+//     description: Unexpected error
+//     type: string
+//   504:
+//     description: The database operations didn't finish before the request timeout
+//     type: string
+func (a *FrontendV1) SaveApprovalPolicy(w http.ResponseWriter, r *http.Request) {
+	var policy payment.ApprovalPolicy
+	if err := ReadBody(r.Body, &policy); err != nil {
+		RespondWithError(w, http.StatusBadRequest, fmt.Errorf("Error reading approval policy body: %s", err.Error()))
+		return
+	}
+	policy.OrganisationID = mux.Vars(r)["organisationID"]
+	if policy.Thresholds == nil {
+		policy.Thresholds = []payment.PaymentAmountType{}
+	}
+	err := policy.Validate()
+	if RespondWithValidationError(w, err) {
+		return
+	}
+
+	if err := a.PaymentRepository.SaveApprovalPolicy(r.Context(), policy); err != nil {
+		RespondWithError(w, GetPersistenceErrorCode(err), fmt.Errorf("Error saving approval policy of organisation %s: %s", policy.OrganisationID, err.Error()))
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, ApprovalPolicyResponse{
+		Data: policy,
 		Links: map[string]string{
 			"self": r.URL.String(),
 		},
 	})
 }
+
+// GetApprovalPolicy retrieves the approval policy of an organisation
+// swagger:operation GET /organisations/{organisationID}/approval-policy getApprovalPolicy
+//
+// ---
+// description: Retrieves the approval policy of an organisation
+// produces:
+// - application/json
+// - application/text
+// parameters:
+// - name: organisationID
+//   in: path
+//   description: The identifier of the organisation
+//   required: true
+//   type: string
+// responses:
+//   '200':
+//     description: The approval policy of the organisation
+//     schema:
+//       "$ref": "#/definitions/ApprovalPolicyResponse"
+//   404:
+//     description: The organisation doesn't have an approval policy, so its payments don't need approval
+//     type: string
+//   500:
+//     description: Unexpected error
+//     type: string
+//   504:
+//     description: The database operations didn't finish before the request timeout
+//     type: string
+func (a *FrontendV1) GetApprovalPolicy(w http.ResponseWriter, r *http.Request) {
+	organisationID := mux.Vars(r)["organisationID"]
+	policy, err := a.PaymentRepository.GetApprovalPolicy(r.Context(), organisationID)
+	if err != nil {
+		RespondWithError(w, GetPersistenceErrorCode(err), fmt.Errorf("Error getting approval policy of organisation %s: %s", organisationID, err.Error()))
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, ApprovalPolicyResponse{
+		Data: policy,
+		Links: map[string]string{
+			"self": r.URL.String(),
+		},
+	})
+}
+
+// DeleteApprovalPolicy removes the approval policy of an organisation
+// swagger:operation DELETE /organisations/{organisationID}/approval-policy deleteApprovalPolicy
+//
+// ---
+// description: Removes the approval policy of an organisation, after which its payments don't need approval
+// produces:
+// - application/text
+// parameters:
+// - name: organisationID
+//   in: path
+//   description: The identifier of the organisation
+//   required: true
+//   type: string
+// responses:
+//   '204':
+//     description: The approval policy has been removed
+//   404:
+//     description: The organisation doesn't have an approval policy
+//     type: string
+//   500:
+//     description: Unexpected error
+//     type: string
+//   504:
+//     description: The database operations didn't finish before the request timeout
+//     type: string
+func (a *FrontendV1) DeleteApprovalPolicy(w http.ResponseWriter, r *http.Request) {
+	organisationID := mux.Vars(r)["organisationID"]
+	if err := a.PaymentRepository.DeleteApprovalPolicy(r.Context(), organisationID); err != nil {
+		RespondWithError(w, GetPersistenceErrorCode(err), fmt.Errorf("Error deleting approval policy of organisation %s: %s", organisationID, err.Error()))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SaveDuplicatePolicy creates or replaces the duplicate policy of an organisation
+// swagger:operation PUT /organisations/{organisationID}/duplicate-policy saveDuplicatePolicy
+//
+// ---
+// description: >
+//   Creates or replaces the duplicate policy of an organisation. Its payments with the same end to end reference, amount, currency
+//   and beneficiary account as an existing payment whose processing date is within the window are rejected or flagged
+//   as suspected duplicates when they are created. The organisation identifier of the path is used as organisation of the policy.
+//   The check is done by the storage atomically with the creation of the payment, so concurrent duplicates are detected
+//   even if they are created in different servers.
+// produces:
+// - application/json
+// - application/text
+// parameters:
+// - name: organisationID
+//   in: path
+//   description: The identifier of the organisation
+//   required: true
+//   type: string
+// - name: policy
+//   in: body
+//   description: The duplicate policy
+//   required: true
+//   schema:
+//     "$ref": "#/definitions/DuplicatePolicy"
+// responses:
+//   '200':
+//     description: The saved duplicate policy
+//     schema:
+//       "$ref": "#/definitions/DuplicatePolicyResponse"
+//   400:
+//     description: The body is not valid
+//     type: string
+//   422:
+//     description: The organisation identifier, the action or the window are not valid
+//     schema:
+//       "$ref": "#/definitions/ValidationErrorResponse"
+//   500:
+//     description: Unexpected error
+//     type: string
+//   504:
+//     description: The database operations didn't finish before the request timeout
+//     type: string
+func (a *FrontendV1) SaveDuplicatePolicy(w http.ResponseWriter, r *http.Request) {
+	var policy payment.DuplicatePolicy
+	if err := ReadBody(r.Body, &policy); err != nil {
+		RespondWithError(w, http.StatusBadRequest, fmt.Errorf("Error reading duplicate policy body: %s", err.Error()))
+		return
+	}
+	policy.OrganisationID = mux.Vars(r)["organisationID"]
+	err := policy.Validate()
+	if RespondWithValidationError(w, err) {
+		return
+	}
+
+	if err := a.PaymentRepository.SaveDuplicatePolicy(r.Context(), policy); err != nil {
+		RespondWithError(w, GetPersistenceErrorCode(err), fmt.Errorf("Error saving duplicate policy of organisation %s: %s", policy.OrganisationID, err.Error()))
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, DuplicatePolicyResponse{
+		Data: policy,
+		Links: map[string]string{
+			"self": r.URL.String(),
+		},
+	})
+}
+
+// GetDuplicatePolicy retrieves the duplicate policy of an organisation
+// swagger:operation GET /organisations/{organisationID}/duplicate-policy getDuplicatePolicy
+//
+// ---
+// description: Retrieves the duplicate policy of an organisation
+// produces:
+// - application/json
+// - application/text
+// parameters:
+// - name: organisationID
+//   in: path
+//   description: The identifier of the organisation
+//   required: true
+//   type: string
+// responses:
+//   '200':
+//     description: The duplicate policy of the organisation
+//     schema:
+//       "$ref": "#/definitions/DuplicatePolicyResponse"
+//   404:
+//     description: The organisation doesn't have a duplicate policy, so its payments aren't checked for duplicates
+//     type: string
+//   500:
+//     description: Unexpected error
+//     type: string
+//   504:
+//     description: The database operations didn't finish before the request timeout
+//     type: string
+func (a *FrontendV1) GetDuplicatePolicy(w http.ResponseWriter, r *http.Request) {
+	organisationID := mux.Vars(r)["organisationID"]
+	policy, err := a.PaymentRepository.GetDuplicatePolicy(r.Context(), organisationID)
+	if err != nil {
+		RespondWithError(w, GetPersistenceErrorCode(err), fmt.Errorf("Error getting duplicate policy of organisation %s: %s", organisationID, err.Error()))
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, DuplicatePolicyResponse{
+		Data: policy,
+		Links: map[string]string{
+			"self": r.URL.String(),
+		},
+	})
+}
+
+// DeleteDuplicatePolicy removes the duplicate policy of an organisation
+// swagger:operation DELETE /organisations/{organisationID}/duplicate-policy deleteDuplicatePolicy
+//
+// ---
+// description: Removes the duplicate policy of an organisation, after which its payments aren't checked for duplicates
+// produces:
+// - application/text
+// parameters:
+// - name: organisationID
+//   in: path
+//   description: The identifier of the organisation
+//   required: true
+//   type: string
+// responses:
+//   '204':
+//     description: The duplicate policy has been removed
+//   404:
+//     description: The organisation doesn't have a duplicate policy
+//     type: string
+//   500:
+//     description: Unexpected error
+//     type: string
+//   504:
+//     description: The database operations didn't finish before the request timeout
+//     type: string
+func (a *FrontendV1) DeleteDuplicatePolicy(w http.ResponseWriter, r *http.Request) {
+	organisationID := mux.Vars(r)["organisationID"]
+	if err := a.PaymentRepository.DeleteDuplicatePolicy(r.Context(), organisationID); err != nil {
+		RespondWithError(w, GetPersistenceErrorCode(err), fmt.Errorf("Error deleting duplicate policy of organisation %s: %s", organisationID, err.Error()))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
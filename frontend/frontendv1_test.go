@@ -2,29 +2,50 @@ package frontend
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"encoding/xml"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/getaceres/payment-demo/fraud"
 	"github.com/getaceres/payment-demo/payment"
+	"github.com/getaceres/payment-demo/payment/bank"
+	"github.com/getaceres/payment-demo/payment/iso20022"
+	"github.com/getaceres/payment-demo/payment/sanctions"
 	"github.com/getaceres/payment-demo/persistence"
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 )
 
 const numPayments = 10
 
+// testValidator checks the exchange information of the test payment, whose rate is quoted as the original amount per unit
+var testValidator = payment.Validator{FX: payment.FXChecker{Quote: payment.OriginalPerUnit}}
+
 var frontend = FrontendV1{
 	Router:            mux.NewRouter(),
 	PaymentRepository: persistence.NewMemoryPaymentRepository(),
+	Validator:         testValidator,
+	TrustActorHeader:  true,
 }
 
 func TestMain(m *testing.M) {
+	list, err := sanctions.LoadList("../test_resources/sanctions.csv")
+	if err != nil {
+		fmt.Printf("Error loading sanctions list: %s", err.Error())
+		os.Exit(-1)
+	}
+	frontend.Screener = &sanctions.Screener{List: list}
 	frontend.InitializeRoutes()
 	os.Exit(m.Run())
 }
@@ -39,7 +60,7 @@ func getDefaultPayment(t *testing.T) payment.Payment {
 
 func addPayment(t *testing.T) payment.Payment {
 	pay := getDefaultPayment(t)
-	pay, err := frontend.PaymentRepository.AddPayment(pay)
+	pay, err := frontend.PaymentRepository.AddPayment(context.Background(), pay)
 	if err != nil {
 		t.Fatalf("Error creating payment: %s", err.Error())
 	}
@@ -47,6 +68,10 @@ func addPayment(t *testing.T) payment.Payment {
 }
 
 func executeRequest(t *testing.T, operation, path string, payload interface{}) *httptest.ResponseRecorder {
+	return executeRequestWithHeaders(t, operation, path, payload, nil)
+}
+
+func executeRequestWithHeaders(t *testing.T, operation, path string, payload interface{}, headers map[string]string) *httptest.ResponseRecorder {
 	var reader io.Reader
 	if payload != nil {
 		text, err := json.Marshal(payload)
@@ -60,6 +85,9 @@ func executeRequest(t *testing.T, operation, path string, payload interface{}) *
 		t.Fatal(err)
 	}
 	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
 	rr := httptest.NewRecorder()
 	frontend.Router.ServeHTTP(rr, req)
 	return rr
@@ -107,26 +135,530 @@ func checkPaymentListResponse(t *testing.T, result *httptest.ResponseRecorder, e
 func TestAdd(t *testing.T) {
 	pay := getDefaultPayment(t)
 	result := executeRequest(t, "POST", "/v1/payments", pay)
+	if strings.Contains(result.Body.String(), `"risk"`) {
+		t.Fatalf("Expected payment without fraud rules to have no risk but got %s", result.Body.String())
+	}
 	returned := checkPaymentResponse(t, result, http.StatusCreated)
 
 	if pay.ID == returned.ID {
 		t.Fatal("Input and output identifiers are the same")
 	}
 
+	if _, err := time.Parse(payment.CreationTimestampLayout, returned.CreatedAt); err != nil {
+		t.Fatalf("Invalid creation time %q: %s", returned.CreatedAt, err.Error())
+	}
+
 	pay.ID = returned.ID
+	pay.Status = payment.CreatedStatus
+	pay.CreatedAt = returned.CreatedAt
 	if !cmp.Equal(pay, returned) {
 		t.Fatalf("Created payment differs from expected.\nExpected:\n%v\nBut got:\n%v", pay, returned)
 	}
 }
 
+func TestIdempotencyKey(t *testing.T) {
+	pay := getDefaultPayment(t)
+	headers := map[string]string{IdempotencyKeyHeader: uuid.New().String()}
+	result := executeRequestWithHeaders(t, "POST", "/v1/payments", pay, headers)
+	created := checkPaymentResponse(t, result, http.StatusCreated)
+	if result.Header().Get(IdempotentReplayedHeader) != "" {
+		t.Fatalf("Unexpected %s header in the response of the first request", IdempotentReplayedHeader)
+	}
+
+	result = executeRequestWithHeaders(t, "POST", "/v1/payments", pay, headers)
+	replayed := checkPaymentResponse(t, result, http.StatusCreated)
+	if result.Header().Get(IdempotentReplayedHeader) != "true" {
+		t.Fatalf("Expected %s header in the response of the repeated request", IdempotentReplayedHeader)
+	}
+	if !cmp.Equal(created, replayed) {
+		t.Fatalf("Repeated request returned a different payment.\nExpected:\n%v\nBut got:\n%v", created, replayed)
+	}
+
+	pay.Attributes.Amount = "1.00"
+	pay.Attributes.FX.OriginalAmount = "2.00"
+	result = executeRequestWithHeaders(t, "POST", "/v1/payments", pay, headers)
+	checkResponseCode(t, result, http.StatusUnprocessableEntity)
+
+	result = executeRequestWithHeaders(t, "POST", "/v1/payments", pay, map[string]string{IdempotencyKeyHeader: strings.Repeat("k", MaxIdempotencyKeyLength+1)})
+	checkResponseCode(t, result, http.StatusBadRequest)
+
+	first := checkPaymentResponse(t, executeRequest(t, "POST", "/v1/payments", pay), http.StatusCreated)
+	second := checkPaymentResponse(t, executeRequest(t, "POST", "/v1/payments", pay), http.StatusCreated)
+	if first.ID == second.ID {
+		t.Fatal("Requests without idempotency key returned the same payment")
+	}
+}
+
+// countingRepository counts the searches of payments, like the ones of the fraud rules
+type countingRepository struct {
+	persistence.PaymentRepository
+	finds int
+}
+
+func (c *countingRepository) FindPayments(ctx context.Context, query persistence.PaymentQuery) ([]payment.Payment, error) {
+	c.finds++
+	return c.PaymentRepository.FindPayments(ctx, query)
+}
+
+func TestIdempotentReplayIsNotAssessed(t *testing.T) {
+	rules, err := fraud.NewEngine(fraud.Config{Rules: []fraud.RuleConfig{
+		{
+			Name:        "velocity",
+			Type:        fraud.VelocityRuleType,
+			Outcome:     payment.ReviewOutcome,
+			Fields:      []string{"organisation_id"},
+			Window:      "1h",
+			MaxPayments: 1,
+		},
+	}})
+	if err != nil {
+		t.Fatalf("Error building fraud rules: %s", err.Error())
+	}
+	repository := &countingRepository{PaymentRepository: persistence.NewMemoryPaymentRepository()}
+	assessed := FrontendV1{
+		Router:            mux.NewRouter(),
+		PaymentRepository: repository,
+		Validator:         testValidator,
+		Rules:             rules,
+	}
+	assessed.InitializeRoutes()
+	post := func(pay payment.Payment, key string) *httptest.ResponseRecorder {
+		body, err := json.Marshal(pay)
+		if err != nil {
+			t.Fatalf("Error marshaling payload: %s", err.Error())
+		}
+		req := httptest.NewRequest("POST", "/v1/payments", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(IdempotencyKeyHeader, key)
+		result := httptest.NewRecorder()
+		assessed.Router.ServeHTTP(result, req)
+		return result
+	}
+
+	pay := getDefaultPayment(t)
+	key := uuid.New().String()
+	created := checkPaymentResponse(t, post(pay, key), http.StatusCreated)
+	if created.Status != payment.CreatedStatus {
+		t.Fatalf("Expected first payment of the organisation to be allowed but got %s", created.Status)
+	}
+	finds := repository.finds
+
+	result := post(pay, key)
+	replayed := checkPaymentResponse(t, result, http.StatusCreated)
+	if result.Header().Get(IdempotentReplayedHeader) != "true" || !cmp.Equal(created, replayed) {
+		t.Fatalf("Expected the repeated request to replay %v but got %v", created, replayed)
+	}
+	if repository.finds != finds {
+		t.Fatalf("Expected the repeated request not to evaluate the fraud rules but it searched payments %d times", repository.finds-finds)
+	}
+
+	pay.Attributes.Amount = "1.00"
+	pay.Attributes.FX.OriginalAmount = "2.00"
+	checkResponseCode(t, post(pay, key), http.StatusUnprocessableEntity)
+	if held := checkPaymentResponse(t, post(pay, uuid.New().String()), http.StatusCreated); held.Status != payment.HeldStatus {
+		t.Fatalf("Expected second payment of the organisation to be held for review but got %s", held.Status)
+	}
+}
+
+func TestValidation(t *testing.T) {
+	pay := getDefaultPayment(t)
+	pay.Attributes.Amount = ""
+	pay.Attributes.Currency = "XYZ"
+	pay.Attributes.DebtorParty.AccountNumber = "GB29XABC10161234567801"
+	result := executeRequest(t, "POST", "/v1/payments", pay)
+	checkResponseCode(t, result, http.StatusUnprocessableEntity)
+	var returned ValidationErrorResponse
+	if err := ReadBody(result.Body, &returned); err != nil {
+		t.Fatalf("Error deserializing response body: %s", err.Error())
+	}
+	expected := []payment.FieldError{
+		{Field: "attributes.amount", Code: payment.RequiredCode},
+		{Field: "attributes.currency", Code: payment.InvalidCurrencyCode},
+		{Field: "attributes.debtor_party.account_number", Code: bank.InvalidIBANCode},
+	}
+	if !cmp.Equal(returned.Errors, expected, cmpopts.IgnoreFields(payment.FieldError{}, "Message")) {
+		t.Fatalf("Unexpected field errors.\nExpected:\n%v\nBut got:\n%v", expected, returned.Errors)
+	}
+
+	existing := addPayment(t)
+	update := payment.Payment{OrganisationID: "organisation"}
+	result = executeRequest(t, "PUT", fmt.Sprintf("/v1/payments/%s", existing.ID), update)
+	checkResponseCode(t, result, http.StatusUnprocessableEntity)
+	got, err := frontend.PaymentRepository.GetPayment(context.Background(), existing.ID)
+	if err != nil {
+		t.Fatalf("Error getting payment %s: %s", existing.ID, err.Error())
+	}
+	if !cmp.Equal(got, existing) {
+		t.Fatalf("Payment %s was modified by an invalid update.\nExpected:\n%v\nBut got:\n%v", existing.ID, existing, got)
+	}
+}
+
+func TestFXCheck(t *testing.T) {
+	pay := addPayment(t)
+	var returned FXCheckResponse
+	checkResponse(t, executeRequest(t, "GET", fmt.Sprintf("/v1/payments/%s/fx-check", pay.ID), nil), http.StatusOK, &returned)
+	if !returned.Data.Checked || !returned.Data.Consistent || returned.Data.ConvertedAmount != "100.21" {
+		t.Fatalf("Expected the test payment to be consistent but got %v", returned.Data)
+	}
+
+	result := executeRequest(t, "GET", fmt.Sprintf("/v1/payments/%s/fx-check", uuid.New().String()), nil)
+	checkResponseCode(t, result, http.StatusNotFound)
+
+	inconsistent := getDefaultPayment(t)
+	inconsistent.Attributes.FX.ExchangeRate = "1.50000"
+	result = executeRequest(t, "POST", "/v1/payments", inconsistent)
+	checkResponseCode(t, result, http.StatusUnprocessableEntity)
+	var validation ValidationErrorResponse
+	if err := ReadBody(result.Body, &validation); err != nil {
+		t.Fatalf("Error deserializing response body: %s", err.Error())
+	}
+	expected := []payment.FieldError{{Field: "attributes.fx", Code: payment.InconsistentFXCode}}
+	if !cmp.Equal(validation.Errors, expected, cmpopts.IgnoreFields(payment.FieldError{}, "Message")) {
+		t.Fatalf("Unexpected field errors.\nExpected:\n%v\nBut got:\n%v", expected, validation.Errors)
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	pay := getDefaultPayment(t)
+	pay.Status = payment.SettledStatus
+	created := checkPaymentResponse(t, executeRequest(t, "POST", "/v1/payments", pay), http.StatusCreated)
+	if created.Status != payment.CreatedStatus {
+		t.Fatalf("Expected new payment to be %s but got %s", payment.CreatedStatus, created.Status)
+	}
+	path := fmt.Sprintf("/v1/payments/%s", created.ID)
+
+	result := executeRequest(t, "POST", path+"/settle", nil)
+	checkResponseCode(t, result, http.StatusConflict)
+
+	update := payment.Payment{Status: payment.SubmittedStatus}
+	result = executeRequest(t, "PUT", path, update)
+	checkResponseCode(t, result, http.StatusUnprocessableEntity)
+
+	headers := map[string]string{ActorHeader: "operator"}
+	result = executeRequestWithHeaders(t, "POST", path+"/submit", TransitionRequest{Reason: "Checked"}, headers)
+	submitted := checkPaymentResponse(t, result, http.StatusOK)
+	if submitted.Status != payment.SubmittedStatus || submitted.Version != created.Version+1 || len(submitted.Transitions) != 1 {
+		t.Fatalf("Unexpected submitted payment: %v", submitted)
+	}
+	transition := submitted.Transitions[0]
+	if transition.Action != payment.SubmitAction || transition.PreviousStatus != payment.CreatedStatus ||
+		transition.Reason != "Checked" || transition.Actor != "operator" || transition.TransitionedAt == "" {
+		t.Fatalf("Unexpected transition: %v", transition)
+	}
+
+	update = payment.Payment{Attributes: payment.PaymentAttributesType{Amount: "50.00"}}
+	result = executeRequest(t, "PUT", path, update)
+	checkResponseCode(t, result, http.StatusUnprocessableEntity)
+	update = payment.Payment{Attributes: payment.PaymentAttributesType{Reference: "New reference"}}
+	result = executeRequest(t, "PUT", path, update)
+	checkPaymentResponse(t, result, http.StatusOK)
+
+	result = executeRequestWithHeaders(t, "POST", path+"/settle", nil, map[string]string{"If-Match": PaymentETag(submitted)})
+	checkResponseCode(t, result, http.StatusPreconditionFailed)
+	settled := checkPaymentResponse(t, executeRequest(t, "POST", path+"/settle", nil), http.StatusOK)
+	returned := checkPaymentResponse(t, executeRequest(t, "POST", path+"/return", nil), http.StatusOK)
+	if settled.Status != payment.SettledStatus || returned.Status != payment.ReturnedStatus || len(returned.Transitions) != 3 {
+		t.Fatalf("Unexpected statuses %s and %s after settling and returning the payment", settled.Status, returned.Status)
+	}
+	result = executeRequest(t, "POST", path+"/cancel", nil)
+	checkResponseCode(t, result, http.StatusConflict)
+
+	result = executeRequest(t, "POST", path+"/unknown", nil)
+	checkResponseCode(t, result, http.StatusNotFound)
+}
+
+func TestApproval(t *testing.T) {
+	pay := getDefaultPayment(t)
+	pay.OrganisationID = uuid.New().String()
+	policyPath := fmt.Sprintf("/v1/organisations/%s/approval-policy", pay.OrganisationID)
+	approvalsPath := "/v1/approvals?filter[organisation_id]=" + pay.OrganisationID
+
+	invalid := payment.ApprovalPolicy{Thresholds: []payment.PaymentAmountType{{Amount: "100", Currency: "XXX"}}}
+	checkResponseCode(t, executeRequest(t, "PUT", policyPath, invalid), http.StatusUnprocessableEntity)
+	policy := payment.ApprovalPolicy{Thresholds: []payment.PaymentAmountType{{Amount: "100.00", Currency: "GBP"}}}
+	var saved ApprovalPolicyResponse
+	checkResponse(t, executeRequest(t, "PUT", policyPath, policy), http.StatusOK, &saved)
+	policy.OrganisationID = pay.OrganisationID
+	var got ApprovalPolicyResponse
+	checkResponse(t, executeRequest(t, "GET", policyPath, nil), http.StatusOK, &got)
+	if !cmp.Equal(saved.Data, policy) || !cmp.Equal(got.Data, policy) {
+		t.Fatalf("Unexpected approval policy.\nExpected:\n%v\nBut saved:\n%v\nAnd got:\n%v", policy, saved.Data, got.Data)
+	}
+
+	creator := map[string]string{ActorHeader: "creator"}
+	pay.CreatedBy = "impostor"
+	created := checkPaymentResponse(t, executeRequestWithHeaders(t, "POST", "/v1/payments", pay, creator), http.StatusCreated)
+	if created.CreatedBy != "creator" {
+		t.Fatalf("Expected payment to be created by creator but got %q", created.CreatedBy)
+	}
+	path := fmt.Sprintf("/v1/payments/%s", created.ID)
+	checkResponseCode(t, executeRequest(t, "POST", path+"/submit", nil), http.StatusConflict)
+	checkResponseCode(t, executeRequest(t, "POST", path+"/request-approval", nil), http.StatusForbidden)
+
+	requester := map[string]string{ActorHeader: "requester"}
+	pending := checkPaymentResponse(t, executeRequestWithHeaders(t, "POST", path+"/request-approval", nil, requester), http.StatusOK)
+	if pending.Status != payment.PendingApprovalStatus {
+		t.Fatalf("Expected payment to be %s but got %s", payment.PendingApprovalStatus, pending.Status)
+	}
+	approvals := checkPaymentListResponse(t, executeRequest(t, "GET", approvalsPath, nil), http.StatusOK)
+	if len(approvals) != 1 || approvals[0].ID != created.ID {
+		t.Fatalf("Expected the payment to be pending approval but got %v", approvals)
+	}
+
+	update := payment.Payment{Attributes: payment.PaymentAttributesType{Amount: "50.00"}}
+	checkResponseCode(t, executeRequest(t, "PUT", path, update), http.StatusUnprocessableEntity)
+	checkResponseCode(t, executeRequest(t, "POST", path+"/approve", nil), http.StatusForbidden)
+	checkResponseCode(t, executeRequestWithHeaders(t, "POST", path+"/approve", nil, requester), http.StatusForbidden)
+	checkResponseCode(t, executeRequestWithHeaders(t, "POST", path+"/approve", nil, creator), http.StatusForbidden)
+	checkResponseCode(t, executeRequestWithHeaders(t, "POST", path+"/reject", nil, creator), http.StatusForbidden)
+
+	approver := map[string]string{ActorHeader: "approver"}
+	approved := checkPaymentResponse(t, executeRequestWithHeaders(t, "POST", path+"/approve", nil, approver), http.StatusOK)
+	if approved.Status != payment.ApprovedStatus || len(approved.Transitions) != 2 || approved.Transitions[1].Actor != "approver" {
+		t.Fatalf("Unexpected approved payment: %v", approved)
+	}
+	if approvals := checkPaymentListResponse(t, executeRequest(t, "GET", approvalsPath, nil), http.StatusOK); len(approvals) != 0 {
+		t.Fatalf("Expected no payments pending approval but got %v", approvals)
+	}
+	submitted := checkPaymentResponse(t, executeRequestWithHeaders(t, "POST", path+"/submit", nil, requester), http.StatusOK)
+	if submitted.Status != payment.SubmittedStatus {
+		t.Fatalf("Expected approved payment to be submitted but got %s", submitted.Status)
+	}
+
+	result := executeRequest(t, "DELETE", policyPath, nil)
+	checkResponseCode(t, result, http.StatusNoContent)
+	checkResponseCode(t, executeRequest(t, "GET", policyPath, nil), http.StatusNotFound)
+	checkResponseCode(t, executeRequest(t, "DELETE", policyPath, nil), http.StatusNotFound)
+	unrestricted := checkPaymentResponse(t, executeRequest(t, "POST", "/v1/payments", pay), http.StatusCreated)
+	result = executeRequest(t, "POST", fmt.Sprintf("/v1/payments/%s/submit", unrestricted.ID), nil)
+	checkPaymentResponse(t, result, http.StatusOK)
+}
+
+func TestSanctionsScreening(t *testing.T) {
+	pay := getDefaultPayment(t)
+	pay.Attributes.BeneficiaryParty.Name = "Dmitry Kovalenko"
+	pay.Status = payment.SettledStatus
+	pay.SanctionsHits = []payment.SanctionsHit{{Field: "attributes.beneficiary_party.name", Score: 1}}
+	held := checkPaymentResponse(t, executeRequest(t, "POST", "/v1/payments", pay), http.StatusCreated)
+	if held.Status != payment.HeldStatus || len(held.SanctionsHits) != 1 || held.SanctionsHits[0].EntryID != "90001" ||
+		held.SanctionsHits[0].Value != "Dmitry Kovalenko" || held.SanctionsHits[0].Score < sanctions.DefaultThreshold {
+		t.Fatalf("Expected payment to be held with a hit of entry 90001 but got %v", held)
+	}
+	path := fmt.Sprintf("/v1/payments/%s", held.ID)
+	checkResponseCode(t, executeRequest(t, "POST", path+"/submit", nil), http.StatusConflict)
+	rename := payment.Payment{Attributes: payment.PaymentAttributesType{BeneficiaryParty: payment.PaymentPartyType{Name: "Someone else"}}}
+	checkResponseCode(t, executeRequest(t, "PUT", path, rename), http.StatusUnprocessableEntity)
+
+	officer := map[string]string{ActorHeader: "compliance"}
+	cleared := checkPaymentResponse(t, executeRequestWithHeaders(t, "POST", path+"/clear-hit", TransitionRequest{Reason: "Different person"}, officer), http.StatusOK)
+	if cleared.Status != payment.CreatedStatus || len(cleared.SanctionsHits) != 1 || cleared.Transitions[1].Actor != "compliance" {
+		t.Fatalf("Expected cleared payment to be created keeping its hits but got %v", cleared)
+	}
+	update := payment.Payment{Attributes: payment.PaymentAttributesType{Reference: "Cleared payment"}}
+	if updated := checkPaymentResponse(t, executeRequest(t, "PUT", path, update), http.StatusOK); updated.Status != payment.CreatedStatus {
+		t.Fatalf("Expected cleared payment not to be screened again without changes in its parties but got %s", updated.Status)
+	}
+	checkPaymentResponse(t, executeRequest(t, "POST", path+"/submit", nil), http.StatusOK)
+
+	confirmed := checkPaymentResponse(t, executeRequest(t, "POST", "/v1/payments", pay), http.StatusCreated)
+	path = fmt.Sprintf("/v1/payments/%s", confirmed.ID)
+	if blocked := checkPaymentResponse(t, executeRequest(t, "POST", path+"/confirm-hit", nil), http.StatusOK); blocked.Status != payment.BlockedStatus {
+		t.Fatalf("Expected confirmed payment to be blocked but got %s", blocked.Status)
+	}
+	checkResponseCode(t, executeRequest(t, "POST", path+"/cancel", nil), http.StatusConflict)
+
+	clean := checkPaymentResponse(t, executeRequest(t, "POST", "/v1/payments", getDefaultPayment(t)), http.StatusCreated)
+	if clean.Status != payment.CreatedStatus || len(clean.SanctionsHits) != 0 {
+		t.Fatalf("Unexpected screening of test payment: %v", clean)
+	}
+	checkResponseCode(t, executeRequest(t, "POST", fmt.Sprintf("/v1/payments/%s/clear-hit", clean.ID), nil), http.StatusConflict)
+	account := payment.Payment{Attributes: payment.PaymentAttributesType{DebtorParty: payment.PaymentPartyType{AccountName: "Blackwood Trading LLC"}}}
+	updated := checkPaymentResponse(t, executeRequest(t, "PUT", fmt.Sprintf("/v1/payments/%s", clean.ID), account), http.StatusOK)
+	if updated.Status != payment.HeldStatus || len(updated.SanctionsHits) != 1 || updated.SanctionsHits[0].Field != "attributes.debtor_party.account_name" {
+		t.Fatalf("Expected payment to be held after matching the sanctions list but got %v", updated)
+	}
+}
+
+func TestFraudRules(t *testing.T) {
+	organisation := uuid.New().String()
+	rules, err := fraud.NewEngine(fraud.Config{Rules: []fraud.RuleConfig{
+		{
+			Name:        "velocity",
+			Type:        fraud.VelocityRuleType,
+			Outcome:     payment.ReviewOutcome,
+			Fields:      []string{"organisation_id", "attributes.beneficiary_party.account_number"},
+			Window:      "1h",
+			MaxPayments: 2,
+		},
+		{
+			Name:    "limit",
+			Type:    fraud.AmountLimitRuleType,
+			Outcome: payment.BlockOutcome,
+			Limits:  map[string][]payment.PaymentAmountType{organisation: {{Amount: "5000", Currency: "GBP"}}},
+		},
+		{
+			Name:       "new-beneficiary",
+			Type:       fraud.NewBeneficiaryRuleType,
+			Outcome:    payment.ReviewOutcome,
+			Thresholds: []payment.PaymentAmountType{{Amount: "1000", Currency: "GBP"}},
+		},
+	}})
+	if err != nil {
+		t.Fatalf("Error building fraud rules: %s", err.Error())
+	}
+	frontend.Rules = rules
+	defer func() { frontend.Rules = nil }()
+
+	pay := getDefaultPayment(t)
+	pay.OrganisationID = organisation
+	pay.Attributes.Amount = "1500.00"
+	pay.Attributes.FX.OriginalAmount = "3000.00"
+	pay.Risk = &payment.PaymentRiskType{Outcome: payment.BlockOutcome}
+	held := checkPaymentResponse(t, executeRequest(t, "POST", "/v1/payments", pay), http.StatusCreated)
+	if held.Status != payment.HeldStatus || held.Risk == nil || held.Risk.Outcome != payment.ReviewOutcome ||
+		len(held.Risk.Reasons) != 1 || held.Risk.Reasons[0].Rule != "new-beneficiary" {
+		t.Fatalf("Expected payment to a new beneficiary to be held for review but got %v", held)
+	}
+	path := fmt.Sprintf("/v1/payments/%s", held.ID)
+	checkResponseCode(t, executeRequest(t, "PUT", path, payment.Payment{Risk: &payment.PaymentRiskType{Outcome: payment.AllowOutcome}}), http.StatusUnprocessableEntity)
+	if cleared := checkPaymentResponse(t, executeRequest(t, "POST", path+"/clear-hit", nil), http.StatusOK); cleared.Status != payment.CreatedStatus {
+		t.Fatalf("Expected reviewed payment to be created but got %s", cleared.Status)
+	}
+
+	pay.Attributes.Amount = "100.00"
+	pay.Attributes.FX.OriginalAmount = "200.00"
+	allowed := checkPaymentResponse(t, executeRequest(t, "POST", "/v1/payments", pay), http.StatusCreated)
+	if allowed.Status != payment.CreatedStatus || allowed.Risk == nil || allowed.Risk.Outcome != payment.AllowOutcome || len(allowed.Risk.Reasons) != 0 {
+		t.Fatalf("Expected payment to be allowed but got %v", allowed)
+	}
+	reviewed := checkPaymentResponse(t, executeRequest(t, "POST", "/v1/payments", pay), http.StatusCreated)
+	if reviewed.Status != payment.HeldStatus || reviewed.Risk == nil || reviewed.Risk.Outcome != payment.ReviewOutcome || reviewed.Risk.Reasons[0].Rule != "velocity" {
+		t.Fatalf("Expected third payment to the beneficiary within an hour to be held for review but got %v", reviewed)
+	}
+
+	pay.Attributes.Amount = "5000.01"
+	pay.Attributes.FX.OriginalAmount = "10000.02"
+	blocked := checkPaymentResponse(t, executeRequest(t, "POST", "/v1/payments", pay), http.StatusCreated)
+	if blocked.Status != payment.BlockedStatus || blocked.Risk == nil || blocked.Risk.Outcome != payment.BlockOutcome || len(blocked.Risk.Reasons) != 2 {
+		t.Fatalf("Expected payment above the limit to be blocked but got %v", blocked)
+	}
+	checkResponseCode(t, executeRequest(t, "POST", fmt.Sprintf("/v1/payments/%s/clear-hit", blocked.ID), nil), http.StatusConflict)
+}
+
+func TestDuplicates(t *testing.T) {
+	pay := getDefaultPayment(t)
+	pay.OrganisationID = uuid.New().String()
+	pay.Attributes.EndToEndReference = uuid.New().String()
+	policyPath := fmt.Sprintf("/v1/organisations/%s/duplicate-policy", pay.OrganisationID)
+
+	checkResponseCode(t, executeRequest(t, "GET", policyPath, nil), http.StatusNotFound)
+	checkResponseCode(t, executeRequest(t, "PUT", policyPath, payment.DuplicatePolicy{Action: "ignore"}), http.StatusUnprocessableEntity)
+	policy := payment.DuplicatePolicy{Action: payment.RejectDuplicates, WindowDays: 1}
+	var saved DuplicatePolicyResponse
+	checkResponse(t, executeRequest(t, "PUT", policyPath, policy), http.StatusOK, &saved)
+	policy.OrganisationID = pay.OrganisationID
+	var got DuplicatePolicyResponse
+	checkResponse(t, executeRequest(t, "GET", policyPath, nil), http.StatusOK, &got)
+	if !cmp.Equal(saved.Data, policy) || !cmp.Equal(got.Data, policy) {
+		t.Fatalf("Unexpected duplicate policy.\nExpected:\n%v\nBut saved:\n%v\nAnd got:\n%v", policy, saved.Data, got.Data)
+	}
+
+	headers := map[string]string{IdempotencyKeyHeader: uuid.New().String()}
+	original := checkPaymentResponse(t, executeRequestWithHeaders(t, "POST", "/v1/payments", pay, headers), http.StatusCreated)
+	if original.SuspectedDuplicateOf != "" {
+		t.Fatalf("Unexpected duplicate %s of the first payment", original.SuspectedDuplicateOf)
+	}
+	result := executeRequestWithHeaders(t, "POST", "/v1/payments", pay, headers)
+	if replayed := checkPaymentResponse(t, result, http.StatusCreated); replayed.ID != original.ID || result.Header().Get(IdempotentReplayedHeader) != "true" {
+		t.Fatalf("Expected the retry with the same idempotency key to replay payment %s but got %s", original.ID, replayed.ID)
+	}
+
+	pay.Attributes.ProcessingDate = "2017-01-19"
+	result = executeRequest(t, "POST", "/v1/payments", pay)
+	checkResponseCode(t, result, http.StatusConflict)
+	var rejected DuplicatePaymentResponse
+	if err := ReadBody(result.Body, &rejected); err != nil {
+		t.Fatalf("Error deserializing response body: %s", err.Error())
+	}
+	if expected := "/v1/payments/" + original.ID; rejected.Links["original"] != expected {
+		t.Fatalf("Expected link to the original payment %s but got %v", expected, rejected.Links)
+	}
+	pay.Attributes.ProcessingDate = "2017-01-20"
+	checkPaymentResponse(t, executeRequest(t, "POST", "/v1/payments", pay), http.StatusCreated)
+
+	policy.Action = payment.FlagDuplicates
+	checkResponse(t, executeRequest(t, "PUT", policyPath, policy), http.StatusOK, &saved)
+	pay.Attributes.ProcessingDate = "2017-01-18"
+	flagged := checkPaymentResponse(t, executeRequest(t, "POST", "/v1/payments", pay), http.StatusCreated)
+	if flagged.SuspectedDuplicateOf != original.ID {
+		t.Fatalf("Expected payment to be flagged as a duplicate of %s but got %q", original.ID, flagged.SuspectedDuplicateOf)
+	}
+	update := payment.Payment{SuspectedDuplicateOf: ""}
+	update.Attributes.Reference = "Not a duplicate"
+	checkPaymentResponse(t, executeRequest(t, "PUT", fmt.Sprintf("/v1/payments/%s", flagged.ID), update), http.StatusOK)
+	update.SuspectedDuplicateOf = flagged.ID
+	checkResponseCode(t, executeRequest(t, "PUT", fmt.Sprintf("/v1/payments/%s", flagged.ID), update), http.StatusUnprocessableEntity)
+
+	checkResponseCode(t, executeRequest(t, "DELETE", policyPath, nil), http.StatusNoContent)
+	checkResponseCode(t, executeRequest(t, "DELETE", policyPath, nil), http.StatusNotFound)
+	if unchecked := checkPaymentResponse(t, executeRequest(t, "POST", "/v1/payments", pay), http.StatusCreated); unchecked.SuspectedDuplicateOf != "" {
+		t.Fatalf("Expected payment not to be checked for duplicates without policy but got %q", unchecked.SuspectedDuplicateOf)
+	}
+}
+
+func TestConcurrentDuplicates(t *testing.T) {
+	concurrent := FrontendV1{
+		Router:            mux.NewRouter(),
+		PaymentRepository: persistence.NewMemoryPaymentRepository(),
+		Validator:         testValidator,
+	}
+	concurrent.InitializeRoutes()
+	pay := getDefaultPayment(t)
+	policy := payment.DuplicatePolicy{OrganisationID: pay.OrganisationID, Action: payment.RejectDuplicates}
+	if err := concurrent.PaymentRepository.SaveDuplicatePolicy(context.Background(), policy); err != nil {
+		t.Fatalf("Error saving duplicate policy: %s", err.Error())
+	}
+
+	body, err := json.Marshal(pay)
+	if err != nil {
+		t.Fatalf("Error marshaling payload: %s", err.Error())
+	}
+	codes := make(chan int, numPayments)
+	for i := 0; i < numPayments; i++ {
+		go func() {
+			req := httptest.NewRequest("POST", "/v1/payments", bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			result := httptest.NewRecorder()
+			concurrent.Router.ServeHTTP(result, req)
+			codes <- result.Code
+		}()
+	}
+
+	created := 0
+	for i := 0; i < numPayments; i++ {
+		switch code := <-codes; code {
+		case http.StatusCreated:
+			created++
+		case http.StatusConflict:
+		default:
+			t.Errorf("Unexpected status code %d creating concurrent duplicates", code)
+		}
+	}
+	if created != 1 {
+		t.Fatalf("Expected one of %d concurrent duplicates to be created but %d were", numPayments, created)
+	}
+}
+
 func TestUpdate(t *testing.T) {
 	pay := addPayment(t)
 
 	update := payment.Payment{
-		ID:      uuid.New().String(),
-		Version: 2,
+		ID: uuid.New().String(),
 		Attributes: payment.PaymentAttributesType{
 			Amount: "110",
+			FX: payment.PaymentExchangeInformationType{
+				OriginalAmount: "220.00",
+			},
 			ChargesInformation: payment.PaymentChargesInformationType{
 				SenderCharges: []payment.PaymentAmountType{
 					payment.PaymentAmountType{
@@ -145,8 +677,8 @@ func TestUpdate(t *testing.T) {
 		t.Fatal("Input and output identifiers are not the same")
 	}
 
-	if returned.Version != 2 {
-		t.Fatalf("Expected update of version to 2 but found %d", pay.Version)
+	if returned.Version != pay.Version+1 {
+		t.Fatalf("Expected update of version to %d but found %d", pay.Version+1, returned.Version)
 	}
 
 	if returned.Attributes.Amount != "110" {
@@ -157,8 +689,9 @@ func TestUpdate(t *testing.T) {
 		t.Fatalf("Expected length of attributes.charges_information.sender_charges to be 1 but found %s", returned.Attributes.ChargesInformation.SenderCharges)
 	}
 
-	pay.Version = 2
+	pay.Version++
 	pay.Attributes.Amount = "110"
+	pay.Attributes.FX.OriginalAmount = "220.00"
 	pay.Attributes.ChargesInformation.SenderCharges = []payment.PaymentAmountType{
 		payment.PaymentAmountType{
 			Amount:   "10",
@@ -173,6 +706,18 @@ func TestUpdate(t *testing.T) {
 	id := uuid.New().String()
 	result = executeRequest(t, "PUT", fmt.Sprintf("/v1/payments/%s", id), pay)
 	checkResponseCode(t, result, http.StatusNotFound)
+
+	stale := payment.Payment{
+		Version: pay.Version + 5,
+		Attributes: payment.PaymentAttributesType{
+			Amount: "120",
+			FX: payment.PaymentExchangeInformationType{
+				OriginalAmount: "240.00",
+			},
+		},
+	}
+	result = executeRequest(t, "PUT", fmt.Sprintf("/v1/payments/%s", pay.ID), stale)
+	checkResponseCode(t, result, http.StatusConflict)
 }
 
 func TestDelete(t *testing.T) {
@@ -187,6 +732,37 @@ func TestDelete(t *testing.T) {
 
 	result = executeRequest(t, "DELETE", fmt.Sprintf("/v1/payments/%s", uuid.New().String()), pay)
 	checkResponseCode(t, result, http.StatusNotFound)
+
+	result = executeRequest(t, "GET", fmt.Sprintf("/v1/payments/%s", pay.ID), nil)
+	checkResponseCode(t, result, http.StatusGone)
+}
+
+func TestRestoreAndPurge(t *testing.T) {
+	pay := addPayment(t)
+	path := fmt.Sprintf("/v1/payments/%s", pay.ID)
+	purgePath := fmt.Sprintf("/v1/admin/payments/%s", pay.ID)
+
+	checkResponseCode(t, executeRequest(t, "POST", path+"/restore", nil), http.StatusConflict)
+	checkResponseCode(t, executeRequest(t, "DELETE", purgePath, nil), http.StatusConflict)
+	checkPaymentResponse(t, executeRequest(t, "DELETE", path, nil), http.StatusOK)
+
+	result := executeRequestWithHeaders(t, "POST", path+"/restore", nil, map[string]string{"If-Match": `"7"`})
+	checkResponseCode(t, result, http.StatusPreconditionFailed)
+	result = executeRequestWithHeaders(t, "POST", path+"/restore", nil, map[string]string{"If-Match": PaymentETag(pay)})
+	restored := checkPaymentResponse(t, result, http.StatusOK)
+	if restored.Version != pay.Version+1 || result.Header().Get("ETag") != PaymentETag(restored) {
+		t.Fatalf("Unexpected restored payment version %d with ETag %s", restored.Version, result.Header().Get("ETag"))
+	}
+	checkPaymentResponse(t, executeRequest(t, "GET", path, nil), http.StatusOK)
+
+	checkPaymentResponse(t, executeRequest(t, "DELETE", path, nil), http.StatusOK)
+	checkResponseCode(t, executeRequest(t, "DELETE", path, nil), http.StatusGone)
+	purged := checkPaymentResponse(t, executeRequest(t, "DELETE", purgePath, nil), http.StatusOK)
+	if !cmp.Equal(purged, restored) {
+		t.Fatalf("Purged payment differs from expected.\nExpected:\n%v\nBut got:\n%v", restored, purged)
+	}
+	checkResponseCode(t, executeRequest(t, "GET", path, nil), http.StatusNotFound)
+	checkResponseCode(t, executeRequest(t, "POST", path+"/restore", nil), http.StatusNotFound)
 }
 
 func TestGet(t *testing.T) {
@@ -203,8 +779,41 @@ func TestGet(t *testing.T) {
 	checkResponseCode(t, result, http.StatusNotFound)
 }
 
+func TestGetPain001(t *testing.T) {
+	pay := addPayment(t)
+	path := fmt.Sprintf("/v1/payments/%s", pay.ID)
+
+	result := executeRequestWithHeaders(t, "GET", path, nil, map[string]string{"Accept": "application/json;q=0.5, application/pain.001+xml"})
+	checkResponseCode(t, result, http.StatusOK)
+	if contentType := result.Header().Get("Content-Type"); contentType != iso20022.Pain001MediaType {
+		t.Fatalf("Expected content type %s but got %s", iso20022.Pain001MediaType, contentType)
+	}
+	var document iso20022.Document
+	if err := xml.Unmarshal(result.Body.Bytes(), &document); err != nil {
+		t.Fatalf("Error reading pain.001 document: %s", err.Error())
+	}
+	if document.XMLName.Space != iso20022.Pain001Namespace || document.Initiation.GroupHeader.MessageID != iso20022.MessageID(pay.ID) {
+		t.Fatalf("Unexpected pain.001 document %s with message identifier %s", document.XMLName.Space, document.Initiation.GroupHeader.MessageID)
+	}
+	transaction := document.Initiation.Instructions[0].Transactions[0]
+	if transaction.PaymentID.EndToEndID != pay.Attributes.EndToEndReference || transaction.Amount.Instructed.Value != pay.Attributes.Amount {
+		t.Fatalf("Unexpected transaction %v for payment %v", transaction, pay.Attributes)
+	}
+
+	result = executeRequestWithHeaders(t, "GET", path, nil, map[string]string{"Accept": "*/*"})
+	checkPaymentResponse(t, result, http.StatusOK)
+
+	pay.Attributes.ChargesInformation.BearerCode = "ALL"
+	pay, err := frontend.PaymentRepository.UpdatePayment(context.Background(), pay)
+	if err != nil {
+		t.Fatalf("Error updating payment: %s", err.Error())
+	}
+	result = executeRequestWithHeaders(t, "GET", path, nil, map[string]string{"Accept": iso20022.Pain001MediaType})
+	checkResponseCode(t, result, http.StatusUnprocessableEntity)
+}
+
 func TestGetList(t *testing.T) {
-	initial, err := frontend.PaymentRepository.GetPayments(nil)
+	initial, err := frontend.PaymentRepository.GetPayments(context.Background(), nil)
 	if err != nil {
 		t.Fatalf("Error getting the initial list of payments: %s", err.Error())
 	}
@@ -222,3 +831,296 @@ func TestGetList(t *testing.T) {
 		t.Fatalf("Unexpected number of payments returned. Expected %d but got %d", expected, len(returned))
 	}
 }
+
+func TestGetListQuery(t *testing.T) {
+	reference := uuid.New().String()
+	for _, currency := range []string{"GBP", "EUR", "GBP"} {
+		pay := getDefaultPayment(t)
+		pay.Attributes.EndToEndReference = reference
+		pay.Attributes.Currency = currency
+		if currency == "EUR" {
+			pay.Attributes.Amount = "1000.00"
+		}
+		if _, err := frontend.PaymentRepository.AddPayment(context.Background(), pay); err != nil {
+			t.Fatalf("Error creating payment: %s", err.Error())
+		}
+	}
+
+	path := fmt.Sprintf("/v1/payments?filter[end_to_end_reference]=%s&filter[currency]=GBP", url.QueryEscape(reference))
+	result := executeRequest(t, "GET", path, nil)
+	returned := checkPaymentListResponse(t, result, http.StatusOK)
+	if len(returned) != 2 {
+		t.Fatalf("Unexpected number of payments returned filtering by currency. Expected 2 but got %d", len(returned))
+	}
+
+	path = fmt.Sprintf("/v1/payments?filter[attributes.end_to_end_reference]=%s&filter[amount][gt]=200&fields=id,attributes.amount,attributes.currency&sort=-attributes.amount", url.QueryEscape(reference))
+	result = executeRequest(t, "GET", path, nil)
+	returned = checkPaymentListResponse(t, result, http.StatusOK)
+	if len(returned) != 1 {
+		t.Fatalf("Unexpected number of payments returned filtering by amount. Expected 1 but got %d", len(returned))
+	}
+	expected := payment.Payment{
+		ID: returned[0].ID,
+		Attributes: payment.PaymentAttributesType{
+			Amount:   "1000.00",
+			Currency: "EUR",
+		},
+	}
+	if !cmp.Equal(expected, returned[0]) {
+		t.Fatalf("Payment with selected fields differs from expected.\nExpected:\n%v\nBut got:\n%v", expected, returned[0])
+	}
+}
+
+func TestGetListInvalidQuery(t *testing.T) {
+	result := executeRequest(t, "GET", "/v1/payments?filter[unknown]=1&filter[amount][gt]=ten&filter[currency][like]=G&sort=-nothing&page=1&filter[currency&page[size]=0&page[after]=abc", nil)
+	checkResponseCode(t, result, http.StatusBadRequest)
+
+	var returned ParameterErrorResponse
+	if err := ReadBody(result.Body, &returned); err != nil {
+		t.Fatalf("Error deserializing response body: %s", err.Error())
+	}
+
+	parameters := make([]string, 0, len(returned.Errors))
+	for _, parameterError := range returned.Errors {
+		parameters = append(parameters, parameterError.Parameter)
+	}
+	expected := []string{"filter[amount][gt]", "filter[currency", "filter[currency][like]", "filter[unknown]", "page", "page[size]", "sort", "page[after]"}
+	if !cmp.Equal(expected, parameters) {
+		t.Fatalf("Unexpected invalid parameters returned.\nExpected:\n%v\nBut got:\n%v", expected, parameters)
+	}
+}
+
+func TestGetListPages(t *testing.T) {
+	reference := uuid.New().String()
+	for i := 0; i < 5; i++ {
+		pay := getDefaultPayment(t)
+		pay.Attributes.EndToEndReference = reference
+		pay.Attributes.Amount = fmt.Sprintf("%d.00", i)
+		if _, err := frontend.PaymentRepository.AddPayment(context.Background(), pay); err != nil {
+			t.Fatalf("Error creating payment: %s", err.Error())
+		}
+	}
+
+	var pages []PaymentListResponse
+	path := fmt.Sprintf("/v1/payments?filter[end_to_end_reference]=%s&sort=-amount&page[size]=2", url.QueryEscape(reference))
+	for path != "" {
+		result := executeRequest(t, "GET", path, nil)
+		var page PaymentListResponse
+		checkResponse(t, result, http.StatusOK, &page)
+		if page.Links["first"] == "" {
+			t.Fatalf("First link not found in page %d", len(pages))
+		}
+		if _, ok := page.Links["prev"]; ok != (len(pages) > 0) {
+			t.Fatalf("Unexpected prev link in page %d: %v", len(pages), page.Links)
+		}
+		pages = append(pages, page)
+		path = page.Links["next"]
+	}
+
+	amounts := make([]string, 0, 5)
+	for _, page := range pages {
+		for _, pay := range page.Data {
+			amounts = append(amounts, pay.Attributes.Amount)
+		}
+	}
+	expected := []string{"4.00", "3.00", "2.00", "1.00", "0.00"}
+	if len(pages) != 3 || !cmp.Equal(amounts, expected) {
+		t.Fatalf("Unexpected payments returned by pages. Expected amounts %v in 3 pages but got %v in %d pages", expected, amounts, len(pages))
+	}
+
+	result := executeRequest(t, "GET", pages[2].Links["prev"], nil)
+	previous := checkPaymentListResponse(t, result, http.StatusOK)
+	if !cmp.Equal(previous, pages[1].Data) {
+		t.Fatalf("Previous page differs from expected.\nExpected:\n%v\nBut got:\n%v", pages[1].Data, previous)
+	}
+}
+
+func TestETag(t *testing.T) {
+	pay := addPayment(t)
+	path := fmt.Sprintf("/v1/payments/%s", pay.ID)
+
+	result := executeRequest(t, "GET", path, nil)
+	checkPaymentResponse(t, result, http.StatusOK)
+	etag := result.Header().Get("ETag")
+	if etag != PaymentETag(pay) {
+		t.Fatalf("Unexpected ETag header. Expected %s but got %s", PaymentETag(pay), etag)
+	}
+
+	result = executeRequestWithHeaders(t, "GET", path, nil, map[string]string{"If-None-Match": etag})
+	checkResponseCode(t, result, http.StatusNotModified)
+	if result.Body.Len() != 0 {
+		t.Fatalf("Unexpected body in not modified response: %s", result.Body.String())
+	}
+
+	update := payment.Payment{
+		Attributes: payment.PaymentAttributesType{
+			Amount: "50.00",
+			FX: payment.PaymentExchangeInformationType{
+				OriginalAmount: "100.00",
+			},
+		},
+	}
+	result = executeRequestWithHeaders(t, "PUT", path, update, map[string]string{"If-Match": `"7"`})
+	checkResponseCode(t, result, http.StatusPreconditionFailed)
+
+	result = executeRequestWithHeaders(t, "PUT", path, update, map[string]string{"If-Match": etag})
+	updated := checkPaymentResponse(t, result, http.StatusOK)
+	if result.Header().Get("ETag") != PaymentETag(updated) || result.Header().Get("ETag") == etag {
+		t.Fatalf("Unexpected ETag header after update: %s", result.Header().Get("ETag"))
+	}
+
+	result = executeRequestWithHeaders(t, "GET", path, nil, map[string]string{"If-None-Match": etag})
+	checkPaymentResponse(t, result, http.StatusOK)
+
+	result = executeRequestWithHeaders(t, "DELETE", path, nil, map[string]string{"If-Match": etag})
+	checkResponseCode(t, result, http.StatusPreconditionFailed)
+
+	result = executeRequestWithHeaders(t, "DELETE", path, nil, map[string]string{"If-Match": "W/" + PaymentETag(updated)})
+	checkResponseCode(t, result, http.StatusPreconditionFailed)
+
+	result = executeRequestWithHeaders(t, "DELETE", path, nil, map[string]string{"If-Match": PaymentETag(updated)})
+	checkPaymentResponse(t, result, http.StatusOK)
+}
+
+// blockingRepository is a repository whose GetPayment doesn't finish until the context is done
+type blockingRepository struct {
+	persistence.PaymentRepository
+}
+
+func (b blockingRepository) GetPayment(ctx context.Context, id string) (payment.Payment, error) {
+	<-ctx.Done()
+	return payment.Payment{}, ctx.Err()
+}
+
+func TestRequestTimeout(t *testing.T) {
+	blocking := FrontendV1{
+		Router:            mux.NewRouter(),
+		PaymentRepository: blockingRepository{persistence.NewMemoryPaymentRepository()},
+		RequestTimeout:    10 * time.Millisecond,
+	}
+	blocking.InitializeRoutes()
+	path := fmt.Sprintf("%s/payments/%s", basePath, uuid.New().String())
+
+	req, err := http.NewRequest("GET", path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := httptest.NewRecorder()
+	blocking.Router.ServeHTTP(result, req)
+	checkResponseCode(t, result, http.StatusGatewayTimeout)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result = httptest.NewRecorder()
+	blocking.Router.ServeHTTP(result, req.WithContext(ctx))
+	checkResponseCode(t, result, StatusClientClosedRequest)
+}
+
+func TestHistory(t *testing.T) {
+	pay := getDefaultPayment(t)
+	headers := map[string]string{ActorHeader: "auditor"}
+	result := executeRequestWithHeaders(t, "POST", "/v1/payments", pay, headers)
+	created := checkPaymentResponse(t, result, http.StatusCreated)
+	path := fmt.Sprintf("/v1/payments/%s", created.ID)
+
+	update := payment.Payment{
+		Attributes: payment.PaymentAttributesType{
+			Amount: "50.00",
+			FX: payment.PaymentExchangeInformationType{
+				OriginalAmount: "100.00",
+			},
+		},
+	}
+	result = executeRequestWithHeaders(t, "PUT", path, update, headers)
+	updated := checkPaymentResponse(t, result, http.StatusOK)
+	result = executeRequest(t, "DELETE", path, nil)
+	checkPaymentResponse(t, result, http.StatusOK)
+
+	var history PaymentRevisionListResponse
+	checkResponse(t, executeRequest(t, "GET", path+"/history", nil), http.StatusOK, &history)
+	expected := []struct {
+		operation persistence.RevisionOperation
+		actor     string
+	}{
+		{persistence.CreateOperation, "auditor"},
+		{persistence.UpdateOperation, "auditor"},
+		{persistence.DeleteOperation, ""},
+	}
+	if len(history.Data) != len(expected) {
+		t.Fatalf("Expected %d revisions but got %d: %v", len(expected), len(history.Data), history.Data)
+	}
+	for i, revision := range history.Data {
+		if revision.Revision != i+1 || revision.Operation != expected[i].operation || revision.Actor != expected[i].actor {
+			t.Errorf("Unexpected revision %d: %v", i+1, revision)
+		}
+	}
+
+	var revision PaymentRevisionResponse
+	checkResponse(t, executeRequest(t, "GET", path+"/history/2", nil), http.StatusOK, &revision)
+	if !cmp.Equal(revision.Data.Payment, updated) {
+		t.Fatalf("Revision 2 differs from the updated payment.\nExpected:\n%v\nBut got:\n%v", updated, revision.Data.Payment)
+	}
+
+	checkResponseCode(t, executeRequest(t, "GET", path+"/history/4", nil), http.StatusNotFound)
+	checkResponseCode(t, executeRequest(t, "GET", path+"/history/last", nil), http.StatusBadRequest)
+	checkResponseCode(t, executeRequest(t, "GET", fmt.Sprintf("/v1/payments/%s/history", uuid.New().String()), nil), http.StatusNotFound)
+}
+
+func TestUntrustedActorHeader(t *testing.T) {
+	untrusted := FrontendV1{
+		Router:            mux.NewRouter(),
+		PaymentRepository: persistence.NewMemoryPaymentRepository(),
+		Validator:         testValidator,
+	}
+	untrusted.InitializeRoutes()
+	body, err := json.Marshal(getDefaultPayment(t))
+	if err != nil {
+		t.Fatalf("Error marshaling payload: %s", err.Error())
+	}
+	req := httptest.NewRequest("POST", "/v1/payments", bytes.NewReader(body))
+	req.Header.Set(ActorHeader, "impostor")
+	result := httptest.NewRecorder()
+	untrusted.Router.ServeHTTP(result, req)
+	created := checkPaymentResponse(t, result, http.StatusCreated)
+	if created.CreatedBy != "" {
+		t.Fatalf("Expected the untrusted %s header to be ignored but the payment was created by %q", ActorHeader, created.CreatedBy)
+	}
+	revisions, err := untrusted.PaymentRepository.GetPaymentRevisions(context.Background(), created.ID)
+	if err != nil {
+		t.Fatalf("Error getting revisions of payment %s: %s", created.ID, err.Error())
+	}
+	if len(revisions) != 1 || revisions[0].Actor != "" {
+		t.Fatalf("Expected a revision without actor but got %v", revisions)
+	}
+}
+
+func TestAsOf(t *testing.T) {
+	pay := addPayment(t)
+	path := fmt.Sprintf("/v1/payments/%s", pay.ID)
+	time.Sleep(time.Millisecond)
+	checkPaymentResponse(t, executeRequest(t, "DELETE", path, nil), http.StatusOK)
+
+	revisions, err := frontend.PaymentRepository.GetPaymentRevisions(context.Background(), pay.ID)
+	if err != nil {
+		t.Fatalf("Error getting revisions of payment %s: %s", pay.ID, err.Error())
+	}
+	created := url.QueryEscape(revisions[0].Timestamp.Format(time.RFC3339Nano))
+	deleted := url.QueryEscape(revisions[1].Timestamp.Format(time.RFC3339Nano))
+
+	returned := checkPaymentResponse(t, executeRequest(t, "GET", path+"?as_of="+created, nil), http.StatusOK)
+	if !cmp.Equal(returned, pay) {
+		t.Fatalf("Payment differs from the created one.\nExpected:\n%v\nBut got:\n%v", pay, returned)
+	}
+	checkResponseCode(t, executeRequest(t, "GET", path+"?as_of="+deleted, nil), http.StatusNotFound)
+	checkResponseCode(t, executeRequest(t, "GET", path+"?as_of=yesterday", nil), http.StatusBadRequest)
+
+	list := checkPaymentListResponse(t, executeRequest(t, "GET", fmt.Sprintf("/v1/payments?filter[id]=%s&as_of=%s", pay.ID, created), nil), http.StatusOK)
+	if len(list) != 1 || list[0].ID != pay.ID {
+		t.Fatalf("Expected deleted payment %s in the list as of its creation but got %v", pay.ID, list)
+	}
+	list = checkPaymentListResponse(t, executeRequest(t, "GET", fmt.Sprintf("/v1/payments?filter[id]=%s&as_of=%s", pay.ID, deleted), nil), http.StatusOK)
+	if len(list) != 0 {
+		t.Fatalf("Expected no payments in the list as of the deletion but got %v", list)
+	}
+	checkResponseCode(t, executeRequest(t, "GET", "/v1/payments?as_of=yesterday", nil), http.StatusBadRequest)
+}
@@ -0,0 +1,47 @@
+package frontend
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/getaceres/payment-demo/payment"
+	"github.com/getaceres/payment-demo/persistence"
+)
+
+const (
+	// IdempotencyKeyHeader is the request header with the key which makes a payment creation idempotent
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotentReplayedHeader is the response header which tells that the response is the one of a previous request with the same key
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+	// MaxIdempotencyKeyLength is the maximum length of an idempotency key
+	MaxIdempotencyKeyLength = 255
+	// DefaultIdempotencyKeyExpiry is the time idempotency keys are kept when FrontendV1 doesn't set one
+	DefaultIdempotencyKeyExpiry = 24 * time.Hour
+)
+
+// GetIdempotencyKey returns the idempotency key of the request for the creation of the payment, which expires after the given time,
+// and true, or false if the request doesn't have an IdempotencyKeyHeader.
+// The fingerprint of the key is a digest of the payment, so requests whose bodies only differ in formatting have the same fingerprint.
+func GetIdempotencyKey(r *http.Request, pay payment.Payment, expiry time.Duration) (persistence.IdempotencyKey, bool, error) {
+	value := r.Header.Get(IdempotencyKeyHeader)
+	if value == "" {
+		return persistence.IdempotencyKey{}, false, nil
+	}
+	if len(value) > MaxIdempotencyKeyLength {
+		return persistence.IdempotencyKey{}, false, fmt.Errorf("%s header can't be longer than %d characters", IdempotencyKeyHeader, MaxIdempotencyKeyLength)
+	}
+	document, err := json.Marshal(pay)
+	if err != nil {
+		return persistence.IdempotencyKey{}, false, fmt.Errorf("Error encoding payment: %s", err.Error())
+	}
+	digest := sha256.Sum256(document)
+	return persistence.IdempotencyKey{
+		Key:         value,
+		Fingerprint: hex.EncodeToString(digest[:]),
+		ExpiresAt:   time.Now().Add(expiry),
+	}, true, nil
+}
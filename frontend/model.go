@@ -1,6 +1,9 @@
 package frontend
 
-import "github.com/getaceres/payment-demo/payment"
+import (
+	"github.com/getaceres/payment-demo/payment"
+	"github.com/getaceres/payment-demo/persistence"
+)
 
 type Response interface {
 	GetLinks() map[string]string
@@ -20,6 +23,75 @@ type PaymentListResponse struct {
 	Links map[string]string `json:"links"`
 }
 
+// PaymentRevisionResponse is the response of a REST operation which returns a single revision of a payment
+// swagger:model
+type PaymentRevisionResponse struct {
+	Data  persistence.PaymentRevision `json:"data"`
+	Links map[string]string           `json:"links"`
+}
+
+// PaymentRevisionListResponse is the response of a REST operation which returns the revisions of a payment
+// swagger:model
+type PaymentRevisionListResponse struct {
+	Data  []persistence.PaymentRevision `json:"data"`
+	Links map[string]string             `json:"links"`
+}
+
+// FXCheckResponse is the response of a REST operation which checks the exchange information of a payment
+// swagger:model
+type FXCheckResponse struct {
+	Data  payment.FXCheckResult `json:"data"`
+	Links map[string]string     `json:"links"`
+}
+
+// ApprovalPolicyResponse is the response of a REST operation which returns the approval policy of an organisation
+// swagger:model
+type ApprovalPolicyResponse struct {
+	Data  payment.ApprovalPolicy `json:"data"`
+	Links map[string]string      `json:"links"`
+}
+
+// DuplicatePolicyResponse is the response of a REST operation which returns the duplicate policy of an organisation
+// swagger:model
+type DuplicatePolicyResponse struct {
+	Data  payment.DuplicatePolicy `json:"data"`
+	Links map[string]string       `json:"links"`
+}
+
+// DuplicatePaymentResponse is the response of a payment creation rejected because the payment is a suspected duplicate.
+// Its original link points to the existing payment.
+// swagger:model
+type DuplicatePaymentResponse struct {
+	Message string            `json:"message"`
+	Links   map[string]string `json:"links"`
+}
+
+// TransitionRequest is the body of the requests which change the status of a payment
+// swagger:model
+type TransitionRequest struct {
+	// Reason explains why the action is done
+	Reason string `json:"reason,omitempty"`
+}
+
+// ParameterError describes an invalid parameter of a request
+// swagger:model
+type ParameterError struct {
+	Parameter string `json:"parameter"`
+	Message   string `json:"message"`
+}
+
+// ParameterErrorResponse is the response of a REST operation which received invalid parameters
+// swagger:model
+type ParameterErrorResponse struct {
+	Errors []ParameterError `json:"errors"`
+}
+
+// ValidationErrorResponse is the response of a REST operation which received an invalid payment
+// swagger:model
+type ValidationErrorResponse struct {
+	Errors []payment.FieldError `json:"errors"`
+}
+
 func (r PaymentResponse) GetLinks() map[string]string {
 	return r.Links
 }
@@ -27,3 +99,27 @@ func (r PaymentResponse) GetLinks() map[string]string {
 func (r PaymentListResponse) GetLinks() map[string]string {
 	return r.Links
 }
+
+func (r PaymentRevisionResponse) GetLinks() map[string]string {
+	return r.Links
+}
+
+func (r PaymentRevisionListResponse) GetLinks() map[string]string {
+	return r.Links
+}
+
+func (r FXCheckResponse) GetLinks() map[string]string {
+	return r.Links
+}
+
+func (r ApprovalPolicyResponse) GetLinks() map[string]string {
+	return r.Links
+}
+
+func (r DuplicatePolicyResponse) GetLinks() map[string]string {
+	return r.Links
+}
+
+func (r DuplicatePaymentResponse) GetLinks() map[string]string {
+	return r.Links
+}
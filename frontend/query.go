@@ -0,0 +1,194 @@
+package frontend
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getaceres/payment-demo/persistence"
+)
+
+const (
+	sortParameter       = "sort"
+	fieldsParameter     = "fields"
+	pageSizeParameter   = "page[size]"
+	pageAfterParameter  = "page[after]"
+	pageBeforeParameter = "page[before]"
+	asOfParameter       = "as_of"
+
+	// DefaultPageSize is the number of payments returned in a page when the page size is not requested
+	DefaultPageSize = 100
+)
+
+var filterParameterRegexp = regexp.MustCompile(`^filter\[([^\[\]]+)\](?:\[([^\[\]]+)\])?$`)
+
+// ParsePaymentListParameters builds a payment query and a page request from the query parameters of a payment list request:
+//   - filter[<field>]=<value> or filter[<field>][<operator>]=<value> to filter payments by a field
+//   - sort=<field>,-<field> to sort the payments by a list of fields in ascending order, or descending if prefixed with -
+//   - fields=<field>,<field> to select the fields returned for each payment
+//   - page[size]=<size> to set the maximum number of payments returned
+//   - page[after]=<cursor> or page[before]=<cursor> to get the page following or preceding a cursor returned in the links of a previous page
+//   - as_of=<time> to get the payments as they were at a time in RFC 3339 format
+//
+// Fields are JSON paths in the payment document. Paths which are not found are looked up inside the payment attributes
+// so filter[currency] is equivalent to filter[attributes.currency].
+// It returns the list of invalid parameters if there's any.
+func ParsePaymentListParameters(parameters url.Values) (persistence.PaymentQuery, persistence.PageRequest, []ParameterError) {
+	var query persistence.PaymentQuery
+	var errors []ParameterError
+	page := persistence.PageRequest{Size: DefaultPageSize}
+
+	names := make([]string, 0, len(parameters))
+	for name := range parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		values := parameters[name]
+		if len(values) != 1 {
+			errors = append(errors, ParameterError{Parameter: name, Message: "Parameter must appear only once"})
+			continue
+		}
+		value := values[0]
+
+		switch {
+		case name == sortParameter:
+			sortFields, err := parseSortParameter(value)
+			if err != nil {
+				errors = append(errors, ParameterError{Parameter: name, Message: err.Error()})
+				continue
+			}
+			query.Sort = sortFields
+		case name == fieldsParameter:
+			fields, err := parseFieldsParameter(value)
+			if err != nil {
+				errors = append(errors, ParameterError{Parameter: name, Message: err.Error()})
+				continue
+			}
+			query.Fields = fields
+		case name == pageSizeParameter:
+			size, err := strconv.Atoi(value)
+			if err != nil || size <= 0 || size > persistence.MaxPageSize {
+				errors = append(errors, ParameterError{Parameter: name, Message: fmt.Sprintf("Page size must be a number between 1 and %d", persistence.MaxPageSize)})
+				continue
+			}
+			page.Size = size
+		case name == pageAfterParameter:
+			page.After = value
+		case name == pageBeforeParameter:
+			page.Before = value
+		case name == asOfParameter:
+			asOf, err := parseAsOfParameter(value)
+			if err != nil {
+				errors = append(errors, ParameterError{Parameter: name, Message: err.Error()})
+				continue
+			}
+			query.AsOf = asOf
+		case strings.HasPrefix(name, "filter"):
+			condition, err := parseFilterParameter(name, value)
+			if err != nil {
+				errors = append(errors, ParameterError{Parameter: name, Message: err.Error()})
+				continue
+			}
+			query.Filter = append(query.Filter, condition)
+		default:
+			errors = append(errors, ParameterError{Parameter: name, Message: "Unknown parameter"})
+		}
+	}
+
+	if page.After != "" && page.Before != "" {
+		errors = append(errors, ParameterError{Parameter: pageBeforeParameter, Message: "Only one of page[after] and page[before] can be used"})
+	}
+	cursors := []struct{ parameter, cursor string }{
+		{pageAfterParameter, page.After},
+		{pageBeforeParameter, page.Before},
+	}
+	for _, cursor := range cursors {
+		if cursor.cursor == "" {
+			continue
+		}
+		if _, err := query.DecodeCursor(cursor.cursor); err != nil {
+			errors = append(errors, ParameterError{Parameter: cursor.parameter, Message: err.Error()})
+		}
+	}
+	return query, page, errors
+}
+
+// parseAsOfParameter parses the time of the as_of parameter, which must be in RFC 3339 format
+func parseAsOfParameter(value string) (time.Time, error) {
+	asOf, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return asOf, fmt.Errorf("Time must be in RFC 3339 format, like 2019-01-31T23:59:59Z")
+	}
+	return asOf, nil
+}
+
+func parseFilterParameter(name, value string) (persistence.FilterCondition, error) {
+	matches := filterParameterRegexp.FindStringSubmatch(name)
+	if matches == nil {
+		return persistence.FilterCondition{}, fmt.Errorf("Malformed filter. Expected filter[<field>] or filter[<field>][<operator>]")
+	}
+
+	operator := persistence.EqualOperator
+	if matches[2] != "" {
+		operator = persistence.FilterOperator(matches[2])
+	}
+
+	field, err := resolvePaymentField(matches[1], persistence.GetPaymentField)
+	if err != nil {
+		return persistence.FilterCondition{}, err
+	}
+	return persistence.NewFilterCondition(field.Path, operator, value)
+}
+
+func parseSortParameter(value string) ([]persistence.SortField, error) {
+	var result []persistence.SortField
+	for _, path := range strings.Split(value, ",") {
+		descending := strings.HasPrefix(path, "-")
+		path = strings.TrimPrefix(path, "-")
+		field, err := resolvePaymentField(path, persistence.GetPaymentField)
+		if err != nil {
+			return nil, err
+		}
+		if field.Repeated {
+			return nil, fmt.Errorf("Field %s can't be used to sort because it may have several values", field.Path)
+		}
+		result = append(result, persistence.SortField{Field: field, Descending: descending})
+	}
+	return result, nil
+}
+
+func parseFieldsParameter(value string) ([]persistence.PaymentField, error) {
+	var result []persistence.PaymentField
+	for _, path := range strings.Split(value, ",") {
+		field, err := resolvePaymentField(path, persistence.GetSelectablePaymentField)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, field)
+	}
+	return result, nil
+}
+
+// resolvePaymentField calls the resolve function with the given path and, if it's not a payment field,
+// with the same path inside the payment attributes. The result of the first call is returned if neither is a payment field.
+func resolvePaymentField(path string, resolve func(string) (persistence.PaymentField, error)) (persistence.PaymentField, error) {
+	field, err := resolve(path)
+	if isUnknownField(err) {
+		attributesField, attributesErr := resolve("attributes." + path)
+		if !isUnknownField(attributesErr) {
+			return attributesField, attributesErr
+		}
+	}
+	return field, err
+}
+
+func isUnknownField(err error) bool {
+	fieldErr, ok := err.(persistence.InvalidFieldError)
+	return ok && fieldErr.Reason == persistence.UnknownFieldReason
+}
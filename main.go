@@ -2,12 +2,22 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/getaceres/payment-demo/fraud"
 	"github.com/getaceres/payment-demo/frontend"
-	"github.com/getaceres/payment-demo/persistence/mongo"
+	"github.com/getaceres/payment-demo/payment"
+	"github.com/getaceres/payment-demo/payment/bank"
+	"github.com/getaceres/payment-demo/payment/iso20022"
+	"github.com/getaceres/payment-demo/payment/sanctions"
+	"github.com/getaceres/payment-demo/persistence"
+	_ "github.com/getaceres/payment-demo/persistence/backends"
 	"github.com/gorilla/mux"
 
 	"github.com/spf13/cobra"
@@ -16,7 +26,16 @@ import (
 func main() {
 
 	var port int
+	var storage string
 	var connectionURL string
+	var requestTimeout time.Duration
+	var idempotencyKeyExpiry time.Duration
+	var fxQuote, fxRounding, fxTolerance, fxRelativeTolerance string
+	var modulusWeights, modulusSubstitutions string
+	var sanctionsList string
+	var sanctionsThreshold int
+	var fraudRules string
+	var trustUserHeader bool
 
 	var cmdServe = &cobra.Command{
 		Use:   "serve",
@@ -24,29 +43,181 @@ func main() {
 		Long:  `This will start the server listening in the provided or the default port`,
 		Args:  cobra.MinimumNArgs(0),
 		Run: func(cmd *cobra.Command, args []string) {
-			startServer(port, connectionURL)
+			if cmd.Flags().Changed("mongourl") && !cmd.Flags().Changed("storage") {
+				storage = connectionURL
+			}
+			fx, err := getFXChecker(fxQuote, fxRounding, fxTolerance, fxRelativeTolerance)
+			if err != nil {
+				fmt.Printf("Invalid FX check configuration: %s", err.Error())
+				os.Exit(-1)
+			}
+			validator := payment.Validator{FX: fx}
+			if modulusWeights != "" {
+				if validator.Modulus, err = bank.LoadModulusChecker(modulusWeights, modulusSubstitutions); err != nil {
+					fmt.Printf("Invalid modulus check configuration: %s", err.Error())
+					os.Exit(-1)
+				}
+			}
+			var screener *sanctions.Screener
+			if sanctionsThreshold < 1 || sanctionsThreshold > 100 {
+				fmt.Printf("Invalid sanctions threshold %d: it must be from 1 to 100", sanctionsThreshold)
+				os.Exit(-1)
+			}
+			if sanctionsList != "" {
+				list, err := sanctions.LoadList(sanctionsList)
+				if err != nil {
+					fmt.Printf("Invalid sanctions screening configuration: %s", err.Error())
+					os.Exit(-1)
+				}
+				screener = &sanctions.Screener{List: list, Threshold: sanctionsThreshold}
+			}
+			var rules *fraud.Engine
+			if fraudRules != "" {
+				if rules, err = fraud.LoadEngine(fraudRules); err != nil {
+					fmt.Printf("Invalid fraud rules configuration: %s", err.Error())
+					os.Exit(-1)
+				}
+			}
+			startServer(port, storage, requestTimeout, idempotencyKeyExpiry, validator, screener, rules, trustUserHeader)
 		},
 	}
 
 	cmdServe.Flags().IntVarP(&port, "port", "p", 8080, "Port to serve")
+	cmdServe.Flags().StringVarP(&storage, "storage", "s", "mongodb://localhost:27017/payment-demo",
+		fmt.Sprintf("URL of the payment storage, like memory://, mongodb://localhost:27017/payment-demo or file:///var/lib/payments.db. Supported schemes are %s",
+			strings.Join(persistence.RegisteredSchemes(), ", ")))
 	cmdServe.Flags().StringVarP(&connectionURL, "mongourl", "m", "mongodb://localhost:27017", "Connection URL to a MongoDB database")
+	cmdServe.Flags().MarkDeprecated("mongourl", "use --storage instead")
+	cmdServe.Flags().DurationVarP(&requestTimeout, "request-timeout", "t", 30*time.Second, "Maximum time the database operations of a request can take. Zero means no limit")
+	cmdServe.Flags().DurationVar(&idempotencyKeyExpiry, "idempotency-key-expiry", frontend.DefaultIdempotencyKeyExpiry,
+		"Time the Idempotency-Key of a payment creation is kept, during which the request can be retried without creating another payment")
+	cmdServe.Flags().StringVar(&fxQuote, "fx-quote", payment.UnitsPerOriginal.String(),
+		"How the exchange rates of the payments are quoted: units-per-original if the amount is the original amount multiplied by the rate or original-per-unit if it is divided")
+	cmdServe.Flags().StringVar(&fxRounding, "fx-rounding", payment.RoundHalfEven.String(),
+		"Rounding mode of the converted amounts of the FX checks: half-even, half-up, half-down, up, down, ceiling or floor")
+	cmdServe.Flags().StringVar(&fxTolerance, "fx-tolerance", "0", "Maximum difference allowed between the amount of a payment and its converted original amount, like 0.01")
+	cmdServe.Flags().StringVar(&fxRelativeTolerance, "fx-relative-tolerance", "0",
+		"Maximum difference allowed between the amount of a payment and its converted original amount as a fraction of the amount, like 0.001 for 0.1%")
+	cmdServe.Flags().StringVar(&modulusWeights, "modulus-weights", "",
+		"Path of the VocaLink modulus weight table, like valacdos.txt, used to check the UK account numbers of the payments. No check is done if it is empty")
+	cmdServe.Flags().StringVar(&modulusSubstitutions, "modulus-substitutions", "", "Path of the VocaLink sort code substitution table, like scsubtab.txt")
+	cmdServe.Flags().StringVar(&sanctionsList, "sanctions-list", "",
+		"Path of the CSV sanctions list, like the OFSI consolidated list, used to screen the debtor and beneficiary of the payments. No screening is done if it is empty")
+	cmdServe.Flags().IntVar(&sanctionsThreshold, "sanctions-threshold", sanctions.DefaultThreshold,
+		"Minimum similarity, from 1 to 100, between a party of a payment and an entry of the sanctions list which holds the payment")
+	cmdServe.Flags().StringVar(&fraudRules, "fraud-rules", "",
+		"Path of the JSON file with the fraud rules evaluated for the payments which are created. No rules are evaluated if it is empty")
+	cmdServe.Flags().BoolVar(&trustUserHeader, "trust-user-header", false,
+		"Trust the X-User-ID header to identify the user of the requests. Only for servers behind a gateway which authenticates the users and sets the header")
+
+	var exportStorage, organisation, messageID, output string
+	var filter map[string]string
+
+	var cmdExport = &cobra.Command{
+		Use:   "export",
+		Short: "Export payments as an ISO 20022 pain.001 document",
+		Long: `This will write the payments of an organisation which match the filter as an ISO 20022 pain.001.001.09
+customer credit transfer initiation document, which can be sent to the bank to make the payments`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if messageID == "" {
+				messageID = time.Now().UTC().Format("20060102150405")
+			}
+			if err := exportPayments(exportStorage, organisation, filter, messageID, output); err != nil {
+				fmt.Printf("Error exporting payments: %s", err.Error())
+				os.Exit(-1)
+			}
+		},
+	}
+
+	cmdExport.Flags().StringVarP(&exportStorage, "storage", "s", "mongodb://localhost:27017/payment-demo",
+		fmt.Sprintf("URL of the payment storage. Supported schemes are %s", strings.Join(persistence.RegisteredSchemes(), ", ")))
+	cmdExport.Flags().StringVar(&organisation, "organisation", "", "Identifier of the organisation whose payments are exported")
+	cmdExport.MarkFlagRequired("organisation")
+	cmdExport.Flags().StringToStringVar(&filter, "filter", nil,
+		"Values of the fields of the exported payments, like status=approved,attributes.processing_date=2019-05-10")
+	cmdExport.Flags().StringVar(&messageID, "message-id", "", "Identifier of the document, up to 35 characters. Defaults to the current UTC time, like 20190510123000")
+	cmdExport.Flags().StringVarP(&output, "output", "o", "", "Path of the file the document is written to. Defaults to the standard output")
 
 	var rootCmd = &cobra.Command{Use: "payment-demo"}
 	rootCmd.AddCommand(cmdServe)
+	rootCmd.AddCommand(cmdExport)
 
 	rootCmd.Execute()
 }
 
-func startServer(port int, connectionURL string) {
+// getFXChecker returns the FX checker configured by the command line flags
+func getFXChecker(quote, rounding, tolerance, relativeTolerance string) (payment.FXChecker, error) {
+	var checker payment.FXChecker
+	var err error
+	if checker.Quote, err = payment.ParseRateQuote(quote); err != nil {
+		return checker, err
+	}
+	if checker.Rounding, err = payment.ParseRoundingMode(rounding); err != nil {
+		return checker, err
+	}
+	if checker.Tolerance, err = payment.ParseDecimal(tolerance); err != nil {
+		return checker, err
+	}
+	checker.RelativeTolerance, err = payment.ParseDecimal(relativeTolerance)
+	return checker, err
+}
+
+// exportPayments writes the pain.001 document with the payments of the organisation which match the filter,
+// in order of identifier, to the output file or to the standard output if it is empty
+func exportPayments(storage, organisation string, filter map[string]string, messageID, output string) error {
+	repository, err := persistence.NewPaymentRepository(storage)
+	if err != nil {
+		return fmt.Errorf("Error initializing payment repository: %s", err.Error())
+	}
+	if closer, ok := repository.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	conditions := map[string]string{"organisation_id": organisation}
+	for path, value := range filter {
+		conditions[path] = value
+	}
+	query, err := persistence.NewFilterQuery(conditions)
+	if err != nil {
+		return err
+	}
+	payments, err := repository.FindPayments(context.Background(), query)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if output != "" {
+		file, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	return iso20022.Write(w, messageID, time.Now(), payments)
+}
+
+func startServer(port int, storage string, requestTimeout, idempotencyKeyExpiry time.Duration, validator payment.Validator, screener *sanctions.Screener, rules *fraud.Engine, trustUserHeader bool) {
 	router := mux.NewRouter()
-	repository, err := mongo.NewMongoPaymentRepository(connectionURL, "payment-demo")
+	repository, err := persistence.NewPaymentRepository(storage)
 	if err != nil {
-		fmt.Printf("Error initializing MongoDB repository: %s", err.Error())
+		fmt.Printf("Error initializing payment repository: %s", err.Error())
 		os.Exit(-1)
 	}
+	if closer, ok := repository.(io.Closer); ok {
+		defer closer.Close()
+	}
 	frontend := frontend.FrontendV1{
-		Router:            router,
-		PaymentRepository: repository,
+		Router:               router,
+		PaymentRepository:    repository,
+		RequestTimeout:       requestTimeout,
+		IdempotencyKeyExpiry: idempotencyKeyExpiry,
+		Validator:            validator,
+		Screener:             screener,
+		Rules:                rules,
+		TrustActorHeader:     trustUserHeader,
 	}
 	frontend.InitializeRoutes()
 	err = http.ListenAndServe(fmt.Sprintf(":%d", port), router)
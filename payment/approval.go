@@ -0,0 +1,132 @@
+package payment
+
+import (
+	"fmt"
+)
+
+// Codes of the field errors returned by ApprovalPolicy.Validate
+const (
+	DuplicateCurrencyCode = "duplicate_currency"
+)
+
+// ApprovalPolicy defines which payments of an organisation must be approved by a second user before they can be submitted
+// swagger:model
+type ApprovalPolicy struct {
+	OrganisationID string `json:"organisation_id"`
+	// Thresholds contains the amount above which the payments in each currency need approval.
+	// Payments in a currency without threshold always need approval.
+	Thresholds []PaymentAmountType `json:"thresholds"`
+}
+
+// ApprovalRequiredError is returned when a payment which needs approval is submitted before being approved
+type ApprovalRequiredError struct {
+	ID             string
+	OrganisationID string
+}
+
+func (e ApprovalRequiredError) Error() string {
+	return fmt.Sprintf("Payment %s must be approved before being submitted according to the approval policy of organisation %s", e.ID, e.OrganisationID)
+}
+
+// FourEyesError is returned when the approval of a payment is requested by an anonymous user, or when it is approved
+// or rejected by the user who created the payment, by the user who requested its approval or by an anonymous user,
+// who could be any of them
+type FourEyesError struct {
+	ID     string
+	Action string
+	Actor  string
+	// Role is what the actor did with the payment which prevents them from doing the action, like created or requested its approval
+	Role string
+}
+
+// Roles of the users who can't decide on the approval of a payment
+const (
+	CreatorRole   = "created it"
+	RequesterRole = "requested its approval"
+)
+
+func (e FourEyesError) Error() string {
+	if e.Actor == "" {
+		return fmt.Sprintf("An identified user is required to %s payment %s", e.Action, e.ID)
+	}
+	return fmt.Sprintf("User %s can't %s payment %s because they %s", e.Actor, e.Action, e.ID, e.Role)
+}
+
+// Validate checks that the organisation identifier of the policy is a UUID and that its thresholds
+// have amounts greater than zero and different ISO 4217 currencies.
+// It returns a ValidationError with the errors of all the invalid fields or nil if the policy is valid.
+func (p ApprovalPolicy) Validate() error {
+	var v validation
+	if v.required("organisation_id", p.OrganisationID) {
+		v.uuid("organisation_id", p.OrganisationID)
+	}
+	currencies := make(map[string]bool)
+	for i, threshold := range p.Thresholds {
+		field := fmt.Sprintf("thresholds.%d.", i)
+		if v.required(field+"amount", threshold.Amount) {
+			v.positiveDecimal(field+"amount", threshold.Amount)
+		}
+		if v.required(field+"currency", threshold.Currency) && v.currency(field+"currency", threshold.Currency) {
+			if currencies[threshold.Currency] {
+				v.add(field+"currency", DuplicateCurrencyCode, "There's another threshold in %s", threshold.Currency)
+			}
+			currencies[threshold.Currency] = true
+		}
+	}
+
+	if len(v.errors) > 0 {
+		return ValidationError{Errors: v.errors}
+	}
+	return nil
+}
+
+// RequiresApproval returns true if the amount of the payment is above the threshold of its currency,
+// if there's no threshold for its currency or if its amount is not a valid number
+func (p ApprovalPolicy) RequiresApproval(pay Payment) bool {
+	for _, threshold := range p.Thresholds {
+		if threshold.Currency != pay.Attributes.Currency {
+			continue
+		}
+		limit, err := ParseDecimal(threshold.Amount)
+		if err != nil {
+			return true
+		}
+		amount, err := ParseDecimal(pay.Attributes.Amount)
+		return err != nil || amount.Cmp(limit) > 0
+	}
+	return true
+}
+
+// CheckSubmission returns an ApprovalRequiredError if the payment needs approval according to the policy
+// and it hasn't been approved, or nil if it can be submitted
+func (p ApprovalPolicy) CheckSubmission(pay Payment) error {
+	if pay.CurrentStatus() != ApprovedStatus && p.RequiresApproval(pay) {
+		return ApprovalRequiredError{ID: pay.ID, OrganisationID: p.OrganisationID}
+	}
+	return nil
+}
+
+// ApprovalRequester returns the user who made the last request of approval of the payment,
+// or an empty string if its approval has never been requested
+func (p Payment) ApprovalRequester() string {
+	for i := len(p.Transitions) - 1; i >= 0; i-- {
+		if p.Transitions[i].Action == RequestApprovalAction {
+			return p.Transitions[i].Actor
+		}
+	}
+	return ""
+}
+
+// checkFourEyes returns a FourEyesError if the actor can't decide on the approval requested for the payment,
+// because they are anonymous, they created the payment or they requested its approval
+func (p Payment) checkFourEyes(action, actor string) error {
+	switch {
+	case actor == "":
+		return FourEyesError{ID: p.ID, Action: action}
+	case actor == p.CreatedBy:
+		return FourEyesError{ID: p.ID, Action: action, Actor: actor, Role: CreatorRole}
+	case actor == p.ApprovalRequester():
+		return FourEyesError{ID: p.ID, Action: action, Actor: actor, Role: RequesterRole}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package payment
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestApprovalPolicy(t *testing.T) {
+	policy := ApprovalPolicy{
+		OrganisationID: "743d5b63-8e6f-432e-a8fa-c5d8d2ee5fcb",
+		Thresholds:     []PaymentAmountType{{Amount: "1000.00", Currency: "GBP"}},
+	}
+	if err := policy.Validate(); err != nil {
+		t.Fatalf("Unexpected error validating policy: %s", err.Error())
+	}
+
+	tests := []struct {
+		amount   string
+		currency string
+		required bool
+	}{
+		{"1000.00", "GBP", false},
+		{"1000", "GBP", false},
+		{"1000.01", "GBP", true},
+		{"10.00", "EUR", true},
+		{"", "GBP", true},
+	}
+	for _, test := range tests {
+		pay := Payment{Attributes: PaymentAttributesType{Amount: test.amount, Currency: test.currency}}
+		if required := policy.RequiresApproval(pay); required != test.required {
+			t.Errorf("Expected approval required to be %t for %s %s but got %t", test.required, test.amount, test.currency, required)
+		}
+		err := policy.CheckSubmission(pay)
+		if (err != nil) != test.required {
+			t.Errorf("Unexpected error checking the submission of %s %s: %v", test.amount, test.currency, err)
+		}
+		pay.Status = ApprovedStatus
+		if err := policy.CheckSubmission(pay); err != nil {
+			t.Errorf("Unexpected error checking the submission of approved %s %s: %s", test.amount, test.currency, err.Error())
+		}
+	}
+
+	invalid := ApprovalPolicy{
+		OrganisationID: "organisation",
+		Thresholds: []PaymentAmountType{
+			{Amount: "0", Currency: "GBP"},
+			{Amount: "100", Currency: "GBP"},
+			{Amount: "ten", Currency: "XXX"},
+		},
+	}
+	validationError, ok := invalid.Validate().(ValidationError)
+	if !ok {
+		t.Fatalf("Expected ValidationError validating an invalid policy")
+	}
+	got := make(map[string]string)
+	for _, fieldError := range validationError.Errors {
+		got[fieldError.Field] = fieldError.Code
+	}
+	expected := map[string]string{
+		"organisation_id":       InvalidUUIDCode,
+		"thresholds.0.amount":   NotPositiveCode,
+		"thresholds.1.currency": DuplicateCurrencyCode,
+		"thresholds.2.amount":   InvalidDecimalCode,
+		"thresholds.2.currency": InvalidCurrencyCode,
+	}
+	if !cmp.Equal(got, expected) {
+		t.Fatalf("Unexpected field errors.\nExpected:\n%v\nBut got:\n%v", expected, got)
+	}
+}
+
+func TestFourEyes(t *testing.T) {
+	pay := Payment{ID: "payment", CreatedBy: "creator"}
+	if _, err := pay.Transition(RequestApprovalAction, "", "", time.Now()); err != (FourEyesError{ID: "payment", Action: RequestApprovalAction}) {
+		t.Errorf("Expected FourEyes error requesting approval anonymously but got %v", err)
+	}
+	pending, err := pay.Transition(RequestApprovalAction, "", "requester", time.Now())
+	if err != nil {
+		t.Fatalf("Error requesting approval: %s", err.Error())
+	}
+	if pending.ApprovalRequester() != "requester" {
+		t.Fatalf("Expected requester to be recorded but got %q", pending.ApprovalRequester())
+	}
+
+	for _, action := range []string{ApproveAction, RejectAction} {
+		for actor, role := range map[string]string{"": "", "creator": CreatorRole, "requester": RequesterRole} {
+			_, err := pending.Transition(action, "", actor, time.Now())
+			if err != (FourEyesError{ID: "payment", Action: action, Actor: actor, Role: role}) {
+				t.Errorf("Expected FourEyes error doing %s by %q but got %v", action, actor, err)
+			}
+		}
+	}
+	if _, err := pay.Transition(RequestApprovalAction, "", "creator", time.Now()); err != nil {
+		t.Errorf("Error requesting approval by the creator: %s", err.Error())
+	}
+
+	approved, err := pending.Transition(ApproveAction, "Checked", "approver", time.Now())
+	if err != nil {
+		t.Fatalf("Error approving payment: %s", err.Error())
+	}
+	if approved.Status != ApprovedStatus || approved.Transitions[1].Actor != "approver" {
+		t.Fatalf("Unexpected approved payment: %v", approved)
+	}
+	if _, err := approved.Transition(SubmitAction, "", "requester", time.Now()); err != nil {
+		t.Fatalf("Error submitting approved payment: %s", err.Error())
+	}
+	if !approved.IsLocked() || approved.IsSubmitted() {
+		t.Fatalf("Expected approved payment to be locked but not submitted")
+	}
+}
@@ -0,0 +1,121 @@
+// Package bank validates the identifiers of bank accounts and banks, like IBANs, UK sort codes and BICs
+package bank
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Codes which identify the format of the account number of a party
+const (
+	IBANCode = "IBAN"
+	BBANCode = "BBAN"
+)
+
+// Codes which identify the format of the bank identifier of a party
+const (
+	// SortCodeBankIDCode identifies UK sort codes
+	SortCodeBankIDCode = "GBDSC"
+	// BICBankIDCode identifies SWIFT business identifier codes
+	BICBankIDCode = "SWBIC"
+)
+
+// Codes of the errors returned by the validations
+const (
+	InvalidIBANCode     = "invalid_iban"
+	InvalidBBANCode     = "invalid_bban"
+	InvalidSortCodeCode = "invalid_sort_code"
+	InvalidBICCode      = "invalid_bic"
+	// InconsistentCodeCode is used when the value of an account number or a bank identifier doesn't match its code
+	InconsistentCodeCode = "inconsistent_code"
+)
+
+var (
+	ibanRegexp     = regexp.MustCompile(`^[A-Z]{2}[0-9]{2}[A-Z0-9]+$`)
+	sortCodeRegexp = regexp.MustCompile(`^[0-9]{6}$`)
+	ukBBANRegexp   = regexp.MustCompile(`^[0-9]{8}$`)
+	bbanRegexp     = regexp.MustCompile(`^[A-Z0-9]{1,30}$`)
+	bicRegexp      = regexp.MustCompile(`^[A-Z]{4}[A-Z]{2}[A-Z0-9]{2}([A-Z0-9]{3})?$`)
+)
+
+// Error is returned when an account number or a bank identifier is not valid
+type Error struct {
+	// Code identifies the kind of error, like invalid_iban
+	Code    string
+	Value   string
+	Message string
+}
+
+func (e Error) Error() string {
+	return e.Message
+}
+
+func invalid(code, value, format string, args ...interface{}) error {
+	return Error{Code: code, Value: value, Message: fmt.Sprintf(format, args...)}
+}
+
+// ValidateSortCode checks that the value is a UK sort code of six digits without separators
+func ValidateSortCode(sortCode string) error {
+	if !sortCodeRegexp.MatchString(sortCode) {
+		return invalid(InvalidSortCodeCode, sortCode, "%q is not a sort code of six digits like 403000", sortCode)
+	}
+	return nil
+}
+
+// ValidateBIC checks that the value is a BIC of eight or eleven characters, which are the bank code and the country code in letters
+// followed by the alphanumeric location code and the optional alphanumeric branch code
+func ValidateBIC(bic string) error {
+	if !bicRegexp.MatchString(bic) {
+		return invalid(InvalidBICCode, bic, "%q is not a BIC like NWBKGB2L or NWBKGB2LXXX", bic)
+	}
+	return nil
+}
+
+// ValidateBBAN checks that the value is a domestic account number of the bank identified by the code.
+// Accounts of banks identified by UK sort codes have eight digits and other BBANs have up to 30 upper case letters and digits.
+// IBANs are not valid BBANs, since their code must be IBAN.
+func ValidateBBAN(bban, bankIDCode string) error {
+	if bankIDCode == SortCodeBankIDCode {
+		if !ukBBANRegexp.MatchString(bban) {
+			return invalid(InvalidBBANCode, bban, "%q is not a UK account number of eight digits", bban)
+		}
+		return nil
+	}
+	if !bbanRegexp.MatchString(bban) {
+		return invalid(InvalidBBANCode, bban, "%q is not a BBAN of up to 30 upper case letters and digits", bban)
+	}
+	if ValidateIBAN(bban) == nil {
+		return invalid(InconsistentCodeCode, bban, "%q is an IBAN but its code is %s", bban, BBANCode)
+	}
+	return nil
+}
+
+// ValidateAccountNumber checks that the account number is valid according to its code, which is IBAN or BBAN,
+// and that it is consistent with the code of the bank identifier. The IBANs of banks identified by UK sort codes must be from GB.
+// Account numbers with other codes are not checked.
+func ValidateAccountNumber(accountNumber, code, bankIDCode string) error {
+	switch code {
+	case IBANCode:
+		if err := ValidateIBAN(accountNumber); err != nil {
+			return err
+		}
+		if bankIDCode == SortCodeBankIDCode && accountNumber[:2] != "GB" {
+			return invalid(InconsistentCodeCode, accountNumber, "%q is not a GB IBAN but the bank is identified by a UK sort code", accountNumber)
+		}
+	case BBANCode:
+		return ValidateBBAN(accountNumber, bankIDCode)
+	}
+	return nil
+}
+
+// ValidateBankID checks that the bank identifier is valid according to its code, which is GBDSC for UK sort codes or SWBIC for BICs.
+// Bank identifiers with other codes are not checked.
+func ValidateBankID(bankID, code string) error {
+	switch code {
+	case SortCodeBankIDCode:
+		return ValidateSortCode(bankID)
+	case BICBankIDCode:
+		return ValidateBIC(bankID)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package bank
+
+import (
+	"testing"
+)
+
+// checkCode checks that the error is a bank Error with the expected code, or nil if the code is empty
+func checkCode(t *testing.T, description string, err error, code string) {
+	t.Helper()
+	if code == "" {
+		if err != nil {
+			t.Errorf("Unexpected error validating %s: %s", description, err.Error())
+		}
+		return
+	}
+	if bankError, ok := err.(Error); !ok || bankError.Code != code {
+		t.Errorf("Expected %s error validating %s but got %v", code, description, err)
+	}
+}
+
+func TestValidateIBAN(t *testing.T) {
+	tests := map[string]string{
+		"GB29NWBK60161331926819":          "",
+		"DE89370400440532013000":          "",
+		"NO9386011117947":                 "",
+		"MT84MALT011000012345MTLCAST001S": "",
+		"GB28NWBK60161331926819":          InvalidIBANCode,
+		"GB29NWBK6016133192681":           InvalidIBANCode,
+		"GB29 NWBK 6016 1331 9268 19":     InvalidIBANCode,
+		"gb29nwbk60161331926819":          InvalidIBANCode,
+		"US29NWBK60161331926819":          InvalidIBANCode,
+		"GBXXNWBK60161331926819":          InvalidIBANCode,
+		"":                                InvalidIBANCode,
+	}
+	for iban, code := range tests {
+		checkCode(t, "IBAN "+iban, ValidateIBAN(iban), code)
+	}
+
+	if length, ok := IBANLength("GB"); !ok || length != 22 {
+		t.Errorf("Expected GB IBANs to have 22 characters but got %d (%t)", length, ok)
+	}
+	if _, ok := IBANLength("US"); ok {
+		t.Error("Expected US not to be in the IBAN registry")
+	}
+}
+
+func TestValidateBankID(t *testing.T) {
+	tests := []struct {
+		bankID string
+		code   string
+		error  string
+	}{
+		{"403000", SortCodeBankIDCode, ""},
+		{"40-30-00", SortCodeBankIDCode, InvalidSortCodeCode},
+		{"40300", SortCodeBankIDCode, InvalidSortCodeCode},
+		{"NWBKGB2L", BICBankIDCode, ""},
+		{"NWBKGB2LXXX", BICBankIDCode, ""},
+		{"NWBKGB2LXX", BICBankIDCode, InvalidBICCode},
+		{"NWB1GB2L", BICBankIDCode, InvalidBICCode},
+		{"nwbkgb2l", BICBankIDCode, InvalidBICCode},
+		{"anything", "OTHER", ""},
+	}
+	for _, test := range tests {
+		checkCode(t, test.code+" "+test.bankID, ValidateBankID(test.bankID, test.code), test.error)
+	}
+}
+
+func TestValidateAccountNumber(t *testing.T) {
+	tests := []struct {
+		accountNumber string
+		code          string
+		bankIDCode    string
+		error         string
+	}{
+		{"GB29NWBK60161331926819", IBANCode, SortCodeBankIDCode, ""},
+		{"GB29NWBK60161331926819", IBANCode, BICBankIDCode, ""},
+		{"DE89370400440532013000", IBANCode, SortCodeBankIDCode, InconsistentCodeCode},
+		{"DE89370400440532013000", IBANCode, BICBankIDCode, ""},
+		{"31926819", IBANCode, SortCodeBankIDCode, InvalidIBANCode},
+		{"31926819", BBANCode, SortCodeBankIDCode, ""},
+		{"3192681", BBANCode, SortCodeBankIDCode, InvalidBBANCode},
+		{"GB29NWBK60161331926819", BBANCode, SortCodeBankIDCode, InvalidBBANCode},
+		{"370400440532013000", BBANCode, BICBankIDCode, ""},
+		{"GB29NWBK60161331926819", BBANCode, BICBankIDCode, InconsistentCodeCode},
+		{"0532-013000", BBANCode, BICBankIDCode, InvalidBBANCode},
+		{"anything", "", "", ""},
+	}
+	for _, test := range tests {
+		description := test.code + " " + test.accountNumber + " of a bank identified by " + test.bankIDCode
+		checkCode(t, description, ValidateAccountNumber(test.accountNumber, test.code, test.bankIDCode), test.error)
+	}
+}
@@ -0,0 +1,59 @@
+package bank
+
+// ibanLengths contains the length of the IBANs of every country of the SWIFT IBAN registry by ISO 3166 country code
+var ibanLengths = map[string]int{
+	"AD": 24, "AE": 23, "AL": 28, "AT": 20, "AZ": 28, "BA": 20, "BE": 16, "BG": 22,
+	"BH": 22, "BI": 27, "BR": 29, "BY": 28, "CH": 21, "CR": 22, "CY": 28, "CZ": 24,
+	"DE": 22, "DJ": 27, "DK": 18, "DO": 28, "EE": 20, "EG": 29, "ES": 24, "FI": 18,
+	"FK": 18, "FO": 18, "FR": 27, "GB": 22, "GE": 22, "GI": 23, "GL": 18, "GR": 27,
+	"GT": 28, "HN": 28, "HR": 21, "HU": 28, "IE": 22, "IL": 23, "IQ": 23, "IS": 26,
+	"IT": 27, "JO": 30, "KW": 30, "KZ": 20, "LB": 28, "LC": 32, "LI": 21, "LT": 20,
+	"LU": 20, "LV": 21, "LY": 25, "MC": 27, "MD": 24, "ME": 22, "MK": 19, "MN": 20,
+	"MR": 27, "MT": 31, "MU": 30, "NI": 28, "NL": 18, "NO": 15, "OM": 23, "PK": 24,
+	"PL": 28, "PS": 29, "PT": 25, "QA": 29, "RO": 24, "RS": 22, "RU": 33, "SA": 24,
+	"SC": 31, "SD": 18, "SE": 24, "SI": 19, "SK": 24, "SM": 27, "SO": 23, "ST": 25,
+	"SV": 28, "TL": 23, "TN": 24, "TR": 26, "UA": 29, "VA": 22, "VG": 24, "XK": 20,
+	"YE": 30,
+}
+
+// IBANLength returns the length of the IBANs of a country and true,
+// or false if the country is not in the IBAN registry
+func IBANLength(country string) (int, bool) {
+	length, ok := ibanLengths[country]
+	return length, ok
+}
+
+// ValidateIBAN checks that the value is an IBAN in electronic format, without spaces and in upper case,
+// whose country is in the IBAN registry, whose length is the one of its country and whose check digits are valid
+// according to the ISO 7064 mod 97-10 algorithm. It returns an Error with the InvalidIBANCode or nil if it is valid.
+func ValidateIBAN(iban string) error {
+	if !ibanRegexp.MatchString(iban) {
+		return invalid(InvalidIBANCode, iban, "%q is not an IBAN in electronic format like GB29NWBK60161331926819", iban)
+	}
+	country := iban[:2]
+	length, ok := IBANLength(country)
+	if !ok {
+		return invalid(InvalidIBANCode, iban, "%s is not a country of the IBAN registry", country)
+	}
+	if len(iban) != length {
+		return invalid(InvalidIBANCode, iban, "%q has %d characters but the IBANs of %s have %d", iban, len(iban), country, length)
+	}
+	if mod97(iban[4:]+iban[:4]) != 1 {
+		return invalid(InvalidIBANCode, iban, "%q has invalid check digits", iban)
+	}
+	return nil
+}
+
+// mod97 returns the remainder of the division by 97 of the number obtained by replacing every letter
+// of the alphanumeric value by two digits, A being 10 and Z 35
+func mod97(value string) int {
+	remainder := 0
+	for _, c := range value {
+		if c >= 'A' && c <= 'Z' {
+			remainder = (remainder*100 + int(c-'A') + 10) % 97
+		} else {
+			remainder = (remainder*10 + int(c-'0')) % 97
+		}
+	}
+	return remainder
+}
@@ -0,0 +1,319 @@
+package bank
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Algorithms of the rows of the modulus weight table
+const (
+	Mod10Algorithm           = "MOD10"
+	Mod11Algorithm           = "MOD11"
+	DoubleAlternateAlgorithm = "DBLAL"
+)
+
+// InvalidModulusCode is the code of the errors returned when an account number fails the modulus check of its sort code
+const InvalidModulusCode = "invalid_modulus"
+
+// Positions of the digits of the sort code and the account number, which VocaLink names u to z and a to h
+const (
+	digitA = 6 + iota
+	digitB
+	digitC
+	digitD
+	digitE
+	digitF
+	digitG
+	digitH
+)
+
+var (
+	// exception2Weights replace the weights of the exception 2 rows when a is not 0 and g is not 9
+	exception2Weights = [14]int{0, 0, 1, 2, 5, 3, 6, 4, 8, 7, 10, 9, 3, 1}
+	// exception2GWeights replace the weights of the exception 2 rows when a is not 0 and g is 9
+	exception2GWeights = [14]int{0, 0, 0, 0, 0, 0, 0, 0, 8, 7, 10, 9, 3, 1}
+)
+
+// ModulusWeight is a row of the VocaLink modulus weight table, which defines the check
+// of the account numbers of a range of sort codes
+type ModulusWeight struct {
+	// Start and End are the first and last sort codes of the range
+	Start string
+	End   string
+	// Algorithm is MOD10, MOD11 or DBLAL
+	Algorithm string
+	// Weights are the weights of the six digits of the sort code followed by the eight digits of the account number
+	Weights [14]int
+	// Exception is the number of the exception rule of the row or 0 if it has none
+	Exception int
+}
+
+// ModulusChecker checks UK account numbers with the modulus checking algorithms published by VocaLink
+type ModulusChecker struct {
+	// Weights are the rows of the weight table, ordered by sort code. The account numbers of sort codes
+	// which aren't in any row can't be checked and are valid.
+	Weights []ModulusWeight
+	// Substitutions replace the sort codes of the exception 5 rows
+	Substitutions map[string]string
+}
+
+// LoadModulusChecker reads the weight table and the optional sort code substitution table from files in the format
+// published by VocaLink, like valacdos.txt and scsubtab.txt, so the tables can be updated without recompiling
+func LoadModulusChecker(weightsPath, substitutionsPath string) (*ModulusChecker, error) {
+	var checker ModulusChecker
+	file, err := os.Open(weightsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if checker.Weights, err = ParseModulusWeights(file); err != nil {
+		return nil, fmt.Errorf("Error reading modulus weights from %s: %s", weightsPath, err.Error())
+	}
+
+	if substitutionsPath != "" {
+		substitutions, err := os.Open(substitutionsPath)
+		if err != nil {
+			return nil, err
+		}
+		defer substitutions.Close()
+		if checker.Substitutions, err = ParseSortCodeSubstitutions(substitutions); err != nil {
+			return nil, fmt.Errorf("Error reading sort code substitutions from %s: %s", substitutionsPath, err.Error())
+		}
+	}
+	return &checker, nil
+}
+
+// ParseModulusWeights reads a weight table with a row per line made of the first and last sort codes,
+// the algorithm, the fourteen weights and the optional exception separated by blanks
+func ParseModulusWeights(reader io.Reader) ([]ModulusWeight, error) {
+	var weights []ModulusWeight
+	err := parseLines(reader, func(fields []string) error {
+		if len(fields) != 17 && len(fields) != 18 {
+			return fmt.Errorf("expected 17 or 18 fields but got %d", len(fields))
+		}
+		row := ModulusWeight{Start: fields[0], End: fields[1], Algorithm: fields[2]}
+		if ValidateSortCode(row.Start) != nil || ValidateSortCode(row.End) != nil || row.Start > row.End {
+			return fmt.Errorf("invalid sort code range %s - %s", row.Start, row.End)
+		}
+		switch row.Algorithm {
+		case Mod10Algorithm, Mod11Algorithm, DoubleAlternateAlgorithm:
+		default:
+			return fmt.Errorf("unknown algorithm %s", row.Algorithm)
+		}
+		numbers := fields[3:]
+		for i, number := range numbers {
+			value, err := strconv.Atoi(number)
+			if err != nil {
+				return fmt.Errorf("%q is not a number", number)
+			}
+			if i < len(row.Weights) {
+				row.Weights[i] = value
+			} else {
+				row.Exception = value
+			}
+		}
+		weights = append(weights, row)
+		return nil
+	})
+	return weights, err
+}
+
+// ParseSortCodeSubstitutions reads a substitution table with the original and the substitute sort codes in every line
+func ParseSortCodeSubstitutions(reader io.Reader) (map[string]string, error) {
+	substitutions := make(map[string]string)
+	err := parseLines(reader, func(fields []string) error {
+		if len(fields) != 2 || ValidateSortCode(fields[0]) != nil || ValidateSortCode(fields[1]) != nil {
+			return fmt.Errorf("expected the original and the substitute sort codes")
+		}
+		substitutions[fields[0]] = fields[1]
+		return nil
+	})
+	return substitutions, err
+}
+
+// parseLines calls parse with the blank separated fields of every line which isn't empty
+func parseLines(reader io.Reader, parse func(fields []string) error) error {
+	scanner := bufio.NewScanner(reader)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if err := parse(fields); err != nil {
+			return fmt.Errorf("line %d: %s", line, err.Error())
+		}
+	}
+	return scanner.Err()
+}
+
+// Check checks the UK account number of eight digits with the rows of the weight table of the sort code,
+// applying their exception rules. When the sort code has two rows both checks must pass, unless its exceptions
+// say that only one of them must. It returns an Error with the InvalidModulusCode or nil if the account number is valid
+// or it can't be checked.
+func (c *ModulusChecker) Check(sortCode, accountNumber string) error {
+	if err := ValidateSortCode(sortCode); err != nil {
+		return err
+	}
+	if err := ValidateBBAN(accountNumber, SortCodeBankIDCode); err != nil {
+		return err
+	}
+	rows := c.rows(sortCode)
+	if len(rows) == 0 {
+		return nil
+	}
+
+	first := rows[0]
+	valid := c.checkRow(first, sortCode, accountNumber)
+	if len(rows) > 1 {
+		switch first.Exception {
+		case 2, 10, 12:
+			// Exceptions 2 and 9, 10 and 11 and 12 and 13 only need one of the checks to pass
+			valid = valid || c.checkRow(rows[1], sortCode, accountNumber)
+		default:
+			valid = valid && c.checkRow(rows[1], sortCode, accountNumber)
+		}
+	}
+	if !valid {
+		return invalid(InvalidModulusCode, accountNumber, "%s is not a valid account number for sort code %s", accountNumber, sortCode)
+	}
+	return nil
+}
+
+// rows returns the rows of the weight table whose range contains the sort code, which are two at most
+func (c *ModulusChecker) rows(sortCode string) []ModulusWeight {
+	var rows []ModulusWeight
+	for _, row := range c.Weights {
+		if row.Start <= sortCode && sortCode <= row.End {
+			rows = append(rows, row)
+			if len(rows) == 2 {
+				break
+			}
+		}
+	}
+	return rows
+}
+
+// checkRow returns true if the account number passes the check of the row
+func (c *ModulusChecker) checkRow(row ModulusWeight, sortCode, accountNumber string) bool {
+	digits := modulusDigits(sortCode, accountNumber)
+	weights := row.Weights
+
+	switch row.Exception {
+	case 3:
+		if digits[digitC] == 6 || digits[digitC] == 9 {
+			return true
+		}
+	case 5:
+		if substitute, ok := c.Substitutions[sortCode]; ok {
+			digits = modulusDigits(substitute, accountNumber)
+		}
+	case 6:
+		// Foreign currency accounts can't be checked
+		if digits[digitA] >= 4 && digits[digitA] <= 8 && digits[digitG] == digits[digitH] {
+			return true
+		}
+	case 8:
+		digits = modulusDigits("090126", accountNumber)
+	case 9:
+		digits = modulusDigits("309634", accountNumber)
+	case 2:
+		if digits[digitA] != 0 {
+			if digits[digitG] == 9 {
+				weights = exception2GWeights
+			} else {
+				weights = exception2Weights
+			}
+		}
+	case 7:
+		if digits[digitG] == 9 {
+			weights = zeroSortCodeWeights(weights)
+		}
+	case 10:
+		ab := digits[digitA]*10 + digits[digitB]
+		if (ab == 9 || ab == 99) && digits[digitG] == 9 {
+			weights = zeroSortCodeWeights(weights)
+		}
+	}
+
+	total := modulusTotal(row.Algorithm, digits, weights)
+	switch row.Exception {
+	case 1:
+		total += 27
+	case 4:
+		return total%11 == digits[digitG]*10+digits[digitH]
+	case 5:
+		return checkDigitMatches(row.Algorithm, total, digits)
+	}
+
+	valid := total%modulus(row.Algorithm) == 0
+	if !valid && row.Exception == 14 {
+		// Accounts whose last digit is 0, 1 or 9 are checked again without it
+		switch digits[digitH] {
+		case 0, 1, 9:
+			shifted := row
+			shifted.Exception = 0
+			return c.checkRow(shifted, sortCode, "0"+accountNumber[:7])
+		}
+	}
+	return valid
+}
+
+// checkDigitMatches checks the exception 5 rows, where the remainder gives the check digit g for MOD11 and h for DBLAL
+func checkDigitMatches(algorithm string, total int, digits [14]int) bool {
+	m := modulus(algorithm)
+	checkDigit := digits[digitH]
+	if algorithm == Mod11Algorithm {
+		checkDigit = digits[digitG]
+	}
+	remainder := total % m
+	switch {
+	case remainder == 0:
+		return checkDigit == 0
+	case remainder == 1 && m == 11:
+		return false
+	}
+	return m-remainder == checkDigit
+}
+
+// modulusTotal returns the sum of the digits multiplied by their weights. The double alternate algorithm
+// adds the digits of the products instead.
+func modulusTotal(algorithm string, digits, weights [14]int) int {
+	total := 0
+	for i := range digits {
+		product := digits[i] * weights[i]
+		if algorithm == DoubleAlternateAlgorithm {
+			total += product/10 + product%10
+		} else {
+			total += product
+		}
+	}
+	return total
+}
+
+func modulus(algorithm string) int {
+	if algorithm == Mod11Algorithm {
+		return 11
+	}
+	return 10
+}
+
+// zeroSortCodeWeights returns the weights with the ones of the sort code and the first two digits of the account number set to zero
+func zeroSortCodeWeights(weights [14]int) [14]int {
+	for i := 0; i < digitC; i++ {
+		weights[i] = 0
+	}
+	return weights
+}
+
+// modulusDigits returns the digits of the sort code followed by the ones of the account number
+func modulusDigits(sortCode, accountNumber string) [14]int {
+	var digits [14]int
+	for i, c := range sortCode + accountNumber {
+		digits[i] = int(c - '0')
+	}
+	return digits
+}
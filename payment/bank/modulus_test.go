@@ -0,0 +1,89 @@
+package bank
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestModulusCheck(t *testing.T) {
+	checker, err := LoadModulusChecker("../../test_resources/valacdos.txt", "../../test_resources/scsubtab.txt")
+	if err != nil {
+		t.Fatalf("Error loading modulus checker: %s", err.Error())
+	}
+
+	// Most cases come from the VocaLink modulus checking specification, checked against the sample weight table of the test resources
+	tests := []struct {
+		sortCode      string
+		accountNumber string
+		error         string
+	}{
+		{"089999", "66374958", ""},
+		{"107999", "88837491", ""},
+		{"202959", "63748472", ""},
+		{"871427", "46238510", ""},
+		{"872427", "46238510", ""},
+		{"871427", "09123496", ""},
+		{"871427", "99123496", ""},
+		{"820000", "73688637", ""},
+		{"827999", "73988638", ""},
+		{"827101", "28748352", ""},
+		{"134020", "63849203", ""},
+		{"118765", "64371389", ""},
+		{"200915", "41011166", ""},
+		{"938611", "07806039", ""},
+		{"938600", "42368003", ""},
+		{"938063", "55065200", ""},
+		{"772798", "99345694", ""},
+		{"086090", "06774744", ""},
+		{"309070", "12345668", ""},
+		{"309070", "12345677", ""},
+		{"309070", "99345694", ""},
+		{"074456", "12345112", ""},
+		{"070116", "34012583", ""},
+		{"074456", "11104102", ""},
+		{"180002", "00000190", ""},
+		{"180002", "65420529", ""},
+		{"999999", "12345678", ""},
+		{"089999", "66374959", InvalidModulusCode},
+		{"107999", "88837493", InvalidModulusCode},
+		{"203099", "66831036", InvalidModulusCode},
+		{"203099", "58716970", InvalidModulusCode},
+		{"118765", "64371388", InvalidModulusCode},
+		{"938063", "15764273", InvalidModulusCode},
+		{"938063", "15764264", InvalidModulusCode},
+		{"938063", "15763217", InvalidModulusCode},
+		{"180002", "00000192", InvalidModulusCode},
+		{"08-99-99", "66374958", InvalidSortCodeCode},
+		{"089999", "6637495", InvalidBBANCode},
+	}
+	for _, test := range tests {
+		checkCode(t, test.sortCode+" "+test.accountNumber, checker.Check(test.sortCode, test.accountNumber), test.error)
+	}
+}
+
+func TestParseModulusWeights(t *testing.T) {
+	weights, err := ParseModulusWeights(strings.NewReader("\n089999 089999 MOD10 0 0 0 0 0 0 7 1 3 7 1 3 7 1\n938000 938696 DBLAL 2 1 2 1 2 1 2 1 2 1 2 1 2 0 5\n"))
+	if err != nil {
+		t.Fatalf("Error parsing modulus weights: %s", err.Error())
+	}
+	expected := ModulusWeight{Start: "938000", End: "938696", Algorithm: DoubleAlternateAlgorithm, Weights: [14]int{2, 1, 2, 1, 2, 1, 2, 1, 2, 1, 2, 1, 2, 0}, Exception: 5}
+	if len(weights) != 2 || weights[1] != expected {
+		t.Errorf("Unexpected modulus weights %v", weights)
+	}
+
+	invalid := []string{
+		"089999 089999 MOD10 0 0 0 0 0 0 7 1 3 7 1 3 7",
+		"089999 089999 MOD12 0 0 0 0 0 0 7 1 3 7 1 3 7 1",
+		"089999 089990 MOD10 0 0 0 0 0 0 7 1 3 7 1 3 7 1",
+		"089999 089999 MOD10 0 0 0 0 0 0 7 1 3 7 1 3 7 X",
+	}
+	for _, table := range invalid {
+		if _, err := ParseModulusWeights(strings.NewReader(table)); err == nil {
+			t.Errorf("Expected error parsing modulus weights %q", table)
+		}
+	}
+
+	if _, err := ParseSortCodeSubstitutions(strings.NewReader("938600 938611 938612")); err == nil {
+		t.Error("Expected error parsing a sort code substitution with three sort codes")
+	}
+}
@@ -0,0 +1,311 @@
+package payment
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+var decimalPattern = regexp.MustCompile(`^[-+]?([0-9]+(\.[0-9]*)?|\.[0-9]+)$`)
+
+var ten = big.NewInt(10)
+
+// RoundingMode determines how numbers are rounded when they have more decimals than the required ones
+type RoundingMode int
+
+const (
+	// RoundHalfEven rounds to the nearest number and to the one with an even last digit when both are equally near.
+	// It is the zero value.
+	RoundHalfEven RoundingMode = iota
+	// RoundHalfUp rounds to the nearest number and away from zero when both are equally near
+	RoundHalfUp
+	// RoundHalfDown rounds to the nearest number and towards zero when both are equally near
+	RoundHalfDown
+	// RoundUp rounds away from zero
+	RoundUp
+	// RoundDown rounds towards zero, which truncates the number
+	RoundDown
+	// RoundCeiling rounds towards positive infinity
+	RoundCeiling
+	// RoundFloor rounds towards negative infinity
+	RoundFloor
+)
+
+var roundingModeNames = map[RoundingMode]string{
+	RoundHalfEven: "half-even",
+	RoundHalfUp:   "half-up",
+	RoundHalfDown: "half-down",
+	RoundUp:       "up",
+	RoundDown:     "down",
+	RoundCeiling:  "ceiling",
+	RoundFloor:    "floor",
+}
+
+func (m RoundingMode) String() string {
+	return roundingModeNames[m]
+}
+
+// ParseRoundingMode returns the rounding mode with the given name, like half-even or floor
+func ParseRoundingMode(name string) (RoundingMode, error) {
+	for mode, modeName := range roundingModeNames {
+		if modeName == name {
+			return mode, nil
+		}
+	}
+	return RoundHalfEven, fmt.Errorf("Unknown rounding mode %q", name)
+}
+
+// roundQuotient returns the quotient of the division of two integers rounded to an integer with the rounding mode
+func roundQuotient(numerator, denominator *big.Int, mode RoundingMode) *big.Int {
+	quotient, remainder := new(big.Int).QuoRem(numerator, denominator, new(big.Int))
+	if remainder.Sign() == 0 {
+		return quotient
+	}
+	sign := numerator.Sign() * denominator.Sign()
+	// half is -1, 0 or 1 if the remainder is lower, equal or greater than half the denominator
+	twice := new(big.Int).Abs(remainder)
+	half := twice.Lsh(twice, 1).Cmp(new(big.Int).Abs(denominator))
+
+	away := false
+	switch mode {
+	case RoundHalfEven:
+		away = half > 0 || (half == 0 && quotient.Bit(0) == 1)
+	case RoundHalfUp:
+		away = half >= 0
+	case RoundHalfDown:
+		away = half > 0
+	case RoundUp:
+		away = true
+	case RoundCeiling:
+		away = sign > 0
+	case RoundFloor:
+		away = sign < 0
+	}
+	if away {
+		quotient.Add(quotient, big.NewInt(int64(sign)))
+	}
+	return quotient
+}
+
+// Decimal is an exact decimal number of arbitrary precision, like the amounts of a payment.
+// It keeps the number of decimals it was written with, so 2.00000 is formatted back as 2.00000 and not as 2.
+// The zero value is the number 0 without decimals. Decimals are immutable, so operations return new values.
+// They are encoded as strings in JSON and BSON, as the amounts of a payment document.
+type Decimal struct {
+	// unscaled is the value multiplied by 10^scale, or nil for 0
+	unscaled *big.Int
+	scale    int
+}
+
+// InvalidDecimalError is returned when a string is not a decimal number
+type InvalidDecimalError struct {
+	Value string
+}
+
+func (e InvalidDecimalError) Error() string {
+	return fmt.Sprintf("%q is not a decimal number", e.Value)
+}
+
+// ParseDecimal parses a decimal number with an optional sign, like 100.21, -5, +.5 or 5.
+// Exponents and fractions are not accepted.
+func ParseDecimal(value string) (Decimal, error) {
+	if !decimalPattern.MatchString(value) {
+		return Decimal{}, InvalidDecimalError{Value: value}
+	}
+	digits := strings.TrimLeft(value, "+")
+	scale := 0
+	if point := strings.IndexByte(digits, '.'); point >= 0 {
+		scale = len(digits) - point - 1
+		digits = digits[:point] + digits[point+1:]
+	}
+	unscaled, ok := new(big.Int).SetString(digits, 10)
+	if !ok {
+		return Decimal{}, InvalidDecimalError{Value: value}
+	}
+	return Decimal{unscaled: unscaled, scale: scale}, nil
+}
+
+// MustParseDecimal is like ParseDecimal but panics if the value is not a decimal number.
+// It is intended for constants.
+func MustParseDecimal(value string) Decimal {
+	d, err := ParseDecimal(value)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// NewDecimal returns the decimal unscaled/10^scale, like 10021/10^2 for 100.21
+func NewDecimal(unscaled *big.Int, scale int) Decimal {
+	if scale < 0 {
+		unscaled = new(big.Int).Mul(unscaled, pow10(-scale))
+		scale = 0
+	}
+	return Decimal{unscaled: new(big.Int).Set(unscaled), scale: scale}
+}
+
+func pow10(exponent int) *big.Int {
+	return new(big.Int).Exp(ten, big.NewInt(int64(exponent)), nil)
+}
+
+func (d Decimal) int() *big.Int {
+	if d.unscaled == nil {
+		return new(big.Int)
+	}
+	return d.unscaled
+}
+
+// Scale returns the number of decimals of the number
+func (d Decimal) Scale() int {
+	return d.scale
+}
+
+// Unscaled returns the value of the number multiplied by 10^Scale, like 10021 for 100.21
+func (d Decimal) Unscaled() *big.Int {
+	return new(big.Int).Set(d.int())
+}
+
+// rescale returns the unscaled value of the number with the given number of decimals, which must not be lower than its scale
+func (d Decimal) rescale(scale int) *big.Int {
+	return new(big.Int).Mul(d.int(), pow10(scale-d.scale))
+}
+
+// Sign returns -1, 0 or 1 if the number is negative, zero or positive
+func (d Decimal) Sign() int {
+	return d.int().Sign()
+}
+
+// Cmp compares two numbers returning -1, 0 or 1 if d is lower, equal or greater than other, regardless of their scales
+func (d Decimal) Cmp(other Decimal) int {
+	scale := maxScale(d, other)
+	return d.rescale(scale).Cmp(other.rescale(scale))
+}
+
+// Equal returns true if both numbers have the same value and the same scale, so they are formatted the same way.
+// Use Cmp to compare numbers regardless of their scales.
+func (d Decimal) Equal(other Decimal) bool {
+	return d.scale == other.scale && d.int().Cmp(other.int()) == 0
+}
+
+// Add returns d+other with the greatest scale of both numbers
+func (d Decimal) Add(other Decimal) Decimal {
+	scale := maxScale(d, other)
+	return Decimal{unscaled: new(big.Int).Add(d.rescale(scale), other.rescale(scale)), scale: scale}
+}
+
+// Sub returns d-other with the greatest scale of both numbers
+func (d Decimal) Sub(other Decimal) Decimal {
+	return d.Add(other.Neg())
+}
+
+// Neg returns -d
+func (d Decimal) Neg() Decimal {
+	return Decimal{unscaled: new(big.Int).Neg(d.int()), scale: d.scale}
+}
+
+// Mul returns d*other with the sum of the scales of both numbers
+func (d Decimal) Mul(other Decimal) Decimal {
+	return Decimal{unscaled: new(big.Int).Mul(d.int(), other.int()), scale: d.scale + other.scale}
+}
+
+// Quo returns d/other rounded to the given number of decimals with the rounding mode.
+// It returns an error if other is zero.
+func (d Decimal) Quo(other Decimal, places int, mode RoundingMode) (Decimal, error) {
+	if other.Sign() == 0 {
+		return Decimal{}, errors.New("Division by zero")
+	}
+	// d/other = (d.unscaled * 10^other.scale) / (other.unscaled * 10^d.scale), scaled by 10^places
+	numerator := new(big.Int).Mul(d.int(), pow10(other.scale+places))
+	denominator := new(big.Int).Mul(other.int(), pow10(d.scale))
+	return Decimal{unscaled: roundQuotient(numerator, denominator, mode), scale: places}, nil
+}
+
+// Round returns the number with the given number of decimals, rounded with the rounding mode if it has more decimals
+// or padded with zeros if it has less
+func (d Decimal) Round(places int, mode RoundingMode) Decimal {
+	if d.scale <= places {
+		return Decimal{unscaled: d.rescale(places), scale: places}
+	}
+	return Decimal{unscaled: roundQuotient(d.int(), pow10(d.scale-places), mode), scale: places}
+}
+
+// Abs returns the absolute value of d
+func (d Decimal) Abs() Decimal {
+	return Decimal{unscaled: new(big.Int).Abs(d.int()), scale: d.scale}
+}
+
+// Rat returns the value of the number as a fraction
+func (d Decimal) Rat() *big.Rat {
+	return new(big.Rat).SetFrac(d.int(), pow10(d.scale))
+}
+
+func maxScale(a, b Decimal) int {
+	if a.scale > b.scale {
+		return a.scale
+	}
+	return b.scale
+}
+
+// String formats the number with all its decimals, like 100.21 or -0.50
+func (d Decimal) String() string {
+	digits := new(big.Int).Abs(d.int()).String()
+	if d.scale > 0 {
+		if len(digits) <= d.scale {
+			digits = strings.Repeat("0", d.scale-len(digits)+1) + digits
+		}
+		digits = digits[:len(digits)-d.scale] + "." + digits[len(digits)-d.scale:]
+	}
+	if d.Sign() < 0 {
+		return "-" + digits
+	}
+	return digits
+}
+
+// MarshalJSON encodes the number as a JSON string
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON decodes a number encoded as a JSON string or as a JSON number, keeping its decimals
+func (d *Decimal) UnmarshalJSON(data []byte) error {
+	value := string(data)
+	if strings.HasPrefix(value, `"`) {
+		if err := json.Unmarshal(data, &value); err != nil {
+			return err
+		}
+	}
+	parsed, err := ParseDecimal(value)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+// MarshalBSONValue encodes the number as a BSON string
+func (d Decimal) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	return bsontype.String, bsoncore.AppendString(nil, d.String()), nil
+}
+
+// UnmarshalBSONValue decodes a number encoded as a BSON string
+func (d *Decimal) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	if t != bsontype.String {
+		return fmt.Errorf("Decimal numbers must be encoded as BSON strings but got BSON type %s", t)
+	}
+	value, _, ok := bsoncore.ReadString(data)
+	if !ok {
+		return fmt.Errorf("Invalid BSON string")
+	}
+	parsed, err := ParseDecimal(value)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
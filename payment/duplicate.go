@@ -0,0 +1,75 @@
+package payment
+
+import (
+	"fmt"
+)
+
+// Actions taken with the suspected duplicates of existing payments
+const (
+	// RejectDuplicates rejects the payments which are suspected duplicates
+	RejectDuplicates = "reject"
+	// FlagDuplicates saves the payments which are suspected duplicates with the identifier of the original one
+	FlagDuplicates = "flag"
+)
+
+// Codes of the field errors returned by DuplicatePolicy.Validate
+const (
+	InvalidDuplicateActionCode = "invalid_duplicate_action"
+	NegativeWindowCode         = "negative_window"
+)
+
+// DuplicatePolicy defines how the payments of an organisation which duplicate existing ones are detected and handled.
+// A payment is a suspected duplicate of an existing payment of the same organisation with the same end to end reference,
+// amount, currency and beneficiary account whose processing date is within the window.
+// The check is done by the storage atomically with the creation of the payment, so concurrent duplicates are detected
+// even if they are created in different servers.
+// swagger:model
+type DuplicatePolicy struct {
+	OrganisationID string `json:"organisation_id"`
+	// Action is reject, to reject the suspected duplicates, or flag, to save them with the identifier of the original payment
+	Action string `json:"action"`
+	// WindowDays is the maximum number of days between the processing dates of a payment and its duplicates.
+	// Zero means that they must have the same processing date.
+	WindowDays int `json:"window_days"`
+}
+
+// DuplicatePaymentError is returned when a payment is rejected because it is a suspected duplicate of an existing one
+type DuplicatePaymentError struct {
+	OrganisationID string
+	OriginalID     string
+}
+
+func (e DuplicatePaymentError) Error() string {
+	return fmt.Sprintf("The payment is a suspected duplicate of payment %s according to the duplicate policy of organisation %s", e.OriginalID, e.OrganisationID)
+}
+
+// Validate checks that the organisation identifier of the policy is a UUID, that its action is reject or flag
+// and that its window is not negative.
+// It returns a ValidationError with the errors of all the invalid fields or nil if the policy is valid.
+func (p DuplicatePolicy) Validate() error {
+	var v validation
+	if v.required("organisation_id", p.OrganisationID) {
+		v.uuid("organisation_id", p.OrganisationID)
+	}
+	if v.required("action", p.Action) && p.Action != RejectDuplicates && p.Action != FlagDuplicates {
+		v.add("action", InvalidDuplicateActionCode, "%q is not %s or %s", p.Action, RejectDuplicates, FlagDuplicates)
+	}
+	if p.WindowDays < 0 {
+		v.add("window_days", NegativeWindowCode, "The window can't be negative")
+	}
+
+	if len(v.errors) > 0 {
+		return ValidationError{Errors: v.errors}
+	}
+	return nil
+}
+
+// Duplicate returns a copy of the payment flagged as a suspected duplicate of the original one,
+// or as it is if the policy rejects the duplicates, in which case a DuplicatePaymentError is returned
+func (p DuplicatePolicy) Duplicate(pay Payment, originalID string) (Payment, error) {
+	if p.Action == RejectDuplicates {
+		return pay, DuplicatePaymentError{OrganisationID: p.OrganisationID, OriginalID: originalID}
+	}
+	pay.SuspectedDuplicateOf = originalID
+	return pay, nil
+}
@@ -0,0 +1,46 @@
+package payment
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDuplicatePolicy(t *testing.T) {
+	pay := Payment{ID: "a8a8a3b5-3a2b-4f63-9b8e-2f4f1a0c6f11"}
+	original := "1f4bd6d4-7ed7-4b39-8a5b-93e7b2a4a2c3"
+
+	flag := DuplicatePolicy{OrganisationID: "743d5b63-8e6f-432e-a8fa-c5d8d2ee5fcb", Action: FlagDuplicates, WindowDays: 1}
+	if err := flag.Validate(); err != nil {
+		t.Fatalf("Unexpected error validating policy: %s", err.Error())
+	}
+	flagged, err := flag.Duplicate(pay, original)
+	if err != nil || flagged.SuspectedDuplicateOf != original {
+		t.Errorf("Expected payment to be flagged as a duplicate of %s but got %s and error %v", original, flagged.SuspectedDuplicateOf, err)
+	}
+
+	reject := DuplicatePolicy{OrganisationID: flag.OrganisationID, Action: RejectDuplicates}
+	rejected, err := reject.Duplicate(pay, original)
+	expectedError := DuplicatePaymentError{OrganisationID: reject.OrganisationID, OriginalID: original}
+	if err != expectedError || rejected.SuspectedDuplicateOf != "" {
+		t.Errorf("Expected duplicate payment to be rejected but got %v", err)
+	}
+
+	invalid := DuplicatePolicy{OrganisationID: "organisation", Action: "ignore", WindowDays: -1}
+	validationError, ok := invalid.Validate().(ValidationError)
+	if !ok {
+		t.Fatalf("Expected ValidationError validating an invalid policy")
+	}
+	got := make(map[string]string)
+	for _, fieldError := range validationError.Errors {
+		got[fieldError.Field] = fieldError.Code
+	}
+	expected := map[string]string{
+		"organisation_id": InvalidUUIDCode,
+		"action":          InvalidDuplicateActionCode,
+		"window_days":     NegativeWindowCode,
+	}
+	if !cmp.Equal(got, expected) {
+		t.Fatalf("Unexpected field errors.\nExpected:\n%v\nBut got:\n%v", expected, got)
+	}
+}
@@ -0,0 +1,153 @@
+package payment
+
+import (
+	"fmt"
+)
+
+// RateQuote determines how the exchange rate of a payment is quoted
+type RateQuote int
+
+const (
+	// UnitsPerOriginal rates are the amount of the payment currency which is obtained for one unit of the original currency,
+	// so the amount of the payment is the original amount multiplied by the rate. It is the zero value.
+	UnitsPerOriginal RateQuote = iota
+	// OriginalPerUnit rates are the amount of the original currency which is exchanged for one unit of the payment currency,
+	// so the amount of the payment is the original amount divided by the rate
+	OriginalPerUnit
+)
+
+// Codes of the FX errors returned by Validate
+const (
+	InconsistentFXCode = "inconsistent_fx"
+)
+
+// FXChecker checks that the amount of a payment is its original amount converted at its exchange rate.
+// The converted amount is rounded to the minor unit of the payment currency with the rounding mode
+// and it must not differ from the payment amount more than the tolerances allow.
+// The zero value checks rates quoted as UnitsPerOriginal rounding half to even without any tolerance.
+type FXChecker struct {
+	Quote    RateQuote
+	Rounding RoundingMode
+	// Tolerance is the maximum absolute difference allowed between the amount and the converted amount, like 0.01
+	Tolerance Decimal
+	// RelativeTolerance is the maximum difference allowed between the amount and the converted amount
+	// as a fraction of the amount, like 0.001 for 0.1%. Differences within any of both tolerances are allowed.
+	RelativeTolerance Decimal
+}
+
+// FXCheckResult is the result of checking the exchange information of a payment
+// swagger:model
+type FXCheckResult struct {
+	// Checked is false if the payment doesn't have exchange information, in which case there's nothing to check
+	Checked bool `json:"checked"`
+	// Consistent is true if the exchange information was checked and the amount matches the converted amount
+	Consistent     bool   `json:"consistent"`
+	Amount         string `json:"amount,omitempty"`
+	Currency       string `json:"currency,omitempty"`
+	OriginalAmount string `json:"original_amount,omitempty"`
+	// OriginalCurrency is the currency of the original amount
+	OriginalCurrency string `json:"original_currency,omitempty"`
+	ExchangeRate     string `json:"exchange_rate,omitempty"`
+	Quote            string `json:"quote,omitempty"`
+	Rounding         string `json:"rounding,omitempty"`
+	// ConvertedAmount is the original amount converted at the exchange rate and rounded to the minor unit of the currency
+	ConvertedAmount string `json:"converted_amount,omitempty"`
+	// Difference is the amount minus the converted amount
+	Difference string `json:"difference,omitempty"`
+	// AllowedDifference is the maximum difference allowed by the tolerances for the amount
+	AllowedDifference string `json:"allowed_difference,omitempty"`
+	// Errors contains the problems which made the payment inconsistent or prevented checking it
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+func (q RateQuote) String() string {
+	if q == OriginalPerUnit {
+		return "original-per-unit"
+	}
+	return "units-per-original"
+}
+
+// ParseRateQuote returns the rate quote with the given name, which is units-per-original or original-per-unit
+func ParseRateQuote(name string) (RateQuote, error) {
+	for _, quote := range []RateQuote{UnitsPerOriginal, OriginalPerUnit} {
+		if quote.String() == name {
+			return quote, nil
+		}
+	}
+	return UnitsPerOriginal, fmt.Errorf("Unknown rate quote %q", name)
+}
+
+// HasFX returns true if the payment has any exchange information
+func (f PaymentExchangeInformationType) HasFX() bool {
+	return f.OriginalAmount != "" || f.OriginalCurrency != "" || f.ExchangeRate != ""
+}
+
+// Check checks the exchange information of the payment. Payments without original amount, original currency
+// and exchange rate are not checked. Otherwise the three of them are required, the amounts and the rate must be
+// positive decimal numbers and the currencies ISO 4217 codes.
+func (c FXChecker) Check(pay Payment) FXCheckResult {
+	attributes := pay.Attributes
+	fx := attributes.FX
+	result := FXCheckResult{
+		Checked:          fx.HasFX(),
+		Amount:           attributes.Amount,
+		Currency:         attributes.Currency,
+		OriginalAmount:   fx.OriginalAmount,
+		OriginalCurrency: fx.OriginalCurrency,
+		ExchangeRate:     fx.ExchangeRate,
+	}
+	if !result.Checked {
+		return result
+	}
+	result.Quote = c.Quote.String()
+	result.Rounding = c.Rounding.String()
+
+	var v validation
+	amount, amountOK := v.positiveMoney("attributes.amount", attributes.Amount, "attributes.currency", attributes.Currency)
+	original, originalOK := v.positiveMoney("attributes.fx.original_amount", fx.OriginalAmount, "attributes.fx.original_currency", fx.OriginalCurrency)
+	var rate Decimal
+	rateOK := v.required("attributes.fx.exchange_rate", fx.ExchangeRate)
+	if rateOK {
+		rate, rateOK = v.positiveDecimal("attributes.fx.exchange_rate", fx.ExchangeRate)
+	}
+	if !amountOK || !originalOK || !rateOK {
+		result.Errors = v.errors
+		return result
+	}
+
+	converted := original.Amount.Mul(rate).Round(amount.MinorUnits(), c.Rounding)
+	if c.Quote == OriginalPerUnit {
+		converted, _ = original.Amount.Quo(rate, amount.MinorUnits(), c.Rounding)
+	}
+	difference := amount.Amount.Sub(converted)
+	allowed := c.Tolerance
+	if relative := amount.Amount.Mul(c.RelativeTolerance); relative.Cmp(allowed) > 0 {
+		allowed = relative
+	}
+	result.ConvertedAmount = converted.String()
+	result.Difference = difference.String()
+	result.AllowedDifference = allowed.String()
+	result.Consistent = difference.Abs().Cmp(allowed) <= 0
+	if !result.Consistent {
+		v.add("attributes.fx", InconsistentFXCode, "%s %s at an exchange rate of %s (%s) is %s %s, which differs from the amount %s %s by more than %s",
+			original.Amount, original.Currency, rate, c.Quote, converted, amount.Currency, amount.Amount, amount.Currency, allowed)
+		result.Errors = v.errors
+	}
+	return result
+}
+
+// positiveMoney adds the errors of an amount and its currency, which must be a positive decimal number
+// and an ISO 4217 currency code, and returns the amount and true if both of them are valid
+func (v *validation) positiveMoney(amountField, amount, currencyField, currency string) (Money, bool) {
+	valid := v.required(amountField, amount)
+	var decimal Decimal
+	if valid {
+		decimal, valid = v.positiveDecimal(amountField, amount)
+	}
+	if v.required(currencyField, currency) {
+		valid = v.currency(currencyField, currency) && valid
+	} else {
+		valid = false
+	}
+	return Money{Amount: decimal, Currency: currency}, valid
+}
@@ -0,0 +1,127 @@
+package payment
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDecimalRounding(t *testing.T) {
+	tests := []struct {
+		value    string
+		mode     RoundingMode
+		expected string
+	}{
+		{"2.345", RoundHalfEven, "2.34"},
+		{"2.355", RoundHalfEven, "2.36"},
+		{"2.345", RoundHalfUp, "2.35"},
+		{"2.345", RoundHalfDown, "2.34"},
+		{"2.3451", RoundHalfDown, "2.35"},
+		{"2.341", RoundUp, "2.35"},
+		{"2.349", RoundDown, "2.34"},
+		{"-2.341", RoundCeiling, "-2.34"},
+		{"-2.341", RoundFloor, "-2.35"},
+		{"-2.345", RoundHalfUp, "-2.35"},
+		{"2.3", RoundHalfEven, "2.30"},
+	}
+	for _, test := range tests {
+		rounded := MustParseDecimal(test.value).Round(2, test.mode)
+		if rounded.String() != test.expected {
+			t.Errorf("Expected %s rounded %s to be %s but got %s", test.value, test.mode, test.expected, rounded)
+		}
+	}
+
+	quotient, err := MustParseDecimal("200.42").Quo(MustParseDecimal("3"), 2, RoundHalfEven)
+	if err != nil || quotient.String() != "66.81" {
+		t.Errorf("Expected 200.42 / 3 to be 66.81 but got %s (%v)", quotient, err)
+	}
+	if _, err := MustParseDecimal("1").Quo(Decimal{}, 2, RoundHalfEven); err == nil {
+		t.Error("Expected error dividing by zero")
+	}
+	if product := MustParseDecimal("1.5").Mul(MustParseDecimal("-0.25")); product.String() != "-0.375" {
+		t.Errorf("Expected 1.5 * -0.25 to be -0.375 but got %s", product)
+	}
+
+	for mode, name := range roundingModeNames {
+		if parsed, err := ParseRoundingMode(name); err != nil || parsed != mode {
+			t.Errorf("Expected rounding mode %s to be parsed but got %v (%v)", name, parsed, err)
+		}
+	}
+	if _, err := ParseRoundingMode("nearest"); err == nil {
+		t.Error("Expected error parsing an unknown rounding mode")
+	}
+}
+
+func TestFXCheck(t *testing.T) {
+	pay, err := GetDefaultTestPayment("../test_resources")
+	if err != nil {
+		t.Fatalf("Error getting test payment: %s", err.Error())
+	}
+	// The amount of the test payment is its original amount divided by the rate, so it is inconsistent
+	// with the default quote, which multiplies them
+	result := FXChecker{}.Check(pay)
+	if !result.Checked || result.Consistent || result.Quote != UnitsPerOriginal.String() {
+		t.Fatalf("Expected the test payment to be inconsistent with the default quote but got %v", result)
+	}
+	if result.ConvertedAmount != "400.84" || result.Difference != "-300.63" || result.AllowedDifference != "0" {
+		t.Errorf("Expected the test payment to be converted to 400.84 and differ by -300.63 but got %v", result)
+	}
+	if len(result.Errors) != 1 || result.Errors[0].Field != "attributes.fx" || result.Errors[0].Code != InconsistentFXCode {
+		t.Errorf("Expected an %s error checking the test payment but got %v", InconsistentFXCode, result.Errors)
+	}
+	result = FXChecker{Quote: OriginalPerUnit}.Check(pay)
+	if !result.Checked || !result.Consistent || result.ConvertedAmount != "100.21" || len(result.Errors) != 0 {
+		t.Fatalf("Expected the test payment to be consistent with rates quoted as %s but got %v", OriginalPerUnit, result)
+	}
+
+	tests := []struct {
+		checker         FXChecker
+		amount          string
+		rate            string
+		consistent      bool
+		convertedAmount string
+	}{
+		{FXChecker{Quote: OriginalPerUnit}, "100.20", "2.00000", false, "100.21"},
+		{FXChecker{Quote: OriginalPerUnit, Tolerance: MustParseDecimal("0.01")}, "100.20", "2.00000", true, "100.21"},
+		{FXChecker{Quote: OriginalPerUnit, RelativeTolerance: MustParseDecimal("0.001")}, "100.11", "2.00000", true, "100.21"},
+		{FXChecker{Quote: OriginalPerUnit, RelativeTolerance: MustParseDecimal("0.001")}, "100.10", "2.00000", false, "100.21"},
+		{FXChecker{}, "400.84", "2.00000", true, "400.84"},
+		{FXChecker{}, "100.21", "0.5", true, "100.21"},
+		{FXChecker{Quote: OriginalPerUnit}, "66.81", "3", true, "66.81"},
+		{FXChecker{Quote: OriginalPerUnit, Rounding: RoundDown}, "66.80", "3", true, "66.80"},
+		{FXChecker{Quote: OriginalPerUnit, Rounding: RoundHalfEven}, "50.10", "4", true, "50.10"},
+		{FXChecker{Quote: OriginalPerUnit, Rounding: RoundHalfUp}, "50.10", "4", false, "50.11"},
+	}
+	for _, test := range tests {
+		checked := pay
+		checked.Attributes.Amount = test.amount
+		checked.Attributes.FX.ExchangeRate = test.rate
+		result := test.checker.Check(checked)
+		if result.Consistent != test.consistent || result.ConvertedAmount != test.convertedAmount {
+			t.Errorf("Unexpected check of %s at %s with %+v: %+v", test.amount, test.rate, test.checker, result)
+		}
+		if !result.Consistent && (len(result.Errors) != 1 || result.Errors[0].Code != InconsistentFXCode) {
+			t.Errorf("Expected an %s error checking %s at %s but got %v", InconsistentFXCode, test.amount, test.rate, result.Errors)
+		}
+	}
+
+	incomplete := pay
+	incomplete.Attributes.FX = PaymentExchangeInformationType{OriginalAmount: "200.42", ExchangeRate: "0"}
+	result = FXChecker{}.Check(incomplete)
+	got := make(map[string]string)
+	for _, fieldError := range result.Errors {
+		got[fieldError.Field] = fieldError.Code
+	}
+	expected := map[string]string{
+		"attributes.fx.original_currency": RequiredCode,
+		"attributes.fx.exchange_rate":     NotPositiveCode,
+	}
+	if result.Consistent || !cmp.Equal(got, expected) {
+		t.Errorf("Unexpected check of incomplete exchange information. Expected errors %v but got %v", expected, got)
+	}
+
+	pay.Attributes.FX = PaymentExchangeInformationType{}
+	if result := (FXChecker{}).Check(pay); result.Checked || result.Consistent || len(result.Errors) != 0 {
+		t.Errorf("Expected payment without exchange information not to be checked but got %v", result)
+	}
+}
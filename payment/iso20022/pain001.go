@@ -0,0 +1,432 @@
+// Package iso20022 renders payments as ISO 20022 messages, like the pain.001 customer credit transfer initiation
+// which banks accept to make the payments of their customers
+package iso20022
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getaceres/payment-demo/payment"
+	"github.com/getaceres/payment-demo/payment/bank"
+)
+
+const (
+	// Pain001Namespace is the namespace of the pain.001.001.09 documents
+	Pain001Namespace = "urn:iso:std:iso:20022:tech:xsd:pain.001.001.09"
+	// Pain001MediaType is the media type of the pain.001 documents
+	Pain001MediaType = "application/pain.001+xml"
+	// NotProvided is used in the mandatory identifiers which the payments don't have, as recommended by the usage guidelines
+	NotProvided = "NOTPROVIDED"
+)
+
+// Maximum lengths of the text fields of the pain.001 documents
+const (
+	maxIdentifierLength = 35
+	maxNameLength       = 140
+	maxAddressLine      = 70
+	maxAddressLines     = 7
+	maxRemittanceLength = 140
+)
+
+// chargeBearers maps the bearer codes of the payments to the pain.001 charge bearer codes.
+// The SWIFT MT codes SHA, OUR and BEN are accepted too. Payments without bearer code follow the service level.
+var chargeBearers = map[string]string{
+	"":     "SLEV",
+	"SLEV": "SLEV",
+	"SHAR": "SHAR",
+	"SHA":  "SHAR",
+	"DEBT": "DEBT",
+	"OUR":  "DEBT",
+	"CRED": "CRED",
+	"BEN":  "CRED",
+}
+
+// Document is a pain.001.001.09 customer credit transfer initiation document
+type Document struct {
+	XMLName    xml.Name                         `xml:"urn:iso:std:iso:20022:tech:xsd:pain.001.001.09 Document"`
+	Initiation CustomerCreditTransferInitiation `xml:"CstmrCdtTrfInitn"`
+}
+
+// CustomerCreditTransferInitiation contains the payment instructions of the document
+type CustomerCreditTransferInitiation struct {
+	GroupHeader  GroupHeader          `xml:"GrpHdr"`
+	Instructions []PaymentInstruction `xml:"PmtInf"`
+}
+
+// GroupHeader identifies the document and contains the number and the sum of the amounts of its transactions
+type GroupHeader struct {
+	MessageID            string `xml:"MsgId"`
+	CreationDateTime     string `xml:"CreDtTm"`
+	NumberOfTransactions string `xml:"NbOfTxs"`
+	ControlSum           string `xml:"CtrlSum"`
+	InitiatingParty      Party  `xml:"InitgPty"`
+}
+
+// PaymentInstruction contains the transactions from the same debtor account which must be executed on the same date
+type PaymentInstruction struct {
+	ID                     string        `xml:"PmtInfId"`
+	Method                 string        `xml:"PmtMtd"`
+	NumberOfTransactions   string        `xml:"NbOfTxs"`
+	ControlSum             string        `xml:"CtrlSum"`
+	RequestedExecutionDate DateChoice    `xml:"ReqdExctnDt"`
+	Debtor                 Party         `xml:"Dbtr"`
+	DebtorAccount          CashAccount   `xml:"DbtrAcct"`
+	DebtorAgent            Agent         `xml:"DbtrAgt"`
+	Transactions           []Transaction `xml:"CdtTrfTxInf"`
+}
+
+// DateChoice is a date in YYYY-MM-DD format
+type DateChoice struct {
+	Date string `xml:"Dt"`
+}
+
+// Transaction is the credit transfer of a payment
+type Transaction struct {
+	PaymentID       PaymentIdentification `xml:"PmtId"`
+	Amount          Amount                `xml:"Amt"`
+	ChargeBearer    string                `xml:"ChrgBr"`
+	CreditorAgent   *Agent                `xml:"CdtrAgt,omitempty"`
+	Creditor        Party                 `xml:"Cdtr"`
+	CreditorAccount CashAccount           `xml:"CdtrAcct"`
+	RemittanceInfo  *RemittanceInfo       `xml:"RmtInf,omitempty"`
+}
+
+// PaymentIdentification contains the identifier of the payment and the end to end identifier passed to the creditor
+type PaymentIdentification struct {
+	InstructionID string `xml:"InstrId,omitempty"`
+	EndToEndID    string `xml:"EndToEndId"`
+}
+
+// Amount contains the instructed amount of a transaction
+type Amount struct {
+	Instructed CurrencyAmount `xml:"InstdAmt"`
+}
+
+// CurrencyAmount is an amount with its currency
+type CurrencyAmount struct {
+	Currency string `xml:"Ccy,attr"`
+	Value    string `xml:",chardata"`
+}
+
+// Party is the debtor, the creditor or the initiating party
+type Party struct {
+	Name          string         `xml:"Nm,omitempty"`
+	PostalAddress *PostalAddress `xml:"PstlAdr,omitempty"`
+}
+
+// PostalAddress contains the lines of an unstructured address
+type PostalAddress struct {
+	Lines []string `xml:"AdrLine"`
+}
+
+// CashAccount identifies the account of the debtor or the creditor
+type CashAccount struct {
+	ID   AccountIdentification `xml:"Id"`
+	Name string                `xml:"Nm,omitempty"`
+}
+
+// AccountIdentification is an IBAN or another account number
+type AccountIdentification struct {
+	IBAN  string                 `xml:"IBAN,omitempty"`
+	Other *GenericIdentification `xml:"Othr,omitempty"`
+}
+
+// GenericIdentification is an account number with the code of its scheme, like BBAN
+type GenericIdentification struct {
+	ID     string      `xml:"Id"`
+	Scheme *SchemeName `xml:"SchmeNm,omitempty"`
+}
+
+// SchemeName contains the code of an identification scheme
+type SchemeName struct {
+	Code string `xml:"Cd"`
+}
+
+// Agent is the bank of the debtor or the creditor
+type Agent struct {
+	FinancialInstitution FinancialInstitution `xml:"FinInstnId"`
+}
+
+// FinancialInstitution identifies a bank by its BIC, its member identifier in a clearing system, like a UK sort code,
+// or any other identifier
+type FinancialInstitution struct {
+	BIC                    string                  `xml:"BICFI,omitempty"`
+	ClearingSystemMemberID *ClearingSystemMemberID `xml:"ClrSysMmbId,omitempty"`
+	Other                  *GenericIdentification  `xml:"Othr,omitempty"`
+}
+
+// ClearingSystemMemberID is the identifier of a bank in a clearing system, like GBDSC for UK sort codes
+type ClearingSystemMemberID struct {
+	ClearingSystem SchemeName `xml:"ClrSysId"`
+	MemberID       string     `xml:"MmbId"`
+}
+
+// RemittanceInfo contains the unstructured remittance information of a transaction
+type RemittanceInfo struct {
+	Unstructured []string `xml:"Ustrd"`
+}
+
+// instructionKey identifies the payments which are grouped in the same payment instruction
+type instructionKey struct {
+	name, address, accountName, accountNumber, accountNumberCode, bankID, bankIDCode, date string
+}
+
+// NewDocument returns the pain.001 document with the credit transfers of the payments, which must belong to the same organisation.
+// The payments from the same debtor account on the same processing date are grouped in the same payment instruction.
+// It returns an error if the message identifier is not valid or if any payment can't be transferred,
+// because it has no valid amount, debtor account or beneficiary account.
+func NewDocument(messageID string, created time.Time, payments []payment.Payment) (*Document, error) {
+	if messageID == "" || len(messageID) > maxIdentifierLength {
+		return nil, fmt.Errorf("The message identifier must have from 1 to %d characters", maxIdentifierLength)
+	}
+	if len(payments) == 0 {
+		return nil, fmt.Errorf("There are no payments to transfer")
+	}
+
+	document := &Document{XMLName: xml.Name{Space: Pain001Namespace, Local: "Document"}}
+	indexes := make(map[instructionKey]int)
+	total := payment.Decimal{}
+	for _, pay := range payments {
+		if pay.OrganisationID != payments[0].OrganisationID {
+			return nil, fmt.Errorf("Payment %s belongs to organisation %s instead of %s", pay.ID, pay.OrganisationID, payments[0].OrganisationID)
+		}
+		transaction, amount, err := newTransaction(pay)
+		if err != nil {
+			return nil, fmt.Errorf("Payment %s can't be transferred: %s", pay.ID, err.Error())
+		}
+		total = total.Add(amount)
+
+		key := newInstructionKey(pay)
+		index, ok := indexes[key]
+		if !ok {
+			instruction, err := newInstruction(pay, strconv.Itoa(len(document.Initiation.Instructions)+1), created)
+			if err != nil {
+				return nil, fmt.Errorf("Payment %s can't be transferred: %s", pay.ID, err.Error())
+			}
+			index = len(document.Initiation.Instructions)
+			indexes[key] = index
+			document.Initiation.Instructions = append(document.Initiation.Instructions, instruction)
+		}
+		instruction := &document.Initiation.Instructions[index]
+		instruction.Transactions = append(instruction.Transactions, transaction)
+	}
+
+	for i := range document.Initiation.Instructions {
+		instruction := &document.Initiation.Instructions[i]
+		sum := payment.Decimal{}
+		for _, transaction := range instruction.Transactions {
+			sum = sum.Add(payment.MustParseDecimal(transaction.Amount.Instructed.Value))
+		}
+		instruction.NumberOfTransactions = strconv.Itoa(len(instruction.Transactions))
+		instruction.ControlSum = sum.String()
+	}
+	document.Initiation.GroupHeader = GroupHeader{
+		MessageID:            messageID,
+		CreationDateTime:     created.UTC().Format(time.RFC3339),
+		NumberOfTransactions: strconv.Itoa(len(payments)),
+		ControlSum:           total.String(),
+		InitiatingParty:      Party{Name: payments[0].OrganisationID},
+	}
+	return document, nil
+}
+
+// Write renders the pain.001 document with the credit transfers of the payments as indented XML
+func Write(w io.Writer, messageID string, created time.Time, payments []payment.Payment) error {
+	document, err := NewDocument(messageID, created, payments)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(document); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
+
+// MessageID returns a message identifier derived from the identifier of a payment, which is a UUID
+// longer than the identifiers of the pain.001 documents
+func MessageID(paymentID string) string {
+	return strings.Replace(paymentID, "-", "", -1)
+}
+
+func newInstructionKey(pay payment.Payment) instructionKey {
+	debtor := pay.Attributes.DebtorParty
+	return instructionKey{
+		name:              debtor.Name,
+		address:           debtor.Address,
+		accountName:       debtor.AccountName,
+		accountNumber:     debtor.AccountNumber,
+		accountNumberCode: debtor.AccountNumberCode,
+		bankID:            debtor.BankID,
+		bankIDCode:        debtor.BankIDCode,
+		date:              pay.Attributes.ProcessingDate,
+	}
+}
+
+// newInstruction returns the payment instruction of the debtor of the payment without transactions.
+// Payments without processing date are executed on the date the document is created.
+func newInstruction(pay payment.Payment, id string, created time.Time) (PaymentInstruction, error) {
+	debtor := pay.Attributes.DebtorParty
+	date := pay.Attributes.ProcessingDate
+	if date == "" {
+		date = created.UTC().Format(payment.DateLayout)
+	} else if _, err := time.Parse(payment.DateLayout, date); err != nil {
+		return PaymentInstruction{}, fmt.Errorf("%q is not a processing date like 2019-01-31", date)
+	}
+	account, err := newCashAccount("debtor", debtor)
+	if err != nil {
+		return PaymentInstruction{}, err
+	}
+	agent := newAgent(debtor)
+	if agent == nil {
+		agent = &Agent{FinancialInstitution: FinancialInstitution{Other: &GenericIdentification{ID: NotProvided}}}
+	}
+	return PaymentInstruction{
+		ID:                     id,
+		Method:                 "TRF",
+		RequestedExecutionDate: DateChoice{Date: date},
+		Debtor:                 newParty(debtor),
+		DebtorAccount:          account,
+		DebtorAgent:            *agent,
+	}, nil
+}
+
+// newTransaction returns the credit transfer of the payment and its amount
+func newTransaction(pay payment.Payment) (Transaction, payment.Decimal, error) {
+	attributes := pay.Attributes
+	amount, err := attributes.AmountMoney()
+	if err != nil {
+		return Transaction{}, amount.Amount, err
+	}
+	if amount.Amount.Sign() <= 0 {
+		return Transaction{}, amount.Amount, fmt.Errorf("%s is not a positive amount", amount)
+	}
+	bearer, ok := chargeBearers[attributes.ChargesInformation.BearerCode]
+	if !ok {
+		return Transaction{}, amount.Amount, fmt.Errorf("%q is not a bearer code like SHAR, DEBT or CRED", attributes.ChargesInformation.BearerCode)
+	}
+	endToEndID := attributes.EndToEndReference
+	if endToEndID == "" {
+		endToEndID = NotProvided
+	} else if len(endToEndID) > maxIdentifierLength {
+		return Transaction{}, amount.Amount, fmt.Errorf("The end to end reference is longer than %d characters", maxIdentifierLength)
+	}
+	account, err := newCashAccount("beneficiary", attributes.BeneficiaryParty)
+	if err != nil {
+		return Transaction{}, amount.Amount, err
+	}
+
+	transaction := Transaction{
+		PaymentID:       PaymentIdentification{InstructionID: MessageID(pay.ID), EndToEndID: endToEndID},
+		Amount:          Amount{Instructed: CurrencyAmount{Currency: amount.Currency, Value: amount.Amount.String()}},
+		ChargeBearer:    bearer,
+		CreditorAgent:   newAgent(attributes.BeneficiaryParty),
+		Creditor:        newParty(attributes.BeneficiaryParty),
+		CreditorAccount: account,
+	}
+	if lines := split(attributes.Reference, maxRemittanceLength); len(lines) > 0 {
+		transaction.RemittanceInfo = &RemittanceInfo{Unstructured: lines}
+	}
+	return transaction, amount.Amount, nil
+}
+
+// newParty returns the name and the address of the party. The account name is used if the party has no name.
+func newParty(party payment.PaymentPartyType) Party {
+	name := party.Name
+	if name == "" {
+		name = party.AccountName
+	}
+	result := Party{Name: truncate(name, maxNameLength)}
+	if lines := split(party.Address, maxAddressLine); len(lines) > 0 {
+		if len(lines) > maxAddressLines {
+			lines = lines[:maxAddressLines]
+		}
+		result.PostalAddress = &PostalAddress{Lines: lines}
+	}
+	return result
+}
+
+// newCashAccount returns the IBAN or the BBAN of the party
+func newCashAccount(role string, party payment.PaymentPartyType) (CashAccount, error) {
+	account := CashAccount{Name: truncate(party.AccountName, maxNameLength)}
+	switch {
+	case party.AccountNumber == "":
+		return account, fmt.Errorf("The %s party has no account number", role)
+	case party.AccountNumberCode == bank.IBANCode:
+		account.ID.IBAN = party.AccountNumber
+	case len(party.AccountNumber) > 34:
+		return account, fmt.Errorf("The account number of the %s party is longer than 34 characters", role)
+	default:
+		account.ID.Other = &GenericIdentification{ID: party.AccountNumber, Scheme: &SchemeName{Code: bank.BBANCode}}
+	}
+	return account, nil
+}
+
+// newAgent returns the bank of the party identified by its BIC or its clearing system member identifier,
+// like a UK sort code, or nil if the party has no bank identifier
+func newAgent(party payment.PaymentPartyType) *Agent {
+	if party.BankID == "" {
+		return nil
+	}
+	var institution FinancialInstitution
+	switch {
+	case party.BankIDCode == bank.BICBankIDCode:
+		institution.BIC = party.BankID
+	case party.BankIDCode != "" && len(party.BankIDCode) <= 5:
+		institution.ClearingSystemMemberID = &ClearingSystemMemberID{
+			ClearingSystem: SchemeName{Code: party.BankIDCode},
+			MemberID:       truncate(party.BankID, maxIdentifierLength),
+		}
+	default:
+		institution.Other = &GenericIdentification{ID: truncate(party.BankID, maxIdentifierLength)}
+	}
+	return &Agent{FinancialInstitution: institution}
+}
+
+// split divides the text in lines of at most the given length, breaking them between words when possible
+func split(text string, length int) []string {
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(text) {
+		for len([]rune(word)) > length {
+			if line != "" {
+				lines = append(lines, line)
+				line = ""
+			}
+			runes := []rune(word)
+			lines = append(lines, string(runes[:length]))
+			word = string(runes[length:])
+		}
+		switch {
+		case line == "":
+			line = word
+		case len([]rune(line))+1+len([]rune(word)) <= length:
+			line += " " + word
+		default:
+			lines = append(lines, line)
+			line = word
+		}
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// truncate cuts the text to the given number of characters
+func truncate(text string, length int) string {
+	runes := []rune(text)
+	if len(runes) > length {
+		return string(runes[:length])
+	}
+	return text
+}
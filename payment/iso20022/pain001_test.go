@@ -0,0 +1,215 @@
+package iso20022
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getaceres/payment-demo/payment"
+	"github.com/google/go-cmp/cmp"
+)
+
+func getTestPayment(t *testing.T) payment.Payment {
+	pay, err := payment.GetDefaultTestPayment("../../test_resources")
+	if err != nil {
+		t.Fatalf("Error reading test payment: %s", err.Error())
+	}
+	return pay
+}
+
+func TestNewDocument(t *testing.T) {
+	created := time.Date(2019, 5, 10, 12, 30, 0, 0, time.UTC)
+	first := getTestPayment(t)
+	second := first
+	second.ID = "8f3ea9c6-2b5e-4c8a-9a57-4b1f0c6e2d11"
+	second.Attributes.Amount = "50.00"
+	second.Attributes.EndToEndReference = ""
+	second.Attributes.Reference = ""
+	second.Attributes.ChargesInformation.BearerCode = "CRED"
+	second.Attributes.BeneficiaryParty = payment.PaymentPartyType{
+		AccountNumber:     "DE89370400440532013000",
+		AccountNumberCode: "IBAN",
+		BankID:            "COBADEFFXXX",
+		BankIDCode:        "SWBIC",
+		Name:              "Max Mustermann",
+	}
+	third := first
+	third.ID = "c1d2e3f4-0000-4000-8000-000000000003"
+	third.Attributes.ProcessingDate = "2017-01-19"
+	third.Attributes.ChargesInformation.BearerCode = ""
+
+	document, err := NewDocument("MSG-1", created, []payment.Payment{first, second, third})
+	if err != nil {
+		t.Fatalf("Error creating document: %s", err.Error())
+	}
+
+	debtor := Party{Name: "Emelia Jane Brown", PostalAddress: &PostalAddress{Lines: []string{"10 Debtor Crescent Sourcetown NE1"}}}
+	debtorAccount := CashAccount{ID: AccountIdentification{IBAN: "GB83XABC10161234567801"}, Name: "EJ Brown Black"}
+	debtorAgent := Agent{FinancialInstitution: FinancialInstitution{
+		ClearingSystemMemberID: &ClearingSystemMemberID{ClearingSystem: SchemeName{Code: "GBDSC"}, MemberID: "203301"},
+	}}
+	owens := Transaction{
+		PaymentID:    PaymentIdentification{InstructionID: "4ee3a8d8ca7b4290a52cdd5b6165ec43", EndToEndID: "Wil piano Jan"},
+		Amount:       Amount{Instructed: CurrencyAmount{Currency: "GBP", Value: "100.21"}},
+		ChargeBearer: "SHAR",
+		CreditorAgent: &Agent{FinancialInstitution: FinancialInstitution{
+			ClearingSystemMemberID: &ClearingSystemMemberID{ClearingSystem: SchemeName{Code: "GBDSC"}, MemberID: "403000"},
+		}},
+		Creditor: Party{Name: "Wilfred Jeremiah Owens", PostalAddress: &PostalAddress{Lines: []string{"1 The Beneficiary Localtown SE2"}}},
+		CreditorAccount: CashAccount{
+			ID:   AccountIdentification{Other: &GenericIdentification{ID: "31926819", Scheme: &SchemeName{Code: "BBAN"}}},
+			Name: "W Owens",
+		},
+		RemittanceInfo: &RemittanceInfo{Unstructured: []string{"Payment for Em's piano lessons"}},
+	}
+	later := owens
+	later.PaymentID.InstructionID = "c1d2e3f4000040008000000000000003"
+	later.ChargeBearer = "SLEV"
+
+	expected := &Document{
+		XMLName: xml.Name{Space: Pain001Namespace, Local: "Document"},
+		Initiation: CustomerCreditTransferInitiation{
+			GroupHeader: GroupHeader{
+				MessageID:            "MSG-1",
+				CreationDateTime:     "2019-05-10T12:30:00Z",
+				NumberOfTransactions: "3",
+				ControlSum:           "250.42",
+				InitiatingParty:      Party{Name: "743d5b63-8e6f-432e-a8fa-c5d8d2ee5fcb"},
+			},
+			Instructions: []PaymentInstruction{
+				{
+					ID:                     "1",
+					Method:                 "TRF",
+					NumberOfTransactions:   "2",
+					ControlSum:             "150.21",
+					RequestedExecutionDate: DateChoice{Date: "2017-01-18"},
+					Debtor:                 debtor,
+					DebtorAccount:          debtorAccount,
+					DebtorAgent:            debtorAgent,
+					Transactions: []Transaction{
+						owens,
+						{
+							PaymentID:       PaymentIdentification{InstructionID: "8f3ea9c62b5e4c8a9a574b1f0c6e2d11", EndToEndID: NotProvided},
+							Amount:          Amount{Instructed: CurrencyAmount{Currency: "GBP", Value: "50.00"}},
+							ChargeBearer:    "CRED",
+							CreditorAgent:   &Agent{FinancialInstitution: FinancialInstitution{BIC: "COBADEFFXXX"}},
+							Creditor:        Party{Name: "Max Mustermann"},
+							CreditorAccount: CashAccount{ID: AccountIdentification{IBAN: "DE89370400440532013000"}},
+						},
+					},
+				},
+				{
+					ID:                     "2",
+					Method:                 "TRF",
+					NumberOfTransactions:   "1",
+					ControlSum:             "100.21",
+					RequestedExecutionDate: DateChoice{Date: "2017-01-19"},
+					Debtor:                 debtor,
+					DebtorAccount:          debtorAccount,
+					DebtorAgent:            debtorAgent,
+					Transactions:           []Transaction{later},
+				},
+			},
+		},
+	}
+	if diff := cmp.Diff(expected, document); diff != "" {
+		t.Errorf("Unexpected document. Diff: %s", diff)
+	}
+}
+
+func TestNewDocumentErrors(t *testing.T) {
+	created := time.Now()
+	pay := getTestPayment(t)
+	if _, err := NewDocument(strings.Repeat("M", 36), created, []payment.Payment{pay}); err == nil {
+		t.Errorf("Expected error with a message identifier longer than 35 characters")
+	}
+	if _, err := NewDocument("MSG-1", created, nil); err == nil {
+		t.Errorf("Expected error without payments")
+	}
+
+	other := pay
+	other.OrganisationID = "ee2fb143-6dfe-4787-b183-ca8ddd4164d2"
+	if _, err := NewDocument("MSG-1", created, []payment.Payment{pay, other}); err == nil {
+		t.Errorf("Expected error with payments of different organisations")
+	}
+
+	invalid := map[string]func(pay *payment.Payment){
+		"invalid amount":          func(pay *payment.Payment) { pay.Attributes.Amount = "ten" },
+		"zero amount":             func(pay *payment.Payment) { pay.Attributes.Amount = "0.00" },
+		"invalid currency":        func(pay *payment.Payment) { pay.Attributes.Currency = "XXY" },
+		"unknown bearer code":     func(pay *payment.Payment) { pay.Attributes.ChargesInformation.BearerCode = "ALL" },
+		"long end to end":         func(pay *payment.Payment) { pay.Attributes.EndToEndReference = strings.Repeat("E", 36) },
+		"no beneficiary account":  func(pay *payment.Payment) { pay.Attributes.BeneficiaryParty.AccountNumber = "" },
+		"no debtor account":       func(pay *payment.Payment) { pay.Attributes.DebtorParty.AccountNumber = "" },
+		"invalid processing date": func(pay *payment.Payment) { pay.Attributes.ProcessingDate = "18/01/2017" },
+	}
+	for name, change := range invalid {
+		changed := pay
+		change(&changed)
+		if _, err := NewDocument("MSG-1", created, []payment.Payment{changed}); err == nil {
+			t.Errorf("Expected error with %s", name)
+		}
+	}
+}
+
+func TestChargeBearers(t *testing.T) {
+	pay := getTestPayment(t)
+	for code, expected := range map[string]string{"": "SLEV", "SLEV": "SLEV", "SHAR": "SHAR", "DEBT": "DEBT", "CRED": "CRED", "OUR": "DEBT", "BEN": "CRED", "SHA": "SHAR"} {
+		pay.Attributes.ChargesInformation.BearerCode = code
+		document, err := NewDocument("MSG-1", time.Now(), []payment.Payment{pay})
+		if err != nil {
+			t.Fatalf("Error creating document with bearer code %q: %s", code, err.Error())
+		}
+		if bearer := document.Initiation.Instructions[0].Transactions[0].ChargeBearer; bearer != expected {
+			t.Errorf("Expected charge bearer %s for bearer code %q but got %s", expected, code, bearer)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	pay := getTestPayment(t)
+	pay.Attributes.ProcessingDate = ""
+	pay.Attributes.DebtorParty.BankID = ""
+	pay.Attributes.Reference = strings.Repeat("Piano lessons ", 12)
+	pay.Attributes.BeneficiaryParty.Address = strings.Repeat("Beneficiary ", 7)
+
+	var buffer bytes.Buffer
+	if err := Write(&buffer, MessageID(pay.ID), time.Date(2019, 5, 10, 23, 30, 0, 0, time.FixedZone("CEST", 2*60*60)), []payment.Payment{pay}); err != nil {
+		t.Fatalf("Error writing document: %s", err.Error())
+	}
+	result := buffer.String()
+	for _, expected := range []string{
+		xml.Header + `<Document xmlns="urn:iso:std:iso:20022:tech:xsd:pain.001.001.09">`,
+		`<MsgId>4ee3a8d8ca7b4290a52cdd5b6165ec43</MsgId>`,
+		`<CreDtTm>2019-05-10T21:30:00Z</CreDtTm>`,
+		`<ReqdExctnDt>
+        <Dt>2019-05-10</Dt>
+      </ReqdExctnDt>`,
+		`<DbtrAgt>
+        <FinInstnId>
+          <Othr>
+            <Id>NOTPROVIDED</Id>
+          </Othr>
+        </FinInstnId>
+      </DbtrAgt>`,
+		`<InstdAmt Ccy="GBP">100.21</InstdAmt>`,
+		`<AdrLine>Beneficiary Beneficiary Beneficiary Beneficiary Beneficiary</AdrLine>`,
+		`<AdrLine>Beneficiary Beneficiary</AdrLine>`,
+		`<Ustrd>` + strings.TrimSpace(strings.Repeat("Piano lessons ", 10)) + `</Ustrd>`,
+		`<Ustrd>Piano lessons Piano lessons</Ustrd>`,
+	} {
+		if !strings.Contains(result, expected) {
+			t.Errorf("Expected %s in document:\n%s", expected, result)
+		}
+	}
+
+	var document Document
+	if err := xml.Unmarshal(buffer.Bytes(), &document); err != nil {
+		t.Fatalf("Error reading written document: %s", err.Error())
+	}
+	if document.Initiation.GroupHeader.ControlSum != "100.21" {
+		t.Errorf("Unexpected control sum %s in written document", document.Initiation.GroupHeader.ControlSum)
+	}
+}
@@ -0,0 +1,304 @@
+package payment
+
+import (
+	"fmt"
+	"time"
+)
+
+// Statuses of the payment lifecycle
+const (
+	CreatedStatus         = "created"
+	PendingApprovalStatus = "pending_approval"
+	ApprovedStatus        = "approved"
+	HeldStatus            = "held"
+	SubmittedStatus       = "submitted"
+	SettledStatus         = "settled"
+	RejectedStatus        = "rejected"
+	ReturnedStatus        = "returned"
+	CancelledStatus       = "cancelled"
+	BlockedStatus         = "blocked"
+)
+
+// Actions which change the status of a payment
+const (
+	RequestApprovalAction = "request-approval"
+	ApproveAction         = "approve"
+	SubmitAction          = "submit"
+	SettleAction          = "settle"
+	RejectAction          = "reject"
+	ReturnAction          = "return"
+	CancelAction          = "cancel"
+	HoldAction            = "hold"
+	ClearHitAction        = "clear-hit"
+	ConfirmHitAction      = "confirm-hit"
+	BlockAction           = "block"
+)
+
+// TransitionTimestampLayout is the format of the timestamps of the payment transitions
+const TransitionTimestampLayout = time.RFC3339Nano
+
+// CreationTimestampLayout is the format of the creation time of the payments, which has a fixed number of decimals
+// so the creation times in UTC are ordered as strings
+const CreationTimestampLayout = "2006-01-02T15:04:05.000000000Z"
+
+// Codes of the field errors returned by CheckUpdate
+const (
+	ReadOnlyCode = "read_only"
+	LockedCode   = "locked"
+)
+
+// Transition is a change of the status of a payment made by an action
+type Transition struct {
+	Action string
+	// From contains the statuses in which the action can be done
+	From []string
+	To   string
+}
+
+// Transitions contains the legal transitions of the payment lifecycle by action.
+// Payments start in the created status and end in the settled, rejected, returned, cancelled or blocked ones.
+// Payments whose approval has been requested must be approved before being submitted.
+// Payments which match the sanctions list or must be reviewed according to the fraud rules are held until the hit is cleared,
+// which makes them created again, or confirmed, which blocks them. Payments can also be blocked directly by the fraud rules.
+var Transitions = map[string]Transition{
+	RequestApprovalAction: {RequestApprovalAction, []string{CreatedStatus}, PendingApprovalStatus},
+	ApproveAction:         {ApproveAction, []string{PendingApprovalStatus}, ApprovedStatus},
+	SubmitAction:          {SubmitAction, []string{CreatedStatus, ApprovedStatus}, SubmittedStatus},
+	SettleAction:          {SettleAction, []string{SubmittedStatus}, SettledStatus},
+	RejectAction:          {RejectAction, []string{PendingApprovalStatus, ApprovedStatus, SubmittedStatus}, RejectedStatus},
+	ReturnAction:          {ReturnAction, []string{SettledStatus}, ReturnedStatus},
+	CancelAction:          {CancelAction, []string{CreatedStatus, PendingApprovalStatus, ApprovedStatus}, CancelledStatus},
+	HoldAction:            {HoldAction, []string{CreatedStatus}, HeldStatus},
+	ClearHitAction:        {ClearHitAction, []string{HeldStatus}, CreatedStatus},
+	ConfirmHitAction:      {ConfirmHitAction, []string{HeldStatus}, BlockedStatus},
+	BlockAction:           {BlockAction, []string{CreatedStatus, HeldStatus}, BlockedStatus},
+}
+
+// PaymentTransition records a change of the status of a payment
+// swagger:model
+type PaymentTransition struct {
+	Action         string `json:"action,omitempty"`
+	PreviousStatus string `json:"previous_status,omitempty"`
+	Status         string `json:"status,omitempty"`
+	Reason         string `json:"reason,omitempty"`
+	// Actor is the user who made the transition
+	Actor string `json:"actor,omitempty"`
+	// TransitionedAt is the time of the transition in RFC 3339 format
+	TransitionedAt string `json:"transitioned_at,omitempty"`
+}
+
+// InvalidTransitionError is returned when an action can't be done in the current status of a payment
+type InvalidTransitionError struct {
+	ID     string
+	Action string
+	Status string
+}
+
+func (e InvalidTransitionError) Error() string {
+	return fmt.Sprintf("Payment %s can't %s in status %s", e.ID, e.Action, e.Status)
+}
+
+// UnknownActionError is returned when an action doesn't exist in the payment lifecycle
+type UnknownActionError struct {
+	Action string
+}
+
+func (e UnknownActionError) Error() string {
+	return fmt.Sprintf("Unknown payment action %s", e.Action)
+}
+
+// CurrentStatus returns the status of the payment. Payments without status, which were stored before it existed, are created.
+func (p Payment) CurrentStatus() string {
+	if p.Status == "" {
+		return CreatedStatus
+	}
+	return p.Status
+}
+
+// IsSubmitted returns true if the payment has been submitted, even if it has been settled, returned or rejected afterwards.
+// Rejected payments are only submitted if they were rejected after their submission and not while pending approval or approved.
+func (p Payment) IsSubmitted() bool {
+	switch p.CurrentStatus() {
+	case SubmittedStatus, SettledStatus, ReturnedStatus:
+		return true
+	case RejectedStatus:
+		for _, transition := range p.Transitions {
+			if transition.Action == SubmitAction {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsLocked returns true if the approval of the payment has been requested, it has been held by the sanctions screening
+// or it has been submitted, after which its economic fields can't change. Rejected payments are always locked,
+// since they are rejected after requesting their approval or submitting them.
+func (p Payment) IsLocked() bool {
+	switch p.CurrentStatus() {
+	case PendingApprovalStatus, ApprovedStatus, HeldStatus, BlockedStatus, RejectedStatus:
+		return true
+	}
+	return p.IsSubmitted()
+}
+
+// Transition returns a copy of the payment in the status the action leads to, with the transition recorded at the end of its transitions.
+// It returns an UnknownActionError if the action doesn't exist or an InvalidTransitionError if it can't be done in the status of the payment.
+// Approvals can only be requested by an identified actor and pending approvals can only be approved or rejected
+// by an identified actor different from the ones who created the payment and requested its approval,
+// otherwise a FourEyesError is returned.
+func (p Payment) Transition(action, reason, actor string, at time.Time) (Payment, error) {
+	transition, ok := Transitions[action]
+	if !ok {
+		return p, UnknownActionError{Action: action}
+	}
+	status := p.CurrentStatus()
+	if !transition.Allowed(status) {
+		return p, InvalidTransitionError{ID: p.ID, Action: action, Status: status}
+	}
+	if action == RequestApprovalAction && actor == "" {
+		return p, FourEyesError{ID: p.ID, Action: action}
+	}
+	if status == PendingApprovalStatus && (action == ApproveAction || action == RejectAction) {
+		if err := p.checkFourEyes(action, actor); err != nil {
+			return p, err
+		}
+	}
+
+	p.Transitions = append(append([]PaymentTransition{}, p.Transitions...), PaymentTransition{
+		Action:         action,
+		PreviousStatus: status,
+		Status:         transition.To,
+		Reason:         reason,
+		Actor:          actor,
+		TransitionedAt: at.UTC().Format(TransitionTimestampLayout),
+	})
+	p.Status = transition.To
+	return p, nil
+}
+
+// Allowed returns true if the transition can be done from the status
+func (t Transition) Allowed(status string) bool {
+	for _, from := range t.From {
+		if from == status {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckUpdate checks that the update of a payment doesn't change the fields which can't be updated directly.
+// The status and the transitions can only change through the lifecycle actions, the sanctions hits through the screening,
+// the risk, the suspected duplicate and the creator can't change after the payment is created and the economic fields, which are the amount, the currency, the exchange information, the charges and the parties,
+// can't change once the payment is locked.
+// It returns a ValidationError with an error for every changed field or nil if the update is allowed.
+func CheckUpdate(existing, updated Payment) error {
+	var v validation
+	if updated.Status != existing.Status {
+		v.add("status", ReadOnlyCode, "The status can only be changed with the payment actions")
+	}
+	if !transitionsEqual(updated.Transitions, existing.Transitions) {
+		v.add("transitions", ReadOnlyCode, "The transitions are recorded by the payment actions")
+	}
+	if !sanctionsHitsEqual(updated.SanctionsHits, existing.SanctionsHits) {
+		v.add("sanctions_hits", ReadOnlyCode, "The sanctions hits are recorded by the sanctions screening")
+	}
+	if !riskEqual(updated.Risk, existing.Risk) {
+		v.add("risk", ReadOnlyCode, "The risk is recorded by the fraud rules when the payment is created")
+	}
+	if updated.SuspectedDuplicateOf != existing.SuspectedDuplicateOf {
+		v.add("suspected_duplicate_of", ReadOnlyCode, "The suspected duplicate is recorded by the duplicate detection when the payment is created")
+	}
+	if updated.CreatedBy != existing.CreatedBy {
+		v.add("created_by", ReadOnlyCode, "The creator is recorded when the payment is created")
+	}
+	if updated.CreatedAt != existing.CreatedAt {
+		v.add("created_at", ReadOnlyCode, "The creation time is recorded when the payment is created")
+	}
+
+	if existing.IsLocked() {
+		before, after := existing.Attributes, updated.Attributes
+		locked := []struct {
+			field   string
+			changed bool
+		}{
+			{"attributes.amount", before.Amount != after.Amount},
+			{"attributes.currency", before.Currency != after.Currency},
+			{"attributes.fx", before.FX != after.FX},
+			{"attributes.charges_information", !chargesEqual(before.ChargesInformation, after.ChargesInformation)},
+			{"attributes.beneficiary_party", !partiesEqual(before.BeneficiaryParty, after.BeneficiaryParty)},
+			{"attributes.debtor_party", !partiesEqual(before.DebtorParty, after.DebtorParty)},
+			{"attributes.sponsor_party", !partiesEqual(before.SponsorParty, after.SponsorParty)},
+		}
+		for _, field := range locked {
+			if field.changed {
+				v.add(field.field, LockedCode, "The field can't be changed once the approval of the payment has been requested, it has been held or it has been submitted")
+			}
+		}
+	}
+
+	if len(v.errors) > 0 {
+		return ValidationError{Errors: v.errors}
+	}
+	return nil
+}
+
+func transitionsEqual(a, b []PaymentTransition) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func sanctionsHitsEqual(a, b []SanctionsHit) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func riskEqual(a, b *PaymentRiskType) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.Outcome != b.Outcome || len(a.Reasons) != len(b.Reasons) {
+		return false
+	}
+	for i := range a.Reasons {
+		if a.Reasons[i] != b.Reasons[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func chargesEqual(a, b PaymentChargesInformationType) bool {
+	if a.BearerCode != b.BearerCode || a.ReceiverChargesAmount != b.ReceiverChargesAmount ||
+		a.ReceiverChargesCurrency != b.ReceiverChargesCurrency || len(a.SenderCharges) != len(b.SenderCharges) {
+		return false
+	}
+	for i := range a.SenderCharges {
+		if a.SenderCharges[i] != b.SenderCharges[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func partiesEqual(a, b PaymentPartyType) bool {
+	if (a.AccountType == nil) != (b.AccountType == nil) || (a.AccountType != nil && *a.AccountType != *b.AccountType) {
+		return false
+	}
+	a.AccountType, b.AccountType = nil, nil
+	return a == b
+}
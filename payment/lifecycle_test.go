@@ -0,0 +1,158 @@
+package payment
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestTransition(t *testing.T) {
+	allowed := map[string][]string{
+		CreatedStatus:         {RequestApprovalAction, SubmitAction, CancelAction, HoldAction, BlockAction},
+		PendingApprovalStatus: {ApproveAction, RejectAction, CancelAction},
+		ApprovedStatus:        {SubmitAction, RejectAction, CancelAction},
+		SubmittedStatus:       {SettleAction, RejectAction},
+		SettledStatus:         {ReturnAction},
+		RejectedStatus:        nil,
+		ReturnedStatus:        nil,
+		CancelledStatus:       nil,
+		HeldStatus:            {ClearHitAction, ConfirmHitAction, BlockAction},
+		BlockedStatus:         nil,
+	}
+	at := time.Date(2019, 5, 1, 10, 30, 0, 0, time.FixedZone("CEST", 2*60*60))
+	for status, actions := range allowed {
+		legal := make(map[string]bool)
+		for _, action := range actions {
+			legal[action] = true
+		}
+		for action, transition := range Transitions {
+			pay := Payment{ID: "payment", Status: status}
+			transitioned, err := pay.Transition(action, "reason", "actor", at)
+			if !legal[action] {
+				if err != (InvalidTransitionError{ID: "payment", Action: action, Status: status}) {
+					t.Errorf("Expected InvalidTransition error doing %s in status %s but got %v", action, status, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("Error doing %s in status %s: %s", action, status, err.Error())
+				continue
+			}
+			expected := []PaymentTransition{{
+				Action:         action,
+				PreviousStatus: status,
+				Status:         transition.To,
+				Reason:         "reason",
+				Actor:          "actor",
+				TransitionedAt: "2019-05-01T08:30:00Z",
+			}}
+			if transitioned.Status != transition.To || !cmp.Equal(transitioned.Transitions, expected) {
+				t.Errorf("Unexpected payment after doing %s in status %s: %v", action, status, transitioned)
+			}
+		}
+	}
+
+	if _, err := (Payment{}).Transition("authorise", "", "", at); err != (UnknownActionError{Action: "authorise"}) {
+		t.Errorf("Expected UnknownAction error but got %v", err)
+	}
+	legacy, err := (Payment{}).Transition(SubmitAction, "", "", at)
+	if err != nil || legacy.Transitions[0].PreviousStatus != CreatedStatus {
+		t.Errorf("Expected payment without status to be submitted as created but got %v (%v)", legacy, err)
+	}
+}
+
+func TestIsSubmitted(t *testing.T) {
+	at := time.Now()
+	for _, test := range []struct {
+		actions   []string
+		submitted bool
+	}{
+		{nil, false},
+		{[]string{SubmitAction}, true},
+		{[]string{SubmitAction, SettleAction, ReturnAction}, true},
+		{[]string{SubmitAction, RejectAction}, true},
+		{[]string{RequestApprovalAction, RejectAction}, false},
+		{[]string{RequestApprovalAction, ApproveAction, RejectAction}, false},
+		{[]string{RequestApprovalAction, ApproveAction, SubmitAction, RejectAction}, true},
+		{[]string{RequestApprovalAction, CancelAction}, false},
+	} {
+		pay := Payment{ID: "payment"}
+		for _, action := range test.actions {
+			actor := "approver"
+			if action == RequestApprovalAction {
+				actor = "requester"
+			}
+			var err error
+			if pay, err = pay.Transition(action, "", actor, at); err != nil {
+				t.Fatalf("Error doing %s: %s", action, err.Error())
+			}
+		}
+		if pay.IsSubmitted() != test.submitted {
+			t.Errorf("Expected submitted to be %t after %v but got %t", test.submitted, test.actions, pay.IsSubmitted())
+		}
+		if pay.IsLocked() != (test.submitted || pay.Status == RejectedStatus) {
+			t.Errorf("Unexpected locked %t after %v", pay.IsLocked(), test.actions)
+		}
+	}
+}
+
+func TestCheckUpdate(t *testing.T) {
+	existing, err := GetDefaultTestPayment("../test_resources")
+	if err != nil {
+		t.Fatalf("Error getting test payment: %s", err.Error())
+	}
+	existing, err = existing.Transition(SubmitAction, "", "", time.Now())
+	if err != nil {
+		t.Fatalf("Error submitting test payment: %s", err.Error())
+	}
+
+	updated := existing
+	updated.Attributes.Reference = "New reference"
+	updated.Transitions = append([]PaymentTransition{}, existing.Transitions...)
+	accountType := *existing.Attributes.BeneficiaryParty.AccountType
+	updated.Attributes.BeneficiaryParty.AccountType = &accountType
+	if err := CheckUpdate(existing, updated); err != nil {
+		t.Fatalf("Unexpected error updating the reference of a submitted payment: %s", err.Error())
+	}
+
+	updated.Status = SettledStatus
+	updated.Transitions = nil
+	updated.Attributes.Amount = "1.00"
+	updated.Attributes.FX.ExchangeRate = "1.5"
+	updated.Attributes.ChargesInformation.SenderCharges = updated.Attributes.ChargesInformation.SenderCharges[:1]
+	updated.Attributes.DebtorParty.Name = "Someone else"
+	updated.SuspectedDuplicateOf = "1f4bd6d4-7ed7-4b39-8a5b-93e7b2a4a2c3"
+	updated.CreatedBy = "approver"
+	updated.CreatedAt = "2019-05-10T12:30:00.000000000Z"
+	err = CheckUpdate(existing, updated)
+	validationError, ok := err.(ValidationError)
+	if !ok {
+		t.Fatalf("Expected ValidationError updating a submitted payment but got %v", err)
+	}
+	expected := map[string]string{
+		"status":                         ReadOnlyCode,
+		"transitions":                    ReadOnlyCode,
+		"suspected_duplicate_of":         ReadOnlyCode,
+		"created_by":                     ReadOnlyCode,
+		"created_at":                     ReadOnlyCode,
+		"attributes.amount":              LockedCode,
+		"attributes.fx":                  LockedCode,
+		"attributes.charges_information": LockedCode,
+		"attributes.debtor_party":        LockedCode,
+	}
+	got := make(map[string]string)
+	for _, fieldError := range validationError.Errors {
+		got[fieldError.Field] = fieldError.Code
+	}
+	if !cmp.Equal(got, expected) {
+		t.Fatalf("Unexpected field errors.\nExpected:\n%v\nBut got:\n%v", expected, got)
+	}
+
+	created, _ := GetDefaultTestPayment("../test_resources")
+	changed := created
+	changed.Attributes.Amount = "1.00"
+	if err := CheckUpdate(created, changed); err != nil {
+		t.Fatalf("Unexpected error updating the amount of a payment which hasn't been submitted: %s", err.Error())
+	}
+}
@@ -8,6 +8,21 @@ type Payment struct {
 	Version        int                   `json:"version,omitempty"`
 	OrganisationID string                `json:"organisation_id,omitempty"`
 	Attributes     PaymentAttributesType `json:"attributes,omitempty"`
+	// Status is the status of the payment in its lifecycle, which can only be changed with the payment actions
+	Status string `json:"status,omitempty"`
+	// Transitions contains the changes of the status of the payment in the order they were made
+	Transitions []PaymentTransition `json:"transitions,omitempty"`
+	// SanctionsHits contains the matches of the parties of the payment with the sanctions list found by the last screening
+	SanctionsHits []SanctionsHit `json:"sanctions_hits,omitempty"`
+	// Risk contains the outcome of the fraud rules evaluated when the payment was created, if they were evaluated
+	Risk *PaymentRiskType `json:"risk,omitempty"`
+	// SuspectedDuplicateOf is the identifier of the existing payment this one was flagged as a duplicate of when it was created
+	SuspectedDuplicateOf string `json:"suspected_duplicate_of,omitempty"`
+	// CreatedBy is the user who created the payment, who can't approve or reject its approval
+	CreatedBy string `json:"created_by,omitempty"`
+	// CreatedAt is the time when the payment was created, in UTC with the CreationTimestampLayout so creation times
+	// can be compared as strings
+	CreatedAt string `json:"created_at,omitempty"`
 }
 
 type PaymentAttributesType struct {
@@ -76,7 +76,7 @@ func TestPaymentSerialization(t *testing.T) {
 			Currency: "GBP",
 			DebtorParty: PaymentPartyType{
 				AccountName:       "EJ Brown Black",
-				AccountNumber:     "GB29XABC10161234567801",
+				AccountNumber:     "GB83XABC10161234567801",
 				AccountNumberCode: "IBAN",
 				Address:           "10 Debtor Crescent Sourcetown NE1",
 				BankID:            "203301",
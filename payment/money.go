@@ -0,0 +1,184 @@
+package payment
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// Money is an amount of a currency. Its JSON and BSON encoding is the same as the one of PaymentAmountType,
+// like {"amount": "100.21", "currency": "GBP"}, so both types can be used for the same documents.
+// Operations which combine several amounts fail with a CurrencyMismatchError if they are not of the same currency.
+type Money struct {
+	Amount   Decimal `json:"amount"`
+	Currency string  `json:"currency"`
+}
+
+// InvalidCurrencyError is returned when a currency is not an ISO 4217 currency code
+type InvalidCurrencyError struct {
+	Currency string
+}
+
+func (e InvalidCurrencyError) Error() string {
+	return fmt.Sprintf("%q is not an ISO 4217 currency code", e.Currency)
+}
+
+// CurrencyMismatchError is returned when amounts of different currencies are combined
+type CurrencyMismatchError struct {
+	Expected string
+	Actual   string
+}
+
+func (e CurrencyMismatchError) Error() string {
+	return fmt.Sprintf("Amount of currency %s can't be combined with an amount of currency %s", e.Actual, e.Expected)
+}
+
+// PrecisionError is returned when an amount has more decimals than the minor unit of its currency
+type PrecisionError struct {
+	Money Money
+}
+
+func (e PrecisionError) Error() string {
+	return fmt.Sprintf("%s has more than %d decimals", e.Money, e.Money.MinorUnits())
+}
+
+// NewMoney returns an amount of the currency or an InvalidCurrencyError if the currency is not an ISO 4217 currency code
+func NewMoney(amount Decimal, currency string) (Money, error) {
+	if !IsCurrency(currency) {
+		return Money{}, InvalidCurrencyError{Currency: currency}
+	}
+	return Money{Amount: amount, Currency: currency}, nil
+}
+
+// ParseMoney parses the amount and returns it as an amount of the currency.
+// It returns an InvalidDecimalError or an InvalidCurrencyError if any of them is not valid.
+func ParseMoney(amount, currency string) (Money, error) {
+	parsed, err := ParseDecimal(amount)
+	if err != nil {
+		return Money{}, err
+	}
+	return NewMoney(parsed, currency)
+}
+
+// FromMinorUnits returns the amount of the currency made of the given number of minor units, like 10021 pennies for 100.21 GBP
+func FromMinorUnits(units *big.Int, currency string) (Money, error) {
+	minorUnits, ok := CurrencyMinorUnits(currency)
+	if !ok {
+		return Money{}, InvalidCurrencyError{Currency: currency}
+	}
+	return Money{Amount: NewDecimal(units, minorUnits), Currency: currency}, nil
+}
+
+// MinorUnits returns the number of decimals of the minor unit of the currency
+func (m Money) MinorUnits() int {
+	units, _ := CurrencyMinorUnits(m.Currency)
+	return units
+}
+
+// ToMinorUnits returns the amount as a number of minor units of its currency, like 10021 pennies for 100.21 GBP,
+// or a PrecisionError if the amount has more decimals than the minor unit. Trailing zeros are not taken into account.
+func (m Money) ToMinorUnits() (*big.Int, error) {
+	scale := m.MinorUnits()
+	if m.Amount.Scale() <= scale {
+		return m.Amount.rescale(scale), nil
+	}
+	units, remainder := new(big.Int).QuoRem(m.Amount.int(), pow10(m.Amount.Scale()-scale), new(big.Int))
+	if remainder.Sign() != 0 {
+		return nil, PrecisionError{Money: m}
+	}
+	return units, nil
+}
+
+// Add returns the sum of both amounts with the greatest number of decimals of both
+func (m Money) Add(other Money) (Money, error) {
+	if m.Currency != other.Currency {
+		return Money{}, CurrencyMismatchError{Expected: m.Currency, Actual: other.Currency}
+	}
+	return Money{Amount: m.Amount.Add(other.Amount), Currency: m.Currency}, nil
+}
+
+// Sub returns the difference of both amounts with the greatest number of decimals of both
+func (m Money) Sub(other Money) (Money, error) {
+	return m.Add(Money{Amount: other.Amount.Neg(), Currency: other.Currency})
+}
+
+// Cmp compares both amounts returning -1, 0 or 1 if m is lower, equal or greater than other
+func (m Money) Cmp(other Money) (int, error) {
+	if m.Currency != other.Currency {
+		return 0, CurrencyMismatchError{Expected: m.Currency, Actual: other.Currency}
+	}
+	return m.Amount.Cmp(other.Amount), nil
+}
+
+// Allocate splits the amount in parts proportional to the ratios without losing any minor unit.
+// The minor units which can't be split proportionally are given one by one to the first parts,
+// so 100.00 GBP allocated in 1:1:1 gives 33.34, 33.33 and 33.33 GBP. The parts have the decimals of the minor unit of the currency.
+// It returns a PrecisionError if the amount has more decimals than the minor unit of its currency.
+func (m Money) Allocate(ratios ...int) ([]Money, error) {
+	total := int64(0)
+	for _, ratio := range ratios {
+		if ratio < 0 {
+			return nil, errors.New("Allocation ratios can't be negative")
+		}
+		total += int64(ratio)
+	}
+	if total == 0 {
+		return nil, errors.New("At least one allocation ratio must be greater than zero")
+	}
+	units, err := m.ToMinorUnits()
+	if err != nil {
+		return nil, err
+	}
+
+	parts := make([]*big.Int, len(ratios))
+	remainder := new(big.Int).Set(units)
+	for i, ratio := range ratios {
+		parts[i] = new(big.Int).Mul(units, big.NewInt(int64(ratio)))
+		parts[i].Quo(parts[i], big.NewInt(total))
+		remainder.Sub(remainder, parts[i])
+	}
+	step := big.NewInt(int64(remainder.Sign()))
+	for i := 0; remainder.Sign() != 0; i++ {
+		if ratios[i] == 0 {
+			continue
+		}
+		parts[i].Add(parts[i], step)
+		remainder.Sub(remainder, step)
+	}
+
+	result := make([]Money, len(parts))
+	for i, part := range parts {
+		result[i] = Money{Amount: NewDecimal(part, m.MinorUnits()), Currency: m.Currency}
+	}
+	return result, nil
+}
+
+// String formats the amount followed by its currency, like 100.21 GBP
+func (m Money) String() string {
+	return m.Amount.String() + " " + m.Currency
+}
+
+// AmountMoney returns the amount of the payment in its currency
+func (a PaymentAttributesType) AmountMoney() (Money, error) {
+	return ParseMoney(a.Amount, a.Currency)
+}
+
+// Money returns the charge amount in its currency
+func (c PaymentAmountType) Money() (Money, error) {
+	return ParseMoney(c.Amount, c.Currency)
+}
+
+// NewPaymentAmount returns the charge with the given amount
+func NewPaymentAmount(m Money) PaymentAmountType {
+	return PaymentAmountType{Amount: m.Amount.String(), Currency: m.Currency}
+}
+
+// ReceiverChargesMoney returns the receiver charges amount in its currency
+func (c PaymentChargesInformationType) ReceiverChargesMoney() (Money, error) {
+	return ParseMoney(c.ReceiverChargesAmount, c.ReceiverChargesCurrency)
+}
+
+// OriginalMoney returns the original amount of the payment before the currency exchange in its original currency
+func (f PaymentExchangeInformationType) OriginalMoney() (Money, error) {
+	return ParseMoney(f.OriginalAmount, f.OriginalCurrency)
+}
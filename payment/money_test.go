@@ -0,0 +1,177 @@
+package payment
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestParseDecimal(t *testing.T) {
+	formatted := map[string]string{
+		"100.21":  "100.21",
+		"2.00000": "2.00000",
+		"-0.50":   "-0.50",
+		"+5":      "5",
+		".5":      "0.5",
+		"5.":      "5",
+		"0.001":   "0.001",
+		"123456789012345678901234567890.123456789": "123456789012345678901234567890.123456789",
+	}
+	for value, expected := range formatted {
+		decimal, err := ParseDecimal(value)
+		if err != nil {
+			t.Errorf("Error parsing decimal %q: %s", value, err.Error())
+			continue
+		}
+		if decimal.String() != expected {
+			t.Errorf("Decimal %q formatted as %q but %q was expected", value, decimal.String(), expected)
+		}
+	}
+
+	for _, value := range []string{"", "ten", "1e5", "1/2", "1.2.3", "--1", "."} {
+		if _, err := ParseDecimal(value); err == nil {
+			t.Errorf("Expected error parsing %q as a decimal", value)
+		}
+	}
+}
+
+func TestDecimalArithmetic(t *testing.T) {
+	a, b := MustParseDecimal("100.21"), MustParseDecimal("0.795")
+	if sum := a.Add(b).String(); sum != "101.005" {
+		t.Errorf("Expected 100.21 + 0.795 to be 101.005 but got %s", sum)
+	}
+	if difference := b.Sub(a).String(); difference != "-99.415" {
+		t.Errorf("Expected 0.795 - 100.21 to be -99.415 but got %s", difference)
+	}
+	if MustParseDecimal("2.00000").Cmp(MustParseDecimal("2")) != 0 {
+		t.Error("Expected 2.00000 and 2 to be equal")
+	}
+	if MustParseDecimal("2.00000").Equal(MustParseDecimal("2")) {
+		t.Error("Expected 2.00000 and 2 to have different representations")
+	}
+	if a.Cmp(b) != 1 || b.Cmp(a) != -1 {
+		t.Error("Expected 100.21 to be greater than 0.795")
+	}
+	if zero := (Decimal{}); zero.String() != "0" || zero.Sign() != 0 {
+		t.Errorf("Expected zero value to be 0 but got %s", zero)
+	}
+}
+
+func TestMoneyEncoding(t *testing.T) {
+	charge := PaymentAmountType{Amount: "10.00", Currency: "USD"}
+	document, err := json.Marshal(charge)
+	if err != nil {
+		t.Fatalf("Error encoding charge: %s", err.Error())
+	}
+	var money Money
+	if err := json.Unmarshal(document, &money); err != nil {
+		t.Fatalf("Error decoding charge as money: %s", err.Error())
+	}
+	encoded, err := json.Marshal(money)
+	if err != nil {
+		t.Fatalf("Error encoding money: %s", err.Error())
+	}
+	if string(encoded) != string(document) {
+		t.Fatalf("Money JSON differs from the charge.\nExpected:\n%s\nBut got:\n%s", document, encoded)
+	}
+
+	document, err = bson.Marshal(charge)
+	if err != nil {
+		t.Fatalf("Error encoding charge as BSON: %s", err.Error())
+	}
+	money = Money{}
+	if err := bson.Unmarshal(document, &money); err != nil {
+		t.Fatalf("Error decoding BSON charge as money: %s", err.Error())
+	}
+	encoded, err = bson.Marshal(money)
+	if err != nil {
+		t.Fatalf("Error encoding money as BSON: %s", err.Error())
+	}
+	if !cmp.Equal(encoded, document) {
+		t.Fatalf("Money BSON differs from the charge.\nExpected:\n%v\nBut got:\n%v", bson.Raw(document), bson.Raw(encoded))
+	}
+	if NewPaymentAmount(money) != charge {
+		t.Fatalf("Expected %v to be converted back to %v but got %v", money, charge, NewPaymentAmount(money))
+	}
+}
+
+func TestMoneyOperations(t *testing.T) {
+	pay, err := GetDefaultTestPayment("../test_resources")
+	if err != nil {
+		t.Fatalf("Error getting test payment: %s", err.Error())
+	}
+	amount, err := pay.Attributes.AmountMoney()
+	if err != nil {
+		t.Fatalf("Error getting payment amount: %s", err.Error())
+	}
+	charge, err := pay.Attributes.ChargesInformation.SenderCharges[0].Money()
+	if err != nil {
+		t.Fatalf("Error getting sender charge: %s", err.Error())
+	}
+	total, err := amount.Add(charge)
+	if err != nil || total.String() != "105.21 GBP" {
+		t.Fatalf("Expected 100.21 GBP + 5.00 GBP to be 105.21 GBP but got %v (%v)", total, err)
+	}
+	if result, err := amount.Cmp(charge); err != nil || result != 1 {
+		t.Fatalf("Expected 100.21 GBP to be greater than 5.00 GBP but got %d (%v)", result, err)
+	}
+
+	receiver, err := pay.Attributes.ChargesInformation.ReceiverChargesMoney()
+	if err != nil {
+		t.Fatalf("Error getting receiver charges: %s", err.Error())
+	}
+	if _, err := amount.Add(receiver); err != (CurrencyMismatchError{Expected: "GBP", Actual: "USD"}) {
+		t.Fatalf("Expected CurrencyMismatch error adding GBP and USD amounts but got %v", err)
+	}
+	if _, err := ParseMoney("1.00", "XYZ"); err != (InvalidCurrencyError{Currency: "XYZ"}) {
+		t.Fatalf("Expected InvalidCurrency error parsing an amount of an unknown currency but got %v", err)
+	}
+
+	units, err := amount.ToMinorUnits()
+	if err != nil || units.Int64() != 10021 {
+		t.Fatalf("Expected 100.21 GBP to be 10021 minor units but got %v (%v)", units, err)
+	}
+	yen, err := FromMinorUnits(big.NewInt(500), "JPY")
+	if err != nil || yen.String() != "500 JPY" {
+		t.Fatalf("Expected 500 minor units of JPY to be 500 JPY but got %v (%v)", yen, err)
+	}
+	if _, err := (Money{Amount: MustParseDecimal("1.005"), Currency: "GBP"}).ToMinorUnits(); err == nil {
+		t.Fatal("Expected Precision error getting the minor units of 1.005 GBP")
+	}
+}
+
+func TestMoneyAllocate(t *testing.T) {
+	tests := []struct {
+		amount   string
+		ratios   []int
+		expected []string
+	}{
+		{"100.00", []int{1, 1, 1}, []string{"33.34", "33.33", "33.33"}},
+		{"0.05", []int{3, 7}, []string{"0.02", "0.03"}},
+		{"100", []int{0, 1, 1}, []string{"0.00", "50.00", "50.00"}},
+		{"-0.10", []int{1, 1, 1}, []string{"-0.04", "-0.03", "-0.03"}},
+	}
+	for _, test := range tests {
+		money, _ := ParseMoney(test.amount, "GBP")
+		parts, err := money.Allocate(test.ratios...)
+		if err != nil {
+			t.Errorf("Error allocating %s: %s", money, err.Error())
+			continue
+		}
+		got := make([]string, len(parts))
+		for i, part := range parts {
+			got[i] = part.Amount.String()
+		}
+		if !cmp.Equal(got, test.expected) {
+			t.Errorf("Unexpected allocation of %s in %v. Expected %v but got %v", money, test.ratios, test.expected, got)
+		}
+	}
+
+	money, _ := ParseMoney("1.00", "GBP")
+	if _, err := money.Allocate(0, 0); err == nil {
+		t.Error("Expected error allocating with zero ratios")
+	}
+}
@@ -0,0 +1,69 @@
+package payment
+
+import (
+	"time"
+)
+
+// Outcomes of the fraud rules, from the least to the most severe
+const (
+	AllowOutcome  = "allow"
+	ReviewOutcome = "review"
+	BlockOutcome  = "block"
+)
+
+// outcomeSeverities contains the severity of every outcome of the fraud rules
+var outcomeSeverities = map[string]int{
+	AllowOutcome:  0,
+	ReviewOutcome: 1,
+	BlockOutcome:  2,
+}
+
+// PaymentRiskType contains the outcome of the fraud rules evaluated for a payment
+// swagger:model
+type PaymentRiskType struct {
+	// Outcome is allow, review or block
+	Outcome string `json:"outcome,omitempty"`
+	// Reasons contains the rules which were triggered by the payment
+	Reasons []RiskReason `json:"reasons,omitempty"`
+}
+
+// RiskReason explains why a fraud rule was triggered by a payment
+// swagger:model
+type RiskReason struct {
+	// Rule is the name of the triggered rule
+	Rule string `json:"rule,omitempty"`
+	// Outcome is the outcome of the rule, review or block
+	Outcome string `json:"outcome,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// IsOutcome returns true if the value is one of the outcomes of the fraud rules
+func IsOutcome(outcome string) bool {
+	_, ok := outcomeSeverities[outcome]
+	return ok
+}
+
+// MoreSevere returns true if outcome a is more severe than outcome b
+func MoreSevere(a, b string) bool {
+	return outcomeSeverities[a] > outcomeSeverities[b]
+}
+
+// Assess returns a copy of the payment with the risk recorded. Payments which must be reviewed are held, unless they are already,
+// and payments which must be blocked are blocked. It returns an InvalidTransitionError if the status of the payment can't change that way.
+func (p Payment) Assess(risk PaymentRiskType, actor string, at time.Time) (Payment, error) {
+	var err error
+	assessed := p
+	switch risk.Outcome {
+	case BlockOutcome:
+		assessed, err = p.Transition(BlockAction, "Blocked by the fraud rules", actor, at)
+	case ReviewOutcome:
+		if p.CurrentStatus() != HeldStatus {
+			assessed, err = p.Transition(HoldAction, "Review required by the fraud rules", actor, at)
+		}
+	}
+	if err != nil {
+		return p, err
+	}
+	assessed.Risk = &risk
+	return assessed, nil
+}
@@ -0,0 +1,34 @@
+package payment
+
+import (
+	"time"
+)
+
+// SanctionsHit is a match of a field of a party of a payment with an entry of the sanctions list
+// swagger:model
+type SanctionsHit struct {
+	// Field is the JSON path of the screened field, like attributes.debtor_party.name
+	Field string `json:"field,omitempty"`
+	// Value is the value of the screened field
+	Value string `json:"value,omitempty"`
+	// EntryID identifies the entry of the sanctions list, like the group ID of the OFSI consolidated list
+	EntryID   string `json:"entry_id,omitempty"`
+	EntryName string `json:"entry_name,omitempty"`
+	// Program is the sanctions regime or program of the entry
+	Program string `json:"program,omitempty"`
+	// MatchedValue is the name or address of the entry which matched the value
+	MatchedValue string `json:"matched_value,omitempty"`
+	// Score is the similarity between the value and the matched value, from 0 to 100
+	Score int `json:"score,omitempty"`
+}
+
+// Hold returns a copy of the payment held with the sanctions hits, which must be cleared or confirmed before it can continue
+// its lifecycle. It returns an InvalidTransitionError if the payment is not in the created status.
+func (p Payment) Hold(hits []SanctionsHit, actor string, at time.Time) (Payment, error) {
+	held, err := p.Transition(HoldAction, "Sanctions screening hit", actor, at)
+	if err != nil {
+		return p, err
+	}
+	held.SanctionsHits = hits
+	return held, nil
+}
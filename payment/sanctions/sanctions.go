@@ -0,0 +1,260 @@
+// Package sanctions screens the parties of payments against a sanctions list, like the OFSI consolidated list or the OFAC SDN list
+package sanctions
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/getaceres/payment-demo/payment"
+)
+
+// DefaultThreshold is the minimum score of the matches reported as hits by the screeners without threshold
+const DefaultThreshold = 90
+
+// Entry is a person, entity or ship of the sanctions list. Aliases of the same target are different entries with the same ID.
+type Entry struct {
+	ID        string
+	Name      string
+	Program   string
+	Addresses []string
+}
+
+// List contains the entries of a sanctions list
+type List struct {
+	Entries []Entry
+}
+
+// columns contains the positions of the columns of a sanctions list file
+type columns struct {
+	id, program      int
+	names, addresses []int
+}
+
+// idColumns, nameColumns, programColumns and addressColumns contain the lower case headers of the columns of every field
+// in the supported lists. Numbered columns, like Name 1 to Name 6 in the OFSI list, are joined in order.
+var (
+	idColumns      = []string{"id", "group id", "ent_num", "uid"}
+	nameColumns    = []string{"name", "sdn_name", "full name"}
+	programColumns = []string{"program", "programs", "regime"}
+	addressColumns = []string{"address"}
+)
+
+// LoadList reads a sanctions list from a CSV file, so the list can be updated without recompiling
+func LoadList(path string) (*List, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	list, err := ParseList(file)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading sanctions list from %s: %s", path, err.Error())
+	}
+	return list, nil
+}
+
+// ParseList reads a sanctions list in CSV format with a header line, like the CSV export of the OFSI consolidated list.
+// Lines before the header, which is the first one with a name column, are ignored. The name of the entries is in a Name column
+// or in numbered Name 1 to Name 6 columns, their identifier in an ID, Group ID, ent_num or UID column,
+// their program in a Program or Regime column and their address in an Address or numbered Address columns.
+// Entries without name are ignored.
+func ParseList(reader io.Reader) (*List, error) {
+	records := csv.NewReader(reader)
+	records.FieldsPerRecord = -1
+	records.LazyQuotes = true
+
+	var header *columns
+	list := &List{}
+	for {
+		record, err := records.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header == nil {
+			header = parseHeader(record)
+			continue
+		}
+
+		entry := Entry{
+			ID:      field(record, header.id),
+			Name:    joinFields(record, header.names),
+			Program: field(record, header.program),
+		}
+		if address := joinFields(record, header.addresses); address != "" {
+			entry.Addresses = []string{address}
+		}
+		if entry.Name != "" {
+			list.Entries = append(list.Entries, entry)
+		}
+	}
+	if header == nil {
+		return nil, fmt.Errorf("there's no header with a name column")
+	}
+	return list, nil
+}
+
+// parseHeader returns the columns of the header or nil if the record is not a header
+func parseHeader(record []string) *columns {
+	header := &columns{id: -1, program: -1}
+	for i, name := range record {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch {
+		case isColumn(name, idColumns, false) && header.id < 0:
+			header.id = i
+		case isColumn(name, programColumns, false) && header.program < 0:
+			header.program = i
+		case isColumn(name, nameColumns, true):
+			header.names = append(header.names, i)
+		case isColumn(name, addressColumns, true):
+			header.addresses = append(header.addresses, i)
+		}
+	}
+	if len(header.names) == 0 {
+		return nil
+	}
+	return header
+}
+
+// isColumn returns true if the header is one of the names or, if numbered is true, one of them followed by a number
+func isColumn(header string, names []string, numbered bool) bool {
+	for _, name := range names {
+		if header == name {
+			return true
+		}
+		if numbered && strings.HasPrefix(header, name+" ") {
+			if _, err := strconv.Atoi(strings.TrimPrefix(header, name+" ")); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func field(record []string, position int) string {
+	if position < 0 || position >= len(record) {
+		return ""
+	}
+	return strings.TrimSpace(record[position])
+}
+
+// joinFields returns the values of the columns which aren't empty separated by spaces
+func joinFields(record []string, positions []int) string {
+	var values []string
+	for _, position := range positions {
+		if value := field(record, position); value != "" {
+			values = append(values, value)
+		}
+	}
+	return strings.Join(values, " ")
+}
+
+// Screener finds the parties of payments which match the entries of a sanctions list
+type Screener struct {
+	List *List
+	// Threshold is the minimum score, from 0 to 100, of the matches reported as hits. Zero means DefaultThreshold.
+	Threshold int
+}
+
+// screenedField is a field of a payment party checked by the screening
+type screenedField struct {
+	path    string
+	value   string
+	address bool
+}
+
+// screenedFields returns the name, account name and address of the debtor and the beneficiary of the payment
+func screenedFields(pay payment.Payment) []screenedField {
+	var fields []screenedField
+	parties := []struct {
+		path  string
+		party payment.PaymentPartyType
+	}{
+		{"attributes.beneficiary_party", pay.Attributes.BeneficiaryParty},
+		{"attributes.debtor_party", pay.Attributes.DebtorParty},
+	}
+	for _, p := range parties {
+		fields = append(fields,
+			screenedField{p.path + ".name", p.party.Name, false},
+			screenedField{p.path + ".account_name", p.party.AccountName, false},
+			screenedField{p.path + ".address", p.party.Address, true},
+		)
+	}
+	return fields
+}
+
+// Changed returns true if the updated payment has different values in the fields checked by the screening
+func Changed(existing, updated payment.Payment) bool {
+	before, after := screenedFields(existing), screenedFields(updated)
+	for i := range before {
+		if before[i] != after[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// Screen compares the names and account names of the debtor and the beneficiary of the payment with the names of the entries
+// of the list and their addresses with the addresses of the entries. It returns a hit for every field and entry whose similarity
+// is at least the threshold, with the best score of the aliases of the entry, sorted by field and descending score.
+func (s Screener) Screen(pay payment.Payment) []payment.SanctionsHit {
+	threshold := s.Threshold
+	if threshold == 0 {
+		threshold = DefaultThreshold
+	}
+
+	var hits []payment.SanctionsHit
+	for _, screened := range screenedFields(pay) {
+		value := normalise(screened.value)
+		if value == "" {
+			continue
+		}
+		best := make(map[string]int)
+		for _, entry := range s.List.Entries {
+			candidates := []string{entry.Name}
+			if screened.address {
+				candidates = entry.Addresses
+			}
+			for _, candidate := range candidates {
+				score := Similarity(value, normalise(candidate))
+				if score < threshold {
+					continue
+				}
+				hit := payment.SanctionsHit{
+					Field:        screened.path,
+					Value:        screened.value,
+					EntryID:      entry.ID,
+					EntryName:    entry.Name,
+					Program:      entry.Program,
+					MatchedValue: candidate,
+					Score:        score,
+				}
+				key := entry.ID
+				if key == "" {
+					key = entry.Name
+				}
+				if i, ok := best[key]; !ok {
+					best[key] = len(hits)
+					hits = append(hits, hit)
+				} else if score > hits[i].Score {
+					hits[i] = hit
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(hits, func(i, j int) bool {
+		if hits[i].Field != hits[j].Field {
+			return hits[i].Field < hits[j].Field
+		}
+		return hits[i].Score > hits[j].Score
+	})
+	return hits
+}
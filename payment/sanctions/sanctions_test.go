@@ -0,0 +1,98 @@
+package sanctions
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/getaceres/payment-demo/payment"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseList(t *testing.T) {
+	list, err := LoadList("../../test_resources/sanctions.csv")
+	if err != nil {
+		t.Fatalf("Error loading sanctions list: %s", err.Error())
+	}
+	expected := []Entry{
+		{ID: "90001", Name: "KOVALENKO Dmitri Ivanovich", Program: "Ruritania", Addresses: []string{"14 Harbour Road Port Vostok"}},
+		{ID: "90001", Name: "KOVALENKO Dmytro", Program: "Ruritania"},
+		{ID: "90002", Name: "NORTHERN STAR SHIPPING LTD", Program: "Ruritania", Addresses: []string{"77 Quay Street Port Vostok"}},
+		{ID: "90003", Name: "BLACKWOOD TRADING, LLC", Program: "Cyber"},
+	}
+	if !cmp.Equal(list.Entries, expected) {
+		t.Fatalf("Unexpected entries.\nExpected:\n%v\nBut got:\n%v", expected, list.Entries)
+	}
+
+	list, err = ParseList(strings.NewReader("ent_num,SDN_Name,SDN_Type,Program\n36,AEROCARIBBEAN AIRLINES,-0-,CUBA\n"))
+	if err != nil || !cmp.Equal(list.Entries, []Entry{{ID: "36", Name: "AEROCARIBBEAN AIRLINES", Program: "CUBA"}}) {
+		t.Errorf("Unexpected entries of list with SDN columns: %v (%v)", list, err)
+	}
+	if _, err := ParseList(strings.NewReader("36,AEROCARIBBEAN AIRLINES,-0-,CUBA\n")); err == nil {
+		t.Error("Expected error parsing a list without header")
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	tests := []struct {
+		a, b string
+		min  int
+		max  int
+	}{
+		{"MARTHA", "MARTHA", 100, 100},
+		{"MARTHA", "MARHTA", 96, 96},
+		{"DMITRI KOVALENKO", "KOVALENKO DMITRI", 100, 100},
+		{"DMITRY KOVALENKO", "KOVALENKO DMITRI", 90, 99},
+		{"WILFRED JEREMIAH OWENS", "KOVALENKO DMITRI IVANOVICH", 0, 70},
+		{"", "MARTHA", 0, 0},
+	}
+	for _, test := range tests {
+		if score := Similarity(test.a, test.b); score < test.min || score > test.max {
+			t.Errorf("Expected similarity between %q and %q from %d to %d but got %d", test.a, test.b, test.min, test.max, score)
+		}
+	}
+}
+
+func TestScreen(t *testing.T) {
+	list, err := LoadList("../../test_resources/sanctions.csv")
+	if err != nil {
+		t.Fatalf("Error loading sanctions list: %s", err.Error())
+	}
+	pay, err := payment.GetDefaultTestPayment("../../test_resources")
+	if err != nil {
+		t.Fatalf("Error getting test payment: %s", err.Error())
+	}
+	screener := Screener{List: list}
+	if hits := screener.Screen(pay); len(hits) != 0 {
+		t.Fatalf("Unexpected hits screening test payment: %v", hits)
+	}
+
+	updated := pay
+	updated.Attributes.BeneficiaryParty.Name = "Dmitry Kovalenko"
+	updated.Attributes.BeneficiaryParty.Address = "14 Harbour Rd, Port Vostok"
+	updated.Attributes.DebtorParty.AccountName = "Blackwood Trading LLC"
+	if !Changed(pay, updated) {
+		t.Error("Expected screened fields to have changed")
+	}
+	hits := screener.Screen(updated)
+	fields := make([]string, 0, len(hits))
+	for _, hit := range hits {
+		fields = append(fields, hit.Field+" "+hit.EntryID)
+	}
+	expected := []string{
+		"attributes.beneficiary_party.address 90001",
+		"attributes.beneficiary_party.name 90001",
+		"attributes.debtor_party.account_name 90003",
+	}
+	if !cmp.Equal(fields, expected) {
+		t.Fatalf("Unexpected hits.\nExpected:\n%v\nBut got:\n%v", expected, hits)
+	}
+	if hits[1].Value != "Dmitry Kovalenko" || hits[1].MatchedValue != "KOVALENKO Dmitri Ivanovich" && hits[1].MatchedValue != "KOVALENKO Dmytro" ||
+		hits[1].Program != "Ruritania" || hits[1].Score < DefaultThreshold {
+		t.Errorf("Unexpected hit details %v", hits[1])
+	}
+
+	strict := Screener{List: list, Threshold: 100}
+	if hits := strict.Screen(updated); len(hits) != 1 || hits[0].Field != "attributes.debtor_party.account_name" || hits[0].Score != 100 {
+		t.Errorf("Expected only the exact match with threshold 100 but got %v", hits)
+	}
+}
@@ -0,0 +1,132 @@
+package sanctions
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// normalise returns the words of the value in upper case without punctuation, separated by single spaces
+func normalise(value string) string {
+	words := strings.FieldsFunc(strings.ToUpper(value), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	return strings.Join(words, " ")
+}
+
+// sortWords returns the words of the value in alphabetical order, so names in different order match
+func sortWords(value string) string {
+	words := strings.Fields(value)
+	sort.Strings(words)
+	return strings.Join(words, " ")
+}
+
+// Similarity returns the similarity between two normalised values from 0, for completely different values, to 100 for equal ones.
+// It is the greatest of the Jaro-Winkler similarity of the values, the one of their words in alphabetical order
+// and the one of their words, so names with and without middle names match.
+func Similarity(a, b string) int {
+	score := jaroWinkler(a, b)
+	if sorted := jaroWinkler(sortWords(a), sortWords(b)); sorted > score {
+		score = sorted
+	}
+	if words := wordSimilarity(a, b); words > score {
+		score = words
+	}
+	return int(score * 100)
+}
+
+// wordSimilarity returns the average of the Jaro-Winkler similarities between every word of the value with fewer words
+// and the most similar word of the other one. Values with a single word are only compared as a whole,
+// since a single word, like a surname, is not enough to identify someone.
+func wordSimilarity(a, b string) float64 {
+	short, long := strings.Fields(a), strings.Fields(b)
+	if len(short) > len(long) {
+		short, long = long, short
+	}
+	if len(short) < 2 {
+		return 0
+	}
+	total := 0.0
+	for _, word := range short {
+		best := 0.0
+		for _, other := range long {
+			if score := jaroWinkler(word, other); score > best {
+				best = score
+			}
+		}
+		total += best
+	}
+	return total / float64(len(short))
+}
+
+// jaroWinkler returns the Jaro similarity of the values increased for the values which share a prefix of up to four characters
+func jaroWinkler(a, b string) float64 {
+	s, t := []rune(a), []rune(b)
+	jaro := jaroSimilarity(s, t)
+	prefix := 0
+	for prefix < len(s) && prefix < len(t) && prefix < 4 && s[prefix] == t[prefix] {
+		prefix++
+	}
+	return jaro + float64(prefix)*0.1*(1-jaro)
+}
+
+// jaroSimilarity returns the Jaro similarity of the values, which depends on the number of characters they share
+// near the same position and on how many of them are transposed
+func jaroSimilarity(s, t []rune) float64 {
+	if len(s) == 0 && len(t) == 0 {
+		return 1
+	}
+	if len(s) == 0 || len(t) == 0 {
+		return 0
+	}
+
+	window := len(s)
+	if len(t) > window {
+		window = len(t)
+	}
+	window = window/2 - 1
+	if window < 0 {
+		window = 0
+	}
+
+	sMatched := make([]bool, len(s))
+	tMatched := make([]bool, len(t))
+	matches := 0
+	for i := range s {
+		start, end := i-window, i+window+1
+		if start < 0 {
+			start = 0
+		}
+		if end > len(t) {
+			end = len(t)
+		}
+		for j := start; j < end; j++ {
+			if !tMatched[j] && s[i] == t[j] {
+				sMatched[i], tMatched[j] = true, true
+				matches++
+				break
+			}
+		}
+	}
+	if matches == 0 {
+		return 0
+	}
+
+	transpositions := 0
+	j := 0
+	for i := range s {
+		if !sMatched[i] {
+			continue
+		}
+		for !tMatched[j] {
+			j++
+		}
+		if s[i] != t[j] {
+			transpositions++
+		}
+		j++
+	}
+
+	m := float64(matches)
+	return (m/float64(len(s)) + m/float64(len(t)) + (m-float64(transpositions)/2)/m) / 3
+}
@@ -0,0 +1,229 @@
+package payment
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/getaceres/payment-demo/payment/bank"
+	"github.com/google/uuid"
+)
+
+const (
+	// PaymentType is the only valid value of the type of a payment
+	PaymentType = "Payment"
+	// DateLayout is the format of the payment dates, which are ISO 8601 calendar dates
+	DateLayout = "2006-01-02"
+)
+
+// Codes of the field errors returned by Validate
+const (
+	RequiredCode        = "required"
+	InvalidDecimalCode  = "invalid_decimal"
+	NotPositiveCode     = "not_positive"
+	InvalidCurrencyCode = "invalid_currency"
+	InvalidDateCode     = "invalid_date"
+	InvalidTypeCode     = "invalid_type"
+	InvalidUUIDCode     = "invalid_uuid"
+)
+
+// FieldError describes why a field of a payment is not valid
+// swagger:model
+type FieldError struct {
+	// Field is the JSON path of the field, like attributes.debtor_party.account_number or attributes.charges_information.sender_charges.0.currency
+	Field string `json:"field"`
+	// Code identifies the kind of error so clients can handle it, like required or invalid_currency
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ValidationError is returned when a payment is not valid. It contains an error for every invalid field.
+type ValidationError struct {
+	Errors []FieldError
+}
+
+func (e ValidationError) Error() string {
+	messages := make([]string, 0, len(e.Errors))
+	for _, fieldError := range e.Errors {
+		messages = append(messages, fmt.Sprintf("%s: %s", fieldError.Field, fieldError.Message))
+	}
+	return "Invalid payment: " + strings.Join(messages, "; ")
+}
+
+// Validator checks that payments are valid
+type Validator struct {
+	// FX checks the consistency of the exchange information of the payments
+	FX FXChecker
+	// Modulus checks the UK account numbers of the beneficiary and debtor parties whose banks are identified by sort codes.
+	// They aren't checked if it is nil.
+	Modulus *bank.ModulusChecker
+}
+
+// DefaultValidator is the validator used by Validate
+var DefaultValidator = Validator{}
+
+// validation collects the errors of the fields of a payment
+type validation struct {
+	errors []FieldError
+}
+
+func (v *validation) add(field, code, format string, args ...interface{}) {
+	v.errors = append(v.errors, FieldError{Field: field, Code: code, Message: fmt.Sprintf(format, args...)})
+}
+
+// required adds a required error if the value is empty and returns false in that case
+func (v *validation) required(field, value string) bool {
+	if value == "" {
+		v.add(field, RequiredCode, "The field is required")
+		return false
+	}
+	return true
+}
+
+// positiveDecimal adds an error if the value is not a decimal number greater than zero
+// and returns the number and true if it is valid
+func (v *validation) positiveDecimal(field, value string) (Decimal, bool) {
+	number, err := ParseDecimal(value)
+	if err != nil {
+		v.add(field, InvalidDecimalCode, "%q is not a decimal number", value)
+		return number, false
+	}
+	if number.Sign() <= 0 {
+		v.add(field, NotPositiveCode, "%s is not greater than zero", value)
+		return number, false
+	}
+	return number, true
+}
+
+// currency adds an error if the value is not an ISO 4217 currency code and returns true if it is valid
+func (v *validation) currency(field, value string) bool {
+	if !IsCurrency(value) {
+		v.add(field, InvalidCurrencyCode, "%q is not an ISO 4217 currency code", value)
+		return false
+	}
+	return true
+}
+
+// merge adds the errors of the fields which don't have any error yet
+func (v *validation) merge(errors []FieldError) {
+	invalid := make(map[string]bool)
+	for _, fieldError := range v.errors {
+		invalid[fieldError.Field] = true
+	}
+	for _, fieldError := range errors {
+		if !invalid[fieldError.Field] {
+			v.errors = append(v.errors, fieldError)
+		}
+	}
+}
+
+func (v *validation) date(field, value string) {
+	if _, err := time.Parse(DateLayout, value); err != nil {
+		v.add(field, InvalidDateCode, "%q is not an ISO 8601 date like 2017-01-18", value)
+	}
+}
+
+func (v *validation) uuid(field, value string) {
+	if _, err := uuid.Parse(value); err != nil || len(value) != 36 {
+		v.add(field, InvalidUUIDCode, "%q is not a UUID like 743d5b63-8e6f-432e-a8fa-c5d8d2ee5fcb", value)
+	}
+}
+
+// party adds an error if the account number or the bank identifier of the party are not valid according to their codes
+func (v *validation) party(field string, party PaymentPartyType) {
+	if party.AccountNumber != "" {
+		v.bank(field+".account_number", bank.ValidateAccountNumber(party.AccountNumber, party.AccountNumberCode, party.BankIDCode))
+	}
+	if party.BankID != "" {
+		v.bank(field+".bank_id", bank.ValidateBankID(party.BankID, party.BankIDCode))
+	}
+}
+
+// modulus adds an error if the account number of a party whose bank is identified by a UK sort code fails the modulus check.
+// The sort code and account number of GB IBANs are the ones inside the IBAN. Parties with invalid account numbers or bank identifiers aren't checked.
+func (v *validation) modulus(field string, party PaymentPartyType, checker *bank.ModulusChecker) {
+	if checker == nil || party.BankIDCode != bank.SortCodeBankIDCode || party.AccountNumber == "" ||
+		bank.ValidateAccountNumber(party.AccountNumber, party.AccountNumberCode, party.BankIDCode) != nil ||
+		bank.ValidateBankID(party.BankID, party.BankIDCode) != nil {
+		return
+	}
+	sortCode, accountNumber := party.BankID, party.AccountNumber
+	switch party.AccountNumberCode {
+	case bank.IBANCode:
+		sortCode, accountNumber = accountNumber[8:14], accountNumber[14:]
+	case bank.BBANCode:
+	default:
+		return
+	}
+	v.bank(field+".account_number", checker.Check(sortCode, accountNumber))
+}
+
+// bank adds the error returned by a validation of the bank package if it is not nil
+func (v *validation) bank(field string, err error) {
+	if bankError, ok := err.(bank.Error); ok {
+		v.add(field, bankError.Code, "%s", bankError.Message)
+	}
+}
+
+// Validate checks that the payment is valid with the DefaultValidator
+func Validate(pay Payment) error {
+	return DefaultValidator.Validate(pay)
+}
+
+// Validate checks that the payment is valid, which means that its type is Payment, its organisation identifier is a UUID,
+// its amount is a decimal number greater than zero, its processing date is an ISO 8601 date and its currency and the currencies
+// of its charges are ISO 4217 codes. Type, organisation identifier, amount, currency and processing date are required,
+// as well as the currency of every sender charge and the receiver charges currency when there's a receiver charges amount.
+// The account numbers and bank identifiers of the parties must be valid according to their codes, as checked by the bank package,
+// and the UK account numbers of the beneficiary and the debtor must pass the modulus check if the validator has a modulus checker.
+// If the payment has exchange information, it must be consistent with the amount according to the FX checker.
+// It returns a ValidationError with the errors of all the invalid fields or nil if the payment is valid.
+func (validator Validator) Validate(pay Payment) error {
+	var v validation
+	if v.required("type", pay.Type) && pay.Type != PaymentType {
+		v.add("type", InvalidTypeCode, "%q is not a valid type. It must be %s", pay.Type, PaymentType)
+	}
+	if v.required("organisation_id", pay.OrganisationID) {
+		v.uuid("organisation_id", pay.OrganisationID)
+	}
+
+	attributes := pay.Attributes
+	if v.required("attributes.amount", attributes.Amount) {
+		v.positiveDecimal("attributes.amount", attributes.Amount)
+	}
+	if v.required("attributes.currency", attributes.Currency) {
+		v.currency("attributes.currency", attributes.Currency)
+	}
+	if v.required("attributes.processing_date", attributes.ProcessingDate) {
+		v.date("attributes.processing_date", attributes.ProcessingDate)
+	}
+
+	charges := attributes.ChargesInformation
+	for i, charge := range charges.SenderCharges {
+		field := fmt.Sprintf("attributes.charges_information.sender_charges.%d.currency", i)
+		if v.required(field, charge.Currency) {
+			v.currency(field, charge.Currency)
+		}
+	}
+	field := "attributes.charges_information.receiver_charges_currency"
+	if charges.ReceiverChargesCurrency != "" {
+		v.currency(field, charges.ReceiverChargesCurrency)
+	} else if charges.ReceiverChargesAmount != "" {
+		v.required(field, charges.ReceiverChargesCurrency)
+	}
+
+	v.party("attributes.beneficiary_party", attributes.BeneficiaryParty)
+	v.party("attributes.debtor_party", attributes.DebtorParty)
+	v.party("attributes.sponsor_party", attributes.SponsorParty)
+	v.modulus("attributes.beneficiary_party", attributes.BeneficiaryParty, validator.Modulus)
+	v.modulus("attributes.debtor_party", attributes.DebtorParty, validator.Modulus)
+
+	if attributes.FX.HasFX() {
+		v.merge(validator.FX.Check(pay).Errors)
+	}
+
+	if len(v.errors) > 0 {
+		return ValidationError{Errors: v.errors}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package payment
+
+import (
+	"testing"
+
+	"github.com/getaceres/payment-demo/payment/bank"
+	"github.com/google/go-cmp/cmp"
+)
+
+// testValidator checks the exchange information of the test payment, whose rate is quoted as OriginalPerUnit
+var testValidator = Validator{FX: FXChecker{Quote: OriginalPerUnit}}
+
+func TestValidate(t *testing.T) {
+	valid, err := GetDefaultTestPayment("../test_resources")
+	if err != nil {
+		t.Fatalf("Error getting test payment: %s", err.Error())
+	}
+	if err := testValidator.Validate(valid); err != nil {
+		t.Fatalf("Unexpected error validating test payment: %s", err.Error())
+	}
+
+	invalid := valid
+	invalid.Type = "Refund"
+	invalid.OrganisationID = "743d5b63"
+	invalid.Attributes.Amount = "-10.00"
+	invalid.Attributes.Currency = "XYZ"
+	invalid.Attributes.ProcessingDate = "18/01/2017"
+	invalid.Attributes.ChargesInformation.SenderCharges = []PaymentAmountType{
+		{Amount: "5.00", Currency: "GBP"},
+		{Amount: "5.00"},
+	}
+	invalid.Attributes.ChargesInformation.ReceiverChargesCurrency = "usd"
+	invalid.Attributes.DebtorParty.AccountNumber = "GB29XABC10161234567801"
+	invalid.Attributes.BeneficiaryParty.BankID = "40-30-00"
+	err = testValidator.Validate(invalid)
+	validationError, ok := err.(ValidationError)
+	if !ok {
+		t.Fatalf("Expected ValidationError validating invalid payment but got %v", err)
+	}
+	expected := map[string]string{
+		"type":                       InvalidTypeCode,
+		"organisation_id":            InvalidUUIDCode,
+		"attributes.amount":          NotPositiveCode,
+		"attributes.currency":        InvalidCurrencyCode,
+		"attributes.processing_date": InvalidDateCode,
+		"attributes.charges_information.sender_charges.1.currency": RequiredCode,
+		"attributes.charges_information.receiver_charges_currency": InvalidCurrencyCode,
+		"attributes.debtor_party.account_number":                   bank.InvalidIBANCode,
+		"attributes.beneficiary_party.bank_id":                     bank.InvalidSortCodeCode,
+	}
+	got := make(map[string]string)
+	for _, fieldError := range validationError.Errors {
+		got[fieldError.Field] = fieldError.Code
+	}
+	if !cmp.Equal(got, expected) {
+		t.Fatalf("Unexpected field errors.\nExpected:\n%v\nBut got:\n%v", expected, got)
+	}
+
+	amounts := map[string]string{
+		"":      RequiredCode,
+		"0.00":  NotPositiveCode,
+		"1e5":   InvalidDecimalCode,
+		"1/2":   InvalidDecimalCode,
+		"ten":   InvalidDecimalCode,
+		"0.001": "",
+	}
+	for amount, code := range amounts {
+		invalid := valid
+		invalid.Attributes.Amount = amount
+		invalid.Attributes.FX = PaymentExchangeInformationType{}
+		err := testValidator.Validate(invalid)
+		if code == "" {
+			if err != nil {
+				t.Errorf("Unexpected error validating amount %q: %s", amount, err.Error())
+			}
+			continue
+		}
+		validationError, ok := err.(ValidationError)
+		if !ok || len(validationError.Errors) != 1 || validationError.Errors[0].Code != code {
+			t.Errorf("Expected a single %s error validating amount %q but got %v", code, amount, err)
+		}
+	}
+}
+
+func TestValidateModulus(t *testing.T) {
+	checker, err := bank.LoadModulusChecker("../test_resources/valacdos.txt", "../test_resources/scsubtab.txt")
+	if err != nil {
+		t.Fatalf("Error loading modulus checker: %s", err.Error())
+	}
+	validator := testValidator
+	validator.Modulus = checker
+	valid, err := GetDefaultTestPayment("../test_resources")
+	if err != nil {
+		t.Fatalf("Error getting test payment: %s", err.Error())
+	}
+	valid.Attributes.BeneficiaryParty.BankID = "089999"
+	valid.Attributes.BeneficiaryParty.AccountNumber = "66374958"
+	valid.Attributes.DebtorParty.AccountNumber = "GB54XABC08999966374958"
+	valid.Attributes.SponsorParty.BankID = "089999"
+	valid.Attributes.SponsorParty.AccountNumber = "66374959"
+	if err := validator.Validate(valid); err != nil {
+		t.Fatalf("Unexpected error validating payment with valid account numbers: %s", err.Error())
+	}
+
+	invalid := valid
+	invalid.Attributes.BeneficiaryParty.AccountNumber = "66374959"
+	invalid.Attributes.DebtorParty.AccountNumber = "GB27XABC08999966374959"
+	err = validator.Validate(invalid)
+	validationError, ok := err.(ValidationError)
+	if !ok {
+		t.Fatalf("Expected ValidationError validating invalid account numbers but got %v", err)
+	}
+	expected := map[string]string{
+		"attributes.beneficiary_party.account_number": bank.InvalidModulusCode,
+		"attributes.debtor_party.account_number":      bank.InvalidModulusCode,
+	}
+	got := make(map[string]string)
+	for _, fieldError := range validationError.Errors {
+		got[fieldError.Field] = fieldError.Code
+	}
+	if !cmp.Equal(got, expected) {
+		t.Fatalf("Unexpected field errors.\nExpected:\n%v\nBut got:\n%v", expected, got)
+	}
+
+	if err := testValidator.Validate(invalid); err != nil {
+		t.Fatalf("Unexpected error validating account numbers without modulus checker: %s", err.Error())
+	}
+}
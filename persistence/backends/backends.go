@@ -0,0 +1,10 @@
+// Package backends registers all the persistence backends of the service, so their storage URLs
+// can be used with persistence.NewPaymentRepository. New backends must be imported here.
+package backends
+
+import (
+	// Every backend registers the storage URL schemes it supports when it's imported
+	_ "github.com/getaceres/payment-demo/persistence/bolt"
+	_ "github.com/getaceres/payment-demo/persistence/mongo"
+	_ "github.com/getaceres/payment-demo/persistence/sql"
+)
@@ -0,0 +1,940 @@
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"time"
+
+	"github.com/getaceres/payment-demo/payment"
+	"github.com/getaceres/payment-demo/persistence"
+	"github.com/google/uuid"
+	"go.etcd.io/bbolt"
+)
+
+var (
+	paymentBucketName   = []byte("payments")
+	indexBucketName     = []byte("indexes")
+	revisionBucketName  = []byte("revisions")
+	deletedBucketName   = []byte("deleted")
+	keyBucketName       = []byte("idempotency_keys")
+	expiryBucketName    = []byte("idempotency_expiry")
+	policyBucketName    = []byte("approval_policies")
+	duplicateBucketName = []byte("duplicate_policies")
+)
+
+func init() {
+	persistence.RegisterRepository("file", func(storage *url.URL) (persistence.PaymentRepository, error) {
+		return NewBoltPaymentRepository(persistence.StorageFilePath(storage))
+	})
+}
+
+// keySeparator separates the indexed value from the payment identifier in the index keys.
+// It is the lowest byte so the keys of a value go before the keys of any value which starts with it.
+const keySeparator = 0
+
+// BoltPaymentRepository keeps the payments in an embedded bolt database stored in a single file.
+// Payments are stored as JSON documents by identifier in the payments bucket.
+// Deleted payments are moved to the deleted bucket, so they are not indexed and they can't be found by queries.
+// The indexes bucket contains a bucket for every scalar payment field whose keys are the field values
+// followed by the identifiers of the payments which have them, so payments can be looked up by field value
+// without reading all the documents. Integer and string values are stored in order, so their indexes
+// can also be used for range conditions. Decimal values are stored in canonical form, so their indexes
+// can only be used for equality conditions.
+// The revisions bucket contains a bucket for every payment which has been stored whose keys are the revision numbers
+// and whose values are the revisions as JSON documents. Revisions are written in the same transaction as the change they record.
+// Idempotency keys are stored as JSON records by key in the idempotency_keys bucket in the same transaction as their payment.
+// The idempotency_expiry bucket contains their expiration times followed by the keys, so the expired keys are found in order
+// and removed every time a new key is stored.
+// Approval and duplicate policies are stored as JSON documents by organisation identifier
+// in the approval_policies and duplicate_policies buckets.
+// Sorting, field selection and pagination are done in memory over the payments matching the filter.
+// Queries over the payments as they were in the past read the revisions of all the payments without using the indexes.
+type BoltPaymentRepository struct {
+	db *bbolt.DB
+}
+
+// NewBoltPaymentRepository opens the bolt database in the given path, creating it if it doesn't exist.
+// The indexes of fields which are not indexed yet are built from the stored payments.
+func NewBoltPaymentRepository(path string) (*BoltPaymentRepository, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("Error opening bolt database %s: %s", path, err.Error())
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		payments, err := tx.CreateBucketIfNotExists(paymentBucketName)
+		if err != nil {
+			return err
+		}
+		indexes, err := tx.CreateBucketIfNotExists(indexBucketName)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(revisionBucketName); err != nil {
+			return err
+		}
+		for _, name := range [][]byte{deletedBucketName, keyBucketName, expiryBucketName, policyBucketName, duplicateBucketName} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		var missing []persistence.PaymentField
+		for _, field := range persistence.GetPaymentFields() {
+			if indexes.Bucket([]byte(field.Path)) != nil {
+				continue
+			}
+			if _, err := indexes.CreateBucket([]byte(field.Path)); err != nil {
+				return err
+			}
+			missing = append(missing, field)
+		}
+		if len(missing) == 0 {
+			return nil
+		}
+		return payments.ForEach(func(id, document []byte) error {
+			pay, err := decodePayment(document)
+			if err != nil {
+				return err
+			}
+			return updateIndexes(tx, missing, pay, putIndexKey)
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Error initializing bolt database %s: %s", path, err.Error())
+	}
+	return &BoltPaymentRepository{db: db}, nil
+}
+
+// Close closes the database file. The repository can't be used after closing it.
+func (b *BoltPaymentRepository) Close() error {
+	return b.db.Close()
+}
+
+func (b *BoltPaymentRepository) AddPayment(ctx context.Context, pay payment.Payment) (payment.Payment, error) {
+	err := b.update(ctx, func(tx *bbolt.Tx) error {
+		var err error
+		pay, err = insertPayment(ctx, tx, pay, nil)
+		return err
+	})
+	if err != nil {
+		return payment.Payment{}, wrapError(err, "Error saving payment: %s")
+	}
+	return pay, nil
+}
+
+func (b *BoltPaymentRepository) AddPaymentOnce(ctx context.Context, pay payment.Payment, key persistence.IdempotencyKey) (payment.Payment, bool, error) {
+	replayed := false
+	err := b.update(ctx, func(tx *bbolt.Tx) error {
+		stored, found, err := replayIdempotencyKey(tx, key)
+		if err != nil || found {
+			pay, replayed = stored, found
+			return err
+		}
+		pay, err = insertPayment(ctx, tx, pay, &key)
+		return err
+	})
+	if err != nil {
+		return payment.Payment{}, false, wrapError(err, "Error saving payment: %s")
+	}
+	return pay, replayed, nil
+}
+
+// AddPaymentUnlessDuplicate looks for the duplicates and saves the payment in the same write transaction,
+// which bolt runs one at a time.
+func (b *BoltPaymentRepository) AddPaymentUnlessDuplicate(ctx context.Context, pay payment.Payment, policy payment.DuplicatePolicy, key *persistence.IdempotencyKey) (payment.Payment, bool, error) {
+	replayed := false
+	err := b.update(ctx, func(tx *bbolt.Tx) error {
+		if key != nil {
+			stored, found, err := replayIdempotencyKey(tx, *key)
+			if err != nil || found {
+				pay, replayed = stored, found
+				return err
+			}
+		}
+		checked, err := persistence.ApplyDuplicatePolicy(pay, policy, func(query persistence.PaymentQuery) ([]payment.Payment, error) {
+			return findPayments(ctx, tx, query)
+		})
+		if err != nil {
+			return err
+		}
+		pay, err = insertPayment(ctx, tx, checked, key)
+		return err
+	})
+	if err != nil {
+		return payment.Payment{}, false, wrapError(err, "Error saving payment: %s")
+	}
+	return pay, replayed, nil
+}
+
+func (b *BoltPaymentRepository) GetIdempotencyRecord(ctx context.Context, key string) (persistence.IdempotencyRecord, error) {
+	var record persistence.IdempotencyRecord
+	err := b.view(ctx, func(tx *bbolt.Tx) error {
+		var found bool
+		var err error
+		record, found, err = getIdempotencyRecord(tx, key)
+		if err != nil {
+			return err
+		}
+		if !found || record.Expired(time.Now()) {
+			return persistence.NotFoundError{
+				ElementType: persistence.IdempotencyKeyElementType,
+				ID:          key,
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return record, wrapError(err, "Error getting idempotency key %s: %s", key)
+	}
+	return record, nil
+}
+
+func (b *BoltPaymentRepository) UpdatePayment(ctx context.Context, pay payment.Payment) (payment.Payment, error) {
+	id := pay.ID
+	if id == "" {
+		return pay, errors.New("Payment with empty identifier passed")
+	}
+
+	err := b.update(ctx, func(tx *bbolt.Tx) error {
+		stored, err := getPayment(tx, id)
+		if err != nil {
+			return err
+		}
+		if stored.Version != pay.Version {
+			return persistence.ConflictError{
+				ElementType:     persistence.PaymentElementType,
+				ID:              id,
+				ExpectedVersion: pay.Version,
+				ActualVersion:   stored.Version,
+			}
+		}
+		if err := deletePayment(tx, stored); err != nil {
+			return err
+		}
+		pay.Version++
+		if err := putPayment(tx, pay); err != nil {
+			return err
+		}
+		return addRevision(ctx, tx, persistence.UpdateOperation, pay)
+	})
+	if err != nil {
+		return pay, wrapError(err, "Error updating payment %s: %s", id)
+	}
+	return pay, nil
+}
+
+func (b *BoltPaymentRepository) DeletePayment(ctx context.Context, id string, expectedVersion int) (payment.Payment, error) {
+	var deleted payment.Payment
+	err := b.update(ctx, func(tx *bbolt.Tx) error {
+		var err error
+		deleted, err = getPayment(tx, id)
+		if err != nil {
+			return err
+		}
+		if expectedVersion != persistence.AnyVersion && deleted.Version != expectedVersion {
+			return persistence.ConflictError{
+				ElementType:     persistence.PaymentElementType,
+				ID:              id,
+				ExpectedVersion: expectedVersion,
+				ActualVersion:   deleted.Version,
+			}
+		}
+		if err := deletePayment(tx, deleted); err != nil {
+			return err
+		}
+		if err := putDocument(tx.Bucket(deletedBucketName), deleted); err != nil {
+			return err
+		}
+		return addRevision(ctx, tx, persistence.DeleteOperation, deleted)
+	})
+	if err != nil {
+		return deleted, wrapError(err, "Error deleting payment %s: %s", id)
+	}
+	return deleted, nil
+}
+
+func (b *BoltPaymentRepository) RestorePayment(ctx context.Context, id string, expectedVersion int) (payment.Payment, error) {
+	var restored payment.Payment
+	err := b.update(ctx, func(tx *bbolt.Tx) error {
+		var err error
+		restored, err = getDeletedPayment(tx, id)
+		if err != nil {
+			return err
+		}
+		if expectedVersion != persistence.AnyVersion && restored.Version != expectedVersion {
+			return persistence.ConflictError{
+				ElementType:     persistence.PaymentElementType,
+				ID:              id,
+				ExpectedVersion: expectedVersion,
+				ActualVersion:   restored.Version,
+			}
+		}
+		if err := tx.Bucket(deletedBucketName).Delete([]byte(id)); err != nil {
+			return err
+		}
+		restored.Version++
+		if err := putPayment(tx, restored); err != nil {
+			return err
+		}
+		return addRevision(ctx, tx, persistence.RestoreOperation, restored)
+	})
+	if err != nil {
+		return restored, wrapError(err, "Error restoring payment %s: %s", id)
+	}
+	return restored, nil
+}
+
+func (b *BoltPaymentRepository) PurgePayment(ctx context.Context, id string) (payment.Payment, error) {
+	var purged payment.Payment
+	err := b.update(ctx, func(tx *bbolt.Tx) error {
+		var err error
+		purged, err = getDeletedPayment(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(deletedBucketName).Delete([]byte(id)); err != nil {
+			return err
+		}
+		// Payments deleted before the revisions were recorded don't have them
+		if err := tx.Bucket(revisionBucketName).DeleteBucket([]byte(id)); err != nil && err != bbolt.ErrBucketNotFound {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return purged, wrapError(err, "Error purging payment %s: %s", id)
+	}
+	return purged, nil
+}
+
+func (b *BoltPaymentRepository) GetPayment(ctx context.Context, id string) (payment.Payment, error) {
+	var pay payment.Payment
+	err := b.view(ctx, func(tx *bbolt.Tx) error {
+		var err error
+		pay, err = getPayment(tx, id)
+		return err
+	})
+	if err != nil {
+		return pay, wrapError(err, "Error getting payment %s: %s", id)
+	}
+	return pay, nil
+}
+
+func (b *BoltPaymentRepository) GetPaymentAsOf(ctx context.Context, id string, asOf time.Time) (payment.Payment, error) {
+	revisions, err := b.GetPaymentRevisions(ctx, id)
+	if err != nil {
+		return payment.Payment{}, err
+	}
+	pay, ok := persistence.PaymentAsOf(revisions, asOf)
+	if !ok {
+		return pay, persistence.NotFoundError{
+			ElementType: persistence.PaymentElementType,
+			ID:          id,
+		}
+	}
+	return pay, nil
+}
+
+func (b *BoltPaymentRepository) GetPaymentRevisions(ctx context.Context, id string) ([]persistence.PaymentRevision, error) {
+	revisions := make([]persistence.PaymentRevision, 0)
+	err := b.view(ctx, func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(revisionBucketName).Bucket([]byte(id))
+		if bucket == nil {
+			return persistence.NotFoundError{
+				ElementType: persistence.PaymentElementType,
+				ID:          id,
+			}
+		}
+		return bucket.ForEach(func(key, document []byte) error {
+			revision, err := decodeRevision(document)
+			if err != nil {
+				return err
+			}
+			revisions = append(revisions, revision)
+			return nil
+		})
+	})
+	if err != nil {
+		return make([]persistence.PaymentRevision, 0), wrapError(err, "Error getting revisions of payment %s: %s", id)
+	}
+	return revisions, nil
+}
+
+func (b *BoltPaymentRepository) GetPaymentRevision(ctx context.Context, id string, revision int) (persistence.PaymentRevision, error) {
+	var result persistence.PaymentRevision
+	err := b.view(ctx, func(tx *bbolt.Tx) error {
+		var document []byte
+		if bucket := tx.Bucket(revisionBucketName).Bucket([]byte(id)); bucket != nil && revision > 0 {
+			document = bucket.Get(revisionKey(uint64(revision)))
+		}
+		if document == nil {
+			return persistence.RevisionNotFound(id, revision)
+		}
+		var err error
+		result, err = decodeRevision(document)
+		return err
+	})
+	if err != nil {
+		return result, wrapError(err, "Error getting revision %d of payment %s: %s", revision, id)
+	}
+	return result, nil
+}
+
+func (b *BoltPaymentRepository) GetPayments(ctx context.Context, filter map[string]string) ([]payment.Payment, error) {
+	query, err := persistence.NewFilterQuery(filter)
+	if err != nil {
+		return make([]payment.Payment, 0), err
+	}
+	return b.FindPayments(ctx, query)
+}
+
+func (b *BoltPaymentRepository) FindPayments(ctx context.Context, query persistence.PaymentQuery) ([]payment.Payment, error) {
+	payments, err := b.findPayments(ctx, query)
+	if err != nil {
+		return make([]payment.Payment, 0), err
+	}
+	return query.Apply(payments), nil
+}
+
+func (b *BoltPaymentRepository) GetPaymentPage(ctx context.Context, query persistence.PaymentQuery, page persistence.PageRequest) (persistence.PaymentPage, error) {
+	if err := query.ValidatePage(page); err != nil {
+		return persistence.PaymentPage{}, err
+	}
+	payments, err := b.findPayments(ctx, query)
+	if err != nil {
+		return persistence.PaymentPage{}, err
+	}
+	return query.Paginate(payments, page)
+}
+
+// findPayments returns the payments which satisfy all the filter conditions of the query, as they were at the AsOf time of the query if it's set.
+// If any of the conditions can use an index, only the payments found in it are read.
+func (b *BoltPaymentRepository) findPayments(ctx context.Context, query persistence.PaymentQuery) ([]payment.Payment, error) {
+	var result []payment.Payment
+	err := b.view(ctx, func(tx *bbolt.Tx) error {
+		var err error
+		result, err = findPayments(ctx, tx, query)
+		return err
+	})
+	if err != nil {
+		return make([]payment.Payment, 0), wrapError(err, "Error getting payments: %s")
+	}
+	return result, nil
+}
+
+// findPayments runs the query of BoltPaymentRepository.findPayments in the transaction
+func findPayments(ctx context.Context, tx *bbolt.Tx, query persistence.PaymentQuery) ([]payment.Payment, error) {
+	conditions := query.Filter
+	result := make([]payment.Payment, 0)
+	add := func(pay payment.Payment) {
+		if persistence.MatchesFilter(pay, conditions) {
+			result = append(result, pay)
+		}
+	}
+	check := func(document []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		pay, err := decodePayment(document)
+		if err != nil {
+			return err
+		}
+		add(pay)
+		return nil
+	}
+
+	if !query.AsOf.IsZero() {
+		err := tx.Bucket(revisionBucketName).ForEach(func(id, _ []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			pay, ok, err := paymentAsOf(tx.Bucket(revisionBucketName).Bucket(id), query.AsOf)
+			if ok {
+				add(pay)
+			}
+			return err
+		})
+		return result, err
+	}
+
+	payments := tx.Bucket(paymentBucketName)
+	ids, indexed := findCandidates(tx, conditions)
+	if !indexed {
+		err := payments.ForEach(func(id, document []byte) error {
+			return check(document)
+		})
+		return result, err
+	}
+	for _, id := range ids {
+		if document := payments.Get(id); document != nil {
+			if err := check(document); err != nil {
+				return result, err
+			}
+		}
+	}
+	return result, nil
+}
+
+func (b *BoltPaymentRepository) SaveApprovalPolicy(ctx context.Context, policy payment.ApprovalPolicy) error {
+	document, err := json.Marshal(policy)
+	if err != nil {
+		return fmt.Errorf("Error encoding approval policy: %s", err.Error())
+	}
+	err = b.update(ctx, func(tx *bbolt.Tx) error {
+		return tx.Bucket(policyBucketName).Put([]byte(policy.OrganisationID), document)
+	})
+	if err != nil {
+		return wrapError(err, "Error saving approval policy of organisation %s: %s", policy.OrganisationID)
+	}
+	return nil
+}
+
+func (b *BoltPaymentRepository) GetApprovalPolicy(ctx context.Context, organisationID string) (payment.ApprovalPolicy, error) {
+	var policy payment.ApprovalPolicy
+	err := b.view(ctx, func(tx *bbolt.Tx) error {
+		document := tx.Bucket(policyBucketName).Get([]byte(organisationID))
+		if document == nil {
+			return persistence.NotFoundError{
+				ElementType: persistence.ApprovalPolicyElementType,
+				ID:          organisationID,
+			}
+		}
+		if err := json.Unmarshal(document, &policy); err != nil {
+			return fmt.Errorf("Error decoding approval policy: %s", err.Error())
+		}
+		return nil
+	})
+	if err != nil {
+		return policy, wrapError(err, "Error getting approval policy of organisation %s: %s", organisationID)
+	}
+	return policy, nil
+}
+
+func (b *BoltPaymentRepository) DeleteApprovalPolicy(ctx context.Context, organisationID string) error {
+	err := b.update(ctx, func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(policyBucketName)
+		if bucket.Get([]byte(organisationID)) == nil {
+			return persistence.NotFoundError{
+				ElementType: persistence.ApprovalPolicyElementType,
+				ID:          organisationID,
+			}
+		}
+		return bucket.Delete([]byte(organisationID))
+	})
+	if err != nil {
+		return wrapError(err, "Error deleting approval policy of organisation %s: %s", organisationID)
+	}
+	return nil
+}
+
+func (b *BoltPaymentRepository) SaveDuplicatePolicy(ctx context.Context, policy payment.DuplicatePolicy) error {
+	document, err := json.Marshal(policy)
+	if err != nil {
+		return fmt.Errorf("Error encoding duplicate policy: %s", err.Error())
+	}
+	err = b.update(ctx, func(tx *bbolt.Tx) error {
+		return tx.Bucket(duplicateBucketName).Put([]byte(policy.OrganisationID), document)
+	})
+	if err != nil {
+		return wrapError(err, "Error saving duplicate policy of organisation %s: %s", policy.OrganisationID)
+	}
+	return nil
+}
+
+func (b *BoltPaymentRepository) GetDuplicatePolicy(ctx context.Context, organisationID string) (payment.DuplicatePolicy, error) {
+	var policy payment.DuplicatePolicy
+	err := b.view(ctx, func(tx *bbolt.Tx) error {
+		document := tx.Bucket(duplicateBucketName).Get([]byte(organisationID))
+		if document == nil {
+			return persistence.NotFoundError{
+				ElementType: persistence.DuplicatePolicyElementType,
+				ID:          organisationID,
+			}
+		}
+		if err := json.Unmarshal(document, &policy); err != nil {
+			return fmt.Errorf("Error decoding duplicate policy: %s", err.Error())
+		}
+		return nil
+	})
+	if err != nil {
+		return policy, wrapError(err, "Error getting duplicate policy of organisation %s: %s", organisationID)
+	}
+	return policy, nil
+}
+
+func (b *BoltPaymentRepository) DeleteDuplicatePolicy(ctx context.Context, organisationID string) error {
+	err := b.update(ctx, func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(duplicateBucketName)
+		if bucket.Get([]byte(organisationID)) == nil {
+			return persistence.NotFoundError{
+				ElementType: persistence.DuplicatePolicyElementType,
+				ID:          organisationID,
+			}
+		}
+		return bucket.Delete([]byte(organisationID))
+	})
+	if err != nil {
+		return wrapError(err, "Error deleting duplicate policy of organisation %s: %s", organisationID)
+	}
+	return nil
+}
+
+// update runs the function in a read-write transaction which is rolled back if the context is finished before committing it
+func (b *BoltPaymentRepository) update(ctx context.Context, function func(*bbolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		if err := function(tx); err != nil {
+			return err
+		}
+		return ctx.Err()
+	})
+}
+
+// view runs the function in a read-only transaction if the context is not finished
+func (b *BoltPaymentRepository) view(ctx context.Context, function func(*bbolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return b.db.View(function)
+}
+
+// wrapError adds the description of the failed operation to unexpected errors.
+// Persistence and context errors are returned as they are so callers can identify them.
+func wrapError(err error, format string, args ...interface{}) error {
+	switch err.(type) {
+	case persistence.NotFoundError, persistence.GoneError, persistence.NotDeletedError, persistence.ConflictError,
+		persistence.IdempotencyKeyReusedError, payment.DuplicatePaymentError:
+		return err
+	}
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return err
+	}
+	return fmt.Errorf(format, append(args, err.Error())...)
+}
+
+func decodePayment(document []byte) (payment.Payment, error) {
+	var pay payment.Payment
+	if err := json.Unmarshal(document, &pay); err != nil {
+		return pay, fmt.Errorf("Error decoding payment: %s", err.Error())
+	}
+	return pay, nil
+}
+
+// getPayment returns the payment with the given identifier or a GoneError if it is deleted
+func getPayment(tx *bbolt.Tx, id string) (payment.Payment, error) {
+	document := tx.Bucket(paymentBucketName).Get([]byte(id))
+	if document == nil {
+		if tx.Bucket(deletedBucketName).Get([]byte(id)) != nil {
+			return payment.Payment{}, persistence.GoneError{
+				ElementType: persistence.PaymentElementType,
+				ID:          id,
+			}
+		}
+		return payment.Payment{}, persistence.NotFoundError{
+			ElementType: persistence.PaymentElementType,
+			ID:          id,
+		}
+	}
+	return decodePayment(document)
+}
+
+// getDeletedPayment returns the deleted payment with the given identifier or a NotDeletedError if it is not deleted
+func getDeletedPayment(tx *bbolt.Tx, id string) (payment.Payment, error) {
+	document := tx.Bucket(deletedBucketName).Get([]byte(id))
+	if document == nil {
+		if tx.Bucket(paymentBucketName).Get([]byte(id)) != nil {
+			return payment.Payment{}, persistence.NotDeletedError{
+				ElementType: persistence.PaymentElementType,
+				ID:          id,
+			}
+		}
+		return payment.Payment{}, persistence.NotFoundError{
+			ElementType: persistence.PaymentElementType,
+			ID:          id,
+		}
+	}
+	return decodePayment(document)
+}
+
+func putPayment(tx *bbolt.Tx, pay payment.Payment) error {
+	if err := putDocument(tx.Bucket(paymentBucketName), pay); err != nil {
+		return err
+	}
+	return updateIndexes(tx, persistence.GetPaymentFields(), pay, putIndexKey)
+}
+
+// putDocument stores the payment as a JSON document in the bucket
+func putDocument(bucket *bbolt.Bucket, pay payment.Payment) error {
+	document, err := json.Marshal(pay)
+	if err != nil {
+		return fmt.Errorf("Error encoding payment: %s", err.Error())
+	}
+	return bucket.Put([]byte(pay.ID), document)
+}
+
+func deletePayment(tx *bbolt.Tx, pay payment.Payment) error {
+	if err := tx.Bucket(paymentBucketName).Delete([]byte(pay.ID)); err != nil {
+		return err
+	}
+	return updateIndexes(tx, persistence.GetPaymentFields(), pay, deleteIndexKey)
+}
+
+// addRevision records a change of a payment in its revision bucket, whose sequence gives the revision number
+func addRevision(ctx context.Context, tx *bbolt.Tx, operation persistence.RevisionOperation, pay payment.Payment) error {
+	bucket, err := tx.Bucket(revisionBucketName).CreateBucketIfNotExists([]byte(pay.ID))
+	if err != nil {
+		return err
+	}
+	sequence, err := bucket.NextSequence()
+	if err != nil {
+		return err
+	}
+	document, err := json.Marshal(persistence.NewPaymentRevision(ctx, operation, int(sequence), pay))
+	if err != nil {
+		return fmt.Errorf("Error encoding revision: %s", err.Error())
+	}
+	return bucket.Put(revisionKey(sequence), document)
+}
+
+// paymentAsOf returns the payment as it was at the given time according to the revisions of its revision bucket,
+// which are read from the last one until one recorded at or before that time is found.
+// It returns false if the payment didn't exist at that time or it had already been deleted.
+func paymentAsOf(bucket *bbolt.Bucket, asOf time.Time) (payment.Payment, bool, error) {
+	cursor := bucket.Cursor()
+	for key, document := cursor.Last(); key != nil; key, document = cursor.Prev() {
+		revision, err := decodeRevision(document)
+		if err != nil {
+			return payment.Payment{}, false, err
+		}
+		if !revision.Timestamp.After(asOf) {
+			return revision.Payment, revision.Operation != persistence.DeleteOperation, nil
+		}
+	}
+	return payment.Payment{}, false, nil
+}
+
+func getIdempotencyRecord(tx *bbolt.Tx, key string) (persistence.IdempotencyRecord, bool, error) {
+	var record persistence.IdempotencyRecord
+	document := tx.Bucket(keyBucketName).Get([]byte(key))
+	if document == nil {
+		return record, false, nil
+	}
+	if err := json.Unmarshal(document, &record); err != nil {
+		return record, false, fmt.Errorf("Error decoding idempotency key: %s", err.Error())
+	}
+	return record, true, nil
+}
+
+// replayIdempotencyKey returns the payment saved with the key and true if the key has been used and hasn't expired
+func replayIdempotencyKey(tx *bbolt.Tx, key persistence.IdempotencyKey) (payment.Payment, bool, error) {
+	record, found, err := getIdempotencyRecord(tx, key.Key)
+	if err != nil || !found || record.Expired(time.Now()) {
+		return payment.Payment{}, false, err
+	}
+	pay, err := record.Replay(key)
+	return pay, err == nil, err
+}
+
+// insertPayment saves the payment with a new identifier and its first revision,
+// along with the idempotency key if it's passed, removing the expired ones
+func insertPayment(ctx context.Context, tx *bbolt.Tx, pay payment.Payment, key *persistence.IdempotencyKey) (payment.Payment, error) {
+	if key != nil {
+		if err := deleteExpiredKeys(tx, time.Now()); err != nil {
+			return pay, err
+		}
+	}
+	pay.ID = uuid.New().String()
+	if err := putPayment(tx, pay); err != nil {
+		return pay, err
+	}
+	if err := addRevision(ctx, tx, persistence.CreateOperation, pay); err != nil {
+		return pay, err
+	}
+	if key == nil {
+		return pay, nil
+	}
+	return pay, putIdempotencyRecord(tx, persistence.IdempotencyRecord{IdempotencyKey: *key, Payment: pay})
+}
+
+func putIdempotencyRecord(tx *bbolt.Tx, record persistence.IdempotencyRecord) error {
+	document, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("Error encoding idempotency key: %s", err.Error())
+	}
+	if err := tx.Bucket(keyBucketName).Put([]byte(record.Key), document); err != nil {
+		return err
+	}
+	return tx.Bucket(expiryBucketName).Put(expiryKey(record.IdempotencyKey), nil)
+}
+
+// deleteExpiredKeys removes the idempotency keys which have expired at the given time
+func deleteExpiredKeys(tx *bbolt.Tx, now time.Time) error {
+	keys := tx.Bucket(keyBucketName)
+	cursor := tx.Bucket(expiryBucketName).Cursor()
+	limit := expiryKey(persistence.IdempotencyKey{ExpiresAt: now.Add(time.Nanosecond)})
+	for key, _ := cursor.First(); key != nil && bytes.Compare(key, limit) < 0; key, _ = cursor.First() {
+		if err := keys.Delete(key[8:]); err != nil {
+			return err
+		}
+		if err := cursor.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expiryKey encodes the expiration time of an idempotency key followed by the key,
+// so the byte order of the keys is the expiration order
+func expiryKey(key persistence.IdempotencyKey) []byte {
+	result := make([]byte, 8, 8+len(key.Key))
+	binary.BigEndian.PutUint64(result, uint64(key.ExpiresAt.UnixNano()))
+	return append(result, key.Key...)
+}
+
+// revisionKey encodes a revision number so the byte order of the keys is the revision order
+func revisionKey(revision uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, revision)
+	return key
+}
+
+func decodeRevision(document []byte) (persistence.PaymentRevision, error) {
+	var revision persistence.PaymentRevision
+	if err := json.Unmarshal(document, &revision); err != nil {
+		return revision, fmt.Errorf("Error decoding revision: %s", err.Error())
+	}
+	return revision, nil
+}
+
+func putIndexKey(index *bbolt.Bucket, key []byte) error {
+	return index.Put(key, nil)
+}
+
+func deleteIndexKey(index *bbolt.Bucket, key []byte) error {
+	return index.Delete(key)
+}
+
+// updateIndexes calls the function with the index bucket and the index key of every value of the given fields in the payment
+func updateIndexes(tx *bbolt.Tx, fields []persistence.PaymentField, pay payment.Payment, function func(*bbolt.Bucket, []byte) error) error {
+	indexes := tx.Bucket(indexBucketName)
+	for _, field := range fields {
+		index := indexes.Bucket([]byte(field.Path))
+		for _, value := range field.Values(pay) {
+			indexed, ok := indexValue(field, value)
+			if !ok {
+				continue
+			}
+			if err := function(index, indexKey(indexed, pay.ID)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// indexValue returns the representation of a field value in the index keys or false if the value can't be indexed
+// because it's not valid for the field kind. Integers are encoded so their byte order is their numeric order
+// and decimals are encoded in canonical form so equal amounts like 10.5 and 10.50 have the same representation.
+func indexValue(field persistence.PaymentField, value string) ([]byte, bool) {
+	parsed, err := field.ParseValue(value)
+	if err != nil {
+		return nil, false
+	}
+	switch typed := parsed.(type) {
+	case int64:
+		encoded := make([]byte, 8)
+		binary.BigEndian.PutUint64(encoded, uint64(typed)^(1<<63))
+		return encoded, true
+	case *big.Rat:
+		return []byte(typed.RatString()), true
+	}
+	return []byte(value), true
+}
+
+func indexKey(value []byte, id string) []byte {
+	key := make([]byte, 0, len(value)+1+len(id))
+	key = append(key, value...)
+	key = append(key, keySeparator)
+	return append(key, id...)
+}
+
+// splitIndexKey returns the indexed value and the payment identifier of an index key
+func splitIndexKey(key []byte) ([]byte, []byte) {
+	separator := bytes.LastIndexByte(key, keySeparator)
+	if separator < 0 {
+		return key, nil
+	}
+	return key[:separator], key[separator+1:]
+}
+
+// findCandidates returns the identifiers of the payments which may satisfy the conditions according to the index
+// of one of them, preferring equality conditions, or false if none of the conditions can use an index.
+// The payments must still be checked against all the conditions.
+func findCandidates(tx *bbolt.Tx, conditions []persistence.FilterCondition) ([][]byte, bool) {
+	var selected *persistence.FilterCondition
+	for i, condition := range conditions {
+		if condition.Operator == persistence.EqualOperator {
+			selected = &conditions[i]
+			break
+		}
+		if selected == nil && isRangeOperator(condition.Operator) && condition.Field.Kind != persistence.DecimalField {
+			selected = &conditions[i]
+		}
+	}
+	if selected == nil {
+		return nil, false
+	}
+	bound, ok := indexValue(selected.Field, selected.Value)
+	if !ok {
+		return nil, false
+	}
+
+	found := make(map[string]bool)
+	ids := make([][]byte, 0)
+	add := func(key []byte) {
+		_, id := splitIndexKey(key)
+		if !found[string(id)] {
+			found[string(id)] = true
+			ids = append(ids, id)
+		}
+	}
+
+	cursor := tx.Bucket(indexBucketName).Bucket([]byte(selected.Field.Path)).Cursor()
+	switch selected.Operator {
+	case persistence.EqualOperator:
+		prefix := append(bound, keySeparator)
+		for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+			add(key)
+		}
+	case persistence.GreaterOperator, persistence.GreaterOrEqualOperator:
+		for key, _ := cursor.Seek(bound); key != nil; key, _ = cursor.Next() {
+			add(key)
+		}
+	case persistence.LowerOperator, persistence.LowerOrEqualOperator:
+		for key, _ := cursor.First(); key != nil; key, _ = cursor.Next() {
+			if value, _ := splitIndexKey(key); bytes.Compare(value, bound) > 0 {
+				break
+			}
+			add(key)
+		}
+	}
+	return ids, true
+}
+
+func isRangeOperator(operator persistence.FilterOperator) bool {
+	switch operator {
+	case persistence.LowerOperator, persistence.LowerOrEqualOperator, persistence.GreaterOperator, persistence.GreaterOrEqualOperator:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,274 @@
+package bolt
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/getaceres/payment-demo/payment"
+	"github.com/getaceres/payment-demo/persistence"
+	"github.com/google/go-cmp/cmp"
+	"go.etcd.io/bbolt"
+)
+
+var tester = persistence.PaymentRepositoryTester{
+	ResourcesPath: "../../test_resources",
+}
+
+var databasePath string
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "payment-demo-bolt")
+	if err != nil {
+		fmt.Printf("Error creating temporary directory: %s", err.Error())
+		os.Exit(-1)
+	}
+	databasePath = filepath.Join(dir, "payments.db")
+	repo, err := NewBoltPaymentRepository(databasePath)
+	if err != nil {
+		fmt.Printf("Error getting bolt repository: %s", err.Error())
+		os.Exit(-1)
+	}
+	tester.Repository = repo
+
+	code := m.Run()
+	tester.Repository.(*BoltPaymentRepository).Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestAdd(t *testing.T) {
+	tester.TestAdd(t)
+}
+
+func TestUpdate(t *testing.T) {
+	tester.TestUpdate(t)
+}
+
+func TestDelete(t *testing.T) {
+	tester.TestDelete(t)
+}
+
+func TestRestore(t *testing.T) {
+	tester.TestRestore(t)
+}
+
+func TestPurge(t *testing.T) {
+	tester.TestPurge(t)
+}
+
+func TestIdempotency(t *testing.T) {
+	tester.TestIdempotency(t, 10)
+}
+
+func TestGetId(t *testing.T) {
+	tester.TestGetId(t)
+}
+
+func TestGetList(t *testing.T) {
+	tester.TestGetList(t, 10)
+}
+
+func TestFilter(t *testing.T) {
+	tester.TestFilter(t)
+}
+
+func TestQuery(t *testing.T) {
+	tester.TestQuery(t)
+}
+
+func TestPagination(t *testing.T) {
+	tester.TestPagination(t)
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	tester.TestConcurrentAccess(t, 20, 10)
+}
+
+func TestCancelledContext(t *testing.T) {
+	tester.TestCancelledContext(t)
+}
+
+func TestHistory(t *testing.T) {
+	tester.TestHistory(t)
+}
+
+func TestAsOf(t *testing.T) {
+	tester.TestAsOf(t)
+}
+
+func TestStatus(t *testing.T) {
+	tester.TestStatus(t)
+}
+
+func TestSanctionsHits(t *testing.T) {
+	tester.TestSanctionsHits(t)
+}
+
+func TestRisk(t *testing.T) {
+	tester.TestRisk(t)
+}
+
+func TestDuplicates(t *testing.T) {
+	tester.TestDuplicates(t)
+}
+
+func TestAddUnlessDuplicate(t *testing.T) {
+	tester.TestAddUnlessDuplicate(t, 10)
+}
+
+func TestApprovalPolicies(t *testing.T) {
+	tester.TestApprovalPolicies(t)
+}
+
+func TestDuplicatePolicies(t *testing.T) {
+	tester.TestDuplicatePolicies(t)
+}
+
+// TestIndexes checks that the index entries of a payment follow its changes and are removed with it
+func TestIndexes(t *testing.T) {
+	repo := tester.Repository.(*BoltPaymentRepository)
+	pay, err := payment.GetDefaultTestPayment(tester.ResourcesPath)
+	if err != nil {
+		t.Fatalf("Error getting default payment: %s", err.Error())
+	}
+	pay, err = repo.AddPayment(context.Background(), pay)
+	if err != nil {
+		t.Fatalf("Error adding payment: %s", err.Error())
+	}
+	checkIndexEntries(t, repo, pay, map[string][]string{
+		"attributes.currency": {"GBP"},
+		"attributes.amount":   {"10021/100"},
+		"attributes.charges_information.sender_charges.currency": {"GBP", "USD"},
+	})
+
+	pay.Attributes.Currency = "EUR"
+	pay.Attributes.Amount = "50.50"
+	pay, err = repo.UpdatePayment(context.Background(), pay)
+	if err != nil {
+		t.Fatalf("Error updating payment: %s", err.Error())
+	}
+	checkIndexEntries(t, repo, pay, map[string][]string{
+		"attributes.currency": {"EUR"},
+		"attributes.amount":   {"101/2"},
+	})
+
+	if _, err := repo.DeletePayment(context.Background(), pay.ID, persistence.AnyVersion); err != nil {
+		t.Fatalf("Error deleting payment: %s", err.Error())
+	}
+	checkIndexEntries(t, repo, pay, map[string][]string{
+		"attributes.currency": nil,
+		"attributes.amount":   nil,
+		"attributes.charges_information.sender_charges.currency": nil,
+	})
+}
+
+func checkIndexEntries(t *testing.T, repo *BoltPaymentRepository, pay payment.Payment, expected map[string][]string) {
+	err := repo.db.View(func(tx *bbolt.Tx) error {
+		for path, values := range expected {
+			var found []string
+			index := tx.Bucket(indexBucketName).Bucket([]byte(path))
+			index.ForEach(func(key, _ []byte) error {
+				value, id := splitIndexKey(key)
+				if string(id) == pay.ID {
+					found = append(found, string(value))
+				}
+				return nil
+			})
+			if !cmp.Equal(found, values) {
+				t.Errorf("Unexpected index entries of field %s for payment %s. Expected %v but got %v", path, pay.ID, values, found)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error reading indexes: %s", err.Error())
+	}
+}
+
+// TestPurgeWithoutRevisions checks that payments stored before the revisions were recorded can be purged
+func TestPurgeWithoutRevisions(t *testing.T) {
+	repo := tester.Repository.(*BoltPaymentRepository)
+	pay, err := payment.GetDefaultTestPayment(tester.ResourcesPath)
+	if err != nil {
+		t.Fatalf("Error getting default payment: %s", err.Error())
+	}
+	pay, err = repo.AddPayment(context.Background(), pay)
+	if err != nil {
+		t.Fatalf("Error adding payment: %s", err.Error())
+	}
+	if _, err := repo.DeletePayment(context.Background(), pay.ID, persistence.AnyVersion); err != nil {
+		t.Fatalf("Error deleting payment: %s", err.Error())
+	}
+	err = repo.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(revisionBucketName).DeleteBucket([]byte(pay.ID))
+	})
+	if err != nil {
+		t.Fatalf("Error deleting revisions: %s", err.Error())
+	}
+
+	if _, err := repo.PurgePayment(context.Background(), pay.ID); err != nil {
+		t.Fatalf("Error purging payment without revisions: %s", err.Error())
+	}
+	if _, err := repo.PurgePayment(context.Background(), pay.ID); err == nil {
+		t.Fatalf("Expected error purging payment %s twice", pay.ID)
+	}
+}
+
+// TestReopen checks that the payments are kept after closing the database and that missing indexes are rebuilt
+func TestReopen(t *testing.T) {
+	path := filepath.Join(filepath.Dir(databasePath), "reopen.db")
+	repo, err := NewBoltPaymentRepository(path)
+	if err != nil {
+		t.Fatalf("Error getting bolt repository: %s", err.Error())
+	}
+	pay, err := payment.GetDefaultTestPayment(tester.ResourcesPath)
+	if err != nil {
+		t.Fatalf("Error getting default payment: %s", err.Error())
+	}
+	pay, err = repo.AddPayment(context.Background(), pay)
+	if err != nil {
+		t.Fatalf("Error adding payment: %s", err.Error())
+	}
+
+	err = repo.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(indexBucketName).DeleteBucket([]byte("attributes.currency"))
+	})
+	if err != nil {
+		t.Fatalf("Error deleting index: %s", err.Error())
+	}
+	repo.Close()
+
+	repo, err = NewBoltPaymentRepository(path)
+	if err != nil {
+		t.Fatalf("Error reopening bolt repository: %s", err.Error())
+	}
+	defer repo.Close()
+
+	got, err := repo.GetPayment(context.Background(), pay.ID)
+	if err != nil {
+		t.Fatalf("Error getting payment after reopening: %s", err.Error())
+	}
+	if !cmp.Equal(got, pay) {
+		t.Fatalf("Payment differs after reopening.\nReturned:\n%v\nBut expected:\n%v", got, pay)
+	}
+
+	found, err := repo.GetPayments(context.Background(), map[string]string{"attributes.currency": pay.Attributes.Currency})
+	if err != nil {
+		t.Fatalf("Error filtering payments after reopening: %s", err.Error())
+	}
+	if len(found) != 1 || found[0].ID != pay.ID {
+		t.Fatalf("Expected payment %s to be found by the rebuilt index but got %v", pay.ID, found)
+	}
+}
+
+func TestStorageURL(t *testing.T) {
+	repo, err := persistence.NewPaymentRepository("file:" + filepath.Join(filepath.Dir(databasePath), "storage.db"))
+	if err != nil {
+		t.Fatalf("Error building repository from storage URL: %s", err.Error())
+	}
+	defer repo.(*BoltPaymentRepository).Close()
+}
@@ -0,0 +1,103 @@
+package persistence
+
+import (
+	"context"
+	"time"
+
+	"github.com/getaceres/payment-demo/payment"
+)
+
+// discardedStatuses contains the statuses of the payments which won't be paid, so they are not originals of duplicates
+var discardedStatuses = []string{payment.RejectedStatus, payment.ReturnedStatus, payment.CancelledStatus, payment.BlockedStatus}
+
+// NewDuplicateQuery builds a query which returns the identifiers of the payments which the payment would duplicate
+// according to the policy: payments of the same organisation with the same end to end reference, amount, currency
+// and beneficiary account number whose processing date is within the window of the policy, unless they won't be paid.
+// It returns false if the payment has no end to end reference, since then it can't be told apart from legitimate
+// payments with the same amount to the same beneficiary.
+func NewDuplicateQuery(pay payment.Payment, policy payment.DuplicatePolicy) (PaymentQuery, bool, error) {
+	attributes := pay.Attributes
+	if attributes.EndToEndReference == "" {
+		return PaymentQuery{}, false, nil
+	}
+	query, err := NewFilterQuery(map[string]string{
+		"organisation_id":                             pay.OrganisationID,
+		"attributes.end_to_end_reference":             attributes.EndToEndReference,
+		"attributes.amount":                           attributes.Amount,
+		"attributes.currency":                         attributes.Currency,
+		"attributes.beneficiary_party.account_number": attributes.BeneficiaryParty.AccountNumber,
+	})
+	if err != nil {
+		return query, false, err
+	}
+
+	dates := []FilterCondition{{Operator: EqualOperator, Value: attributes.ProcessingDate}}
+	if date, err := time.Parse(payment.DateLayout, attributes.ProcessingDate); err == nil && policy.WindowDays > 0 {
+		dates = []FilterCondition{
+			{Operator: GreaterOrEqualOperator, Value: date.AddDate(0, 0, -policy.WindowDays).Format(payment.DateLayout)},
+			{Operator: LowerOrEqualOperator, Value: date.AddDate(0, 0, policy.WindowDays).Format(payment.DateLayout)},
+		}
+	}
+	for _, condition := range dates {
+		if condition.Field, err = GetPaymentField("attributes.processing_date"); err != nil {
+			return query, false, err
+		}
+		query.Filter = append(query.Filter, condition)
+	}
+	for _, status := range discardedStatuses {
+		condition, err := NewFilterCondition("status", NotEqualOperator, status)
+		if err != nil {
+			return query, false, err
+		}
+		query.Filter = append(query.Filter, condition)
+	}
+
+	id, err := GetSelectablePaymentField("id")
+	if err != nil {
+		return query, false, err
+	}
+	query.Fields = []PaymentField{id}
+	return query, true, nil
+}
+
+// ApplyDuplicatePolicy looks for the payments which the payment duplicates with the find function and returns the payment
+// flagged as a duplicate of the first one found, or a DuplicatePaymentError if the policy rejects duplicates.
+// The payment is returned as it is if no payment is found.
+func ApplyDuplicatePolicy(pay payment.Payment, policy payment.DuplicatePolicy, find func(PaymentQuery) ([]payment.Payment, error)) (payment.Payment, error) {
+	query, ok, err := NewDuplicateQuery(pay, policy)
+	if err != nil || !ok {
+		return pay, err
+	}
+	originals, err := find(query)
+	if err != nil || len(originals) == 0 {
+		return pay, err
+	}
+	return policy.Duplicate(pay, originals[0].ID)
+}
+
+// CheckAndAddPayment implements AddPaymentUnlessDuplicate with the rest of operations of the repository
+// for the repositories which can't run them in a single transaction. The caller must hold a lock which serializes
+// the calls for the payments which could duplicate each other.
+func CheckAndAddPayment(ctx context.Context, repository PaymentRepository, pay payment.Payment, policy payment.DuplicatePolicy, key *IdempotencyKey) (payment.Payment, bool, error) {
+	if key != nil {
+		record, err := repository.GetIdempotencyRecord(ctx, key.Key)
+		if err == nil {
+			replayed, err := record.Replay(*key)
+			return replayed, err == nil, err
+		}
+		if _, ok := err.(NotFoundError); !ok {
+			return pay, false, err
+		}
+	}
+	pay, err := ApplyDuplicatePolicy(pay, policy, func(query PaymentQuery) ([]payment.Payment, error) {
+		return repository.FindPayments(ctx, query)
+	})
+	if err != nil {
+		return pay, false, err
+	}
+	if key != nil {
+		return repository.AddPaymentOnce(ctx, pay, *key)
+	}
+	pay, err = repository.AddPayment(ctx, pay)
+	return pay, false, err
+}
@@ -0,0 +1,430 @@
+package persistence
+
+import (
+	"fmt"
+	"math/big"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/getaceres/payment-demo/payment"
+)
+
+// FieldKind determines how the values of a payment field are compared
+type FieldKind int
+
+const (
+	// StringField values are compared as plain strings
+	StringField FieldKind = iota
+	// IntegerField values are compared as integer numbers
+	IntegerField
+	// DecimalField values are decimal numbers stored as strings which are compared by their numeric value
+	DecimalField
+)
+
+// decimalFieldPaths contains the string fields of a payment which hold decimal amounts
+var decimalFieldPaths = map[string]bool{
+	"attributes.amount": true,
+	"attributes.charges_information.sender_charges.amount":   true,
+	"attributes.charges_information.receiver_charges_amount": true,
+	"attributes.fx.exchange_rate":                            true,
+	"attributes.fx.original_amount":                          true,
+}
+
+// UnknownFieldReason is the reason of the InvalidFieldError returned when a path doesn't correspond to any payment field
+const UnknownFieldReason = "not a payment field"
+
+// PaymentField describes a field of a payment which can be used to filter, sort or select payment information
+type PaymentField struct {
+	// Path is the JSON path of the field inside a payment document, like attributes.currency
+	Path string
+	// Names contains the Go names of the struct fields traversed to reach the field, like [Attributes Currency]
+	Names []string
+	// Kind determines how the values of this field are compared
+	Kind FieldKind
+	// Scalar is true if the field holds simple values instead of a nested object
+	Scalar bool
+	// Repeated is true if the path traverses a list so the field may have several values in the same payment
+	Repeated bool
+	index    [][]int
+}
+
+// InvalidFieldError is returned when a payment field path does not exist or it is not usable for the requested operation
+type InvalidFieldError struct {
+	Path   string
+	Reason string
+}
+
+// InvalidValueError is returned when a filter value can't be compared with the values of a payment field
+type InvalidValueError struct {
+	Path  string
+	Value string
+}
+
+func (e InvalidFieldError) Error() string {
+	return fmt.Sprintf("Invalid field %s: %s", e.Path, e.Reason)
+}
+
+func (e InvalidValueError) Error() string {
+	return fmt.Sprintf("Invalid value %q for field %s", e.Value, e.Path)
+}
+
+var paymentFields = buildPaymentFields()
+
+func buildPaymentFields() map[string]PaymentField {
+	fields := make(map[string]PaymentField)
+	collectPaymentFields(reflect.TypeOf(payment.Payment{}), PaymentField{}, fields)
+	return fields
+}
+
+func collectPaymentFields(t reflect.Type, parent PaymentField, fields map[string]PaymentField) {
+	for i := 0; i < t.NumField(); i++ {
+		structField := t.Field(i)
+		name := strings.Split(structField.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+
+		field := PaymentField{
+			Path:     name,
+			Names:    append(append([]string{}, parent.Names...), structField.Name),
+			Repeated: parent.Repeated,
+			index:    append(append([][]int{}, parent.index...), structField.Index),
+		}
+		if parent.Path != "" {
+			field.Path = parent.Path + "." + name
+		}
+
+		fieldType := structField.Type
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		if fieldType.Kind() == reflect.Slice {
+			field.Repeated = true
+			fieldType = fieldType.Elem()
+		}
+
+		switch fieldType.Kind() {
+		case reflect.Struct:
+			fields[field.Path] = field
+			collectPaymentFields(fieldType, field, fields)
+		case reflect.String:
+			field.Kind = StringField
+			if decimalFieldPaths[field.Path] {
+				field.Kind = DecimalField
+			}
+			field.Scalar = true
+			fields[field.Path] = field
+		case reflect.Int, reflect.Int32, reflect.Int64:
+			field.Kind = IntegerField
+			field.Scalar = true
+			fields[field.Path] = field
+		}
+	}
+}
+
+// GetPaymentField returns the description of the scalar payment field with the given JSON path
+func GetPaymentField(path string) (PaymentField, error) {
+	field, ok := paymentFields[path]
+	if !ok {
+		return field, InvalidFieldError{Path: path, Reason: UnknownFieldReason}
+	}
+	if !field.Scalar {
+		return field, InvalidFieldError{Path: path, Reason: "not a scalar field"}
+	}
+	return field, nil
+}
+
+// GetSelectablePaymentField returns the description of the payment field with the given JSON path
+// if it can be selected in a query. Nested objects can be selected but fields inside lists can't.
+func GetSelectablePaymentField(path string) (PaymentField, error) {
+	field, ok := paymentFields[path]
+	if !ok {
+		return field, InvalidFieldError{Path: path, Reason: UnknownFieldReason}
+	}
+	if paymentFields[parentPath(path)].Repeated {
+		return field, InvalidFieldError{Path: path, Reason: "fields inside lists can't be selected"}
+	}
+	return field, nil
+}
+
+func parentPath(path string) string {
+	if i := strings.LastIndex(path, "."); i >= 0 {
+		return path[:i]
+	}
+	return ""
+}
+
+// GetPaymentFields returns the description of all the scalar payment fields sorted by path
+func GetPaymentFields() []PaymentField {
+	result := make([]PaymentField, 0, len(paymentFields))
+	for _, field := range paymentFields {
+		if field.Scalar {
+			result = append(result, field)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Path < result[j].Path
+	})
+	return result
+}
+
+// Values returns the values this field has in the given payment formatted as strings.
+// The result is empty if the field is not set and it may contain several values if the field is repeated.
+func (f PaymentField) Values(pay payment.Payment) []string {
+	values := []reflect.Value{reflect.ValueOf(pay)}
+	for _, index := range f.index {
+		next := make([]reflect.Value, 0, len(values))
+		for _, value := range values {
+			next = appendFieldValues(next, value.FieldByIndex(index))
+		}
+		values = next
+	}
+
+	result := make([]string, 0, len(values))
+	for _, value := range values {
+		switch value.Kind() {
+		case reflect.String:
+			result = append(result, value.String())
+		case reflect.Int, reflect.Int32, reflect.Int64:
+			result = append(result, strconv.FormatInt(value.Int(), 10))
+		}
+	}
+	return result
+}
+
+func appendFieldValues(values []reflect.Value, value reflect.Value) []reflect.Value {
+	switch value.Kind() {
+	case reflect.Ptr:
+		if value.IsNil() {
+			return values
+		}
+		return appendFieldValues(values, value.Elem())
+	case reflect.Slice:
+		for i := 0; i < value.Len(); i++ {
+			values = appendFieldValues(values, value.Index(i))
+		}
+		return values
+	}
+	return append(values, value)
+}
+
+// SetValue sets this field in the payment to the value, formatted as returned by Values.
+// It returns an InvalidFieldError if the field is not scalar or it's inside a list
+// and an InvalidValueError if the value is not valid for an integer field.
+func (f PaymentField) SetValue(pay *payment.Payment, value string) error {
+	if !f.Scalar || f.Repeated {
+		return InvalidFieldError{Path: f.Path, Reason: "only scalar fields outside lists can be set"}
+	}
+	target := reflect.ValueOf(pay).Elem()
+	for _, index := range f.index {
+		target = target.FieldByIndex(index)
+		if target.Kind() == reflect.Ptr {
+			if target.IsNil() {
+				target.Set(reflect.New(target.Type().Elem()))
+			}
+			target = target.Elem()
+		}
+	}
+
+	switch target.Kind() {
+	case reflect.String:
+		target.SetString(value)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return InvalidValueError{Path: f.Path, Value: value}
+		}
+		target.SetInt(parsed)
+	}
+	return nil
+}
+
+// ParseValue validates a string value against the kind of this field.
+// It returns a string for string fields, an int64 for integer fields and a *big.Rat for decimal fields.
+func (f PaymentField) ParseValue(value string) (interface{}, error) {
+	switch f.Kind {
+	case IntegerField:
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, InvalidValueError{Path: f.Path, Value: value}
+		}
+		return parsed, nil
+	case DecimalField:
+		parsed, ok := parseDecimal(value)
+		if !ok {
+			return nil, InvalidValueError{Path: f.Path, Value: value}
+		}
+		return parsed, nil
+	}
+	return value, nil
+}
+
+// Compare compares two values of this field returning -1, 0 or 1 if a is lower, equal or greater than b.
+// Values which can't be parsed according to the field kind are lower than any valid value.
+func (f PaymentField) Compare(a, b string) int {
+	parsedA, errA := f.ParseValue(a)
+	parsedB, errB := f.ParseValue(b)
+	switch {
+	case errA != nil && errB != nil:
+		return strings.Compare(a, b)
+	case errA != nil:
+		return -1
+	case errB != nil:
+		return 1
+	}
+
+	switch f.Kind {
+	case IntegerField:
+		x, y := parsedA.(int64), parsedB.(int64)
+		if x < y {
+			return -1
+		} else if x > y {
+			return 1
+		}
+		return 0
+	case DecimalField:
+		return parsedA.(*big.Rat).Cmp(parsedB.(*big.Rat))
+	}
+	return strings.Compare(a, b)
+}
+
+func parseDecimal(value string) (*big.Rat, bool) {
+	decimal, err := payment.ParseDecimal(value)
+	if err != nil {
+		return nil, false
+	}
+	return decimal.Rat(), true
+}
+
+// FilterOperator is the comparison applied by a filter condition between the payment field and the condition value
+type FilterOperator string
+
+const (
+	// EqualOperator matches if the field is equal to the value
+	EqualOperator FilterOperator = "eq"
+	// NotEqualOperator matches if the field is not equal to the value
+	NotEqualOperator FilterOperator = "ne"
+	// LowerOperator matches if the field is lower than the value
+	LowerOperator FilterOperator = "lt"
+	// LowerOrEqualOperator matches if the field is lower than or equal to the value
+	LowerOrEqualOperator FilterOperator = "lte"
+	// GreaterOperator matches if the field is greater than the value
+	GreaterOperator FilterOperator = "gt"
+	// GreaterOrEqualOperator matches if the field is greater than or equal to the value
+	GreaterOrEqualOperator FilterOperator = "gte"
+)
+
+var filterOperators = map[FilterOperator]bool{
+	EqualOperator:          true,
+	NotEqualOperator:       true,
+	LowerOperator:          true,
+	LowerOrEqualOperator:   true,
+	GreaterOperator:        true,
+	GreaterOrEqualOperator: true,
+}
+
+// InvalidOperatorError is returned when a filter condition uses an unknown operator
+type InvalidOperatorError struct {
+	Path     string
+	Operator FilterOperator
+}
+
+func (e InvalidOperatorError) Error() string {
+	return fmt.Sprintf("Invalid operator %q for field %s", e.Operator, e.Path)
+}
+
+// FilterCondition is a condition over a payment field that a payment must satisfy to be returned in a list
+type FilterCondition struct {
+	Field    PaymentField
+	Operator FilterOperator
+	Value    string
+}
+
+// NewFilterCondition builds a condition over the payment field with the given JSON path.
+// It returns an InvalidFieldError, InvalidOperatorError or InvalidValueError if any of the parameters is not valid.
+func NewFilterCondition(path string, operator FilterOperator, value string) (FilterCondition, error) {
+	var condition FilterCondition
+	field, err := GetPaymentField(path)
+	if err != nil {
+		return condition, err
+	}
+	if !filterOperators[operator] {
+		return condition, InvalidOperatorError{Path: path, Operator: operator}
+	}
+	if _, err := field.ParseValue(value); err != nil {
+		return condition, err
+	}
+	return FilterCondition{Field: field, Operator: operator, Value: value}, nil
+}
+
+// ParseFilter converts a filter expressed as a map of JSON field paths to values into a list of equality conditions.
+// It returns an InvalidFieldError or InvalidValueError if any of the paths or values is not valid.
+func ParseFilter(filter map[string]string) ([]FilterCondition, error) {
+	paths := make([]string, 0, len(filter))
+	for path := range filter {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	conditions := make([]FilterCondition, 0, len(filter))
+	for _, path := range paths {
+		condition, err := NewFilterCondition(path, EqualOperator, filter[path])
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, condition)
+	}
+	return conditions, nil
+}
+
+// Matches returns true if the payment satisfies the condition.
+// Values which can't be parsed according to the field kind are ignored, as if the field was not set.
+// For repeated fields, the not equal operator matches if none of the values is equal to the condition value
+// and the rest of operators match if any of the values satisfies the comparison.
+func (c FilterCondition) Matches(pay payment.Payment) bool {
+	for _, value := range c.Field.Values(pay) {
+		if _, err := c.Field.ParseValue(value); err != nil {
+			continue
+		}
+		comparison := c.Field.Compare(value, c.Value)
+		switch c.Operator {
+		case EqualOperator:
+			if comparison == 0 {
+				return true
+			}
+		case NotEqualOperator:
+			if comparison == 0 {
+				return false
+			}
+		case LowerOperator:
+			if comparison < 0 {
+				return true
+			}
+		case LowerOrEqualOperator:
+			if comparison <= 0 {
+				return true
+			}
+		case GreaterOperator:
+			if comparison > 0 {
+				return true
+			}
+		case GreaterOrEqualOperator:
+			if comparison >= 0 {
+				return true
+			}
+		}
+	}
+	return c.Operator == NotEqualOperator
+}
+
+// MatchesFilter returns true if the payment satisfies all the given conditions
+func MatchesFilter(pay payment.Payment, conditions []FilterCondition) bool {
+	for _, condition := range conditions {
+		if !condition.Matches(pay) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,80 @@
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/getaceres/payment-demo/payment"
+)
+
+const (
+	RevisionElementType = "Payment revision"
+)
+
+// RevisionOperation is the kind of change recorded by a payment revision
+type RevisionOperation string
+
+const (
+	CreateOperation  RevisionOperation = "create"
+	UpdateOperation  RevisionOperation = "update"
+	DeleteOperation  RevisionOperation = "delete"
+	RestoreOperation RevisionOperation = "restore"
+)
+
+// PaymentRevision is an immutable record of a change of a payment.
+// Revisions of a payment are numbered from 1 in the order the changes happened and contain the whole payment document
+// after the change. They are kept after the payment is deleted and removed when it is purged.
+// swagger:model
+type PaymentRevision struct {
+	PaymentID string            `json:"payment_id"`
+	Revision  int               `json:"revision"`
+	Operation RevisionOperation `json:"operation"`
+	Timestamp time.Time         `json:"timestamp"`
+	// Actor is the user who made the change, as set in the context of the operation with WithActor
+	Actor   string          `json:"actor,omitempty"`
+	Payment payment.Payment `json:"payment"`
+}
+
+type actorKey struct{}
+
+// WithActor returns a copy of the context which makes the repository operations record the actor in the revisions they create
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext returns the actor set in the context with WithActor or an empty string if there's none
+func ActorFromContext(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// NewPaymentRevision returns the revision with the given number which records the operation over the payment,
+// made now by the actor of the context
+func NewPaymentRevision(ctx context.Context, operation RevisionOperation, revision int, pay payment.Payment) PaymentRevision {
+	return PaymentRevision{
+		PaymentID: pay.ID,
+		Revision:  revision,
+		Operation: operation,
+		Timestamp: time.Now().UTC(),
+		Actor:     ActorFromContext(ctx),
+		Payment:   pay,
+	}
+}
+
+// PaymentAsOf returns the payment as it was at the given time according to its revisions, sorted by revision number,
+// which is the payment of the last revision recorded at or before that time.
+// It returns false if the payment didn't exist at that time or it had already been deleted.
+func PaymentAsOf(revisions []PaymentRevision, asOf time.Time) (payment.Payment, bool) {
+	for i := len(revisions) - 1; i >= 0; i-- {
+		if !revisions[i].Timestamp.After(asOf) {
+			return revisions[i].Payment, revisions[i].Operation != DeleteOperation
+		}
+	}
+	return payment.Payment{}, false
+}
+
+// RevisionNotFound returns the error returned when a revision of a payment doesn't exist
+func RevisionNotFound(id string, revision int) NotFoundError {
+	return NotFoundError{RevisionElementType, fmt.Sprintf("%s/%d", id, revision)}
+}
@@ -0,0 +1,49 @@
+package persistence
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/getaceres/payment-demo/payment"
+)
+
+// IdempotencyKey identifies a request which must be applied only once, like the creation of a payment
+// which may be retried by a client which didn't get the response
+type IdempotencyKey struct {
+	// Key is the value chosen by the client for the request
+	Key string
+	// Fingerprint is a digest of the content of the request. A key can't be reused for a request with a different content.
+	Fingerprint string
+	// ExpiresAt is the time after which the key is forgotten, so it can be used again
+	ExpiresAt time.Time
+}
+
+// IdempotencyRecord is the stored result of a request made with an idempotency key
+type IdempotencyRecord struct {
+	IdempotencyKey
+	// Payment is the payment saved by the request, as it was saved
+	Payment payment.Payment
+}
+
+// IdempotencyKeyReusedError is returned when an idempotency key is reused for a request with a different content
+type IdempotencyKeyReusedError struct {
+	Key string
+}
+
+func (e IdempotencyKeyReusedError) Error() string {
+	return fmt.Sprintf("Idempotency key %s has already been used for a different request", e.Key)
+}
+
+// Expired returns true if the key has expired at the given time
+func (k IdempotencyKey) Expired(now time.Time) bool {
+	return !now.Before(k.ExpiresAt)
+}
+
+// Replay returns the payment saved by the request of the record if the key has the same fingerprint
+// or an IdempotencyKeyReusedError otherwise
+func (r IdempotencyRecord) Replay(key IdempotencyKey) (payment.Payment, error) {
+	if r.Fingerprint != key.Fingerprint {
+		return payment.Payment{}, IdempotencyKeyReusedError{Key: key.Key}
+	}
+	return r.Payment, nil
+}
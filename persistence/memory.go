@@ -1,63 +1,717 @@
 package persistence
 
 import (
+	"context"
 	"errors"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/getaceres/payment-demo/payment"
 	"github.com/google/uuid"
 )
 
+const (
+	// DefaultMemoryShards is the number of shards used by NewMemoryPaymentRepository
+	DefaultMemoryShards = 32
+	// indexChunkSize is the maximum number of entries of each chunk of a memory index
+	indexChunkSize = 512
+	// indexBatchSize is the number of entries read from a memory index every time it is locked while a page is built
+	indexBatchSize = 64
+)
+
+// memoryIndexOrders are the sort fields of the orders indexed by MemoryPaymentRepository:
+// the default order by identifier and the order by creation time
+var memoryIndexOrders = [][]string{nil, {"created_at"}}
+
+// memoryShard is a portion of the payments stored in memory protected by its own lock
+type memoryShard struct {
+	sync.RWMutex
+	payments  map[string]payment.Payment
+	deleted   map[string]bool
+	revisions map[string][]PaymentRevision
+}
+
+// keyShard is a portion of the idempotency keys stored in memory protected by its own lock.
+// Keys are kept apart from the payments so a key can stay locked while its payment is saved.
+type keyShard struct {
+	sync.Mutex
+	records map[string]IdempotencyRecord
+}
+
+// MemoryPaymentRepository keeps the payments in memory. It is safe for concurrent use.
+// Payments are distributed in shards by identifier, each one with its own lock,
+// so operations over different payments rarely block each other and reads never block other reads.
+// Lists are built by reading the shards one after another, so they are not a consistent snapshot
+// of the payments being modified while the list is built.
+// The payments which aren't deleted are also kept sorted in the indexed orders, so their pages are found without sorting all of them.
+// Approval and duplicate policies are kept in maps with their own lock since they are few and rarely change.
 type MemoryPaymentRepository struct {
-	Payments map[string]payment.Payment
+	shards  []*memoryShard
+	keys    []*keyShard
+	indexes []*memoryIndex
+
+	policiesLock      sync.RWMutex
+	policies          map[string]payment.ApprovalPolicy
+	duplicatePolicies map[string]payment.DuplicatePolicy
+
+	// duplicatesLock serializes the duplicate check and the creation of the payments in AddPaymentUnlessDuplicate
+	duplicatesLock sync.Mutex
 }
 
 func NewMemoryPaymentRepository() *MemoryPaymentRepository {
-	return &MemoryPaymentRepository{
-		Payments: make(map[string]payment.Payment),
+	return NewShardedMemoryPaymentRepository(DefaultMemoryShards)
+}
+
+// NewShardedMemoryPaymentRepository returns an empty repository which distributes the payments in the given number of shards
+func NewShardedMemoryPaymentRepository(shards int) *MemoryPaymentRepository {
+	if shards < 1 {
+		shards = 1
+	}
+	result := &MemoryPaymentRepository{
+		shards:            make([]*memoryShard, shards),
+		keys:              make([]*keyShard, shards),
+		policies:          make(map[string]payment.ApprovalPolicy),
+		duplicatePolicies: make(map[string]payment.DuplicatePolicy),
+	}
+	for _, paths := range memoryIndexOrders {
+		result.indexes = append(result.indexes, newMemoryIndex(paths))
+	}
+	for i := range result.shards {
+		result.shards[i] = &memoryShard{
+			payments:  make(map[string]payment.Payment),
+			deleted:   make(map[string]bool),
+			revisions: make(map[string][]PaymentRevision),
+		}
+		result.keys[i] = &keyShard{
+			records: make(map[string]IdempotencyRecord),
+		}
+	}
+	return result
+}
+
+// addRevision records a change of a payment. The shard must be locked for writing.
+func (s *memoryShard) addRevision(ctx context.Context, operation RevisionOperation, pay payment.Payment) {
+	revisions := s.revisions[pay.ID]
+	s.revisions[pay.ID] = append(revisions, NewPaymentRevision(ctx, operation, len(revisions)+1, pay))
+}
+
+// get returns the stored payment with the given identifier or an error if it doesn't exist or,
+// unless deleted is true, if it's deleted. The shard must be locked.
+func (s *memoryShard) get(id string, deleted bool) (payment.Payment, error) {
+	pay, ok := s.payments[id]
+	if !ok {
+		return pay, NotFoundError{PaymentElementType, id}
+	}
+	if s.deleted[id] && !deleted {
+		return pay, GoneError{PaymentElementType, id}
 	}
+	return pay, nil
+}
+
+func (m *MemoryPaymentRepository) shard(id string) *memoryShard {
+	return m.shards[shardIndex(id, len(m.shards))]
 }
 
-func (m *MemoryPaymentRepository) AddPayment(pay payment.Payment) (payment.Payment, error) {
+func (m *MemoryPaymentRepository) keyShard(key string) *keyShard {
+	return m.keys[shardIndex(key, len(m.keys))]
+}
+
+func shardIndex(value string, shards int) uint32 {
+	hash := fnv.New32a()
+	hash.Write([]byte(value))
+	return hash.Sum32() % uint32(shards)
+}
+
+func (m *MemoryPaymentRepository) AddPayment(ctx context.Context, pay payment.Payment) (payment.Payment, error) {
+	if err := ctx.Err(); err != nil {
+		return pay, err
+	}
 	pay.ID = uuid.New().String()
-	m.Payments[pay.ID] = pay
+	shard := m.shard(pay.ID)
+	shard.Lock()
+	defer shard.Unlock()
+	shard.payments[pay.ID] = pay
+	shard.addRevision(ctx, CreateOperation, pay)
+	for _, index := range m.indexes {
+		index.add(pay)
+	}
 	return pay, nil
 }
 
-func (m *MemoryPaymentRepository) UpdatePayment(pay payment.Payment) (payment.Payment, error) {
+// AddPaymentOnce keeps the key locked while the payment is saved, so concurrent calls with the same key wait for the first one.
+// Expired keys of the shard are removed every time a new key is stored in it.
+func (m *MemoryPaymentRepository) AddPaymentOnce(ctx context.Context, pay payment.Payment, key IdempotencyKey) (payment.Payment, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return pay, false, err
+	}
+	shard := m.keyShard(key.Key)
+	shard.Lock()
+	defer shard.Unlock()
+	now := time.Now()
+	if record, ok := shard.records[key.Key]; ok && !record.Expired(now) {
+		pay, err := record.Replay(key)
+		return pay, err == nil, err
+	}
+	pay, err := m.AddPayment(ctx, pay)
+	if err != nil {
+		return pay, false, err
+	}
+	for stored, record := range shard.records {
+		if record.Expired(now) {
+			delete(shard.records, stored)
+		}
+	}
+	shard.records[key.Key] = IdempotencyRecord{IdempotencyKey: key, Payment: pay}
+	return pay, false, nil
+}
+
+func (m *MemoryPaymentRepository) GetIdempotencyRecord(ctx context.Context, key string) (IdempotencyRecord, error) {
+	if err := ctx.Err(); err != nil {
+		return IdempotencyRecord{}, err
+	}
+	shard := m.keyShard(key)
+	shard.Lock()
+	defer shard.Unlock()
+	record, ok := shard.records[key]
+	if !ok || record.Expired(time.Now()) {
+		return IdempotencyRecord{}, NotFoundError{IdempotencyKeyElementType, key}
+	}
+	return record, nil
+}
+
+func (m *MemoryPaymentRepository) AddPaymentUnlessDuplicate(ctx context.Context, pay payment.Payment, policy payment.DuplicatePolicy, key *IdempotencyKey) (payment.Payment, bool, error) {
+	m.duplicatesLock.Lock()
+	defer m.duplicatesLock.Unlock()
+	return CheckAndAddPayment(ctx, m, pay, policy, key)
+}
+
+func (m *MemoryPaymentRepository) UpdatePayment(ctx context.Context, pay payment.Payment) (payment.Payment, error) {
 	id := pay.ID
 	if id == "" {
 		return pay, errors.New("Payment with empty identifier passed")
 	}
 
-	_, ok := m.Payments[id]
-	if !ok {
-		return pay, NotFoundError{PaymentElementType, id}
+	if err := ctx.Err(); err != nil {
+		return pay, err
+	}
+	shard := m.shard(id)
+	shard.Lock()
+	defer shard.Unlock()
+	stored, err := shard.get(id, false)
+	if err != nil {
+		return pay, err
+	}
+	if stored.Version != pay.Version {
+		return pay, ConflictError{PaymentElementType, id, pay.Version, stored.Version}
+	}
+	pay.Version++
+	shard.payments[id] = pay
+	shard.addRevision(ctx, UpdateOperation, pay)
+	for _, index := range m.indexes {
+		index.update(stored, pay)
 	}
-	m.Payments[id] = pay
 	return pay, nil
 }
 
-func (m *MemoryPaymentRepository) DeletePayment(id string) (payment.Payment, error) {
-	pay, ok := m.Payments[id]
-	if !ok {
-		return pay, NotFoundError{PaymentElementType, id}
+func (m *MemoryPaymentRepository) DeletePayment(ctx context.Context, id string, expectedVersion int) (payment.Payment, error) {
+	if err := ctx.Err(); err != nil {
+		return payment.Payment{}, err
+	}
+	shard := m.shard(id)
+	shard.Lock()
+	defer shard.Unlock()
+	pay, err := shard.get(id, false)
+	if err != nil {
+		return pay, err
+	}
+	if expectedVersion != AnyVersion && pay.Version != expectedVersion {
+		return pay, ConflictError{PaymentElementType, id, expectedVersion, pay.Version}
+	}
+	shard.deleted[id] = true
+	shard.addRevision(ctx, DeleteOperation, pay)
+	for _, index := range m.indexes {
+		index.remove(pay)
+	}
+	return pay, nil
+}
+
+func (m *MemoryPaymentRepository) RestorePayment(ctx context.Context, id string, expectedVersion int) (payment.Payment, error) {
+	if err := ctx.Err(); err != nil {
+		return payment.Payment{}, err
+	}
+	shard := m.shard(id)
+	shard.Lock()
+	defer shard.Unlock()
+	pay, err := shard.get(id, true)
+	if err != nil {
+		return pay, err
+	}
+	if !shard.deleted[id] {
+		return pay, NotDeletedError{PaymentElementType, id}
+	}
+	if expectedVersion != AnyVersion && pay.Version != expectedVersion {
+		return pay, ConflictError{PaymentElementType, id, expectedVersion, pay.Version}
 	}
-	delete(m.Payments, id)
+	pay.Version++
+	shard.payments[id] = pay
+	delete(shard.deleted, id)
+	shard.addRevision(ctx, RestoreOperation, pay)
+	for _, index := range m.indexes {
+		index.add(pay)
+	}
+	return pay, nil
+}
+
+func (m *MemoryPaymentRepository) PurgePayment(ctx context.Context, id string) (payment.Payment, error) {
+	if err := ctx.Err(); err != nil {
+		return payment.Payment{}, err
+	}
+	shard := m.shard(id)
+	shard.Lock()
+	defer shard.Unlock()
+	pay, err := shard.get(id, true)
+	if err != nil {
+		return pay, err
+	}
+	if !shard.deleted[id] {
+		return pay, NotDeletedError{PaymentElementType, id}
+	}
+	delete(shard.payments, id)
+	delete(shard.deleted, id)
+	delete(shard.revisions, id)
 	return pay, nil
 }
 
-func (m *MemoryPaymentRepository) GetPayment(id string) (payment.Payment, error) {
-	pay, ok := m.Payments[id]
+func (m *MemoryPaymentRepository) GetPayment(ctx context.Context, id string) (payment.Payment, error) {
+	if err := ctx.Err(); err != nil {
+		return payment.Payment{}, err
+	}
+	shard := m.shard(id)
+	shard.RLock()
+	defer shard.RUnlock()
+	return shard.get(id, false)
+}
+
+func (m *MemoryPaymentRepository) GetPaymentAsOf(ctx context.Context, id string, asOf time.Time) (payment.Payment, error) {
+	if err := ctx.Err(); err != nil {
+		return payment.Payment{}, err
+	}
+	shard := m.shard(id)
+	shard.RLock()
+	defer shard.RUnlock()
+	pay, ok := PaymentAsOf(shard.revisions[id], asOf)
 	if !ok {
 		return pay, NotFoundError{PaymentElementType, id}
 	}
 	return pay, nil
 }
 
-func (m *MemoryPaymentRepository) GetPayments(filter map[string]string) ([]payment.Payment, error) {
-	result := make([]payment.Payment, 0, len(m.Payments))
-	for _, pay := range m.Payments {
-		result = append(result, pay)
+func (m *MemoryPaymentRepository) GetPaymentRevisions(ctx context.Context, id string) ([]PaymentRevision, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	shard := m.shard(id)
+	shard.RLock()
+	defer shard.RUnlock()
+	revisions, ok := shard.revisions[id]
+	if !ok {
+		return nil, NotFoundError{PaymentElementType, id}
+	}
+	return append([]PaymentRevision(nil), revisions...), nil
+}
+
+func (m *MemoryPaymentRepository) GetPaymentRevision(ctx context.Context, id string, revision int) (PaymentRevision, error) {
+	if err := ctx.Err(); err != nil {
+		return PaymentRevision{}, err
+	}
+	shard := m.shard(id)
+	shard.RLock()
+	defer shard.RUnlock()
+	revisions := shard.revisions[id]
+	if revision < 1 || revision > len(revisions) {
+		return PaymentRevision{}, RevisionNotFound(id, revision)
+	}
+	return revisions[revision-1], nil
+}
+
+func (m *MemoryPaymentRepository) GetPayments(ctx context.Context, filter map[string]string) ([]payment.Payment, error) {
+	query, err := NewFilterQuery(filter)
+	if err != nil {
+		return nil, err
+	}
+	return m.FindPayments(ctx, query)
+}
+
+func (m *MemoryPaymentRepository) FindPayments(ctx context.Context, query PaymentQuery) ([]payment.Payment, error) {
+	payments, err := m.listPayments(ctx, query.AsOf)
+	if err != nil {
+		return nil, err
+	}
+	return query.Apply(payments), nil
+}
+
+// GetPaymentPage finds the pages of the queries sorted in an indexed order by reading the index from the cursor,
+// so only the payments around the page are read. The pages of the queries sorted in other orders and of the queries
+// with an AsOf time, which are evaluated over the revisions, are built by sorting all the payments in memory.
+func (m *MemoryPaymentRepository) GetPaymentPage(ctx context.Context, query PaymentQuery, page PageRequest) (PaymentPage, error) {
+	if err := query.ValidatePage(page); err != nil {
+		return PaymentPage{}, err
+	}
+	if query.AsOf.IsZero() {
+		for _, index := range m.indexes {
+			if index.sorts(query) {
+				return m.indexedPage(ctx, index, query, page)
+			}
+		}
+	}
+	payments, err := m.listPayments(ctx, query.AsOf)
+	if err != nil {
+		return PaymentPage{}, err
+	}
+	return query.Paginate(payments, page)
+}
+
+// indexedPage builds the page of the query with the index, which must sort the payments in the order of the query
+func (m *MemoryPaymentRepository) indexedPage(ctx context.Context, index *memoryIndex, query PaymentQuery, page PageRequest) (PaymentPage, error) {
+	var result PaymentPage
+	// The index is read backwards to follow the order of queries sorted in descending order
+	backwards := query.IdentifierDescending()
+	var payments []payment.Payment
+	var previous, next bool
+	var cursor Cursor
+	var err error
+	switch {
+	case page.After != "":
+		if cursor, err = query.DecodeCursor(page.After); err != nil {
+			return result, err
+		}
+		from := cursor.sortable()
+		payments, next, err = m.scan(ctx, index, query, &from, backwards, page.Size)
+		if err == nil && len(payments) > 0 {
+			first := index.entry(payments[0])
+			_, previous, err = m.scan(ctx, index, query, &first, !backwards, 0)
+		}
+	case page.Before != "":
+		if cursor, err = query.DecodeCursor(page.Before); err != nil {
+			return result, err
+		}
+		from := cursor.sortable()
+		payments, previous, err = m.scan(ctx, index, query, &from, !backwards, page.Size)
+		for i, j := 0, len(payments)-1; i < j; i, j = i+1, j-1 {
+			payments[i], payments[j] = payments[j], payments[i]
+		}
+		if err == nil && len(payments) > 0 {
+			last := index.entry(payments[len(payments)-1])
+			_, next, err = m.scan(ctx, index, query, &last, backwards, 0)
+		}
+	default:
+		payments, next, err = m.scan(ctx, index, query, nil, backwards, page.Size)
+	}
+	if err != nil {
+		return result, err
+	}
+
+	result.Payments = make([]payment.Payment, 0, len(payments))
+	for _, pay := range payments {
+		result.Payments = append(result.Payments, query.Select(pay))
+	}
+	if previous {
+		result.Previous = query.NewCursor(payments[0]).Encode()
+	}
+	if next {
+		result.Next = query.NewCursor(payments[len(payments)-1]).Encode()
 	}
 	return result, nil
 }
+
+// scan returns up to limit payments which satisfy the filter of the query following the entry in the index,
+// or preceding it if backwards is true, starting from the first or the last entry if it is nil.
+// It also returns true if there are more payments which satisfy the filter after them.
+func (m *MemoryPaymentRepository) scan(ctx context.Context, index *memoryIndex, query PaymentQuery, from *sortablePayment, backwards bool, limit int) ([]payment.Payment, bool, error) {
+	result := make([]payment.Payment, 0)
+	for {
+		entries := index.read(from, backwards)
+		if len(entries) == 0 {
+			return result, false, nil
+		}
+		for _, entry := range entries {
+			if err := ctx.Err(); err != nil {
+				return nil, false, err
+			}
+			pay, ok := m.current(entry.payment.ID)
+			if !ok || !query.Matches(pay) {
+				continue
+			}
+			if len(result) == limit {
+				return result, true, nil
+			}
+			result = append(result, pay)
+		}
+		from = &entries[len(entries)-1]
+	}
+}
+
+// current returns the payment with the given identifier and true if it exists and it isn't deleted
+func (m *MemoryPaymentRepository) current(id string) (payment.Payment, bool) {
+	shard := m.shard(id)
+	shard.RLock()
+	defer shard.RUnlock()
+	pay, ok := shard.payments[id]
+	return pay, ok && !shard.deleted[id]
+}
+
+// listPayments returns all the stored payments or, if asOf is not zero, all the payments as they were at that time.
+// The context is checked before reading each shard.
+func (m *MemoryPaymentRepository) listPayments(ctx context.Context, asOf time.Time) ([]payment.Payment, error) {
+	payments := make([]payment.Payment, 0)
+	for _, shard := range m.shards {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		shard.RLock()
+		if asOf.IsZero() {
+			for id, pay := range shard.payments {
+				if !shard.deleted[id] {
+					payments = append(payments, pay)
+				}
+			}
+		} else {
+			for _, revisions := range shard.revisions {
+				if pay, ok := PaymentAsOf(revisions, asOf); ok {
+					payments = append(payments, pay)
+				}
+			}
+		}
+		shard.RUnlock()
+	}
+	return payments, nil
+}
+
+func (m *MemoryPaymentRepository) SaveApprovalPolicy(ctx context.Context, policy payment.ApprovalPolicy) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.policiesLock.Lock()
+	defer m.policiesLock.Unlock()
+	policy.Thresholds = append([]payment.PaymentAmountType(nil), policy.Thresholds...)
+	m.policies[policy.OrganisationID] = policy
+	return nil
+}
+
+func (m *MemoryPaymentRepository) GetApprovalPolicy(ctx context.Context, organisationID string) (payment.ApprovalPolicy, error) {
+	if err := ctx.Err(); err != nil {
+		return payment.ApprovalPolicy{}, err
+	}
+	m.policiesLock.RLock()
+	defer m.policiesLock.RUnlock()
+	policy, ok := m.policies[organisationID]
+	if !ok {
+		return policy, NotFoundError{ApprovalPolicyElementType, organisationID}
+	}
+	policy.Thresholds = append([]payment.PaymentAmountType(nil), policy.Thresholds...)
+	return policy, nil
+}
+
+func (m *MemoryPaymentRepository) DeleteApprovalPolicy(ctx context.Context, organisationID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.policiesLock.Lock()
+	defer m.policiesLock.Unlock()
+	if _, ok := m.policies[organisationID]; !ok {
+		return NotFoundError{ApprovalPolicyElementType, organisationID}
+	}
+	delete(m.policies, organisationID)
+	return nil
+}
+
+func (m *MemoryPaymentRepository) SaveDuplicatePolicy(ctx context.Context, policy payment.DuplicatePolicy) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.policiesLock.Lock()
+	defer m.policiesLock.Unlock()
+	m.duplicatePolicies[policy.OrganisationID] = policy
+	return nil
+}
+
+func (m *MemoryPaymentRepository) GetDuplicatePolicy(ctx context.Context, organisationID string) (payment.DuplicatePolicy, error) {
+	if err := ctx.Err(); err != nil {
+		return payment.DuplicatePolicy{}, err
+	}
+	m.policiesLock.RLock()
+	defer m.policiesLock.RUnlock()
+	policy, ok := m.duplicatePolicies[organisationID]
+	if !ok {
+		return policy, NotFoundError{DuplicatePolicyElementType, organisationID}
+	}
+	return policy, nil
+}
+
+func (m *MemoryPaymentRepository) DeleteDuplicatePolicy(ctx context.Context, organisationID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.policiesLock.Lock()
+	defer m.policiesLock.Unlock()
+	if _, ok := m.duplicatePolicies[organisationID]; !ok {
+		return NotFoundError{DuplicatePolicyElementType, organisationID}
+	}
+	delete(m.duplicatePolicies, organisationID)
+	return nil
+}
+
+// memoryIndex keeps the payments which aren't deleted sorted in the ascending order of its sort fields and their identifier.
+// Entries contain the identifier of the payment and its sort keys, and they are split in chunks of limited size
+// so they are inserted and removed without moving the whole index.
+// The index is updated while the shard of the payment is locked, but the shards are never locked while the index is,
+// so it is read in batches whose payments are read after unlocking it.
+type memoryIndex struct {
+	sync.RWMutex
+	order  PaymentQuery
+	chunks [][]sortablePayment
+}
+
+func newMemoryIndex(paths []string) *memoryIndex {
+	var order PaymentQuery
+	for _, path := range paths {
+		sortField, err := NewSortField(path, false)
+		if err != nil {
+			panic(err)
+		}
+		order.Sort = append(order.Sort, sortField)
+	}
+	return &memoryIndex{order: order}
+}
+
+// sorts returns true if the payments are sorted in the order of the query by the index read forwards or backwards
+func (x *memoryIndex) sorts(query PaymentQuery) bool {
+	if len(query.Sort) != len(x.order.Sort) {
+		return false
+	}
+	for i, sortField := range query.Sort {
+		if sortField.Field.Path != x.order.Sort[i].Field.Path || sortField.Descending != query.IdentifierDescending() {
+			return false
+		}
+	}
+	return true
+}
+
+func (x *memoryIndex) entry(pay payment.Payment) sortablePayment {
+	return sortablePayment{payment: payment.Payment{ID: pay.ID}, keys: x.order.sortKeys(pay)}
+}
+
+// position returns the chunk and the offset of the first entry which isn't sorted before the given one.
+// The chunk is the number of chunks if all the entries are sorted before it. The index must be locked.
+func (x *memoryIndex) position(entry sortablePayment) (int, int) {
+	chunk := sort.Search(len(x.chunks), func(i int) bool {
+		entries := x.chunks[i]
+		return x.order.compareSortable(entries[len(entries)-1], entry) >= 0
+	})
+	if chunk == len(x.chunks) {
+		return chunk, 0
+	}
+	entries := x.chunks[chunk]
+	return chunk, sort.Search(len(entries), func(i int) bool {
+		return x.order.compareSortable(entries[i], entry) >= 0
+	})
+}
+
+func (x *memoryIndex) add(pay payment.Payment) {
+	x.Lock()
+	defer x.Unlock()
+	entry := x.entry(pay)
+	chunk, offset := x.position(entry)
+	if chunk == len(x.chunks) {
+		if chunk == 0 {
+			x.chunks = append(x.chunks, nil)
+		} else {
+			chunk--
+		}
+		offset = len(x.chunks[chunk])
+	}
+	entries := append(x.chunks[chunk], sortablePayment{})
+	copy(entries[offset+1:], entries[offset:])
+	entries[offset] = entry
+	if len(entries) <= indexChunkSize {
+		x.chunks[chunk] = entries
+		return
+	}
+
+	// Full chunks are split in two halves
+	half := len(entries) / 2
+	x.chunks = append(x.chunks, nil)
+	copy(x.chunks[chunk+2:], x.chunks[chunk+1:])
+	x.chunks[chunk] = entries[:half:half]
+	x.chunks[chunk+1] = append([]sortablePayment(nil), entries[half:]...)
+}
+
+func (x *memoryIndex) remove(pay payment.Payment) {
+	x.Lock()
+	defer x.Unlock()
+	chunk, offset := x.position(x.entry(pay))
+	if chunk == len(x.chunks) || x.chunks[chunk][offset].payment.ID != pay.ID {
+		return
+	}
+	entries := append(x.chunks[chunk][:offset], x.chunks[chunk][offset+1:]...)
+	if len(entries) == 0 {
+		x.chunks = append(x.chunks[:chunk], x.chunks[chunk+1:]...)
+		return
+	}
+	x.chunks[chunk] = entries
+}
+
+// update moves the payment if the values of its sort fields have changed
+func (x *memoryIndex) update(stored, pay payment.Payment) {
+	if x.order.compareKeys(x.order.sortKeys(stored), x.order.sortKeys(pay)) != 0 {
+		x.remove(stored)
+		x.add(pay)
+	}
+}
+
+// read returns up to indexBatchSize entries which follow the given one in the order of the index, or precede it
+// if backwards is true, nearest first. The entries are read from the first one, or from the last one, if it is nil.
+func (x *memoryIndex) read(from *sortablePayment, backwards bool) []sortablePayment {
+	x.RLock()
+	defer x.RUnlock()
+	var chunk, offset int
+	switch {
+	case from == nil && backwards:
+		chunk, offset = len(x.chunks), -1
+	case from == nil:
+	case backwards:
+		chunk, offset = x.position(*from)
+		offset--
+	default:
+		chunk, offset = x.position(*from)
+		if chunk < len(x.chunks) && x.order.compareSortable(x.chunks[chunk][offset], *from) == 0 {
+			offset++
+		}
+	}
+
+	result := make([]sortablePayment, 0, indexBatchSize)
+	for len(result) < indexBatchSize {
+		if backwards {
+			for offset < 0 {
+				if chunk--; chunk < 0 {
+					return result
+				}
+				offset = len(x.chunks[chunk]) - 1
+			}
+			result = append(result, x.chunks[chunk][offset])
+			offset--
+			continue
+		}
+		for chunk < len(x.chunks) && offset >= len(x.chunks[chunk]) {
+			chunk, offset = chunk+1, 0
+		}
+		if chunk == len(x.chunks) {
+			return result
+		}
+		result = append(result, x.chunks[chunk][offset])
+		offset++
+	}
+	return result
+}
@@ -1,9 +1,18 @@
 package persistence
 
-import "testing"
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getaceres/payment-demo/payment"
+	"github.com/google/go-cmp/cmp"
+)
 
 var tester = PaymentRepositoryTester{
-	Repository: NewMemoryPaymentRepository(),
+	Repository:    NewMemoryPaymentRepository(),
 	ResourcesPath: "../test_resources",
 }
 
@@ -19,6 +28,18 @@ func TestDelete(t *testing.T) {
 	tester.TestDelete(t)
 }
 
+func TestRestore(t *testing.T) {
+	tester.TestRestore(t)
+}
+
+func TestPurge(t *testing.T) {
+	tester.TestPurge(t)
+}
+
+func TestIdempotency(t *testing.T) {
+	tester.TestIdempotency(t, 10)
+}
+
 func TestGetId(t *testing.T) {
 	tester.TestGetId(t)
 }
@@ -26,3 +47,212 @@ func TestGetId(t *testing.T) {
 func TestGetList(t *testing.T) {
 	tester.TestGetList(t, 10)
 }
+
+func TestFilter(t *testing.T) {
+	tester.TestFilter(t)
+}
+
+func TestQuery(t *testing.T) {
+	tester.TestQuery(t)
+}
+
+func TestPagination(t *testing.T) {
+	tester.TestPagination(t)
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	tester.TestConcurrentAccess(t, 50, 20)
+}
+
+func TestCancelledContext(t *testing.T) {
+	tester.TestCancelledContext(t)
+}
+
+func TestHistory(t *testing.T) {
+	tester.TestHistory(t)
+}
+
+func TestAsOf(t *testing.T) {
+	tester.TestAsOf(t)
+}
+
+func TestStatus(t *testing.T) {
+	tester.TestStatus(t)
+}
+
+func TestSanctionsHits(t *testing.T) {
+	tester.TestSanctionsHits(t)
+}
+
+func TestRisk(t *testing.T) {
+	tester.TestRisk(t)
+}
+
+func TestDuplicates(t *testing.T) {
+	tester.TestDuplicates(t)
+}
+
+func TestAddUnlessDuplicate(t *testing.T) {
+	tester.TestAddUnlessDuplicate(t, 10)
+}
+
+func TestApprovalPolicies(t *testing.T) {
+	tester.TestApprovalPolicies(t)
+}
+
+func TestDuplicatePolicies(t *testing.T) {
+	tester.TestDuplicatePolicies(t)
+}
+
+// TestIndexedPages checks that the pages found with the indexes are the ones built by sorting all the payments
+func TestIndexedPages(t *testing.T) {
+	repository := NewShardedMemoryPaymentRepository(4)
+	pay, err := payment.GetDefaultTestPayment("../test_resources")
+	if err != nil {
+		t.Fatalf("Error getting default payment: %s", err.Error())
+	}
+	creationTimes := []string{"", "2019-05-10T10:00:00.000000000Z", "2019-05-10T10:00:00.000000000Z", "2019-05-11T09:30:00.000000000Z", "2019-05-09T23:59:59.999999999Z"}
+	for i := 0; i < 3*indexChunkSize; i++ {
+		pay.CreatedAt = creationTimes[i%len(creationTimes)]
+		pay.Attributes.Reference = fmt.Sprintf("reference %d", i%3)
+		added, err := repository.AddPayment(context.Background(), pay)
+		if err != nil {
+			t.Fatalf("Error adding payment: %s", err.Error())
+		}
+		if i%7 == 0 {
+			if _, err := repository.DeletePayment(context.Background(), added.ID, AnyVersion); err != nil {
+				t.Fatalf("Error deleting payment: %s", err.Error())
+			}
+		}
+	}
+	payments, err := repository.listPayments(context.Background(), time.Time{})
+	if err != nil {
+		t.Fatalf("Error listing payments: %s", err.Error())
+	}
+
+	condition, err := NewFilterCondition("attributes.reference", NotEqualOperator, "reference 2")
+	if err != nil {
+		t.Fatalf("Error creating filter condition: %s", err.Error())
+	}
+	for _, sorts := range [][]string{nil, {"created_at"}, {"-created_at"}} {
+		query := PaymentQuery{Filter: []FilterCondition{condition}}
+		for _, name := range sorts {
+			sortField, err := NewSortField(strings.TrimPrefix(name, "-"), strings.HasPrefix(name, "-"))
+			if err != nil {
+				t.Fatalf("Error creating sort field: %s", err.Error())
+			}
+			query.Sort = append(query.Sort, sortField)
+		}
+		getPage := func(request PageRequest) PaymentPage {
+			got, err := repository.GetPaymentPage(context.Background(), query, request)
+			if err != nil {
+				t.Fatalf("Error getting page %+v sorted by %v: %s", request, sorts, err.Error())
+			}
+			expected, err := query.Paginate(payments, request)
+			if err != nil {
+				t.Fatalf("Error paginating %+v sorted by %v: %s", request, sorts, err.Error())
+			}
+			if !cmp.Equal(got, expected) {
+				t.Fatalf("Page %+v sorted by %v differs from the sorted one.\nReturned:\n%v\nBut expected:\n%v", request, sorts, got, expected)
+			}
+			return got
+		}
+
+		expected := len(query.Apply(payments))
+		page := getPage(PageRequest{Size: 50})
+		forwards := len(page.Payments)
+		for page.Next != "" {
+			page = getPage(PageRequest{Size: 50, After: page.Next})
+			forwards += len(page.Payments)
+		}
+		backwards := len(page.Payments)
+		for page.Previous != "" {
+			page = getPage(PageRequest{Size: 50, Before: page.Previous})
+			backwards += len(page.Payments)
+		}
+		if forwards != expected || backwards != expected {
+			t.Errorf("Expected to go through %d payments sorted by %v but went through %d forwards and %d backwards", expected, sorts, forwards, backwards)
+		}
+	}
+}
+
+// benchmarkShards contains the numbers of shards compared by the benchmarks: a single shard, whose lock is shared
+// by all the payments, and the default number of shards
+var benchmarkShards = []int{1, DefaultMemoryShards}
+
+func prepareBenchmark(b *testing.B, repository *MemoryPaymentRepository, payments int) []string {
+	pay, err := payment.GetDefaultTestPayment("../test_resources")
+	if err != nil {
+		b.Fatalf("Error getting default payment: %s", err.Error())
+	}
+	ids := make([]string, payments)
+	for i := range ids {
+		added, err := repository.AddPayment(context.Background(), pay)
+		if err != nil {
+			b.Fatalf("Error adding payment: %s", err.Error())
+		}
+		ids[i] = added.ID
+	}
+	return ids
+}
+
+func BenchmarkParallelGet(b *testing.B) {
+	for _, shards := range benchmarkShards {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			repository := NewShardedMemoryPaymentRepository(shards)
+			ids := prepareBenchmark(b, repository, 1000)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					if _, err := repository.GetPayment(context.Background(), ids[i%len(ids)]); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkParallelAdd(b *testing.B) {
+	for _, shards := range benchmarkShards {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			repository := NewShardedMemoryPaymentRepository(shards)
+			pay, err := payment.GetDefaultTestPayment("../test_resources")
+			if err != nil {
+				b.Fatalf("Error getting default payment: %s", err.Error())
+			}
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := repository.AddPayment(context.Background(), pay); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkParallelMixed runs one update for every nine reads
+func BenchmarkParallelMixed(b *testing.B) {
+	for _, shards := range benchmarkShards {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			repository := NewShardedMemoryPaymentRepository(shards)
+			ids := prepareBenchmark(b, repository, 1000)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					pay, err := repository.GetPayment(context.Background(), ids[i%len(ids)])
+					if err != nil {
+						b.Error(err)
+						continue
+					}
+					if i%10 == 0 {
+						// Concurrent updates over the same payment may conflict, which is also part of the measured work
+						repository.UpdatePayment(context.Background(), pay)
+					}
+				}
+			})
+		})
+	}
+}
@@ -1,13 +1,20 @@
 package persistence
 
 import (
+	"context"
 	"fmt"
+	"time"
 
 	"github.com/getaceres/payment-demo/payment"
 )
 
 const (
-	PaymentElementType = "Payment"
+	PaymentElementType         = "Payment"
+	ApprovalPolicyElementType  = "ApprovalPolicy"
+	DuplicatePolicyElementType = "DuplicatePolicy"
+	IdempotencyKeyElementType  = "IdempotencyKey"
+	// AnyVersion can be passed as expected version to the operations which check it so they don't do it
+	AnyVersion = -1
 )
 
 type NotFoundError struct {
@@ -20,27 +27,127 @@ type AlreadyExistsError struct {
 	ID          string
 }
 
+// GoneError is returned when an element has been deleted. Deleted elements can be restored until they are purged.
+type GoneError struct {
+	ElementType string
+	ID          string
+}
+
+// NotDeletedError is returned when an operation which can only be done over deleted elements,
+// like restoring or purging them, is done over an element which is not deleted
+type NotDeletedError struct {
+	ElementType string
+	ID          string
+}
+
+// ConflictError is returned when an element can't be updated because its stored version is not the expected one,
+// which means that it has been modified since it was read
+type ConflictError struct {
+	ElementType     string
+	ID              string
+	ExpectedVersion int
+	ActualVersion   int
+}
+
 // PaymentRepository is the interface that any persistence backend must implement.
 // It contains the basic CRUD operations for individual payments
 // (AddPayment, GetPayment, UpdatePayment and DeletePayment)
-// plus an operation that must return a list of payments filtered by arbitrary parameters.
+// plus operations that must return a list of payments filtered by arbitrary parameters.
+// Deleted payments are kept hidden from the rest of operations, which must return a GoneError for them,
+// so they can be restored with RestorePayment until they are permanently removed with PurgePayment.
+// Every operation receives the context of the request which triggered it. If the context is cancelled or its deadline
+// is exceeded before the operation finishes, the operation must be stopped and the error of the context must be returned.
 type PaymentRepository interface {
 	// AddPayment must save the payment information passed as parameter in the persistence backend asigning it a unique identifier.
 	// It must return the saved document with this new identifier or an error if something unexpected happens
-	AddPayment(pay payment.Payment) (payment.Payment, error)
+	AddPayment(ctx context.Context, pay payment.Payment) (payment.Payment, error)
+	// AddPaymentOnce must save the payment like AddPayment unless a payment has already been saved with the same idempotency key
+	// which hasn't expired yet, in which case it must return the payment as it was saved then and true.
+	// The key must be stored atomically with the payment until its expiration time, so concurrent calls with the same key
+	// save a single payment. An IdempotencyKeyReusedError must be returned if the key was used with a different fingerprint.
+	AddPaymentOnce(ctx context.Context, pay payment.Payment, key IdempotencyKey) (payment.Payment, bool, error)
+	// GetIdempotencyRecord must return the record stored by AddPaymentOnce for the given key
+	// or a NotFoundError if the key hasn't been used or it has expired
+	GetIdempotencyRecord(ctx context.Context, key string) (IdempotencyRecord, error)
+	// AddPaymentUnlessDuplicate must save the payment like AddPayment, or like AddPaymentOnce if a key is passed, after applying
+	// the duplicate policy to the payments returned by the query of NewDuplicateQuery. It must return a DuplicatePaymentError
+	// without saving the payment if the policy rejects it. The check and the insertion must be atomic, so payments created
+	// concurrently by any process that shares the storage can't duplicate each other. If the key has already been used,
+	// the payment saved with it must be returned and true without checking for duplicates.
+	AddPaymentUnlessDuplicate(ctx context.Context, pay payment.Payment, policy payment.DuplicatePolicy, key *IdempotencyKey) (payment.Payment, bool, error)
 	// UpdatePayment must replace the payment information whose identifier is in the input object with the information present in the input parameter.
-	// It must return the updated payment information or an error if something goes wrong or the payment with such identifier does not exist.
-	UpdatePayment(pay payment.Payment) (payment.Payment, error)
-	// DeletePayment must delete the payment information whose identifier matches with the one passed as parameter.
-	// It must return the deleted object or an error if something goes wrong or the payment with such identifier does not exist.
-	DeletePayment(id string) (payment.Payment, error)
+	// The version of the input object is the version that the stored payment is expected to have. The replacement must be atomic and only
+	// happen if the stored version matches the expected one, in which case the saved payment must have its version increased by one.
+	// It must return the updated payment information with the new version or an error if something goes wrong, the payment with such identifier
+	// does not exist, a GoneError if it is deleted or a ConflictError if the stored version is not the expected one.
+	UpdatePayment(ctx context.Context, pay payment.Payment) (payment.Payment, error)
+	// DeletePayment must mark the payment information whose identifier matches with the one passed as parameter as deleted.
+	// Unless the expected version is AnyVersion, the deletion must be atomic and only happen if the stored payment has the expected version.
+	// It must return the deleted object or an error if something goes wrong, the payment with such identifier does not exist,
+	// a GoneError if it is already deleted or a ConflictError if the stored version is not the expected one.
+	DeletePayment(ctx context.Context, id string, expectedVersion int) (payment.Payment, error)
+	// RestorePayment must undo the deletion of the payment whose identifier matches with the one passed as parameter,
+	// increasing its version by one. Unless the expected version is AnyVersion, the restoration must be atomic and only happen
+	// if the stored payment has the expected version. It must return the restored payment or an error if something goes wrong,
+	// the payment with such identifier does not exist, a NotDeletedError if it is not deleted or a ConflictError
+	// if the stored version is not the expected one.
+	RestorePayment(ctx context.Context, id string, expectedVersion int) (payment.Payment, error)
+	// PurgePayment must permanently remove the deleted payment whose identifier matches with the one passed as parameter
+	// together with its revisions, so it can't be restored anymore. It must return the removed payment or an error if something goes wrong,
+	// the payment with such identifier does not exist or a NotDeletedError if it is not deleted.
+	PurgePayment(ctx context.Context, id string) (payment.Payment, error)
 	// GetPayment must return the payment information whose identifier matches with the one passed as parameter.
-	// It must return the payment information or an error if something goes wrong or the payment with such identifier does not exist.
-	GetPayment(id string) (payment.Payment, error)
+	// It must return the payment information or an error if something goes wrong, the payment with such identifier does not exist
+	// or a GoneError if it is deleted.
+	GetPayment(ctx context.Context, id string) (payment.Payment, error)
+	// GetPaymentAsOf must return the payment information whose identifier matches with the one passed as parameter as it was at the given time,
+	// which is the payment of its last revision recorded at or before that time. It must return a NotFoundError if the payment
+	// didn't exist at that time or it had already been deleted.
+	GetPaymentAsOf(ctx context.Context, id string, asOf time.Time) (payment.Payment, error)
 	// GetPayments must return a list of payments which match the filters passed as parameter.
+	// The keys of the filter are JSON paths of payment fields, like attributes.beneficiary_party.bank_id,
+	// and a payment matches if the field has the given value. Decimal and integer fields are compared by their numeric value
+	// and fields inside lists match if any of the elements has the given value. A payment must match all the entries of the filter.
 	// If this parameter is nil or empty, it must return the whole list of payments available in the persistence backend.
+	// Deleted payments must never be returned.
+	// An InvalidFieldError or InvalidValueError must be returned if the filter refers to an unknown field or contains values
+	// which can't be compared with the field. In case of error, it must be returned as second parameter.
+	GetPayments(ctx context.Context, filter map[string]string) ([]payment.Payment, error)
+	// FindPayments must return a list of payments which satisfy all the filter conditions of the query,
+	// sorted in the order defined by the query and containing only the fields selected by it,
+	// as described in PaymentQuery. If the query has an AsOf time, the query must be evaluated over the payments as they were at that time,
+	// as returned by GetPaymentAsOf. In case of error, it must be returned as second parameter.
+	FindPayments(ctx context.Context, query PaymentQuery) ([]payment.Payment, error)
+	// GetPaymentPage must return the requested page of the list of payments defined by the query, as described in PageRequest.
+	// The page must contain the cursors to get the following and the preceding pages if there are payments after the last one
+	// or before the first one. The AsOf time of the query must be honored as in FindPayments.
+	// An InvalidPageError must be returned if the page request is not valid for the query.
 	// In case of error, it must be returned as second parameter.
-	GetPayments(filter map[string]string) ([]payment.Payment, error)
+	GetPaymentPage(ctx context.Context, query PaymentQuery, page PageRequest) (PaymentPage, error)
+	// GetPaymentRevisions must return all the revisions of the payment whose identifier matches with the one passed as parameter,
+	// sorted by revision number. AddPayment, UpdatePayment, DeletePayment and RestorePayment must record a new revision with the actor
+	// of their context atomically with the change, so every change of a payment has a revision. The revisions must be kept after the payment
+	// is deleted and removed when it is purged. It must return a NotFoundError if the payment doesn't exist.
+	GetPaymentRevisions(ctx context.Context, id string) ([]PaymentRevision, error)
+	// GetPaymentRevision must return the revision of a payment with the given number
+	// or a NotFoundError if the payment doesn't have such revision.
+	GetPaymentRevision(ctx context.Context, id string, revision int) (PaymentRevision, error)
+	// SaveApprovalPolicy must save the approval policy of its organisation, replacing the one it had before if any
+	SaveApprovalPolicy(ctx context.Context, policy payment.ApprovalPolicy) error
+	// GetApprovalPolicy must return the approval policy of the organisation whose identifier is passed as parameter
+	// or a NotFoundError if the organisation doesn't have one
+	GetApprovalPolicy(ctx context.Context, organisationID string) (payment.ApprovalPolicy, error)
+	// DeleteApprovalPolicy must remove the approval policy of the organisation whose identifier is passed as parameter
+	// or return a NotFoundError if the organisation doesn't have one
+	DeleteApprovalPolicy(ctx context.Context, organisationID string) error
+	// SaveDuplicatePolicy must save the duplicate policy of its organisation, replacing the one it had before if any
+	SaveDuplicatePolicy(ctx context.Context, policy payment.DuplicatePolicy) error
+	// GetDuplicatePolicy must return the duplicate policy of the organisation whose identifier is passed as parameter
+	// or a NotFoundError if the organisation doesn't have one
+	GetDuplicatePolicy(ctx context.Context, organisationID string) (payment.DuplicatePolicy, error)
+	// DeleteDuplicatePolicy must remove the duplicate policy of the organisation whose identifier is passed as parameter
+	// or return a NotFoundError if the organisation doesn't have one
+	DeleteDuplicatePolicy(ctx context.Context, organisationID string) error
 }
 
 func (e NotFoundError) Error() string {
@@ -50,3 +157,15 @@ func (e NotFoundError) Error() string {
 func (e AlreadyExistsError) Error() string {
 	return fmt.Sprintf("%s %s already exists", e.ElementType, e.ID)
 }
+
+func (e GoneError) Error() string {
+	return fmt.Sprintf("%s %s has been deleted", e.ElementType, e.ID)
+}
+
+func (e NotDeletedError) Error() string {
+	return fmt.Sprintf("%s %s is not deleted", e.ElementType, e.ID)
+}
+
+func (e ConflictError) Error() string {
+	return fmt.Sprintf("%s %s has version %d but version %d was expected", e.ElementType, e.ID, e.ActualVersion, e.ExpectedVersion)
+}
@@ -3,26 +3,337 @@ package mongo
 import (
 	"context"
 	"fmt"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/getaceres/payment-demo/payment"
 	"github.com/getaceres/payment-demo/persistence"
 	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
-	"gopkg.in/mgo.v2/bson"
 )
 
 const (
-	paymentCollectionName = "payments"
+	paymentCollectionName   = "payments"
+	revisionCollectionName  = "payment_revisions"
+	keyCollectionName       = "idempotency_keys"
+	policyCollectionName    = "approval_policies"
+	duplicateCollectionName = "duplicate_policies"
+	lockCollectionName      = "duplicate_locks"
+	// duplicateKeyCode is the code of the write errors caused by a duplicated unique key
+	duplicateKeyCode = 11000
+	// duplicateLockExpiry is the time after which a duplicate lock which hasn't been released can be taken by another call
+	duplicateLockExpiry = time.Minute
+	// duplicateLockRetry is the time waited before trying again to take a duplicate lock which is held by another call
+	duplicateLockRetry = 10 * time.Millisecond
+	// DefaultDatabase is the database used when the storage URL doesn't contain one
+	DefaultDatabase = "payment-demo"
 )
 
+func init() {
+	persistence.RegisterRepository("mongodb", newRepositoryFromURL)
+	persistence.RegisterRepository("mongodb+srv", newRepositoryFromURL)
+}
+
+// newRepositoryFromURL builds a repository from a MongoDB connection URL like mongodb://localhost:27017/payments,
+// which uses the database in the path, creates the payment indexes and fills the decimals of the payments which don't have them
+func newRepositoryFromURL(storage *url.URL) (persistence.PaymentRepository, error) {
+	database := strings.TrimPrefix(storage.Path, "/")
+	if database == "" {
+		database = DefaultDatabase
+	}
+	repository, err := NewMongoPaymentRepository(storage.String(), database)
+	if err != nil {
+		return nil, err
+	}
+	if err := repository.CreateIndexes(context.Background()); err != nil {
+		return nil, err
+	}
+	if err := repository.FillDecimals(context.Background()); err != nil {
+		return nil, err
+	}
+	return repository, nil
+}
+
 type MongoPayment struct {
 	ID      string          `json:"_id" bson:"_id"`
 	Payment payment.Payment `json:"payment"`
+	// Decimals keeps a numeric copy of the decimal fields of the payment, which are stored as strings,
+	// so they can be compared by value in queries. Keys are the field paths with dots replaced by underscores.
+	// Payments stored before it was added don't have it until FillDecimals is called.
+	Decimals map[string][]primitive.Decimal128 `json:"decimals,omitempty" bson:"decimals,omitempty"`
+	// Revision is the number of the last revision of the payment, which is increased atomically with every change
+	Revision int `json:"revision" bson:"revision"`
+	// Pending contains the revisions of the last changes which haven't been copied to the revision collection yet.
+	// They are written in the same update as the change, so a change is never stored without its revision.
+	Pending []persistence.PaymentRevision `json:"pending,omitempty" bson:"pending,omitempty"`
+	// Deleted is true if the payment has been deleted but not purged
+	Deleted bool `json:"deleted,omitempty" bson:"deleted,omitempty"`
+}
+
+// notDeleted is the filter of the documents of payments which are not deleted
+var notDeleted = bson.M{"$ne": true}
+
+// MongoRevision is the document which stores a payment revision. Its identifier is built from the payment identifier
+// and the revision number so a revision can't be recorded twice.
+type MongoRevision struct {
+	ID       string                      `json:"_id" bson:"_id"`
+	Revision persistence.PaymentRevision `json:"revision"`
+}
+
+// MongoIdempotencyKey is the document which stores an idempotency key, identified by the key.
+// The key is inserted before its payment and marked as completed once the payment and its first revision are saved,
+// so the creation of the payment can be finished by a retry if it was interrupted. Expired keys are removed by a TTL index.
+type MongoIdempotencyKey struct {
+	ID          string          `json:"_id" bson:"_id"`
+	Fingerprint string          `json:"fingerprint"`
+	ExpiresAt   time.Time       `json:"expiresat"`
+	Payment     payment.Payment `json:"payment"`
+	Completed   bool            `json:"completed"`
+}
+
+func (k MongoIdempotencyKey) record() persistence.IdempotencyRecord {
+	return persistence.IdempotencyRecord{
+		IdempotencyKey: persistence.IdempotencyKey{Key: k.ID, Fingerprint: k.Fingerprint, ExpiresAt: k.ExpiresAt},
+		Payment:        k.Payment,
+	}
+}
+
+// MongoDuplicateLock is the document which locks the creation of the payments which could be duplicates of each other,
+// identified by the fields they share. It is held by the call whose owner identifier it contains until it is removed
+// or it expires, and expired locks are removed by a TTL index.
+type MongoDuplicateLock struct {
+	ID        string    `json:"_id" bson:"_id"`
+	Owner     string    `json:"owner"`
+	ExpiresAt time.Time `json:"expiresat"`
+}
+
+// MongoDuplicatePolicy is the document which stores the duplicate policy of an organisation, identified by the organisation
+type MongoDuplicatePolicy struct {
+	ID     string                  `json:"_id" bson:"_id"`
+	Policy payment.DuplicatePolicy `json:"policy"`
+}
+
+// MongoApprovalPolicy is the document which stores the approval policy of an organisation, identified by the organisation
+type MongoApprovalPolicy struct {
+	ID     string                 `json:"_id" bson:"_id"`
+	Policy payment.ApprovalPolicy `json:"policy"`
+}
+
+func revisionID(id string, revision int) string {
+	return fmt.Sprintf("%s/%d", id, revision)
+}
+
+func NewMongoPayment(pay payment.Payment) MongoPayment {
+	decimals := make(map[string][]primitive.Decimal128)
+	for _, field := range persistence.GetPaymentFields() {
+		if field.Kind != persistence.DecimalField {
+			continue
+		}
+		for _, value := range field.Values(pay) {
+			if _, err := field.ParseValue(value); err != nil {
+				continue
+			}
+			decimal, err := primitive.ParseDecimal128(value)
+			if err != nil {
+				continue
+			}
+			key := decimalKey(field)
+			decimals[key] = append(decimals[key], decimal)
+		}
+	}
+	return MongoPayment{
+		ID:       pay.ID,
+		Payment:  pay,
+		Decimals: decimals,
+	}
+}
+
+func decimalKey(field persistence.PaymentField) string {
+	return strings.Replace(field.Path, ".", "_", -1)
+}
+
+// documentKey returns the key of a payment field in the MongoDB documents
+func documentKey(field persistence.PaymentField) string {
+	return "payment." + strings.ToLower(strings.Join(field.Names, "."))
+}
+
+// comparisonKey returns the key of the MongoDB documents used to compare the values of a payment field
+func comparisonKey(field persistence.PaymentField) string {
+	if field.Kind == persistence.DecimalField {
+		return "decimals." + decimalKey(field)
+	}
+	return documentKey(field)
+}
+
+// comparisonValue converts a filter value into the value stored in the MongoDB documents for the given field
+func comparisonValue(field persistence.PaymentField, value string) (interface{}, error) {
+	parsed, err := field.ParseValue(value)
+	if err != nil {
+		return nil, err
+	}
+	if field.Kind == persistence.DecimalField {
+		decimal, err := primitive.ParseDecimal128(value)
+		if err != nil {
+			return nil, persistence.InvalidValueError{Path: field.Path, Value: value}
+		}
+		return decimal, nil
+	}
+	return parsed, nil
+}
+
+// buildFilter returns the filter of the payments which satisfy all the conditions. Deleted payments never match it.
+func buildFilter(conditions []persistence.FilterCondition) (bson.M, error) {
+	filter := bson.M{"deleted": notDeleted}
+	var repeated []interface{}
+	for _, condition := range conditions {
+		value, err := comparisonValue(condition.Field, condition.Value)
+		if err != nil {
+			return nil, err
+		}
+		key := comparisonKey(condition.Field)
+		operator := "$" + string(condition.Operator)
+		operators, ok := filter[key].(bson.M)
+		if !ok {
+			operators = bson.M{}
+			filter[key] = operators
+		}
+		// A field can only have one value for every operator, so the conditions which repeat an operator
+		// on the same field, like several not equal conditions, are added as separate clauses
+		if _, ok := operators[operator]; ok {
+			repeated = append(repeated, bson.M{key: bson.M{operator: value}})
+			continue
+		}
+		operators[operator] = value
+	}
+	if len(repeated) > 0 {
+		filter["$and"] = repeated
+	}
+	return filter, nil
+}
+
+// buildSort returns the sort document for the query order or for the reverse order if reverse is true
+func buildSort(query persistence.PaymentQuery, reverse bool) bson.D {
+	direction := func(descending bool) int {
+		if descending != reverse {
+			return -1
+		}
+		return 1
+	}
+	sort := make(bson.D, 0, len(query.Sort)+1)
+	for _, sortField := range query.Sort {
+		sort = append(sort, bson.E{Key: comparisonKey(sortField.Field), Value: direction(sortField.Descending)})
+	}
+	return append(sort, bson.E{Key: "_id", Value: direction(query.IdentifierDescending())})
+}
+
+// buildSeek returns a filter which matches the documents strictly after the cursor in the query order
+// or strictly before it if before is true. Documents without value for a field go before the rest in ascending order.
+func buildSeek(query persistence.PaymentQuery, cursor persistence.Cursor, before bool) (bson.M, error) {
+	clauses := make([]interface{}, 0, len(query.Sort)+1)
+	equal := bson.M{}
+	withEqual := func(key string, condition interface{}) bson.M {
+		clause := bson.M{key: condition}
+		for equalKey, equalValue := range equal {
+			clause[equalKey] = equalValue
+		}
+		return clause
+	}
+
+	for i, sortField := range query.Sort {
+		key := comparisonKey(sortField.Field)
+		var value interface{}
+		if cursor.Keys[i] != nil {
+			var err error
+			value, err = comparisonValue(sortField.Field, *cursor.Keys[i])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		greater := sortField.Descending == before
+		switch {
+		case value == nil && greater:
+			clauses = append(clauses, withEqual(key, bson.M{"$ne": nil}))
+		case value != nil && greater:
+			clauses = append(clauses, withEqual(key, bson.M{"$gt": value}))
+		case value != nil:
+			lower := withEqual("$or", []interface{}{
+				bson.M{key: bson.M{"$lt": value}},
+				bson.M{key: nil},
+			})
+			clauses = append(clauses, lower)
+		}
+		equal[key] = value
+	}
+
+	operator := "$gt"
+	if query.IdentifierDescending() != before {
+		operator = "$lt"
+	}
+	clauses = append(clauses, withEqual("_id", bson.M{operator: cursor.ID}))
+	return bson.M{"$or": clauses}, nil
+}
+
+func buildProjection(fields []persistence.PaymentField, sortFields []persistence.SortField) bson.M {
+	if len(fields) == 0 {
+		return nil
+	}
+	projection := bson.M{"payment.id": 1}
+	for _, field := range fields {
+		projection[documentKey(field)] = 1
+	}
+	for _, sortField := range sortFields {
+		projection[documentKey(sortField.Field)] = 1
+	}
+	// MongoDB rejects projections which contain both a field and any of its parents
+	for key := range projection {
+		for parent := range projection {
+			if strings.HasPrefix(key, parent+".") {
+				delete(projection, key)
+				break
+			}
+		}
+	}
+	return projection
+}
+
+// revisionIndexes contains the indexes created in the revision collection to list the revisions of a payment
+var revisionIndexes = []bson.D{
+	{{Key: "revision.paymentid", Value: 1}, {Key: "revision.revision", Value: 1}},
+}
+
+// indexes contains the indexes created in the payment collection so the most common filters and sort orders
+// can be evaluated without scanning the whole collection. Queries sorted by other fields are still valid but slower.
+var indexes = []bson.D{
+	{{Key: "payment.organisationid", Value: 1}, {Key: "_id", Value: 1}},
+	// Payments with pending revisions are looked up to copy them before reading the revision collection
+	{{Key: "pending.revision", Value: 1}},
+	{{Key: "payment.attributes.processingdate", Value: 1}, {Key: "_id", Value: 1}},
+	{{Key: "decimals.attributes_amount", Value: 1}, {Key: "_id", Value: 1}},
+	{{Key: "payment.status", Value: 1}, {Key: "_id", Value: 1}},
+	// The velocity fraud rules count the payments created within their window
+	{{Key: "payment.createdat", Value: 1}, {Key: "_id", Value: 1}},
+	// Duplicates are looked up by organisation, end to end reference, beneficiary account and processing date
+	{
+		{Key: "payment.organisationid", Value: 1},
+		{Key: "payment.attributes.endtoendreference", Value: 1},
+		{Key: "payment.attributes.beneficiaryparty.accountnumber", Value: 1},
+		{Key: "payment.attributes.processingdate", Value: 1},
+		{Key: "_id", Value: 1},
+	},
 }
 
 type MongoPaymentRepository struct {
 	collection                  *mongo.Collection
+	revisions                   *mongo.Collection
+	keys                        *mongo.Collection
+	policies                    *mongo.Collection
+	duplicatePolicies           *mongo.Collection
+	duplicateLocks              *mongo.Collection
 	defaultFindAndUpdateOptions *options.FindOneAndUpdateOptions
 }
 
@@ -33,73 +344,793 @@ func NewMongoPaymentRepository(connectionURI, database string) (*MongoPaymentRep
 		return &result, fmt.Errorf("Error creating MongoDB client: %s", err.Error())
 	}
 	result.collection = client.Database(database).Collection(paymentCollectionName)
+	result.revisions = client.Database(database).Collection(revisionCollectionName)
+	result.keys = client.Database(database).Collection(keyCollectionName)
+	result.policies = client.Database(database).Collection(policyCollectionName)
+	result.duplicatePolicies = client.Database(database).Collection(duplicateCollectionName)
+	result.duplicateLocks = client.Database(database).Collection(lockCollectionName)
 	result.defaultFindAndUpdateOptions = options.FindOneAndUpdate().SetReturnDocument(options.After)
 	return &result, nil
 }
 
-func (m *MongoPaymentRepository) findAndDo(ID string, function func(bson.M, *payment.Payment) *mongo.SingleResult, toUpdate *payment.Payment, action string) (payment.Payment, error) {
+// CreateIndexes creates the indexes used by the repository queries if they don't exist yet
+func (m *MongoPaymentRepository) CreateIndexes(ctx context.Context) error {
+	if err := createIndexes(ctx, m.collection, indexes); err != nil {
+		return fmt.Errorf("Error creating payment indexes: %s", err.Error())
+	}
+	if err := createIndexes(ctx, m.revisions, revisionIndexes); err != nil {
+		return fmt.Errorf("Error creating revision indexes: %s", err.Error())
+	}
+	_, err := m.keys.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expiresat", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return fmt.Errorf("Error creating idempotency key indexes: %s", err.Error())
+	}
+	_, err = m.duplicateLocks.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expiresat", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return fmt.Errorf("Error creating duplicate lock indexes: %s", err.Error())
+	}
+	return nil
+}
+
+// FillDecimals stores the decimals of the payments which were saved without them, before they were added to the documents,
+// so those payments can be found by their decimal fields. Payments changed meanwhile already have them and are left as they are.
+func (m *MongoPaymentRepository) FillDecimals(ctx context.Context) error {
+	cursor, err := m.collection.Find(ctx, bson.M{"decimals": bson.M{"$exists": false}}, options.Find().SetProjection(bson.M{"payment": 1}))
+	if err != nil {
+		return contextError(ctx, fmt.Errorf("Error getting payments without decimals: %s", err.Error()))
+	}
+	defer cursor.Close(context.Background())
+
+	for cursor.Next(ctx) {
+		var document MongoPayment
+		if err := cursor.Decode(&document); err != nil {
+			return fmt.Errorf("Error decoding payment without decimals: %s", err.Error())
+		}
+		decimals := NewMongoPayment(document.Payment).Decimals
+		filter := bson.M{"_id": document.ID, "decimals": bson.M{"$exists": false}}
+		if _, err := m.collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"decimals": decimals}}); err != nil {
+			return contextError(ctx, fmt.Errorf("Error filling decimals of payment %s: %s", document.ID, err.Error()))
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return contextError(ctx, fmt.Errorf("Error iterating payments without decimals: %s", err.Error()))
+	}
+	return nil
+}
+
+func createIndexes(ctx context.Context, collection *mongo.Collection, indexes []bson.D) error {
+	models := make([]mongo.IndexModel, 0, len(indexes))
+	for _, keys := range indexes {
+		models = append(models, mongo.IndexModel{Keys: keys})
+	}
+	_, err := collection.Indexes().CreateMany(ctx, models)
+	return err
+}
+
+// contextError returns the error of the context if it is cancelled or its deadline is exceeded,
+// which is the cause of any error returned by the driver in that case, or the given error otherwise
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// isDuplicateKey returns true if the error was caused by the insertion of a document with a duplicated unique key
+func isDuplicateKey(err error) bool {
+	if exception, ok := err.(mongo.WriteException); ok {
+		for _, writeError := range exception.WriteErrors {
+			if writeError.Code == duplicateKeyCode {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (m *MongoPaymentRepository) findAndDo(ctx context.Context, ID string, function func(bson.M, *payment.Payment) *mongo.SingleResult, toUpdate *payment.Payment, action string) (MongoPayment, error) {
 	var result MongoPayment
 	err := function(bson.M{"_id": ID}, toUpdate).Decode(&result)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
-			return result.Payment, persistence.NotFoundError{
+			return result, persistence.NotFoundError{
 				ElementType: persistence.PaymentElementType,
 				ID:          ID,
 			}
 		}
-		return result.Payment, fmt.Errorf("Error %s payment %s: %s", action, ID, err.Error())
+		return result, contextError(ctx, fmt.Errorf("Error %s payment %s: %s", action, ID, err.Error()))
 	}
-	return result.Payment, nil
+	return result, nil
 }
 
-func (m *MongoPaymentRepository) AddPayment(pay payment.Payment) (payment.Payment, error) {
-	pay.ID = uuid.New().String()
-	result, err := m.collection.InsertOne(context.Background(), MongoPayment{
-		ID:      pay.ID,
-		Payment: pay,
-	})
+// changePayment applies a change to the payment document which satisfies the filter and pushes its revision
+// to the pending revisions of the document in the same update. MongoDB doesn't support transactions in standalone servers,
+// but updates of a single document are atomic, so the change and its revision are always written together.
+// The change is built from the current document by the function, which returns the changed payment and the update,
+// and it is only applied if the revision of the document hasn't changed since it was read, otherwise it is built again.
+// The pending revisions are copied to the revision collection afterwards, or before reading it if that copy fails.
+// It returns a NotFoundError if no document satisfies the filter.
+func (m *MongoPaymentRepository) changePayment(ctx context.Context, id string, filter bson.M, operation persistence.RevisionOperation,
+	function func(current MongoPayment) (payment.Payment, bson.M), action string) (MongoPayment, error) {
+	filter["_id"] = id
+	for {
+		delete(filter, "revision")
+		var current MongoPayment
+		if err := m.collection.FindOne(ctx, filter).Decode(&current); err != nil {
+			if err == mongo.ErrNoDocuments {
+				return current, persistence.NotFoundError{
+					ElementType: persistence.PaymentElementType,
+					ID:          id,
+				}
+			}
+			return current, contextError(ctx, fmt.Errorf("Error %s payment %s: %s", action, id, err.Error()))
+		}
+
+		pay, update := function(current)
+		revision := current.Revision + 1
+		set, ok := update["$set"].(bson.M)
+		if !ok {
+			set = bson.M{}
+			update["$set"] = set
+		}
+		set["revision"] = revision
+		update["$push"] = bson.M{"pending": persistence.NewPaymentRevision(ctx, operation, revision, pay)}
+		filter["revision"] = current.Revision
+		if current.Revision == 0 {
+			// Documents stored before revisions were recorded don't have a revision number
+			filter["revision"] = bson.M{"$in": []interface{}{0, nil}}
+		}
+
+		var changed MongoPayment
+		err := m.collection.FindOneAndUpdate(ctx, filter, update, m.defaultFindAndUpdateOptions).Decode(&changed)
+		if err == mongo.ErrNoDocuments {
+			// The document has changed since it was read, so the change is built again over the new one
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return changed, ctxErr
+			}
+			continue
+		}
+		if err != nil {
+			return changed, contextError(ctx, fmt.Errorf("Error %s payment %s: %s", action, id, err.Error()))
+		}
+		// The change is already stored with its revision, so the revisions which can't be copied now
+		// are copied before the revision collection is read
+		m.copyRevisions(ctx, changed)
+		return changed, nil
+	}
+}
+
+// copyRevisions copies the pending revisions of a payment document to the revision collection and removes them from the document.
+// Revisions which had already been copied are skipped, so it can be called concurrently for the same document.
+func (m *MongoPaymentRepository) copyRevisions(ctx context.Context, document MongoPayment) error {
+	if len(document.Pending) == 0 {
+		return nil
+	}
+	numbers := make([]int, 0, len(document.Pending))
+	for _, revision := range document.Pending {
+		_, err := m.revisions.InsertOne(ctx, MongoRevision{
+			ID:       revisionID(revision.PaymentID, revision.Revision),
+			Revision: revision,
+		})
+		if err != nil && !isDuplicateKey(err) {
+			return contextError(ctx, fmt.Errorf("Error saving revision %d of payment %s: %s", revision.Revision, revision.PaymentID, err.Error()))
+		}
+		numbers = append(numbers, revision.Revision)
+	}
+	update := bson.M{"$pull": bson.M{"pending": bson.M{"revision": bson.M{"$in": numbers}}}}
+	if _, err := m.collection.UpdateOne(ctx, bson.M{"_id": document.ID}, update); err != nil {
+		return contextError(ctx, fmt.Errorf("Error removing copied revisions of payment %s: %s", document.ID, err.Error()))
+	}
+	return nil
+}
+
+// copyPendingRevisions copies the pending revisions of the payment documents which satisfy the filter to the revision collection,
+// so it contains the revisions of all their changes
+func (m *MongoPaymentRepository) copyPendingRevisions(ctx context.Context, filter bson.M) error {
+	filter["pending.revision"] = bson.M{"$gt": 0}
+	cursor, err := m.collection.Find(ctx, filter, options.Find().SetProjection(bson.M{"pending": 1}))
 	if err != nil {
-		return payment.Payment{}, fmt.Errorf("Error saving payment: %s", err.Error())
+		return contextError(ctx, fmt.Errorf("Error getting pending revisions: %s", err.Error()))
+	}
+	defer cursor.Close(context.Background())
+
+	for cursor.Next(ctx) {
+		var document MongoPayment
+		if err := cursor.Decode(&document); err != nil {
+			return fmt.Errorf("Error decoding pending revisions: %s", err.Error())
+		}
+		if err := m.copyRevisions(ctx, document); err != nil {
+			return err
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return contextError(ctx, fmt.Errorf("Error iterating pending revisions: %s", err.Error()))
+	}
+	return nil
+}
+
+func (m *MongoPaymentRepository) AddPayment(ctx context.Context, pay payment.Payment) (payment.Payment, error) {
+	pay.ID = uuid.New().String()
+	if err := m.insertPayment(ctx, pay, false); err != nil {
+		return payment.Payment{}, err
 	}
-	pay.ID = result.InsertedID.(string)
 	return pay, nil
 }
 
-func (m *MongoPaymentRepository) UpdatePayment(pay payment.Payment) (payment.Payment, error) {
-	return m.findAndDo(pay.ID, func(filter bson.M, pay *payment.Payment) *mongo.SingleResult {
-		return m.collection.FindOneAndReplace(context.Background(), filter, MongoPayment{
-			ID:      pay.ID,
-			Payment: *pay,
-		}, options.FindOneAndReplace().SetReturnDocument(options.After))
-	}, &pay, "updating")
+// insertPayment saves a new payment with its first revision pending, which is copied to the revision collection afterwards.
+// If resume is true, a payment which was already saved is skipped, so the creation of a payment which was interrupted can be finished.
+func (m *MongoPaymentRepository) insertPayment(ctx context.Context, pay payment.Payment, resume bool) error {
+	document := NewMongoPayment(pay)
+	document.Revision = 1
+	document.Pending = []persistence.PaymentRevision{persistence.NewPaymentRevision(ctx, persistence.CreateOperation, document.Revision, pay)}
+	if _, err := m.collection.InsertOne(ctx, document); err != nil {
+		if !(resume && isDuplicateKey(err)) {
+			return contextError(ctx, fmt.Errorf("Error saving payment: %s", err.Error()))
+		}
+		// The pending revision of the stored payment may not have been copied yet
+		m.copyPendingRevisions(ctx, bson.M{"_id": pay.ID})
+		return nil
+	}
+	// The payment is already stored with its revision, so it is copied before the revision collection is read if it fails now
+	m.copyRevisions(ctx, document)
+	return nil
+}
+
+// AddPaymentOnce inserts the key before the payment, so a concurrent call with the same key fails to insert it
+// and returns the payment of the stored key instead. If the stored key hasn't been completed, because its call
+// is still saving the payment or it was interrupted, the creation of its payment is finished before returning it.
+// Expired keys which haven't been removed by the TTL index yet are removed before inserting the new one.
+func (m *MongoPaymentRepository) AddPaymentOnce(ctx context.Context, pay payment.Payment, key persistence.IdempotencyKey) (payment.Payment, bool, error) {
+	pay.ID = uuid.New().String()
+	document := MongoIdempotencyKey{
+		ID:          key.Key,
+		Fingerprint: key.Fingerprint,
+		ExpiresAt:   key.ExpiresAt,
+		Payment:     pay,
+	}
+	for {
+		_, err := m.keys.InsertOne(ctx, document)
+		if err == nil {
+			break
+		}
+		if !isDuplicateKey(err) {
+			return payment.Payment{}, false, contextError(ctx, fmt.Errorf("Error saving idempotency key %s: %s", key.Key, err.Error()))
+		}
+		var stored MongoIdempotencyKey
+		if err := m.keys.FindOne(ctx, bson.M{"_id": key.Key}).Decode(&stored); err != nil {
+			if err == mongo.ErrNoDocuments {
+				continue
+			}
+			return payment.Payment{}, false, contextError(ctx, fmt.Errorf("Error getting idempotency key %s: %s", key.Key, err.Error()))
+		}
+		record := stored.record()
+		if record.Expired(time.Now()) {
+			if _, err := m.keys.DeleteOne(ctx, bson.M{"_id": key.Key, "expiresat": stored.ExpiresAt}); err != nil {
+				return payment.Payment{}, false, contextError(ctx, fmt.Errorf("Error removing idempotency key %s: %s", key.Key, err.Error()))
+			}
+			continue
+		}
+		replayed, err := record.Replay(key)
+		if err != nil {
+			return payment.Payment{}, false, err
+		}
+		if !stored.Completed {
+			if err := m.completeKey(ctx, stored, true); err != nil {
+				return payment.Payment{}, false, err
+			}
+		}
+		return replayed, true, nil
+	}
+	if err := m.completeKey(ctx, document, false); err != nil {
+		return payment.Payment{}, false, err
+	}
+	return pay, false, nil
+}
+
+// AddPaymentUnlessDuplicate holds the duplicate lock of the payment while it looks for its duplicates and saves it,
+// so the calls of any process for payments which could duplicate each other check and save them one after another.
+func (m *MongoPaymentRepository) AddPaymentUnlessDuplicate(ctx context.Context, pay payment.Payment, policy payment.DuplicatePolicy, key *persistence.IdempotencyKey) (payment.Payment, bool, error) {
+	unlock, err := m.lockDuplicates(ctx, pay)
+	if err != nil {
+		return payment.Payment{}, false, contextError(ctx, fmt.Errorf("Error locking duplicates: %s", err.Error()))
+	}
+	defer unlock()
+	return persistence.CheckAndAddPayment(ctx, m, pay, policy, key)
+}
+
+// lockDuplicates takes the lock of the payments which share the organisation, end to end reference, currency
+// and beneficiary account of the payment, waiting until it is released or it expires if another call holds it.
+// It returns the function which releases it.
+func (m *MongoPaymentRepository) lockDuplicates(ctx context.Context, pay payment.Payment) (func(), error) {
+	attributes := pay.Attributes
+	id := strings.Join([]string{pay.OrganisationID, attributes.EndToEndReference, attributes.Currency, attributes.BeneficiaryParty.AccountNumber}, "|")
+	owner := uuid.New().String()
+	for {
+		now := time.Now()
+		lock := MongoDuplicateLock{ID: id, Owner: owner, ExpiresAt: now.Add(duplicateLockExpiry)}
+		_, err := m.duplicateLocks.InsertOne(ctx, lock)
+		if err == nil {
+			break
+		}
+		if !isDuplicateKey(err) {
+			return nil, err
+		}
+		result, err := m.duplicateLocks.ReplaceOne(ctx, bson.M{"_id": id, "expiresat": bson.M{"$lte": now}}, lock)
+		if err != nil {
+			return nil, err
+		}
+		if result.MatchedCount > 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(duplicateLockRetry):
+		}
+	}
+	return func() {
+		m.duplicateLocks.DeleteOne(context.Background(), bson.M{"_id": id, "owner": owner})
+	}, nil
+}
+
+func (m *MongoPaymentRepository) GetIdempotencyRecord(ctx context.Context, key string) (persistence.IdempotencyRecord, error) {
+	var stored MongoIdempotencyKey
+	err := m.keys.FindOne(ctx, bson.M{"_id": key}).Decode(&stored)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return persistence.IdempotencyRecord{}, contextError(ctx, fmt.Errorf("Error getting idempotency key %s: %s", key, err.Error()))
+	}
+	record := stored.record()
+	if err == mongo.ErrNoDocuments || record.Expired(time.Now()) {
+		return persistence.IdempotencyRecord{}, persistence.NotFoundError{
+			ElementType: persistence.IdempotencyKeyElementType,
+			ID:          key,
+		}
+	}
+	return record, nil
+}
+
+// completeKey saves the payment of an idempotency key and marks the key as completed
+func (m *MongoPaymentRepository) completeKey(ctx context.Context, key MongoIdempotencyKey, resume bool) error {
+	if err := m.insertPayment(ctx, key.Payment, resume); err != nil {
+		return err
+	}
+	if _, err := m.keys.UpdateOne(ctx, bson.M{"_id": key.ID}, bson.M{"$set": bson.M{"completed": true}}); err != nil {
+		return contextError(ctx, fmt.Errorf("Error completing idempotency key %s: %s", key.ID, err.Error()))
+	}
+	return nil
+}
+
+func (m *MongoPaymentRepository) UpdatePayment(ctx context.Context, pay payment.Payment) (payment.Payment, error) {
+	expectedVersion := pay.Version
+	pay.Version++
+	filter := bson.M{"payment.version": expectedVersion, "deleted": notDeleted}
+	updated, err := m.changePayment(ctx, pay.ID, filter, persistence.UpdateOperation, func(current MongoPayment) (payment.Payment, bson.M) {
+		document := NewMongoPayment(pay)
+		return pay, bson.M{"$set": bson.M{"payment": document.Payment, "decimals": document.Decimals}}
+	}, "updating")
+	if err != nil {
+		return updated.Payment, m.checkConflict(ctx, pay.ID, expectedVersion, false, err)
+	}
+	return updated.Payment, nil
+}
+
+func (m *MongoPaymentRepository) DeletePayment(ctx context.Context, id string, expectedVersion int) (payment.Payment, error) {
+	deleted, err := m.setDeleted(ctx, id, expectedVersion, true)
+	return deleted.Payment, err
 }
 
-func (m *MongoPaymentRepository) DeletePayment(id string) (payment.Payment, error) {
-	return m.findAndDo(id, func(filter bson.M, pay *payment.Payment) *mongo.SingleResult {
-		return m.collection.FindOneAndDelete(context.Background(), filter)
-	}, nil, "deleting")
+func (m *MongoPaymentRepository) RestorePayment(ctx context.Context, id string, expectedVersion int) (payment.Payment, error) {
+	restored, err := m.setDeleted(ctx, id, expectedVersion, false)
+	return restored.Payment, err
 }
 
-func (m *MongoPaymentRepository) GetPayment(id string) (payment.Payment, error) {
-	return m.findAndDo(id, func(filter bson.M, pay *payment.Payment) *mongo.SingleResult {
-		return m.collection.FindOne(context.Background(), filter)
+// setDeleted marks a payment which is not deleted as deleted or restores a deleted payment, increasing its version,
+// if its version is the expected one, recording the deletion or the restoration as a revision. It returns the changed payment document.
+func (m *MongoPaymentRepository) setDeleted(ctx context.Context, id string, expectedVersion int, deleted bool) (MongoPayment, error) {
+	filter := bson.M{"deleted": notDeleted}
+	operation, action := persistence.DeleteOperation, "deleting"
+	if !deleted {
+		filter["deleted"] = true
+		operation, action = persistence.RestoreOperation, "restoring"
+	}
+	if expectedVersion != persistence.AnyVersion {
+		filter["payment.version"] = expectedVersion
+	}
+	changed, err := m.changePayment(ctx, id, filter, operation, func(current MongoPayment) (payment.Payment, bson.M) {
+		if deleted {
+			return current.Payment, bson.M{"$set": bson.M{"deleted": true}}
+		}
+		restored := current.Payment
+		restored.Version++
+		return restored, bson.M{"$unset": bson.M{"deleted": ""}, "$inc": bson.M{"payment.version": 1}}
+	}, action)
+	return changed, m.checkConflict(ctx, id, expectedVersion, !deleted, err)
+}
+
+func (m *MongoPaymentRepository) PurgePayment(ctx context.Context, id string) (payment.Payment, error) {
+	purged, err := m.findAndDo(ctx, id, func(filter bson.M, pay *payment.Payment) *mongo.SingleResult {
+		filter["deleted"] = true
+		return m.collection.FindOneAndDelete(ctx, filter)
+	}, nil, "purging")
+	if err != nil {
+		return purged.Payment, m.checkConflict(ctx, id, persistence.AnyVersion, true, err)
+	}
+	if _, err := m.revisions.DeleteMany(ctx, bson.M{"revision.paymentid": id}); err != nil {
+		return purged.Payment, contextError(ctx, fmt.Errorf("Error purging revisions of payment %s: %s", id, err.Error()))
+	}
+	return purged.Payment, nil
+}
+
+// checkConflict finds out why an operation which is only done over deleted payments, if deleted is true, or over payments
+// which are not deleted otherwise, and which is conditioned to the payment version didn't find the payment.
+// It converts the NotFoundError returned by the operation into a GoneError or a NotDeletedError if the payment exists
+// but it is or isn't deleted, or into a ConflictError if the payment exists with a different version.
+func (m *MongoPaymentRepository) checkConflict(ctx context.Context, id string, expectedVersion int, deleted bool, err error) error {
+	if _, ok := err.(persistence.NotFoundError); !ok {
+		return err
+	}
+	current, getErr := m.findAndDo(ctx, id, func(filter bson.M, pay *payment.Payment) *mongo.SingleResult {
+		return m.collection.FindOne(ctx, filter)
 	}, nil, "getting")
+	if getErr != nil {
+		return getErr
+	}
+	switch {
+	case current.Deleted && !deleted:
+		return persistence.GoneError{
+			ElementType: persistence.PaymentElementType,
+			ID:          id,
+		}
+	case !current.Deleted && deleted:
+		return persistence.NotDeletedError{
+			ElementType: persistence.PaymentElementType,
+			ID:          id,
+		}
+	}
+	return persistence.ConflictError{
+		ElementType:     persistence.PaymentElementType,
+		ID:              id,
+		ExpectedVersion: expectedVersion,
+		ActualVersion:   current.Payment.Version,
+	}
+}
+
+func (m *MongoPaymentRepository) GetPayment(ctx context.Context, id string) (payment.Payment, error) {
+	found, err := m.findAndDo(ctx, id, func(filter bson.M, pay *payment.Payment) *mongo.SingleResult {
+		filter["deleted"] = notDeleted
+		return m.collection.FindOne(ctx, filter)
+	}, nil, "getting")
+	if err != nil {
+		return found.Payment, m.checkConflict(ctx, id, persistence.AnyVersion, false, err)
+	}
+	return found.Payment, nil
+}
+
+func (m *MongoPaymentRepository) GetPaymentAsOf(ctx context.Context, id string, asOf time.Time) (payment.Payment, error) {
+	revisions, err := m.GetPaymentRevisions(ctx, id)
+	if err != nil {
+		return payment.Payment{}, err
+	}
+	pay, ok := persistence.PaymentAsOf(revisions, asOf)
+	if !ok {
+		return pay, persistence.NotFoundError{
+			ElementType: persistence.PaymentElementType,
+			ID:          id,
+		}
+	}
+	return pay, nil
+}
+
+// paymentsAsOf returns all the payments as they were at the given time, which are the payments of their last revision
+// recorded at or before that time unless it is a deletion. Queries over them are evaluated in memory.
+func (m *MongoPaymentRepository) paymentsAsOf(ctx context.Context, asOf time.Time) ([]payment.Payment, error) {
+	result := make([]payment.Payment, 0)
+	if err := m.copyPendingRevisions(ctx, bson.M{}); err != nil {
+		return result, err
+	}
+	pipeline := []bson.M{
+		{"$match": bson.M{"revision.timestamp": bson.M{"$lte": asOf}}},
+		{"$sort": bson.D{{Key: "revision.paymentid", Value: 1}, {Key: "revision.revision", Value: -1}}},
+		{"$group": bson.M{"_id": "$revision.paymentid", "revision": bson.M{"$first": "$revision"}}},
+		{"$match": bson.M{"revision.operation": bson.M{"$ne": persistence.DeleteOperation}}},
+	}
+	cursor, err := m.revisions.Aggregate(ctx, pipeline)
+	if err != nil {
+		return result, contextError(ctx, fmt.Errorf("Error getting payments: %s", err.Error()))
+	}
+	defer cursor.Close(context.Background())
+
+	for cursor.Next(ctx) {
+		var decoded MongoRevision
+		if err := cursor.Decode(&decoded); err != nil {
+			return result, fmt.Errorf("Error decoding revision: %s", err.Error())
+		}
+		result = append(result, decoded.Revision.Payment)
+	}
+	if err := cursor.Err(); err != nil {
+		return result, contextError(ctx, fmt.Errorf("Error iterating payments: %s", err.Error()))
+	}
+	return result, nil
+}
+
+func (m *MongoPaymentRepository) GetPaymentRevisions(ctx context.Context, id string) ([]persistence.PaymentRevision, error) {
+	result := make([]persistence.PaymentRevision, 0)
+	if err := m.copyPendingRevisions(ctx, bson.M{"_id": id}); err != nil {
+		return result, err
+	}
+	findOptions := options.Find().SetSort(bson.D{{Key: "revision.revision", Value: 1}})
+	cursor, err := m.revisions.Find(ctx, bson.M{"revision.paymentid": id}, findOptions)
+	if err != nil {
+		return result, contextError(ctx, fmt.Errorf("Error getting revisions of payment %s: %s", id, err.Error()))
+	}
+	defer cursor.Close(context.Background())
+
+	for cursor.Next(ctx) {
+		var decoded MongoRevision
+		if err := cursor.Decode(&decoded); err != nil {
+			return result, fmt.Errorf("Error decoding revision: %s", err.Error())
+		}
+		result = append(result, decoded.Revision)
+	}
+	if err := cursor.Err(); err != nil {
+		return result, contextError(ctx, fmt.Errorf("Error iterating revisions of payment %s: %s", id, err.Error()))
+	}
+	if len(result) == 0 {
+		return result, persistence.NotFoundError{
+			ElementType: persistence.PaymentElementType,
+			ID:          id,
+		}
+	}
+	return result, nil
+}
+
+func (m *MongoPaymentRepository) GetPaymentRevision(ctx context.Context, id string, revision int) (persistence.PaymentRevision, error) {
+	var result MongoRevision
+	if err := m.copyPendingRevisions(ctx, bson.M{"_id": id}); err != nil {
+		return result.Revision, err
+	}
+	err := m.revisions.FindOne(ctx, bson.M{"_id": revisionID(id, revision)}).Decode(&result)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return result.Revision, persistence.RevisionNotFound(id, revision)
+		}
+		return result.Revision, contextError(ctx, fmt.Errorf("Error getting revision %d of payment %s: %s", revision, id, err.Error()))
+	}
+	return result.Revision, nil
+}
+
+func (m *MongoPaymentRepository) GetPayments(ctx context.Context, filter map[string]string) ([]payment.Payment, error) {
+	query, err := persistence.NewFilterQuery(filter)
+	if err != nil {
+		return make([]payment.Payment, 0), err
+	}
+	return m.FindPayments(ctx, query)
 }
 
-func (m *MongoPaymentRepository) GetPayments(filter map[string]string) ([]payment.Payment, error) {
+func (m *MongoPaymentRepository) FindPayments(ctx context.Context, query persistence.PaymentQuery) ([]payment.Payment, error) {
+	if !query.AsOf.IsZero() {
+		payments, err := m.paymentsAsOf(ctx, query.AsOf)
+		if err != nil {
+			return make([]payment.Payment, 0), err
+		}
+		return query.Apply(payments), nil
+	}
+
+	filter, err := buildFilter(query.Filter)
+	if err != nil {
+		return make([]payment.Payment, 0), err
+	}
+
+	findOptions := options.Find().SetSort(buildSort(query, false))
+	if projection := buildProjection(query.Fields, nil); projection != nil {
+		findOptions.SetProjection(projection)
+	}
+	return m.find(ctx, filter, findOptions)
+}
+
+func (m *MongoPaymentRepository) GetPaymentPage(ctx context.Context, query persistence.PaymentQuery, page persistence.PageRequest) (persistence.PaymentPage, error) {
+	var result persistence.PaymentPage
+	if err := query.ValidatePage(page); err != nil {
+		return result, err
+	}
+	if !query.AsOf.IsZero() {
+		payments, err := m.paymentsAsOf(ctx, query.AsOf)
+		if err != nil {
+			return result, err
+		}
+		return query.Paginate(payments, page)
+	}
+
+	filter, err := buildFilter(query.Filter)
+	if err != nil {
+		return result, err
+	}
+
+	before := page.Before != ""
+	pageFilter := filter
+	if page.After != "" || page.Before != "" {
+		encoded := page.After
+		if before {
+			encoded = page.Before
+		}
+		cursor, err := query.DecodeCursor(encoded)
+		if err != nil {
+			return result, err
+		}
+		seek, err := buildSeek(query, cursor, before)
+		if err != nil {
+			return result, err
+		}
+		pageFilter = bson.M{"$and": []interface{}{filter, seek}}
+	}
+
+	findOptions := options.Find().SetSort(buildSort(query, before)).SetLimit(int64(page.Size) + 1)
+	if projection := buildProjection(query.Fields, query.Sort); projection != nil {
+		findOptions.SetProjection(projection)
+	}
+	payments, err := m.find(ctx, pageFilter, findOptions)
+	if err != nil {
+		return result, err
+	}
+
+	more := len(payments) > page.Size
+	if more {
+		payments = payments[:page.Size]
+	}
+	if before {
+		for i, j := 0, len(payments)-1; i < j; i, j = i+1, j-1 {
+			payments[i], payments[j] = payments[j], payments[i]
+		}
+	}
+	if len(payments) == 0 {
+		result.Payments = payments
+		return result, nil
+	}
+
+	first := query.NewCursor(payments[0])
+	last := query.NewCursor(payments[len(payments)-1])
+	hasPrevious, hasNext := more && before, more && !before
+	if before {
+		hasNext, err = m.exists(ctx, filter, query, last, false)
+	} else if page.After != "" {
+		hasPrevious, err = m.exists(ctx, filter, query, first, true)
+	}
+	if err != nil {
+		return result, err
+	}
+	if hasPrevious {
+		result.Previous = first.Encode()
+	}
+	if hasNext {
+		result.Next = last.Encode()
+	}
+
+	result.Payments = make([]payment.Payment, len(payments))
+	for i, pay := range payments {
+		result.Payments[i] = query.Select(pay)
+	}
+	return result, nil
+}
+
+// exists returns true if there's any payment matching the filter strictly after the cursor in the query order
+// or strictly before it if before is true
+func (m *MongoPaymentRepository) exists(ctx context.Context, filter bson.M, query persistence.PaymentQuery, cursor persistence.Cursor, before bool) (bool, error) {
+	seek, err := buildSeek(query, cursor, before)
+	if err != nil {
+		return false, err
+	}
+	findOptions := options.Find().
+		SetSort(buildSort(query, before)).
+		SetLimit(1).
+		SetProjection(bson.M{"_id": 1})
+	found, err := m.find(ctx, bson.M{"$and": []interface{}{filter, seek}}, findOptions)
+	if err != nil {
+		return false, err
+	}
+	return len(found) > 0, nil
+}
+
+func (m *MongoPaymentRepository) find(ctx context.Context, filter bson.M, findOptions *options.FindOptions) ([]payment.Payment, error) {
 	result := make([]payment.Payment, 0)
-	cursor, err := m.collection.Find(context.Background(), bson.M{})
+	cursor, err := m.collection.Find(ctx, filter, findOptions)
 	if err != nil {
-		return result, fmt.Errorf("Error getting all payments: %s", err.Error())
+		return result, contextError(ctx, fmt.Errorf("Error getting payments: %s", err.Error()))
 	}
+	// The cursor is closed with a new context so it is released in the server even if the request context is finished
+	defer cursor.Close(context.Background())
 
-	var decoded MongoPayment
-	for cursor.Next(context.Background()) {
+	for cursor.Next(ctx) {
+		var decoded MongoPayment
 		err := cursor.Decode(&decoded)
 		if err != nil {
 			return result, fmt.Errorf("Error decoding result: %s", err.Error())
 		}
 		result = append(result, decoded.Payment)
 	}
+	if err := cursor.Err(); err != nil {
+		return result, contextError(ctx, fmt.Errorf("Error iterating payments: %s", err.Error()))
+	}
 	return result, nil
 }
+
+func (m *MongoPaymentRepository) SaveApprovalPolicy(ctx context.Context, policy payment.ApprovalPolicy) error {
+	document := MongoApprovalPolicy{ID: policy.OrganisationID, Policy: policy}
+	_, err := m.policies.ReplaceOne(ctx, bson.M{"_id": document.ID}, document, options.Replace().SetUpsert(true))
+	if err != nil {
+		return contextError(ctx, fmt.Errorf("Error saving approval policy of organisation %s: %s", policy.OrganisationID, err.Error()))
+	}
+	return nil
+}
+
+func (m *MongoPaymentRepository) GetApprovalPolicy(ctx context.Context, organisationID string) (payment.ApprovalPolicy, error) {
+	var result MongoApprovalPolicy
+	err := m.policies.FindOne(ctx, bson.M{"_id": organisationID}).Decode(&result)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return result.Policy, persistence.NotFoundError{
+				ElementType: persistence.ApprovalPolicyElementType,
+				ID:          organisationID,
+			}
+		}
+		return result.Policy, contextError(ctx, fmt.Errorf("Error getting approval policy of organisation %s: %s", organisationID, err.Error()))
+	}
+	return result.Policy, nil
+}
+
+func (m *MongoPaymentRepository) DeleteApprovalPolicy(ctx context.Context, organisationID string) error {
+	result, err := m.policies.DeleteOne(ctx, bson.M{"_id": organisationID})
+	if err != nil {
+		return contextError(ctx, fmt.Errorf("Error deleting approval policy of organisation %s: %s", organisationID, err.Error()))
+	}
+	if result.DeletedCount == 0 {
+		return persistence.NotFoundError{
+			ElementType: persistence.ApprovalPolicyElementType,
+			ID:          organisationID,
+		}
+	}
+	return nil
+}
+
+func (m *MongoPaymentRepository) SaveDuplicatePolicy(ctx context.Context, policy payment.DuplicatePolicy) error {
+	document := MongoDuplicatePolicy{ID: policy.OrganisationID, Policy: policy}
+	_, err := m.duplicatePolicies.ReplaceOne(ctx, bson.M{"_id": document.ID}, document, options.Replace().SetUpsert(true))
+	if err != nil {
+		return contextError(ctx, fmt.Errorf("Error saving duplicate policy of organisation %s: %s", policy.OrganisationID, err.Error()))
+	}
+	return nil
+}
+
+func (m *MongoPaymentRepository) GetDuplicatePolicy(ctx context.Context, organisationID string) (payment.DuplicatePolicy, error) {
+	var result MongoDuplicatePolicy
+	err := m.duplicatePolicies.FindOne(ctx, bson.M{"_id": organisationID}).Decode(&result)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return result.Policy, persistence.NotFoundError{
+				ElementType: persistence.DuplicatePolicyElementType,
+				ID:          organisationID,
+			}
+		}
+		return result.Policy, contextError(ctx, fmt.Errorf("Error getting duplicate policy of organisation %s: %s", organisationID, err.Error()))
+	}
+	return result.Policy, nil
+}
+
+func (m *MongoPaymentRepository) DeleteDuplicatePolicy(ctx context.Context, organisationID string) error {
+	result, err := m.duplicatePolicies.DeleteOne(ctx, bson.M{"_id": organisationID})
+	if err != nil {
+		return contextError(ctx, fmt.Errorf("Error deleting duplicate policy of organisation %s: %s", organisationID, err.Error()))
+	}
+	if result.DeletedCount == 0 {
+		return persistence.NotFoundError{
+			ElementType: persistence.DuplicatePolicyElementType,
+			ID:          organisationID,
+		}
+	}
+	return nil
+}
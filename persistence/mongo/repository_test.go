@@ -1,12 +1,17 @@
 package mongo
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
 	"testing"
 
+	"github.com/getaceres/payment-demo/payment"
 	"github.com/getaceres/payment-demo/persistence"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 var integrationMongo = flag.Bool("mongo", false, "run MongoDB tests")
@@ -21,6 +26,12 @@ func TestMain(m *testing.M) {
 		fmt.Printf("Error getting MongoDB repository: %s", err.Error())
 	}
 	tester.Repository = repo
+	flag.Parse()
+	if *integrationMongo {
+		if err := repo.CreateIndexes(context.Background()); err != nil {
+			fmt.Printf("Error creating MongoDB indexes: %s", err.Error())
+		}
+	}
 	os.Exit(m.Run())
 }
 
@@ -42,6 +53,24 @@ func TestDelete(t *testing.T) {
 	}
 }
 
+func TestRestore(t *testing.T) {
+	if *integrationMongo {
+		tester.TestRestore(t)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	if *integrationMongo {
+		tester.TestPurge(t)
+	}
+}
+
+func TestIdempotency(t *testing.T) {
+	if *integrationMongo {
+		tester.TestIdempotency(t, 10)
+	}
+}
+
 func TestGetId(t *testing.T) {
 	if *integrationMongo {
 		tester.TestGetId(t)
@@ -53,3 +82,152 @@ func TestGetList(t *testing.T) {
 		tester.TestGetList(t, 10)
 	}
 }
+
+func TestFilter(t *testing.T) {
+	if *integrationMongo {
+		tester.TestFilter(t)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	if *integrationMongo {
+		tester.TestQuery(t)
+	}
+}
+
+func TestPagination(t *testing.T) {
+	if *integrationMongo {
+		tester.TestPagination(t)
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	if *integrationMongo {
+		tester.TestConcurrentAccess(t, 20, 10)
+	}
+}
+
+func TestCancelledContext(t *testing.T) {
+	if *integrationMongo {
+		tester.TestCancelledContext(t)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	if *integrationMongo {
+		tester.TestHistory(t)
+	}
+}
+
+func TestAsOf(t *testing.T) {
+	if *integrationMongo {
+		tester.TestAsOf(t)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	if *integrationMongo {
+		tester.TestStatus(t)
+	}
+}
+
+func TestSanctionsHits(t *testing.T) {
+	if *integrationMongo {
+		tester.TestSanctionsHits(t)
+	}
+}
+
+func TestRisk(t *testing.T) {
+	if *integrationMongo {
+		tester.TestRisk(t)
+	}
+}
+
+func TestDuplicates(t *testing.T) {
+	if *integrationMongo {
+		tester.TestDuplicates(t)
+	}
+}
+
+func TestAddUnlessDuplicate(t *testing.T) {
+	if *integrationMongo {
+		tester.TestAddUnlessDuplicate(t, 10)
+	}
+}
+
+func TestApprovalPolicies(t *testing.T) {
+	if *integrationMongo {
+		tester.TestApprovalPolicies(t)
+	}
+}
+
+func TestDuplicatePolicies(t *testing.T) {
+	if *integrationMongo {
+		tester.TestDuplicatePolicies(t)
+	}
+}
+
+func TestFillDecimals(t *testing.T) {
+	if !*integrationMongo {
+		return
+	}
+	repository := tester.Repository.(*MongoPaymentRepository)
+	pay, err := payment.GetDefaultTestPayment(tester.ResourcesPath)
+	if err != nil {
+		t.Fatalf("Error getting default payment: %s", err.Error())
+	}
+	pay.ID = uuid.New().String()
+	pay.Attributes.EndToEndReference = uuid.New().String()
+	legacy := NewMongoPayment(pay)
+	legacy.Decimals = nil
+	if _, err := repository.collection.InsertOne(context.Background(), legacy); err != nil {
+		t.Fatalf("Error inserting payment without decimals: %s", err.Error())
+	}
+
+	query, err := persistence.NewFilterQuery(map[string]string{
+		"attributes.end_to_end_reference": pay.Attributes.EndToEndReference,
+		"attributes.amount":               pay.Attributes.Amount,
+	})
+	if err != nil {
+		t.Fatalf("Error building query: %s", err.Error())
+	}
+	if found, err := repository.FindPayments(context.Background(), query); err != nil || len(found) != 0 {
+		t.Fatalf("Expected the payment without decimals not to be found by amount but got %v (%v)", found, err)
+	}
+	if err := repository.FillDecimals(context.Background()); err != nil {
+		t.Fatalf("Error filling decimals: %s", err.Error())
+	}
+	found, err := repository.FindPayments(context.Background(), query)
+	if err != nil {
+		t.Fatalf("Error finding payments: %s", err.Error())
+	}
+	if len(found) != 1 || found[0].ID != pay.ID {
+		t.Fatalf("Expected payment %s to be found by amount after filling its decimals but got %v", pay.ID, found)
+	}
+}
+
+func TestBuildFilter(t *testing.T) {
+	var conditions []persistence.FilterCondition
+	for _, status := range []string{"rejected", "cancelled", "blocked"} {
+		condition, err := persistence.NewFilterCondition("status", persistence.NotEqualOperator, status)
+		if err != nil {
+			t.Fatalf("Error creating condition: %s", err.Error())
+		}
+		conditions = append(conditions, condition)
+	}
+	filter, err := buildFilter(conditions)
+	if err != nil {
+		t.Fatalf("Error building filter: %s", err.Error())
+	}
+	expected := bson.M{
+		"deleted":        notDeleted,
+		"payment.status": bson.M{"$ne": "rejected"},
+		"$and": []interface{}{
+			bson.M{"payment.status": bson.M{"$ne": "cancelled"}},
+			bson.M{"payment.status": bson.M{"$ne": "blocked"}},
+		},
+	}
+	if !cmp.Equal(filter, expected) {
+		t.Fatalf("Unexpected filter.\nExpected:\n%v\nBut got:\n%v", expected, filter)
+	}
+}
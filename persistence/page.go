@@ -0,0 +1,179 @@
+package persistence
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/getaceres/payment-demo/payment"
+)
+
+const (
+	// MaxPageSize is the maximum number of payments that can be requested in a single page
+	MaxPageSize = 1000
+)
+
+// PageRequest describes which page of a list of payments must be returned.
+// Pages are delimited by cursors which point to a payment in the list instead of by offsets,
+// so payments added or removed while the list is traversed don't shift the following pages.
+type PageRequest struct {
+	// Size is the maximum number of payments in the page
+	Size int
+	// After is a cursor returned in a previous page. If set, the page starts with the payment following the cursor
+	After string
+	// Before is a cursor returned in a previous page. If set, the page ends with the payment preceding the cursor
+	Before string
+}
+
+// PaymentPage is a page of a list of payments
+type PaymentPage struct {
+	Payments []payment.Payment
+	// Next is the cursor to pass as PageRequest.After to get the following page or empty if this is the last page
+	Next string
+	// Previous is the cursor to pass as PageRequest.Before to get the preceding page or empty if this is the first page
+	Previous string
+}
+
+// InvalidPageError is returned when a page request is not valid for a query
+type InvalidPageError struct {
+	Reason string
+}
+
+func (e InvalidPageError) Error() string {
+	return fmt.Sprintf("Invalid page request: %s", e.Reason)
+}
+
+// Cursor is the position of a payment in a list of payments sorted by a query.
+// It contains the values used to sort the payment and its identifier.
+type Cursor struct {
+	Sort []string  `json:"s"`
+	Keys []*string `json:"k"`
+	ID   string    `json:"id"`
+}
+
+// NewCursor returns the cursor which points to the payment in the order defined by the query
+func (q PaymentQuery) NewCursor(pay payment.Payment) Cursor {
+	return Cursor{
+		Sort: q.sortNames(),
+		Keys: q.sortKeys(pay),
+		ID:   pay.ID,
+	}
+}
+
+// Encode returns the opaque representation of the cursor which is used in page requests
+func (c Cursor) Encode() string {
+	content, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(content)
+}
+
+// DecodeCursor decodes an opaque cursor returned by Cursor.Encode.
+// It returns an InvalidPageError if the cursor is malformed or it was generated for a different sort order.
+func (q PaymentQuery) DecodeCursor(encoded string) (Cursor, error) {
+	var cursor Cursor
+	content, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return cursor, InvalidPageError{Reason: "malformed cursor"}
+	}
+	if err := json.Unmarshal(content, &cursor); err != nil || cursor.ID == "" {
+		return cursor, InvalidPageError{Reason: "malformed cursor"}
+	}
+	if strings.Join(cursor.Sort, ",") != strings.Join(q.sortNames(), ",") || len(cursor.Keys) != len(q.Sort) {
+		return cursor, InvalidPageError{Reason: "the cursor was generated for a different sort order"}
+	}
+	for i, key := range cursor.Keys {
+		if key == nil {
+			continue
+		}
+		if _, err := q.Sort[i].Field.ParseValue(*key); err != nil {
+			return cursor, InvalidPageError{Reason: "malformed cursor"}
+		}
+	}
+	return cursor, nil
+}
+
+func (q PaymentQuery) sortNames() []string {
+	names := make([]string, len(q.Sort))
+	for i, sortField := range q.Sort {
+		names[i] = sortField.String()
+	}
+	return names
+}
+
+// ValidatePage checks that the page request can be used with the query.
+// It returns an InvalidPageError if the page size is out of range, both cursors are set
+// or the query is sorted by a repeated field, which can't be used to delimit pages.
+func (q PaymentQuery) ValidatePage(page PageRequest) error {
+	if page.Size <= 0 || page.Size > MaxPageSize {
+		return InvalidPageError{Reason: fmt.Sprintf("the page size must be between 1 and %d", MaxPageSize)}
+	}
+	if page.After != "" && page.Before != "" {
+		return InvalidPageError{Reason: "only one of the after and before cursors can be set"}
+	}
+	for _, sortField := range q.Sort {
+		if sortField.Field.Repeated {
+			return InvalidPageError{Reason: fmt.Sprintf("paginated lists can't be sorted by field %s because it may have several values", sortField.Field.Path)}
+		}
+	}
+	return nil
+}
+
+func (c Cursor) sortable() sortablePayment {
+	return sortablePayment{payment: payment.Payment{ID: c.ID}, keys: c.Keys}
+}
+
+// Paginate returns the requested page of the payments of the list which satisfy the query filter,
+// sorted and with the fields selected by the query.
+// It is intended for backends which can't evaluate the query by themselves.
+func (q PaymentQuery) Paginate(payments []payment.Payment, page PageRequest) (PaymentPage, error) {
+	var result PaymentPage
+	if err := q.ValidatePage(page); err != nil {
+		return result, err
+	}
+
+	sorted := q.filterAndSort(payments)
+	start, end := 0, len(sorted)
+	switch {
+	case page.After != "":
+		cursor, err := q.DecodeCursor(page.After)
+		if err != nil {
+			return result, err
+		}
+		start = sort.Search(len(sorted), func(i int) bool {
+			return q.compareSortable(sorted[i], cursor.sortable()) > 0
+		})
+		end = start + page.Size
+	case page.Before != "":
+		cursor, err := q.DecodeCursor(page.Before)
+		if err != nil {
+			return result, err
+		}
+		end = sort.Search(len(sorted), func(i int) bool {
+			return q.compareSortable(sorted[i], cursor.sortable()) >= 0
+		})
+		start = end - page.Size
+	default:
+		end = page.Size
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end > len(sorted) {
+		end = len(sorted)
+	}
+
+	result.Payments = make([]payment.Payment, 0, end-start)
+	for _, sortable := range sorted[start:end] {
+		result.Payments = append(result.Payments, q.Select(sortable.payment))
+	}
+	if start < end {
+		if start > 0 {
+			result.Previous = q.NewCursor(sorted[start].payment).Encode()
+		}
+		if end < len(sorted) {
+			result.Next = q.NewCursor(sorted[end-1].payment).Encode()
+		}
+	}
+	return result, nil
+}
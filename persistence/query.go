@@ -0,0 +1,191 @@
+package persistence
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/getaceres/payment-demo/payment"
+)
+
+// SortField is a payment field used to sort a list of payments
+type SortField struct {
+	Field      PaymentField
+	Descending bool
+}
+
+// PaymentQuery describes which payments must be returned in a list, in which order and which of their fields
+type PaymentQuery struct {
+	// Filter contains the conditions that all the returned payments must satisfy
+	Filter []FilterCondition
+	// Sort contains the fields used to sort the payments by order of precedence.
+	// Payments are always sorted by identifier after these fields so the order is deterministic,
+	// in descending order if the last sort field is descending and in ascending order otherwise.
+	// Payments without value for a field go before the rest when sorting in ascending order and after them otherwise.
+	// When a repeated field is used, the lowest value is used to sort in ascending order and the greatest one otherwise.
+	Sort []SortField
+	// Fields contains the fields that must be present in the returned payments. If it is empty, all the fields are returned.
+	// The payment identifier is always returned.
+	Fields []PaymentField
+	// AsOf makes the query return the payments as they were at that time, according to their revisions,
+	// including the payments deleted since then. If it is zero, the current payments are returned.
+	AsOf time.Time
+}
+
+// NewSortField builds a sort criteria over the scalar payment field with the given JSON path
+func NewSortField(path string, descending bool) (SortField, error) {
+	field, err := GetPaymentField(path)
+	if err != nil {
+		return SortField{}, err
+	}
+	return SortField{Field: field, Descending: descending}, nil
+}
+
+// NewFilterQuery builds a query which returns the whole payments matching the given equality filter
+// as described in PaymentRepository.GetPayments
+func NewFilterQuery(filter map[string]string) (PaymentQuery, error) {
+	conditions, err := ParseFilter(filter)
+	if err != nil {
+		return PaymentQuery{}, err
+	}
+	return PaymentQuery{Filter: conditions}, nil
+}
+
+// Matches returns true if the payment satisfies all the filter conditions of the query
+func (q PaymentQuery) Matches(pay payment.Payment) bool {
+	return MatchesFilter(pay, q.Filter)
+}
+
+// Compare returns -1, 0 or 1 if payment a goes before, in the same position or after payment b in the query order
+func (q PaymentQuery) Compare(a, b payment.Payment) int {
+	return q.compareSortable(sortablePayment{a, q.sortKeys(a)}, sortablePayment{b, q.sortKeys(b)})
+}
+
+// sortKeys returns the values of the payment used to sort it. Nil values mean that the payment has no value for the field.
+func (q PaymentQuery) sortKeys(pay payment.Payment) []*string {
+	keys := make([]*string, len(q.Sort))
+	for i, sortField := range q.Sort {
+		if key, ok := sortField.key(pay); ok {
+			keys[i] = &key
+		}
+	}
+	return keys
+}
+
+func (q PaymentQuery) compareKeys(a, b []*string) int {
+	for i, sortField := range q.Sort {
+		comparison := 0
+		switch {
+		case a[i] == nil && b[i] == nil:
+			comparison = 0
+		case a[i] == nil:
+			comparison = -1
+		case b[i] == nil:
+			comparison = 1
+		default:
+			comparison = sortField.Field.Compare(*a[i], *b[i])
+		}
+
+		if sortField.Descending {
+			comparison = -comparison
+		}
+		if comparison != 0 {
+			return comparison
+		}
+	}
+	return 0
+}
+
+// String returns the representation of the sort field used in the sort query parameter, like -attributes.amount
+func (s SortField) String() string {
+	if s.Descending {
+		return "-" + s.Field.Path
+	}
+	return s.Field.Path
+}
+
+// key returns the value of the field used to sort the payment and false if the payment has no value for it
+func (s SortField) key(pay payment.Payment) (string, bool) {
+	var result string
+	found := false
+	for _, value := range s.Field.Values(pay) {
+		if _, err := s.Field.ParseValue(value); err != nil {
+			continue
+		}
+		comparison := s.Field.Compare(value, result)
+		if !found || (s.Descending && comparison > 0) || (!s.Descending && comparison < 0) {
+			result = value
+			found = true
+		}
+	}
+	return result, found
+}
+
+// Select returns a copy of the payment which only contains the fields selected by the query
+func (q PaymentQuery) Select(pay payment.Payment) payment.Payment {
+	if len(q.Fields) == 0 {
+		return pay
+	}
+
+	var result payment.Payment
+	source := reflect.ValueOf(pay)
+	target := reflect.ValueOf(&result).Elem()
+	for _, field := range q.Fields {
+		sourceValue, targetValue := source, target
+		for _, index := range field.index {
+			sourceValue = sourceValue.FieldByIndex(index)
+			targetValue = targetValue.FieldByIndex(index)
+		}
+		targetValue.Set(sourceValue)
+	}
+	result.ID = pay.ID
+	return result
+}
+
+// Apply returns the payments of the list which satisfy the query filter sorted and with the fields selected by the query.
+// It is intended for backends which can't evaluate the query by themselves.
+func (q PaymentQuery) Apply(payments []payment.Payment) []payment.Payment {
+	sorted := q.filterAndSort(payments)
+	result := make([]payment.Payment, len(sorted))
+	for i, sortable := range sorted {
+		result[i] = q.Select(sortable.payment)
+	}
+	return result
+}
+
+// IdentifierDescending returns true if payments with the same sort values are sorted by identifier in descending order
+func (q PaymentQuery) IdentifierDescending() bool {
+	return len(q.Sort) > 0 && q.Sort[len(q.Sort)-1].Descending
+}
+
+// sortablePayment is a payment together with the values used to sort it
+type sortablePayment struct {
+	payment payment.Payment
+	keys    []*string
+}
+
+func (q PaymentQuery) compareSortable(a, b sortablePayment) int {
+	comparison := q.compareKeys(a.keys, b.keys)
+	if comparison != 0 {
+		return comparison
+	}
+	if q.IdentifierDescending() {
+		return strings.Compare(b.payment.ID, a.payment.ID)
+	}
+	return strings.Compare(a.payment.ID, b.payment.ID)
+}
+
+func (q PaymentQuery) filterAndSort(payments []payment.Payment) []sortablePayment {
+	result := make([]sortablePayment, 0, len(payments))
+	for _, pay := range payments {
+		if q.Matches(pay) {
+			result = append(result, sortablePayment{payment: pay, keys: q.sortKeys(pay)})
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return q.compareSortable(result[i], result[j]) < 0
+	})
+	return result
+}
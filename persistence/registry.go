@@ -0,0 +1,74 @@
+package persistence
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// RepositoryFactory builds a payment repository from the URL which describes its storage
+type RepositoryFactory func(storage *url.URL) (PaymentRepository, error)
+
+var (
+	factoriesLock sync.RWMutex
+	factories     = make(map[string]RepositoryFactory)
+)
+
+func init() {
+	RegisterRepository("memory", func(storage *url.URL) (PaymentRepository, error) {
+		return NewMemoryPaymentRepository(), nil
+	})
+}
+
+// RegisterRepository makes a persistence backend available for the storage URLs with the given scheme.
+// Backends usually register themselves in the init function of their package, so importing the package is enough to use them.
+// It panics if the scheme is already registered.
+func RegisterRepository(scheme string, factory RepositoryFactory) {
+	factoriesLock.Lock()
+	defer factoriesLock.Unlock()
+	scheme = strings.ToLower(scheme)
+	if _, ok := factories[scheme]; ok {
+		panic(fmt.Sprintf("Payment repository for scheme %s registered twice", scheme))
+	}
+	factories[scheme] = factory
+}
+
+// RegisteredSchemes returns the sorted list of storage URL schemes which have a registered persistence backend
+func RegisteredSchemes() []string {
+	factoriesLock.RLock()
+	defer factoriesLock.RUnlock()
+	schemes := make([]string, 0, len(factories))
+	for scheme := range factories {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// NewPaymentRepository builds the payment repository described by the storage URL, like memory:// or mongodb://localhost/payments,
+// using the backend registered for its scheme. The returned repository may implement io.Closer if it must be closed after using it.
+func NewPaymentRepository(storage string) (PaymentRepository, error) {
+	storageURL, err := url.Parse(storage)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid storage URL %s: %s", storage, err.Error())
+	}
+
+	factoriesLock.RLock()
+	factory, ok := factories[strings.ToLower(storageURL.Scheme)]
+	factoriesLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Unsupported storage URL %s. Supported schemes are %s", storage, strings.Join(RegisteredSchemes(), ", "))
+	}
+	return factory(storageURL)
+}
+
+// StorageFilePath returns the path of the file referenced by a storage URL of a file based backend.
+// Absolute paths are written as file:///var/lib/payments.db and relative ones as file:payments.db.
+func StorageFilePath(storage *url.URL) string {
+	if storage.Opaque != "" {
+		return storage.Opaque
+	}
+	return storage.Host + storage.Path
+}
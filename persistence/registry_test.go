@@ -0,0 +1,52 @@
+package persistence
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestNewPaymentRepository(t *testing.T) {
+	repository, err := NewPaymentRepository("memory://")
+	if err != nil {
+		t.Fatalf("Error building memory repository: %s", err.Error())
+	}
+	if _, ok := repository.(*MemoryPaymentRepository); !ok {
+		t.Fatalf("Expected a memory repository but got %T", repository)
+	}
+
+	if _, err := NewPaymentRepository("unknown://localhost"); err == nil {
+		t.Fatalf("Expected error building repository with unknown scheme")
+	}
+	if _, err := NewPaymentRepository("://"); err == nil {
+		t.Fatalf("Expected error building repository with malformed URL")
+	}
+}
+
+func TestRegisterRepositoryTwice(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("Expected panic registering the memory scheme twice")
+		}
+	}()
+	RegisterRepository("MEMORY", func(storage *url.URL) (PaymentRepository, error) {
+		return nil, nil
+	})
+}
+
+func TestStorageFilePath(t *testing.T) {
+	tests := map[string]string{
+		"file:///var/lib/payments.db": "/var/lib/payments.db",
+		"file:payments.db":            "payments.db",
+		"file:data/payments.db":       "data/payments.db",
+		"sqlite://payments.db":        "payments.db",
+	}
+	for storage, expected := range tests {
+		storageURL, err := url.Parse(storage)
+		if err != nil {
+			t.Fatalf("Error parsing %s: %s", storage, err.Error())
+		}
+		if path := StorageFilePath(storageURL); path != expected {
+			t.Errorf("Expected path %s for storage URL %s but got %s", expected, storage, path)
+		}
+	}
+}
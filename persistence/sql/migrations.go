@@ -0,0 +1,358 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Migration is a versioned change of the database schema
+type Migration struct {
+	Version     int
+	Description string
+	Statements  []string
+	// Apply makes the changes which can't be written as statements, like filling new columns computed from existing ones.
+	// It is run after the statements in the same transaction. It can be nil.
+	Apply func(ctx context.Context, tx *sql.Tx, dialect dialect) error
+}
+
+// Migrations contains the changes of the database schema sorted by version.
+// Applied migrations are recorded in the schema_migrations table, so they must never be modified.
+// Schema changes must be added as new migrations with the following version.
+// Statements must be valid both in SQLite and PostgreSQL.
+var Migrations = []Migration{
+	{
+		Version:     1,
+		Description: "Create payment tables",
+		Statements: []string{
+			// Decimal amounts are stored as text so they are returned exactly as they were saved.
+			// The _value columns keep their numeric value, or NULL if it's not a valid number, so they can be compared.
+			`CREATE TABLE payments (
+				id TEXT PRIMARY KEY,
+				type TEXT NOT NULL,
+				version INTEGER NOT NULL,
+				organisation_id TEXT NOT NULL,
+				amount TEXT NOT NULL,
+				amount_value NUMERIC,
+				currency TEXT NOT NULL,
+				end_to_end_reference TEXT NOT NULL,
+				numeric_reference TEXT NOT NULL,
+				payment_id TEXT NOT NULL,
+				payment_purpose TEXT NOT NULL,
+				payment_scheme TEXT NOT NULL,
+				payment_type TEXT NOT NULL,
+				processing_date TEXT NOT NULL,
+				reference TEXT NOT NULL,
+				scheme_payment_sub_type TEXT NOT NULL,
+				scheme_payment_type TEXT NOT NULL,
+				charges_information_bearer_code TEXT NOT NULL,
+				charges_information_receiver_charges_amount TEXT NOT NULL,
+				charges_information_receiver_charges_amount_value NUMERIC,
+				charges_information_receiver_charges_currency TEXT NOT NULL,
+				fx_contract_reference TEXT NOT NULL,
+				fx_exchange_rate TEXT NOT NULL,
+				fx_exchange_rate_value NUMERIC,
+				fx_original_amount TEXT NOT NULL,
+				fx_original_amount_value NUMERIC,
+				fx_original_currency TEXT NOT NULL
+			)`,
+			// Every payment has a row for each of its beneficiary, debtor and sponsor parties
+			`CREATE TABLE payment_parties (
+				payment_id TEXT NOT NULL REFERENCES payments (id) ON DELETE CASCADE,
+				role TEXT NOT NULL,
+				account_name TEXT NOT NULL,
+				account_number TEXT NOT NULL,
+				account_number_code TEXT NOT NULL,
+				account_type INTEGER,
+				address TEXT NOT NULL,
+				bank_id TEXT NOT NULL,
+				bank_id_code TEXT NOT NULL,
+				name TEXT NOT NULL,
+				PRIMARY KEY (payment_id, role)
+			)`,
+			`CREATE TABLE payment_sender_charges (
+				payment_id TEXT NOT NULL REFERENCES payments (id) ON DELETE CASCADE,
+				ordinal INTEGER NOT NULL,
+				amount TEXT NOT NULL,
+				amount_value NUMERIC,
+				currency TEXT NOT NULL,
+				PRIMARY KEY (payment_id, ordinal)
+			)`,
+			`CREATE INDEX payments_organisation_id ON payments (organisation_id, id)`,
+			`CREATE INDEX payments_processing_date ON payments (processing_date, id)`,
+			`CREATE INDEX payments_amount_value ON payments (amount_value, id)`,
+		},
+	},
+	{
+		Version:     2,
+		Description: "Create payment revisions table",
+		Statements: []string{
+			// Revisions are kept after the payment is deleted, so they don't reference the payments table.
+			// The payment is stored as a JSON document since revisions are only read by payment.
+			`CREATE TABLE payment_revisions (
+				payment_id TEXT NOT NULL,
+				revision INTEGER NOT NULL,
+				operation TEXT NOT NULL,
+				changed_at TEXT NOT NULL,
+				actor TEXT NOT NULL,
+				document TEXT NOT NULL,
+				PRIMARY KEY (payment_id, revision)
+			)`,
+		},
+	},
+	{
+		Version:     3,
+		Description: "Add deletion time to payments",
+		Statements: []string{
+			// Deleted payments keep their rows until they are purged. The column is NULL for the payments which are not deleted.
+			`ALTER TABLE payments ADD COLUMN deleted_at TEXT`,
+		},
+	},
+	{
+		Version:     4,
+		Description: "Create idempotency keys table",
+		Statements: []string{
+			// Keys keep the payment saved by their request as a JSON document, so it can be returned as it was saved
+			// even after the payment is modified or purged.
+			`CREATE TABLE idempotency_keys (
+				idempotency_key TEXT PRIMARY KEY,
+				fingerprint TEXT NOT NULL,
+				expires_at TEXT NOT NULL,
+				document TEXT NOT NULL
+			)`,
+			`CREATE INDEX idempotency_keys_expires_at ON idempotency_keys (expires_at)`,
+		},
+	},
+	{
+		Version:     5,
+		Description: "Add payment status and transitions",
+		Statements: []string{
+			// Payments stored before the lifecycle existed have an empty status, which means created
+			`ALTER TABLE payments ADD COLUMN status TEXT NOT NULL DEFAULT ''`,
+			`CREATE TABLE payment_transitions (
+				payment_id TEXT NOT NULL REFERENCES payments (id) ON DELETE CASCADE,
+				ordinal INTEGER NOT NULL,
+				action TEXT NOT NULL,
+				previous_status TEXT NOT NULL,
+				status TEXT NOT NULL,
+				reason TEXT NOT NULL,
+				actor TEXT NOT NULL,
+				transitioned_at TEXT NOT NULL,
+				PRIMARY KEY (payment_id, ordinal)
+			)`,
+			`CREATE INDEX payments_status ON payments (status, id)`,
+		},
+	},
+	{
+		Version:     6,
+		Description: "Create approval policies table",
+		Statements: []string{
+			`CREATE TABLE approval_policies (
+				organisation_id TEXT PRIMARY KEY,
+				document TEXT NOT NULL
+			)`,
+		},
+	},
+	{
+		Version:     7,
+		Description: "Create payment sanctions hits table",
+		Statements: []string{
+			`CREATE TABLE payment_sanctions_hits (
+				payment_id TEXT NOT NULL REFERENCES payments (id) ON DELETE CASCADE,
+				ordinal INTEGER NOT NULL,
+				field TEXT NOT NULL,
+				value TEXT NOT NULL,
+				entry_id TEXT NOT NULL,
+				entry_name TEXT NOT NULL,
+				program TEXT NOT NULL,
+				matched_value TEXT NOT NULL,
+				score INTEGER NOT NULL,
+				PRIMARY KEY (payment_id, ordinal)
+			)`,
+		},
+	},
+	{
+		Version:     8,
+		Description: "Add payment risk",
+		Statements: []string{
+			`ALTER TABLE payments ADD COLUMN risk_outcome TEXT NOT NULL DEFAULT ''`,
+			`CREATE TABLE payment_risk_reasons (
+				payment_id TEXT NOT NULL REFERENCES payments (id) ON DELETE CASCADE,
+				ordinal INTEGER NOT NULL,
+				rule TEXT NOT NULL,
+				outcome TEXT NOT NULL,
+				reason TEXT NOT NULL,
+				PRIMARY KEY (payment_id, ordinal)
+			)`,
+		},
+	},
+	{
+		Version:     9,
+		Description: "Add duplicate detection",
+		Statements: []string{
+			`ALTER TABLE payments ADD COLUMN suspected_duplicate_of TEXT NOT NULL DEFAULT ''`,
+			`CREATE TABLE duplicate_policies (
+				organisation_id TEXT PRIMARY KEY,
+				document TEXT NOT NULL
+			)`,
+			// Duplicates are looked up by organisation and end to end reference before comparing the rest of their fields
+			`CREATE INDEX payments_duplicates ON payments (organisation_id, end_to_end_reference, processing_date)`,
+		},
+	},
+	{
+		Version:     10,
+		Description: "Add payment creators",
+		Statements: []string{
+			`ALTER TABLE payments ADD COLUMN created_by TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		Version:     11,
+		Description: "Add payment creation times",
+		Statements: []string{
+			`ALTER TABLE payments ADD COLUMN created_at TEXT NOT NULL DEFAULT ''`,
+			// The velocity fraud rules count the payments created within their window
+			`CREATE INDEX payments_created_at ON payments (created_at, id)`,
+		},
+	},
+	{
+		Version:     12,
+		Description: "Allow payments without risk",
+		Statements: []string{
+			// The risk outcome is NULL for the payments whose fraud rules weren't evaluated,
+			// which were stored with an empty outcome before
+			`ALTER TABLE payments RENAME COLUMN risk_outcome TO previous_risk_outcome`,
+			`ALTER TABLE payments ADD COLUMN risk_outcome TEXT`,
+			`UPDATE payments SET risk_outcome = NULLIF(previous_risk_outcome, '')`,
+			`ALTER TABLE payments DROP COLUMN previous_risk_outcome`,
+		},
+	},
+	{
+		Version:     13,
+		Description: "Compare decimals with sortable keys",
+		Statements: []string{
+			// SQLite stores NUMERIC columns as floating point numbers, so the _value columns are replaced
+			// by text keys whose byte order is the numeric order of the decimals, or NULL if they're not valid numbers
+			`ALTER TABLE payments ADD COLUMN amount_key TEXT`,
+			`ALTER TABLE payments ADD COLUMN charges_information_receiver_charges_amount_key TEXT`,
+			`ALTER TABLE payments ADD COLUMN fx_exchange_rate_key TEXT`,
+			`ALTER TABLE payments ADD COLUMN fx_original_amount_key TEXT`,
+			`ALTER TABLE payment_sender_charges ADD COLUMN amount_key TEXT`,
+			`DROP INDEX payments_amount_value`,
+			`ALTER TABLE payments DROP COLUMN amount_value`,
+			`ALTER TABLE payments DROP COLUMN charges_information_receiver_charges_amount_value`,
+			`ALTER TABLE payments DROP COLUMN fx_exchange_rate_value`,
+			`ALTER TABLE payments DROP COLUMN fx_original_amount_value`,
+			`ALTER TABLE payment_sender_charges DROP COLUMN amount_value`,
+			`CREATE INDEX payments_amount_key ON payments (amount_key, id)`,
+		},
+		Apply: func(ctx context.Context, tx *sql.Tx, dialect dialect) error {
+			columns := []string{"amount", "charges_information_receiver_charges_amount", "fx_exchange_rate", "fx_original_amount"}
+			if err := fillDecimalKeys(ctx, tx, dialect, "payments", []string{"id"}, columns); err != nil {
+				return err
+			}
+			return fillDecimalKeys(ctx, tx, dialect, senderChargesTable, []string{"payment_id", "ordinal"}, []string{"amount"})
+		},
+	},
+}
+
+// fillDecimalKeys sets the _key columns of the decimal columns of every row of the table, which is identified by the key columns
+func fillDecimalKeys(ctx context.Context, tx *sql.Tx, dialect dialect, table string, keys, columns []string) error {
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("SELECT %s, %s FROM %s", strings.Join(keys, ", "), strings.Join(columns, ", "), table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	// The rows are read before updating them, since some drivers can't run statements while a query is open
+	var updates [][]sql.NullString
+	for rows.Next() {
+		values := make([]sql.NullString, len(keys)+len(columns))
+		pointers := make([]interface{}, len(values))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return err
+		}
+		updates = append(updates, values)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	for _, values := range updates {
+		builder := queryBuilder{dialect: dialect}
+		assignments := make([]string, len(columns))
+		for i, column := range columns {
+			assignments[i] = fmt.Sprintf("%s_key = %s", column, builder.arg(decimalKeyValue(values[len(keys)+i].String)))
+		}
+		conditions := make([]string, len(keys))
+		for i, key := range keys {
+			conditions[i] = fmt.Sprintf("%s = %s", key, builder.arg(values[i].String))
+		}
+		statement := fmt.Sprintf("UPDATE %s SET %s WHERE %s", table, strings.Join(assignments, ", "), strings.Join(conditions, " AND "))
+		if _, err := tx.ExecContext(ctx, statement, builder.args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrate applies the migrations which have not been applied yet, each one in its own transaction
+func migrate(ctx context.Context, db *sql.DB, dialect dialect) error {
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		description TEXT NOT NULL,
+		applied_at TEXT NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("Error creating migrations table: %s", err.Error())
+	}
+
+	var current int
+	err = db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current)
+	if err != nil {
+		return fmt.Errorf("Error getting schema version: %s", err.Error())
+	}
+
+	for _, migration := range Migrations {
+		if migration.Version <= current {
+			continue
+		}
+		if err := applyMigration(ctx, db, dialect, migration); err != nil {
+			return fmt.Errorf("Error applying migration %d (%s): %s", migration.Version, migration.Description, err.Error())
+		}
+	}
+	return nil
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, dialect dialect, migration Migration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The version is recorded first so concurrent instances applying the same migration fail instead of applying it twice
+	builder := queryBuilder{dialect: dialect}
+	insert := fmt.Sprintf("INSERT INTO schema_migrations (version, description, applied_at) VALUES (%s, %s, %s)",
+		builder.arg(migration.Version), builder.arg(migration.Description), builder.arg(time.Now().UTC().Format(time.RFC3339)))
+	if _, err := tx.ExecContext(ctx, insert, builder.args...); err != nil {
+		return err
+	}
+	for _, statement := range migration.Statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+	if migration.Apply != nil {
+		if err := migration.Apply(ctx, tx, dialect); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
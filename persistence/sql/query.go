@@ -0,0 +1,304 @@
+package sql
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/getaceres/payment-demo/payment"
+	"github.com/getaceres/payment-demo/persistence"
+)
+
+const (
+	senderChargesTable = "payment_sender_charges"
+	transitionsTable   = "payment_transitions"
+	sanctionsHitsTable = "payment_sanctions_hits"
+	riskReasonsTable   = "payment_risk_reasons"
+	// paymentSource joins every payment with its parties, so the payment queries return one row per payment
+	paymentSource = `payments p
+		JOIN payment_parties beneficiary_party ON beneficiary_party.payment_id = p.id AND beneficiary_party.role = 'beneficiary'
+		JOIN payment_parties debtor_party ON debtor_party.payment_id = p.id AND debtor_party.role = 'debtor'
+		JOIN payment_parties sponsor_party ON sponsor_party.payment_id = p.id AND sponsor_party.role = 'sponsor'`
+)
+
+// partyRoles maps the payment attributes which contain a party to the role of the party in the payment_parties table
+var partyRoles = map[string]string{
+	"beneficiary_party": "beneficiary",
+	"debtor_party":      "debtor",
+	"sponsor_party":     "sponsor",
+}
+
+// repeatedTables maps the lists of a payment to the child tables which store their elements
+var repeatedTables = map[string]string{
+	"charges_information.sender_charges": senderChargesTable,
+	"transitions":                        transitionsTable,
+	"sanctions_hits":                     sanctionsHitsTable,
+	"risk.reasons":                       riskReasonsTable,
+}
+
+// dialect contains the differences between the supported databases
+type dialect struct {
+	// placeholder returns the placeholder of the nth parameter of a statement, starting at 1
+	placeholder func(n int) string
+	// collation is added to string expressions so they are compared byte by byte, as in the rest of backends
+	collation string
+	// lockRows is added to the queries which lock the rows they read until the end of the transaction
+	lockRows string
+}
+
+var dialects = map[string]dialect{
+	"sqlite": {
+		placeholder: func(int) string { return "?" },
+	},
+	"postgres": {
+		placeholder: func(n int) string { return fmt.Sprintf("$%d", n) },
+		collation:   ` COLLATE "C"`,
+		lockRows:    " FOR UPDATE",
+	},
+}
+
+// queryBuilder collects the parameters of a statement while it is built
+type queryBuilder struct {
+	dialect dialect
+	args    []interface{}
+}
+
+// arg adds a parameter to the statement and returns its placeholder
+func (b *queryBuilder) arg(value interface{}) string {
+	b.args = append(b.args, value)
+	return b.dialect.placeholder(len(b.args))
+}
+
+// column is the location of a scalar payment field in the database
+type column struct {
+	// table is the alias of the table in paymentSource or the child table for repeated fields
+	table    string
+	name     string
+	repeated bool
+	// comparison is the column used to compare values of the field, which is the sortable key for decimal fields
+	comparison string
+	// collate is true if the field holds strings, so the dialect collation must be applied to comparisons
+	collate bool
+}
+
+// getColumn returns the column of a scalar payment field. Attributes are stored in the payments table
+// with the path of nested objects as prefix, like fx_exchange_rate, except parties and the elements of lists,
+// like sender charges, transitions, sanctions hits and risk reasons, which are stored in their own tables.
+func getColumn(field persistence.PaymentField) column {
+	path := strings.TrimPrefix(field.Path, "attributes.")
+	parts := strings.Split(path, ".")
+	result := column{table: "p", name: strings.Replace(path, ".", "_", -1)}
+	if _, ok := partyRoles[parts[0]]; ok && len(parts) == 2 {
+		result = column{table: parts[0], name: parts[1]}
+	} else if field.Repeated {
+		result = column{table: repeatedTables[strings.Join(parts[:len(parts)-1], ".")], name: parts[len(parts)-1], repeated: true}
+	}
+
+	result.comparison = result.name
+	switch field.Kind {
+	case persistence.DecimalField:
+		// Decimal keys are compared byte by byte like strings
+		result.comparison = result.name + "_key"
+		result.collate = true
+	case persistence.StringField:
+		result.collate = true
+	}
+	return result
+}
+
+// expression returns the SQL expression used to compare the values of the column in the given table alias
+func (c column) expression(table string) string {
+	return table + "." + c.comparison
+}
+
+// comparisonValue converts a filter value into the parameter compared with the column of a payment field
+func comparisonValue(field persistence.PaymentField, value string) (interface{}, error) {
+	parsed, err := field.ParseValue(value)
+	if err != nil {
+		return nil, err
+	}
+	if field.Kind == persistence.DecimalField {
+		key, ok := decimalKeyValue(value).(string)
+		if !ok {
+			return nil, persistence.InvalidValueError{Path: field.Path, Value: value}
+		}
+		return key, nil
+	}
+	return parsed, nil
+}
+
+// maxKeyIntegerDigits is the maximum number of integer digits of the decimal numbers which have a sortable key
+const maxKeyIntegerDigits = 999
+
+// decimalKey returns a text key of a decimal number whose byte order is the numeric order of the numbers,
+// so decimal fields are compared exactly instead of as the floating point numbers SQLite stores in NUMERIC columns.
+// The key starts with 0 for negative numbers, 1 for zero and 2 for positive numbers, followed by the number
+// of integer digits written with three digits and by the integer and fraction digits without leading or trailing zeros.
+// Negative numbers have these digits replaced by their complement to 9 and end with a ~, so greater absolute values
+// have lower keys. It returns false if the number has more than maxKeyIntegerDigits integer digits.
+func decimalKey(value payment.Decimal) (string, bool) {
+	if value.Sign() == 0 {
+		return "1", true
+	}
+	scale := value.Scale()
+	digits := new(big.Int).Abs(value.Unscaled()).String()
+	if len(digits) <= scale {
+		digits = strings.Repeat("0", scale-len(digits)+1) + digits
+	}
+	integer := strings.TrimLeft(digits[:len(digits)-scale], "0")
+	fraction := strings.TrimRight(digits[len(digits)-scale:], "0")
+	if len(integer) > maxKeyIntegerDigits {
+		return "", false
+	}
+	key := fmt.Sprintf("%03d%s%s", len(integer), integer, fraction)
+	if value.Sign() > 0 {
+		return "2" + key, true
+	}
+	return "0" + strings.Map(func(digit rune) rune { return '9' - digit + '0' }, key) + "~", true
+}
+
+// decimalKeyValue returns the sortable key of a decimal value stored in the column which compares a decimal field,
+// which is NULL if the value is not a valid number or it is too large to have a key
+func decimalKeyValue(value string) interface{} {
+	decimal, err := payment.ParseDecimal(value)
+	if err != nil {
+		return nil
+	}
+	key, ok := decimalKey(decimal)
+	if !ok {
+		return nil
+	}
+	return key
+}
+
+var sqlOperators = map[persistence.FilterOperator]string{
+	persistence.EqualOperator:          "=",
+	persistence.NotEqualOperator:       "<>",
+	persistence.LowerOperator:          "<",
+	persistence.LowerOrEqualOperator:   "<=",
+	persistence.GreaterOperator:        ">",
+	persistence.GreaterOrEqualOperator: ">=",
+}
+
+// compare returns the comparison between an expression over a column and a parameter applying the dialect collation to strings
+func (b *queryBuilder) compare(c column, expression, operator string, value interface{}) string {
+	collation := ""
+	if c.collate {
+		collation = b.dialect.collation
+	}
+	return fmt.Sprintf("%s%s %s %s", expression, collation, operator, b.arg(value))
+}
+
+// buildWhere returns the condition which matches the payments satisfying all the filter conditions.
+// Payments without valid value for a field only match not equal conditions, as in the rest of backends.
+func (b *queryBuilder) buildWhere(conditions []persistence.FilterCondition) (string, error) {
+	// Deleted payments are never returned by queries
+	clauses := []string{"p.deleted_at IS NULL"}
+	for _, condition := range conditions {
+		value, err := comparisonValue(condition.Field, condition.Value)
+		if err != nil {
+			return "", err
+		}
+		c := getColumn(condition.Field)
+		operator, ok := sqlOperators[condition.Operator]
+		if !ok {
+			return "", persistence.InvalidOperatorError{Path: condition.Field.Path, Operator: condition.Operator}
+		}
+
+		switch {
+		case c.repeated && condition.Operator == persistence.NotEqualOperator:
+			clauses = append(clauses, fmt.Sprintf("NOT EXISTS (SELECT 1 FROM %s c WHERE c.payment_id = p.id AND %s)",
+				c.table, b.compare(c, c.expression("c"), "=", value)))
+		case c.repeated:
+			clauses = append(clauses, fmt.Sprintf("EXISTS (SELECT 1 FROM %s c WHERE c.payment_id = p.id AND %s)",
+				c.table, b.compare(c, c.expression("c"), operator, value)))
+		case condition.Operator == persistence.NotEqualOperator:
+			clauses = append(clauses, fmt.Sprintf("(%s IS NULL OR %s)",
+				c.expression(c.table), b.compare(c, c.expression(c.table), operator, value)))
+		default:
+			clauses = append(clauses, b.compare(c, c.expression(c.table), operator, value))
+		}
+	}
+	return strings.Join(clauses, " AND "), nil
+}
+
+// sortExpression returns the expression used to sort payments by a field.
+// Repeated fields are sorted by their lowest value in ascending order and by their greatest one otherwise.
+func (b *queryBuilder) sortExpression(sortField persistence.SortField) string {
+	c := getColumn(sortField.Field)
+	collation := ""
+	if c.collate {
+		collation = b.dialect.collation
+	}
+	if !c.repeated {
+		return c.expression(c.table) + collation
+	}
+	aggregate := "MIN"
+	if sortField.Descending {
+		aggregate = "MAX"
+	}
+	return fmt.Sprintf("(SELECT %s(%s%s) FROM %s c WHERE c.payment_id = p.id)", aggregate, c.expression("c"), collation, c.table)
+}
+
+// buildOrder returns the ORDER BY clause for the query order or for the reverse order if reverse is true.
+// Payments without value for a field go before the rest in ascending order.
+func (b *queryBuilder) buildOrder(query persistence.PaymentQuery, reverse bool) string {
+	direction := func(descending bool) string {
+		if descending != reverse {
+			return "DESC NULLS LAST"
+		}
+		return "ASC NULLS FIRST"
+	}
+	terms := make([]string, 0, len(query.Sort)+1)
+	for _, sortField := range query.Sort {
+		terms = append(terms, b.sortExpression(sortField)+" "+direction(sortField.Descending))
+	}
+	terms = append(terms, "p.id"+b.dialect.collation+" "+direction(query.IdentifierDescending()))
+	return "ORDER BY " + strings.Join(terms, ", ")
+}
+
+// buildSeek returns a condition which matches the payments strictly after the cursor in the query order
+// or strictly before it if before is true
+func (b *queryBuilder) buildSeek(query persistence.PaymentQuery, cursor persistence.Cursor, before bool) (string, error) {
+	clauses := make([]string, 0, len(query.Sort)+1)
+	var equal []string
+	withEqual := func(condition string) string {
+		return "(" + strings.Join(append(append([]string{}, equal...), condition), " AND ") + ")"
+	}
+
+	for i, sortField := range query.Sort {
+		c := getColumn(sortField.Field)
+		expression := c.expression(c.table)
+		var value interface{}
+		if cursor.Keys[i] != nil {
+			var err error
+			value, err = comparisonValue(sortField.Field, *cursor.Keys[i])
+			if err != nil {
+				return "", err
+			}
+		}
+
+		greater := sortField.Descending == before
+		switch {
+		case value == nil && greater:
+			clauses = append(clauses, withEqual(expression+" IS NOT NULL"))
+		case value != nil && greater:
+			clauses = append(clauses, withEqual(b.compare(c, expression, ">", value)))
+		case value != nil:
+			clauses = append(clauses, withEqual(fmt.Sprintf("(%s OR %s IS NULL)", b.compare(c, expression, "<", value), expression)))
+		}
+
+		if value == nil {
+			equal = append(equal, expression+" IS NULL")
+		} else {
+			equal = append(equal, b.compare(c, expression, "=", value))
+		}
+	}
+
+	operator := ">"
+	if query.IdentifierDescending() != before {
+		operator = "<"
+	}
+	clauses = append(clauses, withEqual(b.compare(column{collate: true}, "p.id", operator, cursor.ID)))
+	return "(" + strings.Join(clauses, " OR ") + ")", nil
+}
@@ -0,0 +1,345 @@
+package sql
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getaceres/payment-demo/payment"
+	"github.com/getaceres/payment-demo/persistence"
+)
+
+var integrationPostgres = flag.String("postgres", "", "connection URL of a PostgreSQL database used to run the PostgreSQL tests")
+
+var sqliteTester = persistence.PaymentRepositoryTester{
+	ResourcesPath: "../../test_resources",
+}
+
+var postgresTester = persistence.PaymentRepositoryTester{
+	ResourcesPath: "../../test_resources",
+}
+
+var databaseDir string
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	var err error
+	databaseDir, err = ioutil.TempDir("", "payment-demo-sql")
+	if err != nil {
+		fmt.Printf("Error creating temporary directory: %s", err.Error())
+		os.Exit(-1)
+	}
+	sqliteRepository, err := NewSQLPaymentRepository("sqlite", filepath.Join(databaseDir, "payments.db"))
+	if err != nil {
+		fmt.Printf("Error getting SQLite repository: %s", err.Error())
+		os.Exit(-1)
+	}
+	sqliteTester.Repository = sqliteRepository
+
+	if *integrationPostgres != "" {
+		postgresRepository, err := NewSQLPaymentRepository("postgres", *integrationPostgres)
+		if err != nil {
+			fmt.Printf("Error getting PostgreSQL repository: %s", err.Error())
+			os.Exit(-1)
+		}
+		postgresTester.Repository = postgresRepository
+	}
+
+	code := m.Run()
+	sqliteRepository.Close()
+	os.RemoveAll(databaseDir)
+	os.Exit(code)
+}
+
+// forEachTester runs the test with the SQLite repository and, if the postgres flag is set, with the PostgreSQL one
+func forEachTester(t *testing.T, test func(*testing.T, persistence.PaymentRepositoryTester)) {
+	t.Run("sqlite", func(t *testing.T) {
+		test(t, sqliteTester)
+	})
+	if *integrationPostgres != "" {
+		t.Run("postgres", func(t *testing.T) {
+			test(t, postgresTester)
+		})
+	}
+}
+
+func TestAdd(t *testing.T) {
+	forEachTester(t, func(t *testing.T, tester persistence.PaymentRepositoryTester) {
+		tester.TestAdd(t)
+	})
+}
+
+func TestUpdate(t *testing.T) {
+	forEachTester(t, func(t *testing.T, tester persistence.PaymentRepositoryTester) {
+		tester.TestUpdate(t)
+	})
+}
+
+func TestDelete(t *testing.T) {
+	forEachTester(t, func(t *testing.T, tester persistence.PaymentRepositoryTester) {
+		tester.TestDelete(t)
+	})
+}
+
+func TestRestore(t *testing.T) {
+	forEachTester(t, func(t *testing.T, tester persistence.PaymentRepositoryTester) {
+		tester.TestRestore(t)
+	})
+}
+
+func TestPurge(t *testing.T) {
+	forEachTester(t, func(t *testing.T, tester persistence.PaymentRepositoryTester) {
+		tester.TestPurge(t)
+	})
+}
+
+func TestIdempotency(t *testing.T) {
+	forEachTester(t, func(t *testing.T, tester persistence.PaymentRepositoryTester) {
+		tester.TestIdempotency(t, 10)
+	})
+}
+
+func TestGetId(t *testing.T) {
+	forEachTester(t, func(t *testing.T, tester persistence.PaymentRepositoryTester) {
+		tester.TestGetId(t)
+	})
+}
+
+func TestGetList(t *testing.T) {
+	forEachTester(t, func(t *testing.T, tester persistence.PaymentRepositoryTester) {
+		tester.TestGetList(t, 10)
+	})
+}
+
+func TestFilter(t *testing.T) {
+	forEachTester(t, func(t *testing.T, tester persistence.PaymentRepositoryTester) {
+		tester.TestFilter(t)
+	})
+}
+
+func TestQuery(t *testing.T) {
+	forEachTester(t, func(t *testing.T, tester persistence.PaymentRepositoryTester) {
+		tester.TestQuery(t)
+	})
+}
+
+func TestPagination(t *testing.T) {
+	forEachTester(t, func(t *testing.T, tester persistence.PaymentRepositoryTester) {
+		tester.TestPagination(t)
+	})
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	forEachTester(t, func(t *testing.T, tester persistence.PaymentRepositoryTester) {
+		tester.TestConcurrentAccess(t, 20, 10)
+	})
+}
+
+func TestCancelledContext(t *testing.T) {
+	forEachTester(t, func(t *testing.T, tester persistence.PaymentRepositoryTester) {
+		tester.TestCancelledContext(t)
+	})
+}
+
+func TestHistory(t *testing.T) {
+	forEachTester(t, func(t *testing.T, tester persistence.PaymentRepositoryTester) {
+		tester.TestHistory(t)
+	})
+}
+
+func TestAsOf(t *testing.T) {
+	forEachTester(t, func(t *testing.T, tester persistence.PaymentRepositoryTester) {
+		tester.TestAsOf(t)
+	})
+}
+
+func TestStatus(t *testing.T) {
+	forEachTester(t, func(t *testing.T, tester persistence.PaymentRepositoryTester) {
+		tester.TestStatus(t)
+	})
+}
+
+func TestSanctionsHits(t *testing.T) {
+	forEachTester(t, func(t *testing.T, tester persistence.PaymentRepositoryTester) {
+		tester.TestSanctionsHits(t)
+	})
+}
+
+func TestRisk(t *testing.T) {
+	forEachTester(t, func(t *testing.T, tester persistence.PaymentRepositoryTester) {
+		tester.TestRisk(t)
+	})
+}
+
+func TestDuplicates(t *testing.T) {
+	forEachTester(t, func(t *testing.T, tester persistence.PaymentRepositoryTester) {
+		tester.TestDuplicates(t)
+	})
+}
+
+func TestAddUnlessDuplicate(t *testing.T) {
+	forEachTester(t, func(t *testing.T, tester persistence.PaymentRepositoryTester) {
+		tester.TestAddUnlessDuplicate(t, 10)
+	})
+}
+
+func TestApprovalPolicies(t *testing.T) {
+	forEachTester(t, func(t *testing.T, tester persistence.PaymentRepositoryTester) {
+		tester.TestApprovalPolicies(t)
+	})
+}
+
+func TestDuplicatePolicies(t *testing.T) {
+	forEachTester(t, func(t *testing.T, tester persistence.PaymentRepositoryTester) {
+		tester.TestDuplicatePolicies(t)
+	})
+}
+
+// TestFieldColumns checks that every scalar payment field is stored in a column which can be used to filter payments
+func TestFieldColumns(t *testing.T) {
+	forEachTester(t, func(t *testing.T, tester persistence.PaymentRepositoryTester) {
+		pay, err := payment.GetDefaultTestPayment(tester.ResourcesPath)
+		if err != nil {
+			t.Fatalf("Error getting default payment: %s", err.Error())
+		}
+		pay, err = tester.Repository.AddPayment(context.Background(), pay)
+		if err != nil {
+			t.Fatalf("Error adding payment: %s", err.Error())
+		}
+
+		for _, field := range persistence.GetPaymentFields() {
+			for _, value := range field.Values(pay) {
+				filter := map[string]string{"id": pay.ID, field.Path: value}
+				found, err := tester.Repository.GetPayments(context.Background(), filter)
+				if err != nil {
+					t.Errorf("Error filtering by field %s: %s", field.Path, err.Error())
+					continue
+				}
+				if len(found) != 1 {
+					t.Errorf("Expected to find the payment filtering by field %s with value %q but got %d payments", field.Path, value, len(found))
+				}
+			}
+		}
+	})
+}
+
+// TestSchema checks that the payments can be read with plain SQL and that the migrations are only applied once
+func TestSchema(t *testing.T) {
+	repo := sqliteTester.Repository.(*SQLPaymentRepository)
+	pay, err := payment.GetDefaultTestPayment(sqliteTester.ResourcesPath)
+	if err != nil {
+		t.Fatalf("Error getting default payment: %s", err.Error())
+	}
+	pay, err = repo.AddPayment(context.Background(), pay)
+	if err != nil {
+		t.Fatalf("Error adding payment: %s", err.Error())
+	}
+
+	var amount, beneficiary string
+	var charges int
+	err = repo.db.QueryRow(`SELECT p.amount, b.name, (SELECT COUNT(*) FROM payment_sender_charges c WHERE c.payment_id = p.id)
+		FROM payments p JOIN payment_parties b ON b.payment_id = p.id AND b.role = 'beneficiary'
+		WHERE p.id = ?`, pay.ID).Scan(&amount, &beneficiary, &charges)
+	if err != nil {
+		t.Fatalf("Error reading payment with SQL: %s", err.Error())
+	}
+	if amount != pay.Attributes.Amount || beneficiary != pay.Attributes.BeneficiaryParty.Name || charges != len(pay.Attributes.ChargesInformation.SenderCharges) {
+		t.Fatalf("Unexpected payment columns: amount %s, beneficiary %s and %d sender charges", amount, beneficiary, charges)
+	}
+
+	reopened, err := NewSQLPaymentRepository("sqlite", filepath.Join(databaseDir, "payments.db"))
+	if err != nil {
+		t.Fatalf("Error reopening SQLite repository: %s", err.Error())
+	}
+	defer reopened.Close()
+	var migrations int
+	if err := reopened.db.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&migrations); err != nil {
+		t.Fatalf("Error reading applied migrations: %s", err.Error())
+	}
+	if migrations != len(Migrations) {
+		t.Fatalf("Expected %d applied migrations but got %d", len(Migrations), migrations)
+	}
+	if _, err := reopened.GetPayment(context.Background(), pay.ID); err != nil {
+		t.Fatalf("Error getting payment after reopening: %s", err.Error())
+	}
+}
+
+func TestStorageURL(t *testing.T) {
+	repo, err := persistence.NewPaymentRepository("sqlite:" + filepath.Join(databaseDir, "storage.db"))
+	if err != nil {
+		t.Fatalf("Error building repository from storage URL: %s", err.Error())
+	}
+	defer repo.(*SQLPaymentRepository).Close()
+}
+
+// TestDecimalKeys checks that the byte order of the decimal keys is the numeric order of the numbers
+func TestDecimalKeys(t *testing.T) {
+	ordered := [][]string{
+		{"-1000.5"}, {"-1000"}, {"-999.99"}, {"-10"}, {"-1.55"}, {"-1.5", "-1.50"}, {"-1"}, {"-0.05"},
+		{"0", "0.00", "-0"}, {"0.001"}, {"0.05", "+.05"}, {"0.5"}, {"1"}, {"1.05"}, {"1.5", "1.500"}, {"1.55"}, {"9"}, {"10", "010.0"},
+		{"90071992547409930.01"}, {"90071992547409930.02"}, {"100000000000000000000"},
+	}
+	var previous string
+	for i, equal := range ordered {
+		key, ok := decimalKeyValue(equal[0]).(string)
+		if !ok {
+			t.Fatalf("Expected key for %s", equal[0])
+		}
+		for _, value := range equal[1:] {
+			if other := decimalKeyValue(value); other != key {
+				t.Errorf("Expected %s and %s to have the same key but got %s and %v", equal[0], value, key, other)
+			}
+		}
+		if i > 0 && previous >= key {
+			t.Errorf("Expected key of %s to be greater than the key of %s but got %s and %s", equal[0], ordered[i-1][0], key, previous)
+		}
+		previous = key
+	}
+	if key := decimalKeyValue("ten"); key != nil {
+		t.Errorf("Expected no key for an invalid number but got %v", key)
+	}
+}
+
+// TestDecimalPrecision checks that decimal fields are compared exactly, even when their floating point values are the same
+func TestDecimalPrecision(t *testing.T) {
+	forEachTester(t, func(t *testing.T, tester persistence.PaymentRepositoryTester) {
+		pay, err := payment.GetDefaultTestPayment(tester.ResourcesPath)
+		if err != nil {
+			t.Fatalf("Error getting default payment: %s", err.Error())
+		}
+		pay.Attributes.EndToEndReference = fmt.Sprintf("precision-%d", time.Now().UnixNano())
+		for _, amount := range []string{"90071992547409930.01", "90071992547409930.02"} {
+			pay.Attributes.Amount = amount
+			if _, err := tester.Repository.AddPayment(context.Background(), pay); err != nil {
+				t.Fatalf("Error adding payment: %s", err.Error())
+			}
+		}
+
+		for operator, expected := range map[persistence.FilterOperator]int{
+			persistence.EqualOperator:   1,
+			persistence.GreaterOperator: 1,
+			persistence.LowerOperator:   0,
+		} {
+			reference, err := persistence.NewFilterCondition("attributes.end_to_end_reference", persistence.EqualOperator, pay.Attributes.EndToEndReference)
+			if err != nil {
+				t.Fatal(err)
+			}
+			amount, err := persistence.NewFilterCondition("attributes.amount", operator, "90071992547409930.01")
+			if err != nil {
+				t.Fatal(err)
+			}
+			found, err := tester.Repository.FindPayments(context.Background(), persistence.PaymentQuery{Filter: []persistence.FilterCondition{reference, amount}})
+			if err != nil {
+				t.Fatalf("Error finding payments: %s", err.Error())
+			}
+			if len(found) != expected {
+				t.Errorf("Expected %d payments with amount %s 90071992547409930.01 but got %d", expected, operator, len(found))
+			}
+		}
+	})
+}
@@ -1,7 +1,11 @@
 package persistence
 
 import (
+	"context"
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/getaceres/payment-demo/payment"
 	"github.com/google/go-cmp/cmp"
@@ -28,7 +32,7 @@ func (p PaymentRepositoryTester) getDefaultPayment(t *testing.T) payment.Payment
 func (p PaymentRepositoryTester) TestAdd(t *testing.T) {
 	payment := p.getDefaultPayment(t)
 
-	newPayment, err := p.Repository.AddPayment(payment)
+	newPayment, err := p.Repository.AddPayment(context.Background(), payment)
 	if err != nil {
 		t.Fatalf("Error adding payment: %s", err.Error())
 	}
@@ -41,39 +45,71 @@ func (p PaymentRepositoryTester) TestAdd(t *testing.T) {
 func (p PaymentRepositoryTester) TestUpdate(t *testing.T) {
 	payment := p.getDefaultPayment(t)
 
-	newPayment, err := p.Repository.AddPayment(payment)
+	newPayment, err := p.Repository.AddPayment(context.Background(), payment)
 	if err != nil {
 		t.Fatalf("Error adding payment: %s", err.Error())
 	}
 
-	newPayment.Version = 2
+	newPayment.Attributes.Amount = "200.00"
 
-	updated, err := p.Repository.UpdatePayment(newPayment)
+	updated, err := p.Repository.UpdatePayment(context.Background(), newPayment)
 	if err != nil {
 		t.Fatalf("Error updating payment: %s", err.Error())
 	}
 
-	if !cmp.Equal(updated, newPayment) {
-		t.Fatalf("Returned updated payment differs from the passed one.\nReturned:\n%v\nBut expected:\n%v", updated, newPayment)
+	expected := newPayment
+	expected.Version = newPayment.Version + 1
+	if !cmp.Equal(updated, expected) {
+		t.Fatalf("Returned updated payment differs from the passed one.\nReturned:\n%v\nBut expected:\n%v", updated, expected)
+	}
+
+	got, err := p.Repository.GetPayment(context.Background(), newPayment.ID)
+	if err != nil {
+		t.Fatalf("Error getting updated payment: %s", err.Error())
+	}
+	if !cmp.Equal(got, expected) {
+		t.Fatalf("Stored updated payment differs from the expected one.\nReturned:\n%v\nBut expected:\n%v", got, expected)
+	}
+
+	stale := newPayment
+	stale.Attributes.Amount = "300.00"
+	_, err = p.Repository.UpdatePayment(context.Background(), stale)
+	if conflict, ok := err.(ConflictError); !ok {
+		t.Fatalf("Expected Conflict error updating payment with a stale version but got %v", err)
+	} else if conflict.ExpectedVersion != stale.Version || conflict.ActualVersion != expected.Version {
+		t.Fatalf("Unexpected versions in conflict error: %v", conflict)
+	}
+
+	got, err = p.Repository.GetPayment(context.Background(), newPayment.ID)
+	if err != nil {
+		t.Fatalf("Error getting updated payment: %s", err.Error())
+	}
+	if !cmp.Equal(got, expected) {
+		t.Fatalf("Payment was modified by an update with a stale version.\nReturned:\n%v\nBut expected:\n%v", got, expected)
 	}
 
 	newId := uuid.New().String()
 	updated.ID = newId
-	updated, err = p.Repository.UpdatePayment(updated)
+	updated, err = p.Repository.UpdatePayment(context.Background(), updated)
 	p.checkNotFoundError(newId, "updating", err, t)
 }
 
 func (p PaymentRepositoryTester) TestDelete(t *testing.T) {
 	payment := p.getDefaultPayment(t)
 
-	newPayment, err := p.Repository.AddPayment(payment)
+	newPayment, err := p.Repository.AddPayment(context.Background(), payment)
 	if err != nil {
 		t.Fatalf("Error adding payment: %s", err.Error())
 	}
 
-	deleted, err := p.Repository.DeletePayment(newPayment.ID)
+	_, err = p.Repository.DeletePayment(context.Background(), newPayment.ID, newPayment.Version+1)
+	if _, ok := err.(ConflictError); !ok {
+		t.Fatalf("Expected Conflict error deleting payment with a stale version but got %v", err)
+	}
+
+	deleted, err := p.Repository.DeletePayment(context.Background(), newPayment.ID, newPayment.Version)
 	if err != nil {
-		t.Fatalf("Error adding payment: %s", err.Error())
+		t.Fatalf("Error deleting payment: %s", err.Error())
 	}
 
 	if !cmp.Equal(deleted, newPayment) {
@@ -81,30 +117,258 @@ func (p PaymentRepositoryTester) TestDelete(t *testing.T) {
 	}
 
 	id := deleted.ID
-	deleted, err = p.Repository.GetPayment(id)
+	_, err = p.Repository.GetPayment(context.Background(), id)
+	p.checkGoneError(id, "getting", err, t)
+
+	_, err = p.Repository.UpdatePayment(context.Background(), deleted)
+	p.checkGoneError(id, "updating", err, t)
+
+	_, err = p.Repository.DeletePayment(context.Background(), id, AnyVersion)
+	p.checkGoneError(id, "deleting", err, t)
+
+	found, err := p.Repository.GetPayments(context.Background(), map[string]string{"id": id})
+	if err != nil {
+		t.Fatalf("Error getting payment list: %s", err.Error())
+	}
+	if len(found) != 0 {
+		t.Fatalf("Expected deleted payment %s not to be listed but got %v", id, found)
+	}
+
+	nonExisting := uuid.New().String()
+	_, err = p.Repository.DeletePayment(context.Background(), nonExisting, AnyVersion)
+	p.checkNotFoundError(nonExisting, "deleting", err, t)
+}
+
+// TestRestore checks that deleted payments can be restored with a new version
+func (p PaymentRepositoryTester) TestRestore(t *testing.T) {
+	newPayment, err := p.Repository.AddPayment(context.Background(), p.getDefaultPayment(t))
+	if err != nil {
+		t.Fatalf("Error adding payment: %s", err.Error())
+	}
+	id := newPayment.ID
+
+	_, err = p.Repository.RestorePayment(context.Background(), id, AnyVersion)
+	if _, ok := err.(NotDeletedError); !ok {
+		t.Fatalf("Expected NotDeleted error restoring payment %s which is not deleted but got %v", id, err)
+	}
+	if _, err := p.Repository.DeletePayment(context.Background(), id, AnyVersion); err != nil {
+		t.Fatalf("Error deleting payment %s: %s", id, err.Error())
+	}
+
+	_, err = p.Repository.RestorePayment(context.Background(), id, newPayment.Version+1)
+	if _, ok := err.(ConflictError); !ok {
+		t.Fatalf("Expected Conflict error restoring payment with a stale version but got %v", err)
+	}
+	restored, err := p.Repository.RestorePayment(context.Background(), id, newPayment.Version)
+	if err != nil {
+		t.Fatalf("Error restoring payment %s: %s", id, err.Error())
+	}
+	expected := newPayment
+	expected.Version++
+	if !cmp.Equal(restored, expected) {
+		t.Fatalf("Restored payment differs from expected.\nReturned:\n%v\nBut expected:\n%v", restored, expected)
+	}
+
+	got, err := p.Repository.GetPayment(context.Background(), id)
+	if err != nil {
+		t.Fatalf("Error getting restored payment %s: %s", id, err.Error())
+	}
+	if !cmp.Equal(got, expected) {
+		t.Fatalf("Returned payment differs from the restored one.\nReturned:\n%v\nBut expected:\n%v", got, expected)
+	}
+	found, err := p.Repository.GetPayments(context.Background(), map[string]string{"id": id})
+	if err != nil {
+		t.Fatalf("Error getting payment list: %s", err.Error())
+	}
+	if len(found) != 1 {
+		t.Fatalf("Expected restored payment %s to be listed but got %v", id, found)
+	}
+
+	revisions, err := p.Repository.GetPaymentRevisions(context.Background(), id)
+	if err != nil {
+		t.Fatalf("Error getting revisions of payment %s: %s", id, err.Error())
+	}
+	last := revisions[len(revisions)-1]
+	if len(revisions) != 3 || last.Operation != RestoreOperation || !cmp.Equal(last.Payment, expected) {
+		t.Fatalf("Expected the restore to be recorded as the third revision but got %v", revisions)
+	}
+
+	nonExisting := uuid.New().String()
+	_, err = p.Repository.RestorePayment(context.Background(), nonExisting, AnyVersion)
+	p.checkNotFoundError(nonExisting, "restoring", err, t)
+}
+
+// TestPurge checks that only deleted payments can be purged and that they are removed together with their history
+func (p PaymentRepositoryTester) TestPurge(t *testing.T) {
+	newPayment, err := p.Repository.AddPayment(context.Background(), p.getDefaultPayment(t))
+	if err != nil {
+		t.Fatalf("Error adding payment: %s", err.Error())
+	}
+	id := newPayment.ID
+
+	_, err = p.Repository.PurgePayment(context.Background(), id)
+	if _, ok := err.(NotDeletedError); !ok {
+		t.Fatalf("Expected NotDeleted error purging payment %s which is not deleted but got %v", id, err)
+	}
+	if _, err := p.Repository.DeletePayment(context.Background(), id, AnyVersion); err != nil {
+		t.Fatalf("Error deleting payment %s: %s", id, err.Error())
+	}
+	purged, err := p.Repository.PurgePayment(context.Background(), id)
+	if err != nil {
+		t.Fatalf("Error purging payment %s: %s", id, err.Error())
+	}
+	if !cmp.Equal(purged, newPayment) {
+		t.Fatalf("Purged payment differs from expected.\nReturned:\n%v\nBut expected:\n%v", purged, newPayment)
+	}
+
+	_, err = p.Repository.GetPayment(context.Background(), id)
 	p.checkNotFoundError(id, "getting", err, t)
+	_, err = p.Repository.GetPaymentRevisions(context.Background(), id)
+	p.checkNotFoundError(id, "listing revisions of", err, t)
+	_, err = p.Repository.RestorePayment(context.Background(), id, AnyVersion)
+	p.checkNotFoundError(id, "restoring", err, t)
+	_, err = p.Repository.PurgePayment(context.Background(), id)
+	p.checkNotFoundError(id, "purging", err, t)
+}
+
+// TestIdempotency checks that a payment is saved only once for the same idempotency key until it expires,
+// even by concurrent calls, and that the key can't be reused for a different payment
+func (p PaymentRepositoryTester) TestIdempotency(t *testing.T, goroutines int) {
+	key := IdempotencyKey{
+		Key:         uuid.New().String(),
+		Fingerprint: "fingerprint",
+		ExpiresAt:   time.Now().Add(time.Hour),
+	}
+	created, replayed, err := p.Repository.AddPaymentOnce(context.Background(), p.getDefaultPayment(t), key)
+	if err != nil {
+		t.Fatalf("Error adding payment with idempotency key %s: %s", key.Key, err.Error())
+	}
+	if replayed {
+		t.Fatalf("Expected payment to be saved with new idempotency key %s but it was replayed", key.Key)
+	}
+	got, err := p.Repository.GetPayment(context.Background(), created.ID)
+	if err != nil {
+		t.Fatalf("Error getting payment %s saved with idempotency key: %s", created.ID, err.Error())
+	}
+	if !cmp.Equal(got, created) {
+		t.Fatalf("Returned payment differs from the saved one.\nReturned:\n%v\nBut expected:\n%v", got, created)
+	}
+
+	// The payment is returned as it was saved even if it has been modified since then
+	updated := created
+	updated.Attributes.Reference = "Updated"
+	if _, err := p.Repository.UpdatePayment(context.Background(), updated); err != nil {
+		t.Fatalf("Error updating payment %s: %s", created.ID, err.Error())
+	}
+	replay, replayed, err := p.Repository.AddPaymentOnce(context.Background(), p.getDefaultPayment(t), key)
+	if err != nil {
+		t.Fatalf("Error repeating payment with idempotency key %s: %s", key.Key, err.Error())
+	}
+	if !replayed || !cmp.Equal(replay, created) {
+		t.Fatalf("Expected the saved payment to be replayed for idempotency key %s but got %v (replayed %t)", key.Key, replay, replayed)
+	}
+
+	reused := key
+	reused.Fingerprint = "other fingerprint"
+	_, _, err = p.Repository.AddPaymentOnce(context.Background(), p.getDefaultPayment(t), reused)
+	if _, ok := err.(IdempotencyKeyReusedError); !ok {
+		t.Fatalf("Expected IdempotencyKeyReused error reusing key %s with a different fingerprint but got %v", key.Key, err)
+	}
+	record, err := p.Repository.GetIdempotencyRecord(context.Background(), key.Key)
+	if err != nil {
+		t.Fatalf("Error getting idempotency key %s: %s", key.Key, err.Error())
+	}
+	if record.Key != key.Key || record.Fingerprint != key.Fingerprint || !cmp.Equal(record.Payment, created) {
+		t.Fatalf("Unexpected record of idempotency key %s: %v", key.Key, record)
+	}
+	missing := uuid.New().String()
+	if _, err := p.Repository.GetIdempotencyRecord(context.Background(), missing); err == nil {
+		t.Fatalf("Expected NotFound error getting unknown idempotency key %s", missing)
+	} else if _, ok := err.(NotFoundError); !ok {
+		t.Fatalf("Expected NotFound error getting unknown idempotency key %s but got %v", missing, err)
+	}
+
+	expired := IdempotencyKey{
+		Key:         uuid.New().String(),
+		Fingerprint: "fingerprint",
+		ExpiresAt:   time.Now().Add(-time.Second),
+	}
+	first, _, err := p.Repository.AddPaymentOnce(context.Background(), p.getDefaultPayment(t), expired)
+	if err != nil {
+		t.Fatalf("Error adding payment with idempotency key %s: %s", expired.Key, err.Error())
+	}
+	second, replayed, err := p.Repository.AddPaymentOnce(context.Background(), p.getDefaultPayment(t), expired)
+	if err != nil {
+		t.Fatalf("Error adding payment with expired idempotency key %s: %s", expired.Key, err.Error())
+	}
+	if replayed || second.ID == first.ID {
+		t.Fatalf("Expected a new payment to be saved with expired idempotency key %s but %s was replayed", expired.Key, first.ID)
+	}
+	if _, err := p.Repository.GetIdempotencyRecord(context.Background(), expired.Key); err == nil {
+		t.Fatalf("Expected NotFound error getting expired idempotency key %s", expired.Key)
+	} else if _, ok := err.(NotFoundError); !ok {
+		t.Fatalf("Expected NotFound error getting expired idempotency key %s but got %v", expired.Key, err)
+	}
+
+	// Only one of several concurrent calls with the same key must save the payment
+	concurrent := IdempotencyKey{
+		Key:         uuid.New().String(),
+		Fingerprint: "fingerprint",
+		ExpiresAt:   time.Now().Add(time.Hour),
+	}
+	reference := uuid.New().String()
+	defaultPayment := p.getDefaultPayment(t)
+	defaultPayment.Attributes.EndToEndReference = reference
+	var wait sync.WaitGroup
+	var lock sync.Mutex
+	ids := make(map[string]int)
+	for i := 0; i < goroutines; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			pay, _, err := p.Repository.AddPaymentOnce(context.Background(), defaultPayment, concurrent)
+			if err != nil {
+				t.Errorf("Error adding payment with idempotency key %s: %s", concurrent.Key, err.Error())
+				return
+			}
+			lock.Lock()
+			ids[pay.ID]++
+			lock.Unlock()
+		}()
+	}
+	wait.Wait()
+	if len(ids) != 1 {
+		t.Fatalf("Expected all the concurrent calls with the same idempotency key to return the same payment but got %v", ids)
+	}
+	saved, err := p.Repository.GetPayments(context.Background(), map[string]string{"attributes.end_to_end_reference": reference})
+	if err != nil {
+		t.Fatalf("Error listing payments: %s", err.Error())
+	}
+	if len(saved) != 1 {
+		t.Fatalf("Expected a single payment to be saved by concurrent calls with the same idempotency key but got %d", len(saved))
+	}
 }
 
 func (p PaymentRepositoryTester) TestGetId(t *testing.T) {
 	payment := p.getDefaultPayment(t)
 
-	newPayment, err := p.Repository.AddPayment(payment)
+	newPayment, err := p.Repository.AddPayment(context.Background(), payment)
 	if err != nil {
 		t.Fatalf("Error adding payment: %s", err.Error())
 	}
 
-	got, err := p.Repository.GetPayment(newPayment.ID)
+	got, err := p.Repository.GetPayment(context.Background(), newPayment.ID)
 	if !cmp.Equal(got, newPayment) {
 		t.Fatalf("Returned get payment differs from the created one.\nReturned:\n%v\nBut expected:\n%v", got, newPayment)
 	}
 
 	newID := uuid.New().String()
-	got, err = p.Repository.GetPayment(newID)
+	got, err = p.Repository.GetPayment(context.Background(), newID)
 	p.checkNotFoundError(newID, "getting", err, t)
 }
 
 func (p PaymentRepositoryTester) TestGetList(t *testing.T, toCreate int) {
-	existing, err := p.Repository.GetPayments(nil)
+	existing, err := p.Repository.GetPayments(context.Background(), nil)
 	if err != nil {
 		t.Errorf("Error listing all payments: %s", err.Error())
 	}
@@ -112,13 +376,13 @@ func (p PaymentRepositoryTester) TestGetList(t *testing.T, toCreate int) {
 	payment := p.getDefaultPayment(t)
 
 	for i := 0; i < toCreate; i++ {
-		_, err := p.Repository.AddPayment(payment)
+		_, err := p.Repository.AddPayment(context.Background(), payment)
 		if err != nil {
 			t.Fatalf("Error adding payment: %s", err.Error())
 		}
 	}
 
-	existing, err = p.Repository.GetPayments(nil)
+	existing, err = p.Repository.GetPayments(context.Background(), nil)
 	if err != nil {
 		t.Errorf("Error listing all payments after adding: %s", err.Error())
 	}
@@ -129,6 +393,1128 @@ func (p PaymentRepositoryTester) TestGetList(t *testing.T, toCreate int) {
 
 }
 
+func (p PaymentRepositoryTester) TestFilter(t *testing.T) {
+	reference := uuid.New().String()
+	base := p.getDefaultPayment(t)
+	base.Attributes.EndToEndReference = reference
+
+	first := base
+	first.Attributes.Currency = "EUR"
+	first.Attributes.Amount = "10.50"
+	first.Attributes.BeneficiaryParty.BankID = "111111"
+
+	second := base
+	second.Attributes.Currency = "EUR"
+	second.Attributes.Amount = "10.5"
+	second.Attributes.BeneficiaryParty.BankID = "222222"
+
+	third := base
+	third.Attributes.Currency = "USD"
+	third.Attributes.Amount = "200"
+	third.Attributes.ChargesInformation.SenderCharges = []payment.PaymentAmountType{
+		payment.PaymentAmountType{
+			Amount:   "1.00",
+			Currency: "CHF",
+		},
+	}
+
+	for _, pay := range []payment.Payment{first, second, third} {
+		if _, err := p.Repository.AddPayment(context.Background(), pay); err != nil {
+			t.Fatalf("Error adding payment: %s", err.Error())
+		}
+	}
+
+	tests := []struct {
+		filter   map[string]string
+		expected int
+	}{
+		{map[string]string{"attributes.end_to_end_reference": reference}, 3},
+		{map[string]string{"attributes.end_to_end_reference": reference, "attributes.currency": "EUR"}, 2},
+		{map[string]string{"attributes.end_to_end_reference": reference, "attributes.beneficiary_party.bank_id": "111111"}, 1},
+		{map[string]string{"attributes.end_to_end_reference": reference, "attributes.amount": "10.500"}, 2},
+		{map[string]string{"attributes.end_to_end_reference": reference, "attributes.charges_information.sender_charges.currency": "USD"}, 2},
+		{map[string]string{"attributes.end_to_end_reference": reference, "attributes.charges_information.sender_charges.currency": "CHF"}, 1},
+		{map[string]string{"attributes.end_to_end_reference": reference, "version": "0"}, 3},
+		{map[string]string{"attributes.end_to_end_reference": reference, "attributes.currency": "JPY"}, 0},
+	}
+
+	for _, test := range tests {
+		found, err := p.Repository.GetPayments(context.Background(), test.filter)
+		if err != nil {
+			t.Fatalf("Error listing payments with filter %v: %s", test.filter, err.Error())
+		}
+		if len(found) != test.expected {
+			t.Errorf("Expected %d payments with filter %v but got %d", test.expected, test.filter, len(found))
+		}
+		for _, pay := range found {
+			if pay.Attributes.EndToEndReference != reference {
+				t.Errorf("Payment %s returned with filter %v has unexpected reference %s", pay.ID, test.filter, pay.Attributes.EndToEndReference)
+			}
+		}
+	}
+
+	_, err := p.Repository.GetPayments(context.Background(), map[string]string{"attributes.unknown": "value"})
+	if _, ok := err.(InvalidFieldError); !ok {
+		t.Errorf("Expected InvalidFieldError filtering by an unknown field but got %v", err)
+	}
+
+	_, err = p.Repository.GetPayments(context.Background(), map[string]string{"attributes.amount": "ten"})
+	if _, ok := err.(InvalidValueError); !ok {
+		t.Errorf("Expected InvalidValueError filtering by a non numeric amount but got %v", err)
+	}
+}
+
+func (p PaymentRepositoryTester) TestQuery(t *testing.T) {
+	reference := uuid.New().String()
+	amounts := []string{"9.50", "100.21", "20", "1000"}
+	dates := []string{"2017-01-18", "2017-02-01", "2016-12-31", "2017-01-01"}
+	for i := range amounts {
+		pay := p.getDefaultPayment(t)
+		pay.Attributes.EndToEndReference = reference
+		pay.Attributes.Amount = amounts[i]
+		pay.Attributes.ProcessingDate = dates[i]
+		if _, err := p.Repository.AddPayment(context.Background(), pay); err != nil {
+			t.Fatalf("Error adding payment: %s", err.Error())
+		}
+	}
+
+	newCondition := func(path string, operator FilterOperator, value string) FilterCondition {
+		condition, err := NewFilterCondition(path, operator, value)
+		if err != nil {
+			t.Fatalf("Error creating condition over %s: %s", path, err.Error())
+		}
+		return condition
+	}
+	newSortField := func(path string, descending bool) SortField {
+		sortField, err := NewSortField(path, descending)
+		if err != nil {
+			t.Fatalf("Error creating sort field %s: %s", path, err.Error())
+		}
+		return sortField
+	}
+	referenceCondition := newCondition("attributes.end_to_end_reference", EqualOperator, reference)
+
+	tests := []struct {
+		query    PaymentQuery
+		expected []string
+	}{
+		{
+			PaymentQuery{
+				Filter: []FilterCondition{referenceCondition},
+				Sort:   []SortField{newSortField("attributes.amount", true)},
+			},
+			[]string{"1000", "100.21", "20", "9.50"},
+		},
+		{
+			PaymentQuery{
+				Filter: []FilterCondition{referenceCondition},
+				Sort:   []SortField{newSortField("attributes.processing_date", false)},
+			},
+			[]string{"20", "1000", "9.50", "100.21"},
+		},
+		{
+			PaymentQuery{
+				Filter: []FilterCondition{
+					referenceCondition,
+					newCondition("attributes.processing_date", GreaterOrEqualOperator, "2017-01-01"),
+					newCondition("attributes.processing_date", LowerOperator, "2017-02-01"),
+				},
+				Sort: []SortField{newSortField("attributes.amount", false)},
+			},
+			[]string{"9.50", "1000"},
+		},
+		{
+			PaymentQuery{
+				Filter: []FilterCondition{
+					referenceCondition,
+					newCondition("attributes.amount", GreaterOperator, "20"),
+				},
+				Sort: []SortField{newSortField("attributes.amount", false)},
+			},
+			[]string{"100.21", "1000"},
+		},
+		{
+			PaymentQuery{
+				Filter: []FilterCondition{
+					referenceCondition,
+					newCondition("attributes.amount", NotEqualOperator, "20.00"),
+					newCondition("attributes.amount", LowerOrEqualOperator, "100.21"),
+				},
+				Sort: []SortField{newSortField("attributes.amount", true)},
+			},
+			[]string{"100.21", "9.50"},
+		},
+		{
+			PaymentQuery{
+				Filter: []FilterCondition{
+					referenceCondition,
+					newCondition("attributes.amount", NotEqualOperator, "20.00"),
+					newCondition("attributes.amount", NotEqualOperator, "9.5"),
+				},
+				Sort: []SortField{newSortField("attributes.amount", false)},
+			},
+			[]string{"100.21", "1000"},
+		},
+		{
+			PaymentQuery{
+				Filter: []FilterCondition{
+					referenceCondition,
+					newCondition("attributes.processing_date", GreaterOrEqualOperator, "2017-01-18"),
+					newCondition("attributes.processing_date", GreaterOrEqualOperator, "2017-01-01"),
+				},
+				Sort: []SortField{newSortField("attributes.amount", false)},
+			},
+			[]string{"9.50", "100.21"},
+		},
+	}
+
+	for _, test := range tests {
+		found, err := p.Repository.FindPayments(context.Background(), test.query)
+		if err != nil {
+			t.Fatalf("Error finding payments with query %v: %s", test.query, err.Error())
+		}
+		amounts := make([]string, 0, len(found))
+		for _, pay := range found {
+			amounts = append(amounts, pay.Attributes.Amount)
+		}
+		if !cmp.Equal(amounts, test.expected) {
+			t.Errorf("Unexpected payments found with query %v. Expected amounts %v but got %v", test.query, test.expected, amounts)
+		}
+	}
+
+	amountField, err := GetSelectablePaymentField("attributes.amount")
+	if err != nil {
+		t.Fatalf("Error getting amount field: %s", err.Error())
+	}
+	debtorField, err := GetSelectablePaymentField("attributes.debtor_party")
+	if err != nil {
+		t.Fatalf("Error getting debtor field: %s", err.Error())
+	}
+
+	found, err := p.Repository.FindPayments(context.Background(), PaymentQuery{
+		Filter: []FilterCondition{referenceCondition},
+		Fields: []PaymentField{amountField, debtorField},
+	})
+	if err != nil {
+		t.Fatalf("Error finding payments with selected fields: %s", err.Error())
+	}
+	if len(found) != len(amounts) {
+		t.Fatalf("Expected %d payments with selected fields but got %d", len(amounts), len(found))
+	}
+	defaultPayment := p.getDefaultPayment(t)
+	for _, pay := range found {
+		expected := payment.Payment{
+			ID: pay.ID,
+			Attributes: payment.PaymentAttributesType{
+				Amount:      pay.Attributes.Amount,
+				DebtorParty: defaultPayment.Attributes.DebtorParty,
+			},
+		}
+		if pay.ID == "" || pay.Attributes.Amount == "" || !cmp.Equal(pay, expected) {
+			t.Errorf("Payment with selected fields differs from expected.\nReturned:\n%v\nBut expected:\n%v", pay, expected)
+		}
+	}
+}
+
+func (p PaymentRepositoryTester) TestPagination(t *testing.T) {
+	amounts := []string{"1", "2", "2", "3", "4", "5", "6"}
+	for _, descending := range []bool{false, true} {
+		reference := uuid.New().String()
+		for _, amount := range amounts {
+			pay := p.getDefaultPayment(t)
+			pay.Attributes.EndToEndReference = reference
+			pay.Attributes.Amount = amount
+			if _, err := p.Repository.AddPayment(context.Background(), pay); err != nil {
+				t.Fatalf("Error adding payment: %s", err.Error())
+			}
+		}
+
+		referenceCondition, err := NewFilterCondition("attributes.end_to_end_reference", EqualOperator, reference)
+		if err != nil {
+			t.Fatalf("Error creating reference condition: %s", err.Error())
+		}
+		sortField, err := NewSortField("attributes.amount", descending)
+		if err != nil {
+			t.Fatalf("Error creating sort field: %s", err.Error())
+		}
+		query := PaymentQuery{
+			Filter: []FilterCondition{referenceCondition},
+			Sort:   []SortField{sortField},
+		}
+
+		expected, err := p.Repository.FindPayments(context.Background(), query)
+		if err != nil {
+			t.Fatalf("Error finding payments: %s", err.Error())
+		}
+		if len(expected) != len(amounts) {
+			t.Fatalf("Expected %d payments but got %d", len(amounts), len(expected))
+		}
+
+		var forward []payment.Payment
+		var pages []PaymentPage
+		request := PageRequest{Size: 3}
+		for {
+			page, err := p.Repository.GetPaymentPage(context.Background(), query, request)
+			if err != nil {
+				t.Fatalf("Error getting page %d: %s", len(pages), err.Error())
+			}
+			if (page.Previous == "") != (len(pages) == 0) {
+				t.Fatalf("Unexpected previous cursor %q in page %d", page.Previous, len(pages))
+			}
+			pages = append(pages, page)
+			forward = append(forward, page.Payments...)
+			if len(pages) == 1 {
+				// Payments added before the current position must not shift the following pages
+				extra := p.getDefaultPayment(t)
+				extra.Attributes.EndToEndReference = reference
+				extra.Attributes.Amount = "1"
+				if descending {
+					extra.Attributes.Amount = "7"
+				}
+				if _, err := p.Repository.AddPayment(context.Background(), extra); err != nil {
+					t.Fatalf("Error adding payment: %s", err.Error())
+				}
+			}
+			if page.Next == "" {
+				break
+			}
+			request = PageRequest{Size: 3, After: page.Next}
+		}
+
+		if len(pages) != 3 {
+			t.Fatalf("Expected 3 pages but got %d", len(pages))
+		}
+		if !cmp.Equal(forward, expected) {
+			t.Fatalf("Payments read by pages differ from expected.\nReturned:\n%v\nBut expected:\n%v", forward, expected)
+		}
+
+		var backward []payment.Payment
+		request = PageRequest{Size: 3, Before: pages[2].Previous}
+		for request.Before != "" {
+			page, err := p.Repository.GetPaymentPage(context.Background(), query, request)
+			if err != nil {
+				t.Fatalf("Error getting previous page: %s", err.Error())
+			}
+			if page.Next == "" {
+				t.Fatal("Expected a next cursor in a page read backwards")
+			}
+			backward = append(page.Payments, backward...)
+			request = PageRequest{Size: 3, Before: page.Previous}
+		}
+		current, err := p.Repository.FindPayments(context.Background(), query)
+		if err != nil {
+			t.Fatalf("Error finding payments: %s", err.Error())
+		}
+		position := 0
+		for position < len(current) && current[position].ID != pages[2].Payments[0].ID {
+			position++
+		}
+		if !cmp.Equal(backward, current[:position]) {
+			t.Fatalf("Payments read backwards differ from expected.\nReturned:\n%v\nBut expected:\n%v", backward, current[:position])
+		}
+	}
+
+	invalid := []PageRequest{
+		PageRequest{Size: 0},
+		PageRequest{Size: MaxPageSize + 1},
+		PageRequest{Size: 1, After: "invalid"},
+		PageRequest{Size: 1, After: "a", Before: "b"},
+	}
+	for _, request := range invalid {
+		_, err := p.Repository.GetPaymentPage(context.Background(), PaymentQuery{}, request)
+		if _, ok := err.(InvalidPageError); !ok {
+			t.Errorf("Expected InvalidPageError with page request %v but got %v", request, err)
+		}
+	}
+}
+
+// TestConcurrentAccess runs operations over the repository from several goroutines at the same time.
+// It is intended to be run with the race detector enabled.
+func (p PaymentRepositoryTester) TestConcurrentAccess(t *testing.T, goroutines, iterations int) {
+	shared, err := p.Repository.AddPayment(context.Background(), p.getDefaultPayment(t))
+	if err != nil {
+		t.Fatalf("Error adding payment: %s", err.Error())
+	}
+
+	// Only one of several concurrent updates over the same version must succeed
+	var wait sync.WaitGroup
+	var lock sync.Mutex
+	succeeded := 0
+	for i := 0; i < goroutines; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			update := shared
+			update.Attributes.Reference = fmt.Sprintf("Update %d", i)
+			_, err := p.Repository.UpdatePayment(context.Background(), update)
+			if err == nil {
+				lock.Lock()
+				succeeded++
+				lock.Unlock()
+			} else if _, ok := err.(ConflictError); !ok {
+				t.Errorf("Expected success or Conflict error updating shared payment but got %v", err)
+			}
+		}(i)
+	}
+	wait.Wait()
+	if succeeded != 1 {
+		t.Fatalf("Expected exactly one concurrent update to succeed but %d did", succeeded)
+	}
+
+	reference := uuid.New().String()
+	defaultPayment := p.getDefaultPayment(t)
+	for i := 0; i < goroutines; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			pay := defaultPayment
+			pay.Attributes.EndToEndReference = reference
+			pay.Attributes.Reference = fmt.Sprintf("Goroutine %d", i)
+			pay, err := p.Repository.AddPayment(context.Background(), pay)
+			if err != nil {
+				t.Errorf("Error adding payment: %s", err.Error())
+				return
+			}
+
+			for j := 0; j < iterations; j++ {
+				pay.Attributes.Amount = fmt.Sprintf("%d.00", j)
+				pay, err = p.Repository.UpdatePayment(context.Background(), pay)
+				if err != nil {
+					t.Errorf("Error updating payment %s: %s", pay.ID, err.Error())
+					return
+				}
+
+				got, err := p.Repository.GetPayment(context.Background(), pay.ID)
+				if err != nil {
+					t.Errorf("Error getting payment %s: %s", pay.ID, err.Error())
+					return
+				}
+				if !cmp.Equal(got, pay) {
+					t.Errorf("Payment %s differs from the last update.\nReturned:\n%v\nBut expected:\n%v", pay.ID, got, pay)
+					return
+				}
+
+				_, err = p.Repository.GetPayments(context.Background(), map[string]string{"attributes.end_to_end_reference": reference})
+				if err != nil {
+					t.Errorf("Error listing payments: %s", err.Error())
+					return
+				}
+			}
+
+			if _, err := p.Repository.DeletePayment(context.Background(), pay.ID, pay.Version); err != nil {
+				t.Errorf("Error deleting payment %s: %s", pay.ID, err.Error())
+			}
+		}(i)
+	}
+	wait.Wait()
+
+	remaining, err := p.Repository.GetPayments(context.Background(), map[string]string{"attributes.end_to_end_reference": reference})
+	if err != nil {
+		t.Fatalf("Error listing payments: %s", err.Error())
+	}
+	if len(remaining) != 0 {
+		t.Fatalf("Expected all the payments created concurrently to be deleted but %d remain", len(remaining))
+	}
+}
+
+// TestCancelledContext checks that the operations return the context error instead of accessing the payments
+// when the context is cancelled or its deadline is exceeded
+func (p PaymentRepositoryTester) TestCancelledContext(t *testing.T) {
+	existing, err := p.Repository.AddPayment(context.Background(), p.getDefaultPayment(t))
+	if err != nil {
+		t.Fatalf("Error adding payment: %s", err.Error())
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancelExpired := context.WithTimeout(context.Background(), -time.Second)
+	defer cancelExpired()
+
+	contexts := []struct {
+		ctx      context.Context
+		expected error
+	}{
+		{cancelled, context.Canceled},
+		{expired, context.DeadlineExceeded},
+	}
+	for _, test := range contexts {
+		operations := map[string]func() error{
+			"adding": func() error {
+				_, err := p.Repository.AddPayment(test.ctx, p.getDefaultPayment(t))
+				return err
+			},
+			"adding once": func() error {
+				key := IdempotencyKey{Key: uuid.New().String(), ExpiresAt: time.Now().Add(time.Hour)}
+				_, _, err := p.Repository.AddPaymentOnce(test.ctx, p.getDefaultPayment(t), key)
+				return err
+			},
+			"updating": func() error {
+				_, err := p.Repository.UpdatePayment(test.ctx, existing)
+				return err
+			},
+			"deleting": func() error {
+				_, err := p.Repository.DeletePayment(test.ctx, existing.ID, AnyVersion)
+				return err
+			},
+			"restoring": func() error {
+				_, err := p.Repository.RestorePayment(test.ctx, existing.ID, AnyVersion)
+				return err
+			},
+			"purging": func() error {
+				_, err := p.Repository.PurgePayment(test.ctx, existing.ID)
+				return err
+			},
+			"getting": func() error {
+				_, err := p.Repository.GetPayment(test.ctx, existing.ID)
+				return err
+			},
+			"getting a past version of": func() error {
+				_, err := p.Repository.GetPaymentAsOf(test.ctx, existing.ID, time.Now())
+				return err
+			},
+			"finding past versions of": func() error {
+				_, err := p.Repository.FindPayments(test.ctx, PaymentQuery{AsOf: time.Now()})
+				return err
+			},
+			"listing": func() error {
+				_, err := p.Repository.GetPayments(test.ctx, nil)
+				return err
+			},
+			"finding": func() error {
+				_, err := p.Repository.FindPayments(test.ctx, PaymentQuery{})
+				return err
+			},
+			"paginating": func() error {
+				_, err := p.Repository.GetPaymentPage(test.ctx, PaymentQuery{}, PageRequest{Size: 1})
+				return err
+			},
+			"listing revisions of": func() error {
+				_, err := p.Repository.GetPaymentRevisions(test.ctx, existing.ID)
+				return err
+			},
+			"getting a revision of": func() error {
+				_, err := p.Repository.GetPaymentRevision(test.ctx, existing.ID, 1)
+				return err
+			},
+		}
+		for action, operation := range operations {
+			if err := operation(); err != test.expected {
+				t.Errorf("Expected error %v %s payment with a finished context but got %v", test.expected, action, err)
+			}
+		}
+	}
+
+	got, err := p.Repository.GetPayment(context.Background(), existing.ID)
+	if err != nil {
+		t.Fatalf("Error getting payment %s: %s", existing.ID, err.Error())
+	}
+	if !cmp.Equal(got, existing) {
+		t.Fatalf("Payment %s was modified with a finished context.\nReturned:\n%v\nBut expected:\n%v", existing.ID, got, existing)
+	}
+}
+
+// TestHistory checks that every change of a payment is recorded as a revision with its actor
+// and that the revisions are kept after deleting the payment
+func (p PaymentRepositoryTester) TestHistory(t *testing.T) {
+	start := time.Now().Truncate(time.Millisecond)
+	created, err := p.Repository.AddPayment(WithActor(context.Background(), "creator"), p.getDefaultPayment(t))
+	if err != nil {
+		t.Fatalf("Error adding payment: %s", err.Error())
+	}
+
+	toUpdate := created
+	toUpdate.Attributes.Amount = "500.00"
+	updated, err := p.Repository.UpdatePayment(WithActor(context.Background(), "updater"), toUpdate)
+	if err != nil {
+		t.Fatalf("Error updating payment %s: %s", created.ID, err.Error())
+	}
+
+	// Failed changes must not be recorded
+	if _, err := p.Repository.UpdatePayment(context.Background(), toUpdate); err == nil {
+		t.Fatalf("Expected ConflictError updating payment %s with an old version but got nil", created.ID)
+	}
+
+	deleted, err := p.Repository.DeletePayment(WithActor(context.Background(), "deleter"), created.ID, AnyVersion)
+	if err != nil {
+		t.Fatalf("Error deleting payment %s: %s", created.ID, err.Error())
+	}
+	end := time.Now()
+
+	expected := []PaymentRevision{
+		{PaymentID: created.ID, Revision: 1, Operation: CreateOperation, Actor: "creator", Payment: created},
+		{PaymentID: created.ID, Revision: 2, Operation: UpdateOperation, Actor: "updater", Payment: updated},
+		{PaymentID: created.ID, Revision: 3, Operation: DeleteOperation, Actor: "deleter", Payment: deleted},
+	}
+	revisions, err := p.Repository.GetPaymentRevisions(context.Background(), created.ID)
+	if err != nil {
+		t.Fatalf("Error getting revisions of payment %s: %s", created.ID, err.Error())
+	}
+	if len(revisions) != len(expected) {
+		t.Fatalf("Expected %d revisions of payment %s but got %d: %v", len(expected), created.ID, len(revisions), revisions)
+	}
+	for i, revision := range revisions {
+		if revision.Timestamp.Before(start) || revision.Timestamp.After(end) {
+			t.Errorf("Revision %d has timestamp %s out of the test time range", revision.Revision, revision.Timestamp)
+		}
+		if i > 0 && revision.Timestamp.Before(revisions[i-1].Timestamp) {
+			t.Errorf("Revision %d has timestamp %s before the previous revision", revision.Revision, revision.Timestamp)
+		}
+		expected[i].Timestamp = revision.Timestamp
+		if !cmp.Equal(revision, expected[i]) {
+			t.Errorf("Unexpected revision %d of payment %s.\nReturned:\n%v\nBut expected:\n%v", i+1, created.ID, revision, expected[i])
+		}
+
+		got, err := p.Repository.GetPaymentRevision(context.Background(), created.ID, revision.Revision)
+		if err != nil {
+			t.Fatalf("Error getting revision %d of payment %s: %s", revision.Revision, created.ID, err.Error())
+		}
+		if !cmp.Equal(got, revision) {
+			t.Errorf("Revision %d of payment %s differs from the listed one.\nReturned:\n%v\nBut expected:\n%v", revision.Revision, created.ID, got, revision)
+		}
+	}
+
+	for _, revision := range []int{0, len(expected) + 1} {
+		_, err := p.Repository.GetPaymentRevision(context.Background(), created.ID, revision)
+		p.checkNotFoundError(created.ID, fmt.Sprintf("getting revision %d of", revision), err, t)
+	}
+	nonExisting := uuid.New().String()
+	_, err = p.Repository.GetPaymentRevisions(context.Background(), nonExisting)
+	p.checkNotFoundError(nonExisting, "listing revisions of", err, t)
+}
+
+// TestAsOf checks that payments are returned as they were at a past time, including the ones which have been deleted since then
+func (p PaymentRepositoryTester) TestAsOf(t *testing.T) {
+	// Revision timestamps may be stored with millisecond precision, so changes are separated to get different timestamps
+	pause := func() { time.Sleep(5 * time.Millisecond) }
+	created, err := p.Repository.AddPayment(context.Background(), p.getDefaultPayment(t))
+	if err != nil {
+		t.Fatalf("Error adding payment: %s", err.Error())
+	}
+	pause()
+	toUpdate := created
+	toUpdate.Attributes.Amount = "500.00"
+	updated, err := p.Repository.UpdatePayment(context.Background(), toUpdate)
+	if err != nil {
+		t.Fatalf("Error updating payment %s: %s", created.ID, err.Error())
+	}
+	pause()
+	if _, err := p.Repository.DeletePayment(context.Background(), created.ID, AnyVersion); err != nil {
+		t.Fatalf("Error deleting payment %s: %s", created.ID, err.Error())
+	}
+
+	revisions, err := p.Repository.GetPaymentRevisions(context.Background(), created.ID)
+	if err != nil {
+		t.Fatalf("Error getting revisions of payment %s: %s", created.ID, err.Error())
+	}
+	if len(revisions) != 3 {
+		t.Fatalf("Expected 3 revisions of payment %s but got %d", created.ID, len(revisions))
+	}
+
+	tests := []struct {
+		name     string
+		asOf     time.Time
+		expected *payment.Payment
+	}{
+		{"before creation", revisions[0].Timestamp.Add(-time.Millisecond), nil},
+		{"at creation", revisions[0].Timestamp, &created},
+		{"after update", revisions[1].Timestamp.Add(time.Millisecond / 2), &updated},
+		{"at deletion", revisions[2].Timestamp, nil},
+	}
+	filter, err := NewFilterCondition("id", EqualOperator, created.ID)
+	if err != nil {
+		t.Fatalf("Error building filter: %s", err.Error())
+	}
+	for _, test := range tests {
+		var expectedList []payment.Payment
+		got, err := p.Repository.GetPaymentAsOf(context.Background(), created.ID, test.asOf)
+		if test.expected == nil {
+			p.checkNotFoundError(created.ID, "getting "+test.name+" version of", err, t)
+			expectedList = []payment.Payment{}
+		} else {
+			if err != nil {
+				t.Fatalf("Error getting payment %s %s: %s", created.ID, test.name, err.Error())
+			}
+			if !cmp.Equal(got, *test.expected) {
+				t.Errorf("Unexpected payment %s %s.\nReturned:\n%v\nBut expected:\n%v", created.ID, test.name, got, *test.expected)
+			}
+			expectedList = []payment.Payment{*test.expected}
+		}
+
+		query := PaymentQuery{Filter: []FilterCondition{filter}, AsOf: test.asOf}
+		found, err := p.Repository.FindPayments(context.Background(), query)
+		if err != nil {
+			t.Fatalf("Error finding payments %s: %s", test.name, err.Error())
+		}
+		if !cmp.Equal(found, expectedList) {
+			t.Errorf("Unexpected payments found %s.\nReturned:\n%v\nBut expected:\n%v", test.name, found, expectedList)
+		}
+		page, err := p.Repository.GetPaymentPage(context.Background(), query, PageRequest{Size: 10})
+		if err != nil {
+			t.Fatalf("Error getting page of payments %s: %s", test.name, err.Error())
+		}
+		if !cmp.Equal(page.Payments, expectedList) {
+			t.Errorf("Unexpected page of payments %s.\nReturned:\n%v\nBut expected:\n%v", test.name, page.Payments, expectedList)
+		}
+	}
+
+	nonExisting := uuid.New().String()
+	_, err = p.Repository.GetPaymentAsOf(context.Background(), nonExisting, time.Now())
+	p.checkNotFoundError(nonExisting, "getting past version of", err, t)
+}
+
+// TestStatus checks that the status and the transitions of the payments are stored and can be used to filter them
+func (p PaymentRepositoryTester) TestStatus(t *testing.T) {
+	reference := uuid.New().String()
+	pay := p.getDefaultPayment(t)
+	pay.Attributes.EndToEndReference = reference
+	pay.Status = payment.CreatedStatus
+	pay, err := p.Repository.AddPayment(context.Background(), pay)
+	if err != nil {
+		t.Fatalf("Error adding payment: %s", err.Error())
+	}
+
+	at := time.Date(2019, 5, 1, 10, 30, 0, 0, time.UTC)
+	for _, action := range []string{payment.SubmitAction, payment.SettleAction} {
+		transitioned, err := pay.Transition(action, "Reason to "+action, "operator", at)
+		if err != nil {
+			t.Fatalf("Error applying action %s: %s", action, err.Error())
+		}
+		pay, err = p.Repository.UpdatePayment(context.Background(), transitioned)
+		if err != nil {
+			t.Fatalf("Error updating payment after %s: %s", action, err.Error())
+		}
+		at = at.Add(time.Hour)
+	}
+
+	got, err := p.Repository.GetPayment(context.Background(), pay.ID)
+	if err != nil {
+		t.Fatalf("Error getting payment: %s", err.Error())
+	}
+	if !cmp.Equal(got, pay) {
+		t.Fatalf("Stored payment differs from the transitioned one.\nReturned:\n%v\nBut expected:\n%v", got, pay)
+	}
+	if got.Status != payment.SettledStatus || len(got.Transitions) != 2 || got.Transitions[1].PreviousStatus != payment.SubmittedStatus {
+		t.Fatalf("Unexpected status %s and transitions %v", got.Status, got.Transitions)
+	}
+
+	tests := []struct {
+		filter   map[string]string
+		expected int
+	}{
+		{map[string]string{"attributes.end_to_end_reference": reference, "status": payment.SettledStatus}, 1},
+		{map[string]string{"attributes.end_to_end_reference": reference, "status": payment.CreatedStatus}, 0},
+		{map[string]string{"attributes.end_to_end_reference": reference, "transitions.action": payment.SubmitAction}, 1},
+		{map[string]string{"attributes.end_to_end_reference": reference, "transitions.status": payment.RejectedStatus}, 0},
+	}
+	for _, test := range tests {
+		found, err := p.Repository.GetPayments(context.Background(), test.filter)
+		if err != nil {
+			t.Fatalf("Error listing payments with filter %v: %s", test.filter, err.Error())
+		}
+		if len(found) != test.expected {
+			t.Errorf("Expected %d payments with filter %v but got %d", test.expected, test.filter, len(found))
+		}
+	}
+}
+
+// TestSanctionsHits checks that the sanctions hits of the payments are stored and can be used to filter them
+func (p PaymentRepositoryTester) TestSanctionsHits(t *testing.T) {
+	reference := uuid.New().String()
+	pay := p.getDefaultPayment(t)
+	pay.Attributes.EndToEndReference = reference
+	pay.Status = payment.CreatedStatus
+	pay, err := p.Repository.AddPayment(context.Background(), pay)
+	if err != nil {
+		t.Fatalf("Error adding payment: %s", err.Error())
+	}
+
+	hits := []payment.SanctionsHit{
+		{
+			Field:        "attributes.beneficiary_party.name",
+			Value:        pay.Attributes.BeneficiaryParty.Name,
+			EntryID:      "90001",
+			EntryName:    "KOVALENKO Dmitri Ivanovich",
+			Program:      "Ruritania",
+			MatchedValue: "KOVALENKO Dmitri Ivanovich",
+			Score:        93,
+		},
+		{
+			Field:        "attributes.debtor_party.address",
+			Value:        pay.Attributes.DebtorParty.Address,
+			EntryID:      "90002",
+			EntryName:    "NORTHERN STAR SHIPPING LTD",
+			MatchedValue: "77 Quay Street Port Vostok",
+			Score:        100,
+		},
+	}
+	held, err := pay.Hold(hits, "screening", time.Date(2019, 5, 1, 10, 30, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("Error holding payment: %s", err.Error())
+	}
+	pay, err = p.Repository.UpdatePayment(context.Background(), held)
+	if err != nil {
+		t.Fatalf("Error updating held payment: %s", err.Error())
+	}
+
+	got, err := p.Repository.GetPayment(context.Background(), pay.ID)
+	if err != nil {
+		t.Fatalf("Error getting payment: %s", err.Error())
+	}
+	if !cmp.Equal(got, pay) || !cmp.Equal(got.SanctionsHits, hits) {
+		t.Fatalf("Stored payment differs from the held one.\nReturned:\n%v\nBut expected:\n%v", got, pay)
+	}
+
+	tests := []struct {
+		filter   map[string]string
+		expected int
+	}{
+		{map[string]string{"attributes.end_to_end_reference": reference, "status": payment.HeldStatus}, 1},
+		{map[string]string{"attributes.end_to_end_reference": reference, "sanctions_hits.entry_id": "90002"}, 1},
+		{map[string]string{"attributes.end_to_end_reference": reference, "sanctions_hits.score": "93"}, 1},
+		{map[string]string{"attributes.end_to_end_reference": reference, "sanctions_hits.entry_id": "90003"}, 0},
+	}
+	for _, test := range tests {
+		found, err := p.Repository.GetPayments(context.Background(), test.filter)
+		if err != nil {
+			t.Fatalf("Error listing payments with filter %v: %s", test.filter, err.Error())
+		}
+		if len(found) != test.expected {
+			t.Errorf("Expected %d payments with filter %v but got %d", test.expected, test.filter, len(found))
+		}
+	}
+}
+
+// TestRisk checks that the risk of the payments is stored and can be used to filter them
+// and that payments without risk are returned without it
+func (p PaymentRepositoryTester) TestRisk(t *testing.T) {
+	unassessed, err := p.Repository.AddPayment(context.Background(), p.getDefaultPayment(t))
+	if err != nil {
+		t.Fatalf("Error adding payment: %s", err.Error())
+	}
+	if unassessed, err = p.Repository.GetPayment(context.Background(), unassessed.ID); err != nil {
+		t.Fatalf("Error getting payment: %s", err.Error())
+	}
+	if unassessed.Risk != nil {
+		t.Fatalf("Expected payment without risk but got %v", *unassessed.Risk)
+	}
+
+	reference := uuid.New().String()
+	pay := p.getDefaultPayment(t)
+	pay.Attributes.EndToEndReference = reference
+	pay.Status = payment.CreatedStatus
+	risk := payment.PaymentRiskType{
+		Outcome: payment.ReviewOutcome,
+		Reasons: []payment.RiskReason{
+			{Rule: "beneficiary-velocity", Outcome: payment.ReviewOutcome, Reason: "5 payments in the last hour"},
+			{Rule: "new-beneficiary", Outcome: payment.ReviewOutcome, Reason: "First payment to the beneficiary"},
+		},
+	}
+	pay, err = pay.Assess(risk, "", time.Date(2019, 5, 1, 10, 30, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("Error assessing payment: %s", err.Error())
+	}
+	pay, err = p.Repository.AddPayment(context.Background(), pay)
+	if err != nil {
+		t.Fatalf("Error adding payment: %s", err.Error())
+	}
+
+	got, err := p.Repository.GetPayment(context.Background(), pay.ID)
+	if err != nil {
+		t.Fatalf("Error getting payment: %s", err.Error())
+	}
+	if !cmp.Equal(got, pay) || !cmp.Equal(got.Risk, &risk) {
+		t.Fatalf("Stored payment differs from the assessed one.\nReturned:\n%v\nBut expected:\n%v", got, pay)
+	}
+
+	tests := []struct {
+		filter   map[string]string
+		expected int
+	}{
+		{map[string]string{"attributes.end_to_end_reference": reference, "risk.outcome": payment.ReviewOutcome}, 1},
+		{map[string]string{"attributes.end_to_end_reference": reference, "risk.outcome": payment.BlockOutcome}, 0},
+		{map[string]string{"attributes.end_to_end_reference": reference, "risk.reasons.rule": "new-beneficiary"}, 1},
+	}
+	for _, test := range tests {
+		found, err := p.Repository.GetPayments(context.Background(), test.filter)
+		if err != nil {
+			t.Fatalf("Error listing payments with filter %v: %s", test.filter, err.Error())
+		}
+		if len(found) != test.expected {
+			t.Errorf("Expected %d payments with filter %v but got %d", test.expected, test.filter, len(found))
+		}
+	}
+}
+
+// TestDuplicates checks that the suspected duplicates are recorded and that the duplicate queries
+// find the payments with the same economic fields within the window
+func (p PaymentRepositoryTester) TestDuplicates(t *testing.T) {
+	reference := uuid.New().String()
+	original := p.getDefaultPayment(t)
+	original.Attributes.EndToEndReference = reference
+	original.Attributes.ProcessingDate = "2019-05-10"
+	original, err := p.Repository.AddPayment(context.Background(), original)
+	if err != nil {
+		t.Fatalf("Error adding payment: %s", err.Error())
+	}
+
+	policy := payment.DuplicatePolicy{OrganisationID: original.OrganisationID, Action: payment.FlagDuplicates, WindowDays: 2}
+	duplicate := p.getDefaultPayment(t)
+	duplicate.Attributes.EndToEndReference = reference
+	duplicate.Attributes.ProcessingDate = "2019-05-12"
+	duplicate.SuspectedDuplicateOf = original.ID
+	duplicate, err = p.Repository.AddPayment(context.Background(), duplicate)
+	if err != nil {
+		t.Fatalf("Error adding payment: %s", err.Error())
+	}
+	got, err := p.Repository.GetPayment(context.Background(), duplicate.ID)
+	if err != nil {
+		t.Fatalf("Error getting payment: %s", err.Error())
+	}
+	if !cmp.Equal(got, duplicate) {
+		t.Fatalf("Stored payment differs from the flagged one.\nReturned:\n%v\nBut expected:\n%v", got, duplicate)
+	}
+	flagged, err := p.Repository.GetPayments(context.Background(), map[string]string{"suspected_duplicate_of": original.ID})
+	if err != nil {
+		t.Fatalf("Error listing suspected duplicates: %s", err.Error())
+	}
+	if len(flagged) != 1 || flagged[0].ID != duplicate.ID {
+		t.Errorf("Expected payment %s to be the only suspected duplicate of %s but got %v", duplicate.ID, original.ID, flagged)
+	}
+
+	tests := []struct {
+		change   func(pay *payment.Payment)
+		window   int
+		expected int
+	}{
+		{func(pay *payment.Payment) {}, 2, 2},
+		{func(pay *payment.Payment) { pay.Attributes.Amount = "100.210" }, 2, 2},
+		{func(pay *payment.Payment) { pay.Attributes.ProcessingDate = "2019-05-13" }, 2, 1},
+		{func(pay *payment.Payment) { pay.Attributes.ProcessingDate = "2019-05-08" }, 2, 1},
+		{func(pay *payment.Payment) { pay.Attributes.ProcessingDate = "2019-05-07" }, 2, 0},
+		{func(pay *payment.Payment) { pay.Attributes.ProcessingDate = "2019-05-12" }, 0, 1},
+		{func(pay *payment.Payment) { pay.Attributes.Amount = "100.22" }, 2, 0},
+		{func(pay *payment.Payment) { pay.Attributes.Currency = "EUR" }, 2, 0},
+		{func(pay *payment.Payment) { pay.Attributes.BeneficiaryParty.AccountNumber = "12345678" }, 2, 0},
+		{func(pay *payment.Payment) { pay.OrganisationID = uuid.New().String() }, 2, 0},
+	}
+	for i, test := range tests {
+		pay := p.getDefaultPayment(t)
+		pay.Attributes.EndToEndReference = reference
+		pay.Attributes.ProcessingDate = "2019-05-11"
+		test.change(&pay)
+		policy.WindowDays = test.window
+		query, ok, err := NewDuplicateQuery(pay, policy)
+		if err != nil || !ok {
+			t.Fatalf("Error building duplicate query %d: %v", i, err)
+		}
+		found, err := p.Repository.FindPayments(context.Background(), query)
+		if err != nil {
+			t.Fatalf("Error finding duplicates %d: %s", i, err.Error())
+		}
+		if len(found) != test.expected {
+			t.Errorf("Expected %d duplicates in test %d but got %d", test.expected, i, len(found))
+		}
+	}
+
+	// Cancelled payments are not originals of duplicates
+	cancelled, err := duplicate.Transition(payment.CancelAction, "", "", time.Now())
+	if err != nil {
+		t.Fatalf("Error cancelling payment: %s", err.Error())
+	}
+	if _, err := p.Repository.UpdatePayment(context.Background(), cancelled); err != nil {
+		t.Fatalf("Error updating payment: %s", err.Error())
+	}
+	pay := p.getDefaultPayment(t)
+	pay.Attributes.EndToEndReference = reference
+	pay.Attributes.ProcessingDate = "2019-05-11"
+	policy.WindowDays = 2
+	query, _, err := NewDuplicateQuery(pay, policy)
+	if err != nil {
+		t.Fatalf("Error building duplicate query: %s", err.Error())
+	}
+	found, err := p.Repository.FindPayments(context.Background(), query)
+	if err != nil {
+		t.Fatalf("Error finding duplicates: %s", err.Error())
+	}
+	if len(found) != 1 || found[0].ID != original.ID {
+		t.Errorf("Expected %s to be the only duplicate after cancelling %s but got %v", original.ID, duplicate.ID, found)
+	}
+
+	pay.Attributes.EndToEndReference = ""
+	if _, ok, err := NewDuplicateQuery(pay, policy); ok || err != nil {
+		t.Errorf("Expected no duplicate query for a payment without end to end reference but got %t and %v", ok, err)
+	}
+}
+
+// TestAddUnlessDuplicate checks that the duplicate policy is applied to the saved payments,
+// also when several calls save the same payment concurrently
+func (p PaymentRepositoryTester) TestAddUnlessDuplicate(t *testing.T, goroutines int) {
+	policy := payment.DuplicatePolicy{OrganisationID: uuid.New().String(), Action: payment.RejectDuplicates}
+	if err := p.Repository.SaveDuplicatePolicy(context.Background(), policy); err != nil {
+		t.Fatalf("Error saving duplicate policy: %s", err.Error())
+	}
+	newPayment := func() payment.Payment {
+		pay := p.getDefaultPayment(t)
+		pay.OrganisationID = policy.OrganisationID
+		pay.Attributes.EndToEndReference = uuid.New().String()
+		return pay
+	}
+
+	pay := newPayment()
+	original, replayed, err := p.Repository.AddPaymentUnlessDuplicate(context.Background(), pay, policy, nil)
+	if err != nil || replayed {
+		t.Fatalf("Error adding payment: %v (replayed %t)", err, replayed)
+	}
+	got, err := p.Repository.GetPayment(context.Background(), original.ID)
+	if err != nil {
+		t.Fatalf("Error getting payment %s: %s", original.ID, err.Error())
+	}
+	if !cmp.Equal(got, original) {
+		t.Fatalf("Stored payment differs from the returned one.\nReturned:\n%v\nBut expected:\n%v", got, original)
+	}
+	_, _, err = p.Repository.AddPaymentUnlessDuplicate(context.Background(), pay, policy, nil)
+	if duplicate, ok := err.(payment.DuplicatePaymentError); !ok || duplicate.OriginalID != original.ID {
+		t.Fatalf("Expected DuplicatePayment error with original %s but got %v", original.ID, err)
+	}
+	flag := policy
+	flag.Action = payment.FlagDuplicates
+	flagged, _, err := p.Repository.AddPaymentUnlessDuplicate(context.Background(), pay, flag, nil)
+	if err != nil {
+		t.Fatalf("Error adding flagged duplicate: %s", err.Error())
+	}
+	if flagged.SuspectedDuplicateOf != original.ID {
+		t.Fatalf("Expected payment to be flagged as a duplicate of %s but got %q", original.ID, flagged.SuspectedDuplicateOf)
+	}
+
+	// A used idempotency key replays its payment instead of finding it as a duplicate
+	key := IdempotencyKey{
+		Key:         uuid.New().String(),
+		Fingerprint: "fingerprint",
+		ExpiresAt:   time.Now().Add(time.Hour),
+	}
+	pay = newPayment()
+	created, replayed, err := p.Repository.AddPaymentUnlessDuplicate(context.Background(), pay, policy, &key)
+	if err != nil || replayed {
+		t.Fatalf("Error adding payment with idempotency key %s: %v (replayed %t)", key.Key, err, replayed)
+	}
+	replay, replayed, err := p.Repository.AddPaymentUnlessDuplicate(context.Background(), pay, policy, &key)
+	if err != nil {
+		t.Fatalf("Error repeating payment with idempotency key %s: %s", key.Key, err.Error())
+	}
+	if !replayed || !cmp.Equal(replay, created) {
+		t.Fatalf("Expected the saved payment to be replayed for idempotency key %s but got %v (replayed %t)", key.Key, replay, replayed)
+	}
+	if _, err := p.Repository.GetIdempotencyRecord(context.Background(), key.Key); err != nil {
+		t.Fatalf("Error getting idempotency key %s: %s", key.Key, err.Error())
+	}
+
+	// Only one of several concurrent duplicates must be saved
+	pay = newPayment()
+	errs := make(chan error, goroutines)
+	for i := 0; i < goroutines; i++ {
+		go func() {
+			_, _, err := p.Repository.AddPaymentUnlessDuplicate(context.Background(), pay, policy, nil)
+			errs <- err
+		}()
+	}
+	saved := 0
+	for i := 0; i < goroutines; i++ {
+		switch err := <-errs; err.(type) {
+		case nil:
+			saved++
+		case payment.DuplicatePaymentError:
+		default:
+			t.Errorf("Error adding concurrent duplicate: %s", err.Error())
+		}
+	}
+	if saved != 1 {
+		t.Fatalf("Expected one of %d concurrent duplicates to be saved but %d were", goroutines, saved)
+	}
+	stored, err := p.Repository.GetPayments(context.Background(), map[string]string{"attributes.end_to_end_reference": pay.Attributes.EndToEndReference})
+	if err != nil {
+		t.Fatalf("Error listing payments: %s", err.Error())
+	}
+	if len(stored) != 1 {
+		t.Fatalf("Expected a single payment to be saved by concurrent duplicates but got %d", len(stored))
+	}
+}
+
+// TestApprovalPolicies checks that the approval policies are saved, replaced and deleted by organisation
+func (p PaymentRepositoryTester) TestApprovalPolicies(t *testing.T) {
+	organisationID := uuid.New().String()
+	_, err := p.Repository.GetApprovalPolicy(context.Background(), organisationID)
+	if _, ok := err.(NotFoundError); !ok {
+		t.Fatalf("Expected NotFound error getting missing approval policy but got %v", err)
+	}
+
+	for _, amount := range []string{"1000.00", "2500.50"} {
+		policy := payment.ApprovalPolicy{
+			OrganisationID: organisationID,
+			Thresholds: []payment.PaymentAmountType{
+				{Amount: amount, Currency: "GBP"},
+				{Amount: "500", Currency: "EUR"},
+			},
+		}
+		if err := p.Repository.SaveApprovalPolicy(context.Background(), policy); err != nil {
+			t.Fatalf("Error saving approval policy: %s", err.Error())
+		}
+		got, err := p.Repository.GetApprovalPolicy(context.Background(), organisationID)
+		if err != nil {
+			t.Fatalf("Error getting approval policy: %s", err.Error())
+		}
+		if !cmp.Equal(got, policy) {
+			t.Fatalf("Stored approval policy differs from the saved one.\nReturned:\n%v\nBut expected:\n%v", got, policy)
+		}
+	}
+
+	if err := p.Repository.DeleteApprovalPolicy(context.Background(), organisationID); err != nil {
+		t.Fatalf("Error deleting approval policy: %s", err.Error())
+	}
+	_, err = p.Repository.GetApprovalPolicy(context.Background(), organisationID)
+	if _, ok := err.(NotFoundError); !ok {
+		t.Fatalf("Expected NotFound error getting deleted approval policy but got %v", err)
+	}
+	err = p.Repository.DeleteApprovalPolicy(context.Background(), organisationID)
+	if _, ok := err.(NotFoundError); !ok {
+		t.Fatalf("Expected NotFound error deleting missing approval policy but got %v", err)
+	}
+}
+
+// TestDuplicatePolicies checks that the duplicate policies are saved, replaced and deleted by organisation
+func (p PaymentRepositoryTester) TestDuplicatePolicies(t *testing.T) {
+	organisationID := uuid.New().String()
+	_, err := p.Repository.GetDuplicatePolicy(context.Background(), organisationID)
+	if _, ok := err.(NotFoundError); !ok {
+		t.Fatalf("Expected NotFound error getting missing duplicate policy but got %v", err)
+	}
+
+	for _, action := range []string{payment.FlagDuplicates, payment.RejectDuplicates} {
+		policy := payment.DuplicatePolicy{OrganisationID: organisationID, Action: action, WindowDays: 3}
+		if err := p.Repository.SaveDuplicatePolicy(context.Background(), policy); err != nil {
+			t.Fatalf("Error saving duplicate policy: %s", err.Error())
+		}
+		got, err := p.Repository.GetDuplicatePolicy(context.Background(), organisationID)
+		if err != nil {
+			t.Fatalf("Error getting duplicate policy: %s", err.Error())
+		}
+		if !cmp.Equal(got, policy) {
+			t.Fatalf("Stored duplicate policy differs from the saved one.\nReturned:\n%v\nBut expected:\n%v", got, policy)
+		}
+	}
+
+	if err := p.Repository.DeleteDuplicatePolicy(context.Background(), organisationID); err != nil {
+		t.Fatalf("Error deleting duplicate policy: %s", err.Error())
+	}
+	_, err = p.Repository.GetDuplicatePolicy(context.Background(), organisationID)
+	if _, ok := err.(NotFoundError); !ok {
+		t.Fatalf("Expected NotFound error getting deleted duplicate policy but got %v", err)
+	}
+	err = p.Repository.DeleteDuplicatePolicy(context.Background(), organisationID)
+	if _, ok := err.(NotFoundError); !ok {
+		t.Fatalf("Expected NotFound error deleting missing duplicate policy but got %v", err)
+	}
+}
+
 func (p PaymentRepositoryTester) checkNotFoundError(id, action string, err error, t *testing.T) {
 	if err == nil {
 		t.Fatalf("Expected NotFound error %s non existing payment %s but got nil", action, id)
@@ -139,3 +1525,9 @@ func (p PaymentRepositoryTester) checkNotFoundError(id, action string, err error
 		}
 	}
 }
+
+func (p PaymentRepositoryTester) checkGoneError(id, action string, err error, t *testing.T) {
+	if _, ok := err.(GoneError); !ok {
+		t.Fatalf("Expected Gone error %s deleted payment %s but got %v", action, id, err)
+	}
+}